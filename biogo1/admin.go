@@ -0,0 +1,445 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// message shown to a kicked player
+const ADMIN_KICK_MESSAGE = "<LF=2><BODY><CENTER>You have been disconnected<BR><BODY>by the server admin.<END>"
+
+// AdminServer is a small JSON API for the operators: who is online, which
+// slots are taken, which games run on the relays, and a few actions. Every
+// request needs the admin token as "Authorization: Bearer <token>".
+//
+// Lobby state is read and changed on the event loop of the lobby, so the
+// answers are consistent snapshots.
+type AdminServer struct {
+	conf        *Configuration
+	lobbies     []*Lobby
+	maintenance *Maintenance
+	server      *http.Server
+}
+
+func NewAdminServer(conf *Configuration, lobbies []*Lobby, maintenance *Maintenance) *AdminServer {
+	as := &AdminServer{conf: conf, lobbies: lobbies, maintenance: maintenance}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/clients", as.handleClients)
+	mux.HandleFunc("POST /api/clients/{userid}/kick", as.handleKick)
+	mux.HandleFunc("POST /api/clients/{userid}/disconnect", as.handleDisconnect)
+	mux.HandleFunc("GET /api/slots", as.handleSlots)
+	mux.HandleFunc("POST /api/slots/{title}/{area}/{room}/{slot}/reset", as.handleResetSlot)
+	mux.HandleFunc("GET /api/games", as.handleGames)
+	mux.HandleFunc("POST /api/broadcast", as.handleBroadcast)
+	mux.HandleFunc("GET /api/maintenance", as.handleMaintenance)
+	mux.HandleFunc("POST /api/maintenance", as.handleScheduleMaintenance)
+	mux.HandleFunc("DELETE /api/maintenance", as.handleCancelMaintenance)
+	mux.HandleFunc("GET /api/log", as.handleLogLevels)
+	mux.HandleFunc("PUT /api/log", as.handleSetLogLevels)
+	mux.HandleFunc("GET /api/capture", as.handleCapture)
+	mux.HandleFunc("POST /api/capture/{userid}", as.handleStartCapture)
+	mux.HandleFunc("DELETE /api/capture/{userid}", as.handleStopCapture)
+	as.server = &http.Server{
+		Addr:              fmt.Sprintf("%s:%d", conf.AdminHost, conf.AdminPort),
+		Handler:           as.authorize(mux),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return as
+}
+
+// Run blocks serving the API.
+func (as *AdminServer) Run() {
+	adminLog.Info("admin API served", "url", "http://"+as.server.Addr)
+	if err := as.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		adminLog.Error("admin API stopped", "err", err)
+	}
+}
+
+func (as *AdminServer) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(as.conf.AdminToken)) != 1 {
+			writeJSONError(w, http.StatusUnauthorized, "invalid admin token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+// lobby returns the lobby of a title, nil if it isn't served.
+func (as *AdminServer) lobby(title string) *Lobby {
+	for _, l := range as.lobbies {
+		if l.variant.Name == title {
+			return l
+		}
+	}
+	return nil
+}
+
+type AdminClient struct {
+	Title    string `json:"title"`
+	UserID   string `json:"userid"`
+	Handle   string `json:"handle"`
+	Nickname string `json:"nickname"`
+	State    string `json:"state"`
+	Area     int    `json:"area"`
+	Room     int    `json:"room"`
+	Slot     int    `json:"slot"`
+	Host     bool   `json:"host"`
+	Game     int    `json:"game"`
+	Remote   string `json:"remote"`
+}
+
+func (as *AdminServer) handleClients(w http.ResponseWriter, r *http.Request) {
+	clients := []AdminClient{}
+	for _, l := range as.lobbies {
+		ph := l.packetHandler
+		ph.Sync(func() { clients = append(clients, ph.adminClients()...) })
+	}
+	writeJSON(w, http.StatusOK, clients)
+}
+
+func (as *AdminServer) handleKick(w http.ResponseWriter, r *http.Request) {
+	as.removeClient(w, r.PathValue("userid"), true)
+}
+
+func (as *AdminServer) handleDisconnect(w http.ResponseWriter, r *http.Request) {
+	as.removeClient(w, r.PathValue("userid"), false)
+}
+
+// removeClient disconnects a player from the lobby, or from a game on the
+// local relay. A kick shows the player a notice first.
+func (as *AdminServer) removeClient(w http.ResponseWriter, userid string, kick bool) {
+	for _, l := range as.lobbies {
+		ph, server := l.packetHandler, l.lobbyServer
+		found := false
+		ph.Sync(func() { found = ph.adminDisconnect(server, userid, kick) })
+		if found {
+			writeJSON(w, http.StatusOK, map[string]string{"removed": userid, "from": l.variant.Name + " lobby"})
+			return
+		}
+		if l.gamePacketHandler.RemoveClientByID(l.gameServer, userid, "removed by admin") {
+			writeJSON(w, http.StatusOK, map[string]string{"removed": userid, "from": l.variant.Name + " game"})
+			return
+		}
+	}
+	writeJSONError(w, http.StatusNotFound, fmt.Sprintf("%s is not connected", userid))
+}
+
+type AdminSlot struct {
+	Title    string            `json:"title"`
+	Area     int               `json:"area"`
+	Room     int               `json:"room"`
+	Slot     int               `json:"slot"`
+	Name     string            `json:"name"`
+	Status   string            `json:"status"`
+	Scenario string            `json:"scenario"`
+	Rules    map[string]string `json:"rules"`
+	Host     string            `json:"host"`
+	Game     int               `json:"game"`
+	Password bool              `json:"password"`
+	Players  []string          `json:"players"`
+}
+
+// handleSlots lists the slots that are taken, all of them with ?all=1.
+func (as *AdminServer) handleSlots(w http.ResponseWriter, r *http.Request) {
+	all := r.URL.Query().Get("all") == "1"
+	slots := []AdminSlot{}
+	for _, l := range as.lobbies {
+		ph := l.packetHandler
+		ph.Sync(func() { slots = append(slots, ph.adminSlots(all)...) })
+	}
+	writeJSON(w, http.StatusOK, slots)
+}
+
+func (as *AdminServer) handleResetSlot(w http.ResponseWriter, r *http.Request) {
+	l := as.lobby(r.PathValue("title"))
+	if l == nil {
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("title %q is not served", r.PathValue("title")))
+		return
+	}
+	var nr [3]int
+	for i, name := range []string{"area", "room", "slot"} {
+		n, err := strconv.Atoi(r.PathValue(name))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid %s %q", name, r.PathValue(name)))
+			return
+		}
+		nr[i] = n
+	}
+	ph, server := l.packetHandler, l.lobbyServer
+	var err error
+	ph.Sync(func() { err = ph.adminResetSlot(server, nr[0], nr[1], nr[2]) })
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"reset": nr})
+}
+
+// handleGames lists the games the relays of every title reported.
+func (as *AdminServer) handleGames(w http.ResponseWriter, r *http.Request) {
+	games := []RelayGameInfo{}
+	for _, l := range as.lobbies {
+		games = append(games, l.packetHandler.relays.Games(l.variant.Name)...)
+	}
+	writeJSON(w, http.StatusOK, games)
+}
+
+func (as *AdminServer) handleBroadcast(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Message == "" {
+		writeJSONError(w, http.StatusBadRequest, `expected {"message": "..."}`)
+		return
+	}
+	for _, l := range as.lobbies {
+		ph, server := l.packetHandler, l.lobbyServer
+		ph.Call(func() { ph.broadcastAnnouncement(server, req.Message) })
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"broadcast": req.Message})
+}
+
+type AdminCapture struct {
+	Dir    string         `json:"dir"`
+	Users  []string       `json:"users"`
+	Traces []CaptureTrace `json:"traces"`
+}
+
+type AdminMaintenance struct {
+	At     *time.Time `json:"at"`
+	Reason string     `json:"reason"`
+}
+
+func (as *AdminServer) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	at, reason := as.maintenance.Status()
+	status := AdminMaintenance{Reason: reason}
+	if !at.IsZero() {
+		status.At = &at
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// handleScheduleMaintenance takes {"at": RFC 3339 time} or {"in": minutes},
+// and an optional "reason".
+func (as *AdminServer) handleScheduleMaintenance(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		At     time.Time `json:"at"`
+		In     int       `json:"in"`
+		Reason string    `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.In > 0 {
+		req.At = time.Now().Add(time.Duration(req.In) * time.Minute)
+	}
+	if err := as.maintenance.Schedule(req.At, req.Reason); err != nil {
+		writeJSONError(w, http.StatusConflict, err.Error())
+		return
+	}
+	as.handleMaintenance(w, r)
+}
+
+func (as *AdminServer) handleCancelMaintenance(w http.ResponseWriter, r *http.Request) {
+	if err := as.maintenance.Cancel(); err != nil {
+		writeJSONError(w, http.StatusConflict, err.Error())
+		return
+	}
+	as.handleMaintenance(w, r)
+}
+
+func (as *AdminServer) handleLogLevels(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, LogLevels())
+}
+
+// handleSetLogLevels takes {"subsystem": "level"}, "" for all subsystems.
+func (as *AdminServer) handleSetLogLevels(w http.ResponseWriter, r *http.Request) {
+	var req map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// the default for all goes first, the exceptions after it
+	for _, subsystem := range slices.Sorted(maps.Keys(req)) {
+		level := req[subsystem]
+		if err := SetLogLevel(subsystem, level); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		adminLog.Info("log level changed", "subsystem", subsystem, "level", level)
+	}
+	as.handleLogLevels(w, r)
+}
+
+func (as *AdminServer) handleCapture(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, AdminCapture{
+		Dir:    packetCapture.Dir(),
+		Users:  packetCapture.Users(),
+		Traces: packetCapture.Traces(),
+	})
+}
+
+func (as *AdminServer) handleStartCapture(w http.ResponseWriter, r *http.Request) {
+	packetCapture.Start(r.PathValue("userid"))
+	as.handleCapture(w, r)
+}
+
+func (as *AdminServer) handleStopCapture(w http.ResponseWriter, r *http.Request) {
+	userid := r.PathValue("userid")
+	if !packetCapture.Stop(userid) {
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("%s is not captured", userid))
+		return
+	}
+	as.handleCapture(w, r)
+}
+
+// adminClients describes the clients of the lobby, runs on the event loop.
+func (ph *PacketHandler) adminClients() []AdminClient {
+	var clients []AdminClient
+	for _, cl := range ph.clients.GetList() {
+		c := AdminClient{
+			Title:  ph.variant.Name,
+			UserID: cl.userID,
+			State:  cl.state.String(),
+			Area:   cl.area,
+			Room:   cl.room,
+			Slot:   cl.slot,
+			Host:   cl.host == 1,
+			Game:   cl.GameNumber,
+			Remote: cl.socket.RemoteAddr().String(),
+		}
+		if cl.hnPair != nil {
+			c.Handle = string(cl.hnPair.handle)
+			if nickname, err := decodeSJIS(cl.hnPair.nickname); err == nil {
+				c.Nickname = nickname
+			}
+		}
+		clients = append(clients, c)
+	}
+	return clients
+}
+
+// adminSlots describes the slots of the lobby, runs on the event loop.
+func (ph *PacketHandler) adminSlots(all bool) []AdminSlot {
+	var slots []AdminSlot
+	for area := 1; area <= ph.areas.GetAreaCount(); area++ {
+		for room := 1; room <= ph.rooms.GetRoomCount(); room++ {
+			for nr := 1; nr <= ph.slots.GetSlotCount(); nr++ {
+				slot := ph.slots.GetSlot(area, room, nr)
+				players := ph.clients.inSlot(area, room, nr)
+				if !all && slot.GetStatus() == STATUS_FREE && len(players) == 0 {
+					continue
+				}
+				s := AdminSlot{
+					Title:    ph.variant.Name,
+					Area:     area,
+					Room:     room,
+					Slot:     nr,
+					Status:   slotStatusName(slot.GetStatus()),
+					Scenario: ph.variant.ScenarioName(slot.GetScenario()),
+					Rules:    make(map[string]string),
+					Host:     slot.GetHost(),
+					Game:     slot.gamenr,
+					Password: slot.GetProtection() == PROTECTION_ON,
+					Players:  []string{},
+				}
+				if name, err := decodeSJIS(slot.GetName()); err == nil {
+					s.Name = name
+				}
+				for i := 0; i < int(slot.GetRulesCount()); i++ {
+					if v := int(slot.GetRuleValue(i)); v < int(slot.GetRulesAttCount(i)) {
+						s.Rules[slot.GetRuleName(i)] = slot.GetRuleAttributeDescription(i, v)
+					}
+				}
+				for _, cl := range players {
+					s.Players = append(s.Players, cl.userID)
+				}
+				slots = append(slots, s)
+			}
+		}
+	}
+	return slots
+}
+
+func slotStatusName(status byte) string {
+	switch status {
+	case STATUS_DISABLED:
+		return "disabled"
+	case STATUS_FREE:
+		return "free"
+	case STATUS_INCREATE:
+		return "in creation"
+	case STATUS_GAMESET:
+		return "game set"
+	case STATUS_BUSY:
+		return "busy"
+	}
+	return fmt.Sprintf("unknown %d", status)
+}
+
+// adminDisconnect closes the lobby connection of a player, after showing
+// the kick notice. It runs on the event loop and tells if the player was
+// found.
+func (ph *PacketHandler) adminDisconnect(server *ServerThread, userid string, kick bool) bool {
+	cl := ph.clients.FindClientByUserID(userid)
+	if cl == nil {
+		return false
+	}
+	adminLog.Info("removing player", "title", ph.variant.Name, "userid", userid, "kick", kick)
+	socket := cl.socket
+	if !kick {
+		server.Disconnect(socket)
+		return true
+	}
+	ph.sendShutdown(server, socket, ADMIN_KICK_MESSAGE)
+	time.AfterFunc(SHUTDOWN_NOTICE_DELAY, func() { server.Disconnect(socket) })
+	return true
+}
+
+// adminResetSlot sends the players of a slot back to the room and frees
+// it, like a host cancelling. It runs on the event loop.
+func (ph *PacketHandler) adminResetSlot(server *ServerThread, area, room, slot int) error {
+	if area < 1 || area > ph.areas.GetAreaCount() || room < 1 || room > ph.rooms.GetRoomCount() ||
+		slot < 1 || slot > ph.slots.GetSlotCount() {
+		return fmt.Errorf("no slot %d in area %d room %d", slot, area, room)
+	}
+	adminLog.Info("resetting slot", "title", ph.variant.Name, "area", area, "room", room, "slot", slot)
+	ph.broadcastCancelSlot(server, area, room, slot)
+	for _, cl := range ph.clients.inSlot(area, room, slot) {
+		cl.host = 0
+		cl.player = 0
+		ph.clients.Move(cl, area, room, 0)
+		cl.state = STATE_ROOM
+		ph.db.UpdateClientOrigin(cl.userID, STATUS_LOBBY, area, room, 0)
+	}
+	ph.slots.GetSlot(area, room, slot).Reset()
+	ph.broadcastPasswdProtect(server, area, room, slot)
+	ph.broadcastSlotSceneType(server, area, room, slot)
+	ph.broadcastSlotTitle(server, area, room, slot)
+	ph.broadcastSlotAttrib2(server, area, room, slot)
+	ph.broadcastSlotPlayerStatus(server, area, room, slot)
+	ph.broadcastSlotStatus(server, area, room, slot)
+	return nil
+}
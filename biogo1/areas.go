@@ -1,22 +1,22 @@
 package main
 
-import "fmt"
-
 const (
 	STATUS_ACTIVE   byte = 3
 	STATUS_INACTIVE byte = 0
 )
 
 type Areas struct {
-	areas []*Area
+	areas  []*Area
+	locked bool // all areas show as inactive, for maintenance
 }
 
-func NewAreas() *Areas {
+// NewAreas copies the areas of a title, see Variant.
+func NewAreas(areas []*Area) *Areas {
 	a := &Areas{}
-	a.areas = append(a.areas,
-		NewArea(1, "East Town", "<BODY><SIZE=3>standard rules<END>", STATUS_ACTIVE),
-		NewArea(2, "West Town", "<BODY><SIZE=3>individual games<END>", STATUS_ACTIVE),
-	)
+	for _, area := range areas {
+		copied := *area
+		a.areas = append(a.areas, &copied)
+	}
 	return a
 }
 
@@ -40,14 +40,13 @@ func (a *Areas) GetDescription(areaNumber int) string {
 }
 
 func (a *Areas) GetStatus(areaNumber int) byte {
-	fmt.Printf("\n\nget status for area %d\n", areaNumber)
-	fmt.Printf("get status for area %d\n", areaNumber)
-	fmt.Printf("get status for area %d\n", areaNumber)
-	fmt.Printf("get status for area %d\n", areaNumber)
-	fmt.Printf("get status for area %d\n", areaNumber)
-	fmt.Printf("get status for area %d\n\n\n", areaNumber)
-	if areaNumber <= 0 || areaNumber > len(a.areas) {
+	if areaNumber <= 0 || areaNumber > len(a.areas) || a.locked {
 		return 0
 	}
 	return a.areas[areaNumber-1].status
 }
+
+// SetLocked locks or unlocks all areas, their own status is kept.
+func (a *Areas) SetLocked(locked bool) {
+	a.locked = locked
+}
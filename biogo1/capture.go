@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bioserver/commands"
+	"bioserver/protocol"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	CAPTURE_IN    = "in"    // sent by the client
+	CAPTURE_OUT   = "out"   // sent by the server
+	CAPTURE_CLOSE = "close" // the connection was closed, no packet
+
+	CAPTURE_LOBBY = "lobby"
+	CAPTURE_GAME  = "game"
+
+	// packets kept for a connection until its user is known, so a trace
+	// starts with the login
+	CAPTURE_PENDING = 32
+)
+
+// packetCapture records the traffic of the users an operator picked.
+var packetCapture = NewCapture("captures")
+
+// CaptureRecord is one line of a trace: a packet as seen on the wire and,
+// for lobby packets, its decoded payload with the secret strings decrypted.
+// Game data is relayed without looking into it and only has Raw.
+type CaptureRecord struct {
+	Time    time.Time     `json:"time"`
+	Conn    uint64        `json:"conn"`
+	Server  string        `json:"server"`
+	Title   string        `json:"title"`
+	Dir     string        `json:"dir"`
+	Remote  string        `json:"remote"`
+	UserID  string        `json:"userid,omitempty"`
+	Cmd     string        `json:"cmd,omitempty"`
+	Qsw     string        `json:"qsw,omitempty"`
+	PID     int           `json:"pid,omitempty"`
+	Raw     string        `json:"raw"` // hex
+	Message string        `json:"message,omitempty"`
+	Fields  captureFields `json:"fields,omitempty"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// Capture writes a JSONL trace per connection of every captured user to
+// dir. The traces can be read back with the dissector and replayed.
+type Capture struct {
+	dir    string
+	users  map[string]bool
+	conns  map[net.Conn]*captureConn
+	nextID uint64
+	active atomic.Bool // any user captured
+	mu     sync.Mutex
+}
+
+type captureConn struct {
+	id      uint64
+	userid  string
+	pending []CaptureRecord
+	file    *os.File
+	path    string
+	records int
+	last    CaptureRecord // written last
+	closed  bool          // the close is in the trace
+}
+
+// CaptureTrace is an open trace file.
+type CaptureTrace struct {
+	UserID  string `json:"userid"`
+	Conn    uint64 `json:"conn"`
+	File    string `json:"file"`
+	Records int    `json:"records"`
+}
+
+func NewCapture(dir string) *Capture {
+	return &Capture{dir: dir, users: make(map[string]bool), conns: make(map[net.Conn]*captureConn)}
+}
+
+// SetDir changes where new traces are written.
+func (c *Capture) SetDir(dir string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dir = dir
+}
+
+// Dir returns where traces are written.
+func (c *Capture) Dir() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.dir
+}
+
+// Enabled tells if anybody is captured, callers can skip looking up the
+// user of a connection when not.
+func (c *Capture) Enabled() bool {
+	return c.active.Load()
+}
+
+// Start captures the connections of a user from their next packet on, new
+// connections from their login on.
+func (c *Capture) Start(userid string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.users[userid] = true
+	c.active.Store(true)
+	serverLog.Info("capture started", "userid", userid)
+}
+
+// Stop ends capturing a user and closes their traces, it tells if the user
+// was captured.
+func (c *Capture) Stop(userid string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.users[userid] {
+		return false
+	}
+	delete(c.users, userid)
+	for conn, cc := range c.conns {
+		if cc.userid == userid {
+			c.closeConn(conn, cc)
+		}
+	}
+	if len(c.users) == 0 {
+		c.active.Store(false)
+		clear(c.conns)
+	}
+	serverLog.Info("capture stopped", "userid", userid)
+	return true
+}
+
+// Users returns the captured users.
+func (c *Capture) Users() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	users := make([]string, 0, len(c.users))
+	for u := range c.users {
+		users = append(users, u)
+	}
+	slices.Sort(users)
+	return users
+}
+
+// Traces returns the open trace files.
+func (c *Capture) Traces() []CaptureTrace {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var traces []CaptureTrace
+	for _, cc := range c.conns {
+		if cc.file != nil {
+			traces = append(traces, CaptureTrace{UserID: cc.userid, Conn: cc.id, File: cc.path, Records: cc.records})
+		}
+	}
+	slices.SortFunc(traces, func(a, b CaptureTrace) int { return int(a.Conn) - int(b.Conn) })
+	return traces
+}
+
+// RecordPacket adds a lobby format packet of conn to its trace. userid is
+// empty until the server knows who is on the connection, data is not kept.
+func (c *Capture) RecordPacket(conn net.Conn, server, title, userid, dir string, data []byte) {
+	if !c.active.Load() {
+		return
+	}
+	rec := newCaptureRecord(conn, server, title, userid, dir, data)
+	h, m, err := protocol.Decode(data)
+	if m != nil {
+		rec.Cmd = protocol.Name(h.Cmd)
+		rec.Qsw = commands.GetConstName(h.Qsw)
+		rec.PID = h.PID
+		rec.Message = strings.TrimPrefix(fmt.Sprintf("%T", m), "*protocol.")
+		rec.Fields = protocol.Fields(m)
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	c.record(conn, rec)
+}
+
+// RecordGameData adds relayed game data of conn to its trace.
+func (c *Capture) RecordGameData(conn net.Conn, title, userid, dir string, data []byte) {
+	if !c.active.Load() {
+		return
+	}
+	c.record(conn, newCaptureRecord(conn, CAPTURE_GAME, title, userid, dir, data))
+}
+
+func newCaptureRecord(conn net.Conn, server, title, userid, dir string, data []byte) CaptureRecord {
+	return CaptureRecord{
+		Time:   time.Now(),
+		Server: server,
+		Title:  title,
+		Dir:    dir,
+		Remote: conn.RemoteAddr().String(),
+		UserID: userid,
+		Raw:    hex.EncodeToString(data),
+	}
+}
+
+func (c *Capture) record(conn net.Conn, rec CaptureRecord) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cc, ok := c.conns[conn]
+	if !ok {
+		c.nextID++
+		cc = &captureConn{id: c.nextID}
+		c.conns[conn] = cc
+	}
+	rec.Conn = cc.id
+	if rec.UserID != "" && cc.userid == "" {
+		cc.userid = rec.UserID
+	}
+	switch {
+	case cc.userid == "":
+		// not logged in yet, keep the start for when we know who it is
+		if len(cc.pending) < CAPTURE_PENDING {
+			cc.pending = append(cc.pending, rec)
+		}
+	case !c.users[cc.userid]:
+		cc.pending = nil
+	default:
+		if cc.file == nil && !c.open(cc, rec) {
+			return
+		}
+		for _, p := range cc.pending {
+			p.UserID = cc.userid
+			c.write(cc, p)
+		}
+		cc.pending = nil
+		c.write(cc, rec)
+	}
+}
+
+// RecordClose notes in the trace of conn that the connection is gone.
+// What the server still sends to it while cleaning up comes after that.
+func (c *Capture) RecordClose(conn net.Conn) {
+	if !c.active.Load() {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cc, ok := c.conns[conn]; ok {
+		c.recordClose(cc)
+	}
+}
+
+// Close ends the trace of a closed connection.
+func (c *Capture) Close(conn net.Conn) {
+	if !c.active.Load() {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cc, ok := c.conns[conn]; ok {
+		c.recordClose(cc)
+		c.closeConn(conn, cc)
+	}
+}
+
+func (c *Capture) recordClose(cc *captureConn) {
+	if cc.file == nil || cc.closed {
+		return
+	}
+	cc.closed = true
+	last := cc.last
+	c.write(cc, CaptureRecord{Time: time.Now(), Conn: cc.id, Server: last.Server, Title: last.Title,
+		Dir: CAPTURE_CLOSE, Remote: last.Remote, UserID: last.UserID})
+}
+
+func (c *Capture) closeConn(conn net.Conn, cc *captureConn) {
+	if cc.file != nil {
+		cc.file.Close()
+		serverLog.Info("capture closed", "userid", cc.userid, "file", cc.path, "records", cc.records)
+	}
+	delete(c.conns, conn)
+}
+
+// open creates the trace file named after the first captured packet.
+func (c *Capture) open(cc *captureConn, rec CaptureRecord) bool {
+	if err := os.MkdirAll(c.dir, 0o755); err != nil {
+		serverLog.Error("creating capture directory", "dir", c.dir, "err", err)
+		return false
+	}
+	name := fmt.Sprintf("%s-%s-%s-%s-%d.jsonl", rec.Time.Format("20060102-150405"),
+		rec.Title, rec.Server, captureFileName(cc.userid), cc.id)
+	path := filepath.Join(c.dir, name)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		serverLog.Error("creating capture file", "file", path, "err", err)
+		return false
+	}
+	cc.file, cc.path = f, path
+	serverLog.Info("capture opened", "userid", cc.userid, "file", path)
+	return true
+}
+
+func (c *Capture) write(cc *captureConn, rec CaptureRecord) {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		serverLog.Error("encoding capture record", "err", err)
+		return
+	}
+	if _, err := cc.file.Write(append(line, '\n')); err != nil {
+		serverLog.Error("writing capture file", "file", cc.path, "err", err)
+		return
+	}
+	cc.records++
+	cc.last = rec
+}
+
+// captureFileName keeps only the characters of a userid that are safe in a
+// file name.
+func captureFileName(userid string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, userid)
+}
+
+// captureFields keeps the field order of the payload in the JSON.
+type captureFields []protocol.Field
+
+func (f captureFields) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	if err := writeCaptureValue(&b, []protocol.Field(f)); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// UnmarshalJSON skips the fields when a trace is read back, readers decode
+// Raw again.
+func (f *captureFields) UnmarshalJSON(data []byte) error {
+	*f = nil
+	return nil
+}
+
+func writeCaptureValue(b *bytes.Buffer, v any) error {
+	switch v := v.(type) {
+	case []protocol.Field:
+		b.WriteByte('{')
+		for i, f := range v {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			name, _ := json.Marshal(f.Name)
+			b.Write(name)
+			b.WriteByte(':')
+			if err := writeCaptureValue(b, f.Value); err != nil {
+				return err
+			}
+		}
+		b.WriteByte('}')
+	case []any:
+		b.WriteByte('[')
+		for i, e := range v {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			if err := writeCaptureValue(b, e); err != nil {
+				return err
+			}
+		}
+		b.WriteByte(']')
+	default:
+		value, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		b.Write(value)
+	}
+	return nil
+}
+
+// captureUserID returns the user on a lobby connection, empty before the
+// login.
+func (ph *PacketHandler) captureUserID(socket net.Conn) string {
+	if cl := ph.clients.FindClientBySocket(socket); cl != nil {
+		return cl.userID
+	}
+	return ""
+}
+
+// captureUserID returns the user on a game connection, empty before the
+// session check.
+func (gsp *GameServerPacketHandler) captureUserID(conn net.Conn) string {
+	if cl := gsp.sessions.FindClientBySocket(conn); cl != nil {
+		return cl.userID
+	}
+	return ""
+}
@@ -1,95 +1,227 @@
 package main
 
 import (
-	"bytes"
-	"encoding/binary"
+	"bioserver/protocol"
 	"net"
 	"slices"
+	"sync"
 )
 
+// place is an area, room and slot, zero where the client isn't in one.
+type place struct {
+	area, room, slot int
+}
+
+// ClientList is the registry of connected clients. It can be used from
+// any goroutine: lookups go through maps by connection, user id and handle,
+// and through the clients in every area, room and slot. Lists are never
+// changed in place, so GetList and the index lists are snapshots that can
+// be iterated while clients come and go.
+//
+// Area, room, slot and handle of a listed client have to be changed with
+// Move and SetHNPair to keep the indexes right.
 type ClientList struct {
-	clients []*Client
+	clients  []*Client
+	bySocket map[net.Conn]*Client
+	byUserID map[string]*Client
+	byHandle map[string]*Client
+	byArea   map[int][]*Client
+	byRoom   map[place][]*Client // slot is always 0
+	bySlot   map[place][]*Client
+	mu       sync.RWMutex
 }
 
 func NewClientList() *ClientList {
-	return &ClientList{clients: make([]*Client, 0)}
+	return &ClientList{
+		clients:  make([]*Client, 0),
+		bySocket: make(map[net.Conn]*Client),
+		byUserID: make(map[string]*Client),
+		byHandle: make(map[string]*Client),
+		byArea:   make(map[int][]*Client),
+		byRoom:   make(map[place][]*Client),
+		bySlot:   make(map[place][]*Client),
+	}
+}
+
+// with returns a copy of list with c appended.
+func with(list []*Client, c *Client) []*Client {
+	n := make([]*Client, len(list), len(list)+1)
+	copy(n, list)
+	return append(n, c)
+}
+
+// without returns a copy of list without c.
+func without(list []*Client, c *Client) []*Client {
+	i := slices.Index(list, c)
+	if i < 0 {
+		return list
+	}
+	return slices.Concat(list[:i], list[i+1:])
+}
+
+func handleOf(c *Client) string {
+	if c.hnPair == nil {
+		return ""
+	}
+	return string(c.hnPair.handle)
 }
 
 func (cl *ClientList) Add(c *Client) {
-	cl.clients = append(cl.clients, c)
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.clients = with(cl.clients, c)
+	cl.bySocket[c.socket] = c
+	cl.byUserID[c.userID] = c
+	if h := handleOf(c); h != "" {
+		cl.byHandle[h] = c
+	}
+	cl.index(c)
+}
+
+func (cl *ClientList) Remove(c *Client) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if !slices.Contains(cl.clients, c) {
+		return
+	}
+	cl.clients = without(cl.clients, c)
+	if cl.bySocket[c.socket] == c {
+		delete(cl.bySocket, c.socket)
+	}
+	if cl.byUserID[c.userID] == c {
+		delete(cl.byUserID, c.userID)
+		// an older connection of this user might still be listed
+		for _, o := range cl.clients {
+			if o.userID == c.userID {
+				cl.byUserID[c.userID] = o
+			}
+		}
+	}
+	if h := handleOf(c); h != "" && cl.byHandle[h] == c {
+		delete(cl.byHandle, h)
+	}
+	cl.unindex(c)
 }
 
+// index adds a client to the lists of its place, mu has to be held.
+func (cl *ClientList) index(c *Client) {
+	cl.byArea[c.area] = with(cl.byArea[c.area], c)
+	room := place{c.area, c.room, 0}
+	cl.byRoom[room] = with(cl.byRoom[room], c)
+	slot := place{c.area, c.room, c.slot}
+	cl.bySlot[slot] = with(cl.bySlot[slot], c)
+}
+
+// unindex removes a client from the lists of its place, mu has to be held.
+func (cl *ClientList) unindex(c *Client) {
+	drop := func(list []*Client) []*Client {
+		list = without(list, c)
+		if len(list) == 0 {
+			return nil
+		}
+		return list
+	}
+	if l := drop(cl.byArea[c.area]); l != nil {
+		cl.byArea[c.area] = l
+	} else {
+		delete(cl.byArea, c.area)
+	}
+	room := place{c.area, c.room, 0}
+	if l := drop(cl.byRoom[room]); l != nil {
+		cl.byRoom[room] = l
+	} else {
+		delete(cl.byRoom, room)
+	}
+	slot := place{c.area, c.room, c.slot}
+	if l := drop(cl.bySlot[slot]); l != nil {
+		cl.bySlot[slot] = l
+	} else {
+		delete(cl.bySlot, slot)
+	}
+}
+
+// Move puts a client into another area, room and slot.
+func (cl *ClientList) Move(c *Client, area, room, slot int) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	listed := slices.Contains(cl.clients, c)
+	if listed {
+		cl.unindex(c)
+	}
+	c.area, c.room, c.slot = area, room, slot
+	if listed {
+		cl.index(c)
+	}
+}
+
+// SetHNPair sets the chosen handle of a client.
+func (cl *ClientList) SetHNPair(c *Client, hn *HNPair) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if h := handleOf(c); h != "" && cl.byHandle[h] == c {
+		delete(cl.byHandle, h)
+	}
+	c.hnPair = hn
+	if h := handleOf(c); h != "" && slices.Contains(cl.clients, c) {
+		cl.byHandle[h] = c
+	}
+}
+
+// GetList returns all clients, the slice must not be modified.
 func (cl *ClientList) GetList() []*Client {
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
 	return cl.clients
 }
 
+// inSlot returns the clients of a slot, the slice must not be modified.
+func (cl *ClientList) inSlot(area, room, slot int) []*Client {
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+	return cl.bySlot[place{area, room, slot}]
+}
+
 func (cl *ClientList) FindClientBySocket(socket net.Conn) *Client {
-	for _, c := range cl.clients {
-		if c.socket == socket {
-			return c
-		}
-	}
-	return nil
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+	return cl.bySocket[socket]
 }
 
 func (cl *ClientList) FindClientByHandle(handle string) *Client {
-	for _, c := range cl.clients {
-		if string(c.hnPair.handle) == handle {
-			return c
-		}
-	}
-	return nil
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+	return cl.byHandle[handle]
 }
 
 func (cl *ClientList) FindClientByUserID(userid string) *Client {
-	for _, c := range cl.clients {
-		if c.userID == userid {
-			return c
-		}
-	}
-	return nil
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+	return cl.byUserID[userid]
 }
 
 func (cl *ClientList) FindClientBySlot(area, room, slot, player int) *Client {
-	for _, c := range cl.clients {
-		if c.area == area && c.room == room && c.slot == slot && c.player == byte(player) {
+	for _, c := range cl.inSlot(area, room, slot) {
+		if c.player == byte(player) {
 			return c
 		}
 	}
 	return nil
 }
 
-func (cl *ClientList) Remove(c *Client) {
-	for i, client := range cl.clients {
-		if client == c {
-			cl.clients = slices.Delete(cl.clients, i, i+1)
-			break
-		}
-	}
-}
-
 func (cl *ClientList) CountPlayersInSlot(area, room, slot int) int {
-	count := 0
-	for _, c := range cl.clients {
-		if c.slot == slot && c.area == area && c.room == room {
-			count++
-		}
-	}
-	return count
+	return len(cl.inSlot(area, room, slot))
 }
 
 func (cl *ClientList) CountPlayersInArea(nr int) []int {
 	// TODO: what is unknown 3rd value? is it ingame?
 	retval := []int{0, 0, 0}
 
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+	retval[0] = len(cl.byRoom[place{nr, 0, 0}])
+	retval[1] = len(cl.byArea[nr]) - retval[0]
 	for _, c := range cl.clients {
-		if c.area == nr {
-			if c.room == 0 {
-				retval[0]++
-			} else {
-				retval[1]++
-			}
-		} else if c.area == 51 {
+		if c.area != nr && c.afterGame {
 			retval[2]++
 		}
 	}
@@ -97,51 +229,35 @@ func (cl *ClientList) CountPlayersInArea(nr int) []int {
 }
 
 func (cl *ClientList) CountPlayersInRoom(area int, room int) int {
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+	return len(cl.byRoom[place{area, room, 0}])
+}
+
+// CountPlayersInAgl counts the players back from a game
+func (cl *ClientList) CountPlayersInAgl() int {
 	count := 0
-	for _, c := range cl.clients {
-		if c.room == room && c.area == area {
+	for _, c := range cl.GetList() {
+		if c.afterGame {
 			count++
 		}
 	}
 	return count
 }
 
-func (cl *ClientList) GetPlayerStats(area, room, slotnr int) []byte {
-	retval := make([]byte, 1024)
-	playercnt := byte(cl.CountPlayersInSlot(area, room, slotnr) & 0xff)
-
-	// Create a buffer to write the data
-	buffer := bytes.NewBuffer(retval[:0])
-
-	// Write slotnr as a short (2 bytes)
-	binary.Write(buffer, binary.BigEndian, uint16(slotnr))
-
-	// Write the constant byte 3; TODO why ???
-	buffer.WriteByte(3)
-
-	// Write the player count
-	buffer.WriteByte(playercnt)
-
-	// Iterate over clients and add their stats to the buffer
-	for _, client := range cl.clients {
-		if client.area == area && client.room == room && client.slot == slotnr {
-			buffer.Write(client.hnPair.GetHNPair())
-			characterStats := client.characterStats
-			binary.Write(buffer, binary.BigEndian, uint16(len(characterStats)))
-			buffer.Write(characterStats)
-		}
+// GetPlayerStats returns the players in a slot for the PLAYERSTATS packet
+func (cl *ClientList) GetPlayerStats(area, room, slotnr int) []protocol.CharacterStat {
+	var stats []protocol.CharacterStat
+	for _, client := range cl.inSlot(area, room, slotnr) {
+		stats = append(stats, client.GetCharacterStat())
 	}
-
-	// Return the slice of the buffer's bytes
-	return buffer.Bytes()
+	return stats
 }
 
 func (cl *ClientList) GetFreePlayerNum(area, room, slot int) int {
 	fpn := []byte{0, 0, 0, 0, 0}
-	for _, c := range cl.clients {
-		if c.area == area && c.room == room && c.slot == slot {
-			fpn[c.player] = 1
-		}
+	for _, c := range cl.inSlot(area, room, slot) {
+		fpn[c.player] = 1
 	}
 	for i := 2; i < 5; i++ {
 		if fpn[i] == 0 {
@@ -153,7 +269,7 @@ func (cl *ClientList) GetFreePlayerNum(area, room, slot int) int {
 
 func (cl *ClientList) GetPlayerCountAgl(nr int) byte {
 	count := byte(0)
-	for _, c := range cl.clients {
+	for _, c := range cl.GetList() {
 		if c.GameNumber == nr {
 			count++
 		}
@@ -179,10 +295,10 @@ func (cl *ClientList) GetClientStatus(handle []byte) byte {
 }
 
 func (cl *ClientList) GetHostOfSlot(area, room, slot int) *Client {
-	for _, c := range cl.clients {
-		if c.area == area && c.room == room && c.slot == slot && c.host == 1 {
+	for _, c := range cl.inSlot(area, room, slot) {
+		if c.host == 1 {
 			return c
 		}
 	}
 	return nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// testConn is a connection nothing is read from or written to, only its
+// identity matters to the client list.
+type testConn struct {
+	net.Conn
+	id int
+}
+
+// checkIndexes compares every index of the list with its clients.
+func checkIndexes(t *testing.T, cl *ClientList) {
+	t.Helper()
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+
+	userids := make(map[string]bool)
+	handles := make(map[string]bool)
+	for _, c := range cl.clients {
+		if cl.bySocket[c.socket] != c {
+			t.Errorf("%s: bySocket has %v", c.userID, cl.bySocket[c.socket])
+		}
+		userids[c.userID] = true
+		if o := cl.byUserID[c.userID]; o == nil || o.userID != c.userID || !slices.Contains(cl.clients, o) {
+			t.Errorf("%s: byUserID has %v", c.userID, o)
+		}
+		if h := handleOf(c); h != "" {
+			handles[h] = true
+			if cl.byHandle[h] != c {
+				t.Errorf("%s: byHandle[%s] has %v", c.userID, h, cl.byHandle[h])
+			}
+		}
+		if n := count(cl.byArea[c.area], c); n != 1 {
+			t.Errorf("%s: %d times in area %d", c.userID, n, c.area)
+		}
+		if n := count(cl.byRoom[place{c.area, c.room, 0}], c); n != 1 {
+			t.Errorf("%s: %d times in room %d/%d", c.userID, n, c.area, c.room)
+		}
+		if n := count(cl.bySlot[place{c.area, c.room, c.slot}], c); n != 1 {
+			t.Errorf("%s: %d times in slot %d/%d/%d", c.userID, n, c.area, c.room, c.slot)
+		}
+	}
+	if len(cl.bySocket) != len(cl.clients) {
+		t.Errorf("bySocket has %d clients, the list %d", len(cl.bySocket), len(cl.clients))
+	}
+	if len(cl.byUserID) != len(userids) {
+		t.Errorf("byUserID has %d users, the list %d", len(cl.byUserID), len(userids))
+	}
+	if len(cl.byHandle) != len(handles) {
+		t.Errorf("byHandle has %d handles, the list %d", len(cl.byHandle), len(handles))
+	}
+	// clients are only listed at their own place, and no list is left empty
+	for area, list := range cl.byArea {
+		for _, c := range list {
+			if c.area != area || !slices.Contains(cl.clients, c) {
+				t.Errorf("%s listed in area %d", c.userID, area)
+			}
+		}
+	}
+	for name, index := range map[string]map[place][]*Client{"room": cl.byRoom, "slot": cl.bySlot} {
+		total := 0
+		for p, list := range index {
+			if len(list) == 0 {
+				t.Errorf("empty %s list %v", name, p)
+			}
+			total += len(list)
+			for _, c := range list {
+				if c.area != p.area || c.room != p.room || (name == "slot" && c.slot != p.slot) {
+					t.Errorf("%s listed in %s %v", c.userID, name, p)
+				}
+			}
+		}
+		if total != len(cl.clients) {
+			t.Errorf("%s lists have %d clients, the list %d", name, total, len(cl.clients))
+		}
+	}
+}
+
+func count(list []*Client, c *Client) int {
+	n := 0
+	for _, o := range list {
+		if o == c {
+			n++
+		}
+	}
+	return n
+}
+
+func TestClientListRemovePromotesOlderConnection(t *testing.T) {
+	cl := NewClientList()
+	older := NewClient(&testConn{id: 1}, "alice", "")
+	newer := NewClient(&testConn{id: 2}, "alice", "")
+	cl.Add(older)
+	cl.Add(newer)
+	if got := cl.FindClientByUserID("alice"); got != newer {
+		t.Fatalf("FindClientByUserID = %p, want the newer connection %p", got, newer)
+	}
+	cl.Remove(newer)
+	if got := cl.FindClientByUserID("alice"); got != older {
+		t.Fatalf("FindClientByUserID after Remove = %p, want the older connection %p", got, older)
+	}
+	checkIndexes(t, cl)
+	cl.Remove(older)
+	if got := cl.FindClientByUserID("alice"); got != nil {
+		t.Fatalf("FindClientByUserID after removing both = %p", got)
+	}
+	checkIndexes(t, cl)
+}
+
+// TestClientListConcurrent changes the list from many goroutines while
+// others look clients up, run it with -race.
+func TestClientListConcurrent(t *testing.T) {
+	const (
+		workers = 8
+		rounds  = 300
+	)
+	cl := NewClientList()
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				if list := cl.GetList(); len(list) > 0 {
+					cl.FindClientBySocket(list[len(list)/2].socket)
+				}
+				cl.FindClientByUserID("user1-0")
+				cl.FindClientByHandle("H1-0")
+				cl.FindClientBySlot(1, 1, 1, 2)
+				cl.CountPlayersInArea(1)
+				cl.CountPlayersInRoom(1, 1)
+				cl.CountPlayersInSlot(1, 1, 1)
+			}
+		}()
+	}
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(int64(w)))
+			var mine []*Client
+			for i := 0; i < rounds; i++ {
+				switch op := rnd.Intn(10); {
+				case op < 3 || len(mine) == 0:
+					// a second connection of a user now and then
+					userid := fmt.Sprintf("user%d-%d", w, rnd.Intn(5))
+					c := NewClient(&testConn{id: w*rounds + i}, userid, "")
+					c.area, c.room, c.slot = rnd.Intn(3), rnd.Intn(3), rnd.Intn(3)
+					cl.Add(c)
+					mine = append(mine, c)
+				case op < 5:
+					j := rnd.Intn(len(mine))
+					cl.Remove(mine[j])
+					mine = slices.Delete(mine, j, j+1)
+				case op < 8:
+					cl.Move(mine[rnd.Intn(len(mine))], rnd.Intn(3), rnd.Intn(3), rnd.Intn(3))
+				default:
+					c := mine[rnd.Intn(len(mine))]
+					cl.SetHNPair(c, NewHNPairFromStrings(fmt.Sprintf("H%d-%d", w, i), "nick"))
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	checkIndexes(t, cl)
+
+	// removing the rest has to empty every index
+	for _, c := range cl.GetList() {
+		cl.Remove(c)
+	}
+	checkIndexes(t, cl)
+	if len(cl.byArea) != 0 || len(cl.byRoom) != 0 || len(cl.bySlot) != 0 || len(cl.byUserID) != 0 || len(cl.byHandle) != 0 {
+		t.Fatalf("indexes left after removing everyone: %d areas, %d rooms, %d slots, %d users, %d handles",
+			len(cl.byArea), len(cl.byRoom), len(cl.bySlot), len(cl.byUserID), len(cl.byHandle))
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import "fmt"
+
+// ClientState is where a client is in the lobby flow, it decides which
+// commands the client may send.
+type ClientState int
+
+const (
+	STATE_CONNECTED     ClientState = iota // socket open, no session yet
+	STATE_AUTHENTICATED                    // session checked
+	STATE_HANDLE                           // handle/nickname chosen
+	STATE_CHARACTER                        // character chosen, area selection
+	STATE_AREA                             // in an area, room selection
+	STATE_ROOM                             // in a room, slot list
+	STATE_SLOT                             // created or joined a game slot
+	STATE_INGAME                           // game started, leaving for the game server
+	STATE_AGL                              // after game lobby
+)
+
+var stateNames = map[ClientState]string{
+	STATE_CONNECTED:     "connected",
+	STATE_AUTHENTICATED: "authenticated",
+	STATE_HANDLE:        "handle chosen",
+	STATE_CHARACTER:     "character chosen",
+	STATE_AREA:          "area",
+	STATE_ROOM:          "room",
+	STATE_SLOT:          "slot",
+	STATE_INGAME:        "in game",
+	STATE_AGL:           "after game lobby",
+}
+
+func (s ClientState) String() string {
+	if name, ok := stateNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("state(%d)", int(s))
+}
+
+// states in which commands are legal, used when registering handlers
+var (
+	anyState      = []ClientState{STATE_CONNECTED, STATE_AUTHENTICATED, STATE_HANDLE, STATE_CHARACTER, STATE_AREA, STATE_ROOM, STATE_SLOT, STATE_INGAME, STATE_AGL}
+	loggedInState = anyState[1:]
+	handleState   = anyState[2:]
+	roomState     = []ClientState{STATE_ROOM, STATE_SLOT, STATE_INGAME}
+	slotState     = []ClientState{STATE_SLOT, STATE_INGAME}
+)
@@ -1,6 +1,9 @@
 package commands
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 const (
 	SERVER     byte = 0x18 // a packet from the server
@@ -253,3 +256,14 @@ func GetConstName(v any) string {
 	}
 	return "UNKNOWN"
 }
+
+// GetConstValue is GetConstName backwards, the name is matched ignoring
+// case.
+func GetConstValue(name string) (int, bool) {
+	for key, n := range constNames {
+		if strings.EqualFold(n, name) {
+			return key, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	DEFAULT_CONFIG_FILE = "config.properties"
+	ENV_PREFIX          = "BIOSERVER_"
+)
+
+// Configuration holds everything a deployment may want to change without
+// recompiling. The key names follow the Java server's config.properties
+// (gs_ip, db_user, db_password) so existing files keep working.
+//
+// Values are applied in this order, later sources winning:
+// built-in defaults, config file, BIOSERVER_* environment variables, flags.
+type Configuration struct {
+	ConfigFile string
+
+	Variants       string
+	LobbyHost      string
+	LobbyPort      int
+	GameHost       string
+	GamePort       int
+	File2LobbyPort int
+	File2GamePort  int
+	GsIP           string
+	Relays         string
+	File2Relays    string
+	RelayCapacity  int
+	RelayControl   int
+	RelaySecret    string
+
+	DBDriver   string
+	DBUser     string
+	DBPassword string
+	DBHost     string
+	DBPort     int
+	DBName     string
+
+	WebHost      string
+	WebPort      int
+	WebCert      string
+	WebKey       string
+	WebBaseURL   string
+	WebLobbyHost string
+
+	PatchFile    string
+	PatchVersion string
+
+	ShutdownMessage string
+	ShutdownTimeout int
+
+	AdminHost  string
+	AdminPort  int
+	AdminToken string
+
+	MetricsHost string
+	MetricsPort int
+
+	LogFormat string
+	LogLevel  string
+
+	CaptureDir   string
+	CaptureUsers string
+}
+
+// configKey describes one setting, shared by the file parser, the
+// environment lookup and the command line flags.
+type configKey struct {
+	name  string
+	usage string
+	str   *string
+	num   *int
+}
+
+func NewConfiguration() *Configuration {
+	return &Configuration{
+		ConfigFile:      DEFAULT_CONFIG_FILE,
+		Variants:        FILE1.Name,
+		LobbyHost:       "0.0.0.0",
+		LobbyPort:       FILE1.LobbyPort,
+		GameHost:        "0.0.0.0",
+		GamePort:        FILE1.GamePort,
+		File2LobbyPort:  FILE2.LobbyPort,
+		File2GamePort:   FILE2.GamePort,
+		GsIP:            "127.0.0.1",
+		DBDriver:        DB_DRIVER_MYSQL,
+		DBUser:          "bioserver",
+		DBPassword:      "",
+		DBHost:          "localhost",
+		DBPort:          3306,
+		DBName:          "bioserver",
+		WebHost:         "0.0.0.0",
+		WebPort:         0,
+		WebBaseURL:      "https://www01.kddi-mmbb.jp/00000002",
+		PatchVersion:    "101 0311172500",
+		ShutdownMessage: "<LF=2><BODY><CENTER>The server is shutting down.<BR><BODY>Please try again later.<END>",
+		ShutdownTimeout: 300,
+		AdminHost:       "127.0.0.1",
+		MetricsHost:     "127.0.0.1",
+		LogFormat:       LOG_FORMAT_TEXT,
+		LogLevel:        "info",
+		CaptureDir:      "captures",
+	}
+}
+
+func (c *Configuration) keys() []configKey {
+	return []configKey{
+		{name: "variants", usage: "titles to serve, comma separated: file1, file2", str: &c.Variants},
+		{name: "lobby_host", usage: "address the lobby servers bind to", str: &c.LobbyHost},
+		{name: "lobby_port", usage: "port of the File #1 lobby server", num: &c.LobbyPort},
+		{name: "game_host", usage: "address the game servers bind to", str: &c.GameHost},
+		{name: "game_port", usage: "port of the File #1 game server", num: &c.GamePort},
+		{name: "file2_lobby_port", usage: "port of the File #2 lobby server", num: &c.File2LobbyPort},
+		{name: "file2_game_port", usage: "port of the File #2 game server", num: &c.File2GamePort},
+		{name: "gs_ip", usage: "IP address of the gameserver sent to clients", str: &c.GsIP},
+		{name: "relays", usage: "more File #1 game servers, comma separated host:port[@network...]", str: &c.Relays},
+		{name: "file2_relays", usage: "more File #2 game servers, comma separated host:port[@network...]", str: &c.File2Relays},
+		{name: "relay_capacity", usage: "games per game server at a time, 0 is unlimited", num: &c.RelayCapacity},
+		{name: "relay_control_port", usage: "port remote game servers connect to, on lobby_host, 0 disables them", num: &c.RelayControl},
+		{name: "relay_secret", usage: "secret remote game servers authenticate with", str: &c.RelaySecret},
+		{name: "db_driver", usage: "storage backend: mysql or memory", str: &c.DBDriver},
+		{name: "db_user", usage: "database user", str: &c.DBUser},
+		{name: "db_password", usage: "database password", str: &c.DBPassword},
+		{name: "db_host", usage: "database host", str: &c.DBHost},
+		{name: "db_port", usage: "database port", num: &c.DBPort},
+		{name: "db_name", usage: "database name", str: &c.DBName},
+		{name: "web_host", usage: "address the login pages bind to", str: &c.WebHost},
+		{name: "web_port", usage: "port of the login pages, 0 disables them", num: &c.WebPort},
+		{name: "web_cert", usage: "TLS certificate for the login pages", str: &c.WebCert},
+		{name: "web_key", usage: "TLS key for the login pages", str: &c.WebKey},
+		{name: "web_base_url", usage: "URL the game reaches the login pages at", str: &c.WebBaseURL},
+		{name: "web_lobby_host", usage: "lobby host name handed to the game, defaults to the web_base_url host", str: &c.WebLobbyHost},
+		{name: "patch_file", usage: "File #1 1.01 patch (patch.raw) sent to unpatched clients, empty disables patching", str: &c.PatchFile},
+		{name: "patch_version", usage: "version string of the patch file", str: &c.PatchVersion},
+		{name: "shutdown_message", usage: "notice shown to connected players when the server stops", str: &c.ShutdownMessage},
+		{name: "shutdown_timeout", usage: "seconds running games may take to finish when the server stops", num: &c.ShutdownTimeout},
+		{name: "admin_host", usage: "address the admin API binds to", str: &c.AdminHost},
+		{name: "admin_port", usage: "port of the admin API, 0 disables it", num: &c.AdminPort},
+		{name: "admin_token", usage: "bearer token the admin API requires", str: &c.AdminToken},
+		{name: "metrics_host", usage: "address the Prometheus metrics bind to", str: &c.MetricsHost},
+		{name: "metrics_port", usage: "port of the Prometheus /metrics, 0 disables it", num: &c.MetricsPort},
+		{name: "log_format", usage: "log output: text or json", str: &c.LogFormat},
+		{name: "log_level", usage: "log level, optionally per subsystem: info,lobby=debug,game=warn", str: &c.LogLevel},
+		{name: "capture_dir", usage: "directory packet traces are written to", str: &c.CaptureDir},
+		{name: "capture_users", usage: "userids whose packets are recorded from the start, comma separated", str: &c.CaptureUsers},
+	}
+}
+
+func (k configKey) set(value string) error {
+	if k.str != nil {
+		*k.str = value
+		return nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("%s: %q is not a number", k.name, value)
+	}
+	*k.num = n
+	return nil
+}
+
+func (k configKey) flagName() string {
+	return strings.ReplaceAll(k.name, "_", "-")
+}
+
+func (k configKey) envName() string {
+	return ENV_PREFIX + strings.ToUpper(k.name)
+}
+
+// LoadConfiguration builds the configuration from the defaults, the config
+// file, the environment and the given command line arguments.
+// A missing default config file is not an error, a missing explicit one is.
+func LoadConfiguration(args []string) (*Configuration, error) {
+	conf := NewConfiguration()
+
+	fs := flag.NewFlagSet("bioserver", flag.ContinueOnError)
+	configFile := fs.String("config", "", "configuration file (.properties, .toml or .yaml)")
+	overrides := make(map[string]*string)
+	for _, k := range conf.keys() {
+		overrides[k.name] = fs.String(k.flagName(), "", k.usage)
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	explicit := *configFile != ""
+	if !explicit {
+		if env, ok := os.LookupEnv(ENV_PREFIX + "CONFIG"); ok && env != "" {
+			*configFile = env
+			explicit = true
+		} else {
+			*configFile = DEFAULT_CONFIG_FILE
+		}
+	}
+	conf.ConfigFile = *configFile
+
+	values, err := readConfigFile(*configFile)
+	if err != nil {
+		if explicit || !os.IsNotExist(err) {
+			return nil, err
+		}
+		values = nil
+	}
+
+	for _, k := range conf.keys() {
+		if v, ok := values[k.name]; ok {
+			if err := k.set(v); err != nil {
+				return nil, fmt.Errorf("%s: %w", *configFile, err)
+			}
+		}
+		if v, ok := os.LookupEnv(k.envName()); ok {
+			if err := k.set(v); err != nil {
+				return nil, fmt.Errorf("%s: %w", k.envName(), err)
+			}
+		}
+	}
+
+	// only flags that were given on the command line override
+	var flagErr error
+	fs.Visit(func(f *flag.Flag) {
+		for _, k := range conf.keys() {
+			if k.flagName() == f.Name {
+				if err := k.set(*overrides[k.name]); err != nil && flagErr == nil {
+					flagErr = err
+				}
+			}
+		}
+	})
+	if flagErr != nil {
+		return nil, flagErr
+	}
+
+	if err := conf.validate(); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+func (c *Configuration) validate() error {
+	if _, err := resolveIPv4(c.GsIP); err != nil {
+		return fmt.Errorf("gs_ip: %w, check properties file", err)
+	}
+	for _, port := range []int{c.LobbyPort, c.GamePort, c.File2LobbyPort, c.File2GamePort, c.DBPort} {
+		if port <= 0 || port > 0xffff {
+			return fmt.Errorf("invalid port %d", port)
+		}
+	}
+	served, err := ParseVariants(c.Variants)
+	if err != nil {
+		return fmt.Errorf("variants: %w", err)
+	}
+	ports := make(map[int]bool)
+	for _, v := range served {
+		lobby, game := c.Ports(v)
+		for _, port := range []int{lobby, game} {
+			if ports[port] {
+				return fmt.Errorf("port %d is used twice", port)
+			}
+			ports[port] = true
+		}
+	}
+	if c.RelayCapacity < 0 {
+		return fmt.Errorf("invalid relay_capacity %d", c.RelayCapacity)
+	}
+	for _, v := range served {
+		relays, err := c.GetRelays(v)
+		if err != nil {
+			return err
+		}
+		if len(relays) > 1 && (c.RelayControl == 0 || c.RelaySecret == "") {
+			return fmt.Errorf("remote relays need relay_control_port and relay_secret")
+		}
+	}
+	if c.RelayControl < 0 || c.RelayControl > 0xffff || (c.RelayControl != 0 && ports[c.RelayControl]) {
+		return fmt.Errorf("invalid relay_control_port %d", c.RelayControl)
+	}
+	if c.ShutdownTimeout < 0 {
+		return fmt.Errorf("invalid shutdown_timeout %d", c.ShutdownTimeout)
+	}
+	if c.WebPort < 0 || c.WebPort > 0xffff {
+		return fmt.Errorf("invalid web_port %d", c.WebPort)
+	}
+	if (c.WebCert == "") != (c.WebKey == "") {
+		return fmt.Errorf("web_cert and web_key must be set together")
+	}
+	if c.AdminPort < 0 || c.AdminPort > 0xffff {
+		return fmt.Errorf("invalid admin_port %d", c.AdminPort)
+	}
+	if c.AdminPort != 0 && c.AdminToken == "" {
+		return fmt.Errorf("admin_port needs admin_token")
+	}
+	if c.MetricsPort < 0 || c.MetricsPort > 0xffff {
+		return fmt.Errorf("invalid metrics_port %d", c.MetricsPort)
+	}
+	return nil
+}
+
+// Ports returns the lobby and game server port of a title.
+func (c *Configuration) Ports(v *Variant) (lobby int, game int) {
+	if v == FILE2 {
+		return c.File2LobbyPort, c.File2GamePort
+	}
+	return c.LobbyPort, c.GamePort
+}
+
+// GameServerIP returns the 4 byte IPv4 address that is sent to the clients
+// in the GSINFO packet.
+func (c *Configuration) GameServerIP() []byte {
+	if ip, err := resolveIPv4(c.GsIP); err == nil {
+		return ip
+	}
+	return []byte{127, 0, 0, 1}
+}
+
+// GetRelays lists the game servers of a title, the one in this process
+// first, followed by the configured remote ones.
+func (c *Configuration) GetRelays(v *Variant) ([]*Relay, error) {
+	_, port := c.Ports(v)
+	local := &Relay{Name: "local", IP: c.GameServerIP(), Port: port, Capacity: c.RelayCapacity, Local: true}
+	list := c.Relays
+	if v == FILE2 {
+		list = c.File2Relays
+	}
+	remote, err := ParseRelays(list, c.RelayCapacity)
+	if err != nil {
+		return nil, err
+	}
+	return append([]*Relay{local}, remote...), nil
+}
+
+// resolveIPv4 returns the 4 byte address of an IP or host name.
+func resolveIPv4(host string) ([]byte, error) {
+	if ip := net.ParseIP(host).To4(); ip != nil {
+		return []byte(ip), nil
+	}
+	ips, err := net.LookupIP(host)
+	if err == nil {
+		for _, ip := range ips {
+			if ip4 := ip.To4(); ip4 != nil {
+				return []byte(ip4), nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("unknown host %q", host)
+}
+
+// readConfigFile reads a flat list of settings. Three formats are accepted:
+//
+//	key=value           Java style config.properties (also key: value)
+//	key = "value"       TOML; a [section] prefixes the keys, [db] user -> db_user
+//	key: value          YAML; one level of nesting is flattened the same way
+//
+// The format is picked from the file extension.
+func readConfigFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ext := strings.ToLower(filepath.Ext(path))
+	values := make(map[string]string)
+	section := ""
+	lineNr := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lineNr++
+		raw := scanner.Text()
+		line := strings.TrimSpace(raw)
+		if line == "" || line[0] == '#' || line[0] == '!' || line[0] == ';' {
+			continue
+		}
+
+		switch ext {
+		case ".toml":
+			if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+				section = strings.TrimSpace(line[1 : len(line)-1])
+				continue
+			}
+		case ".yaml", ".yml":
+			if line == "---" {
+				continue
+			}
+			indented := raw[0] == ' ' || raw[0] == '\t'
+			if !indented {
+				section = ""
+			}
+			if !indented && strings.HasSuffix(line, ":") {
+				section = strings.TrimSpace(strings.TrimSuffix(line, ":"))
+				continue
+			}
+		}
+
+		sep := strings.IndexAny(line, "=:")
+		if sep < 0 {
+			return nil, fmt.Errorf("%s:%d: expected key=value", path, lineNr)
+		}
+		key := strings.TrimSpace(line[:sep])
+		value := unquoteConfigValue(strings.TrimSpace(line[sep+1:]))
+		if section != "" {
+			key = section + "_" + key
+		}
+		values[strings.ReplaceAll(key, ".", "_")] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+func unquoteConfigValue(v string) string {
+	if len(v) >= 2 && (v[0] == '"' || v[0] == '\'') {
+		if end := strings.IndexByte(v[1:], v[0]); end >= 0 {
+			return v[1 : end+1]
+		}
+	}
+	// strip trailing comments of TOML/YAML values
+	if i := strings.Index(v, " #"); i >= 0 {
+		v = strings.TrimSpace(v[:i])
+	}
+	return v
+}
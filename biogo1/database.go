@@ -3,7 +3,6 @@ package main
 import (
 	"database/sql"
 	"fmt"
-	"log"
 	"io"
 	"bytes"
 	
@@ -12,12 +11,27 @@ import (
 	_ "github.com/go-sql-driver/mysql"
 )
 
+// Database is the MySQL implementation of Store, using the schema of
+// bioserv1/database/bioserver.sql.
 type Database struct {
 	db *sql.DB
 }
 
-func NewDatabase(dbUser, dbPassword string) (*Database, error) {
-	dsn := fmt.Sprintf("%s:%s@tcp(localhost:3306)/bioserver?charset=utf8", dbUser, dbPassword)
+func NewDatabase(conf *Configuration) (*Database, error) {
+	database, err := openDatabase(conf)
+	if err != nil {
+		return nil, err
+	}
+	if err = database.ResetSessions(); err != nil {
+		dbLog.Error("resetting sessions", "err", err)
+	}
+	return database, nil
+}
+
+// openDatabase connects without touching any table, for the migrate
+// subcommand which may run against an empty or a live database.
+func openDatabase(conf *Configuration) (*Database, error) {
+	dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?charset=utf8", conf.DBUser, conf.DBPassword, conf.DBHost, conf.DBPort, conf.DBName)
 	db, err := sql.Open("mysql", dsn)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database connection: %w", err)
@@ -25,15 +39,13 @@ func NewDatabase(dbUser, dbPassword string) (*Database, error) {
 	if err = db.Ping(); err != nil {
 		return nil, fmt.Errorf("failed to ping database: %w", err)
 	}
-	log.Println("Database connection established")
-	database := &Database{db: db}
-	if err = database.setupDBRestart(); err != nil {
-		log.Printf("setupDBRestart warning: %v", err)
-	}
-	return database, nil
+	dbLog.Info("database connection established", "host", conf.DBHost, "name", conf.DBName)
+	return &Database{db: db}, nil
 }
 
-func (d *Database) setupDBRestart() error {
+// ResetSessions puts every session back to offline, nobody is connected
+// after a (re)start.
+func (d *Database) ResetSessions() error {
 	_, err := d.db.Exec("UPDATE sessions SET area=-1, room=0, slot=0, gamesess=0, state=0")
 	return err
 }
@@ -76,14 +88,14 @@ func (d * Database) CreateNewHNPair(cl *Client) {
 
 	if dec, err := decodeSJIS(cl.hnPair.nickname); err != nil {
 		nickname = "sjis"
-		log.Printf("ShiftJIS decoding failed: %v", err)
+		dbLog.Warn("ShiftJIS decoding failed", "userid", uid, "err", err)
 	} else {
 		nickname = dec
 	}
 	query := "INSERT INTO hnpairs (userid, handle, nickname) VALUES (?, ?, ?)"
 
 	if _, err := d.db.Exec(query, uid, handle, nickname); err != nil {
-		log.Printf("Failed to insert HNPair: %v", err)
+		dbLog.Error("inserting HNPair", "userid", uid, "err", err)
 	}
 
 }
@@ -96,14 +108,14 @@ func (d * Database) UpdateHNPair(cl *Client) {
 
 	if dec, err := decodeSJIS(cl.hnPair.nickname); err != nil {
 		nickname = "sjis"
-		log.Printf("ShiftJIS decoding failed: %v", err)
+		dbLog.Warn("ShiftJIS decoding failed", "userid", uid, "err", err)
 	} else {
 		nickname = dec
 	}
 	query := "UPDATE hnpairs SET nickname=? WHERE userid=? AND handle=?"
 
 	if _, err := d.db.Exec(query, nickname, uid, handle); err != nil {
-		log.Printf("Failed to update HNPair: %v", err)
+		dbLog.Error("updating HNPair", "userid", uid, "err", err)
 	}
 }
 
@@ -125,14 +137,14 @@ func (d *Database) GetHNPairs(userid string) *HNPairs {
 	hnpairs := NewHNPairs()
 	rows, err := d.db.Query("SELECT handle, nickname FROM hnpairs WHERE userid=?", userid)
 	if err != nil {
-		log.Printf("failed to get HN pairs: %v", err)
+		dbLog.Error("getting HN pairs", "userid", userid, "err", err)
 		return hnpairs
 	}
 	defer rows.Close()
 	for rows.Next() {
 		var handle, nickname string
 		if err := rows.Scan(&handle, &nickname); err != nil {
-			log.Printf("failed to scan HN pair: %v", err)
+			dbLog.Error("scanning HN pair", "userid", userid, "err", err)
 			continue
 		}
 		hnpairs.Add(NewHNPairFromStrings(handle, nickname))
@@ -146,14 +158,77 @@ func (d *Database) GetMOTD() (string, error) {
 	if err != nil {
 		return "", fmt.Errorf("failed to get MOTD: %w", err)
 	}
-	fmt.Println("Returning MOTD:", motd)
 	return motd, nil
 }
 
 func (d *Database) UpdateClientGame(userid string, gameNumber int) error {
     _, err := d.db.Exec("UPDATE sessions SET gamesess=? WHERE userid=?", gameNumber, userid)
     if err != nil {
-        log.Printf("Failed to update client game number for userid %s: %v", userid, err)
+        dbLog.Error("updating client game number", "userid", userid, "err", err)
     }
     return err
 }
+
+func (d *Database) Close() error {
+	return d.db.Close()
+}
+
+func (d *Database) CreateUser(userid, pwhash string) error {
+	var count int
+	if err := d.db.QueryRow("SELECT count(*) FROM users WHERE userid=?", userid).Scan(&count); err != nil {
+		return fmt.Errorf("failed to check user %s: %w", userid, err)
+	}
+	if count > 0 {
+		return ErrUserExists
+	}
+	if _, err := d.db.Exec("INSERT INTO users (userid, passwd, pwhash) VALUES (?, '', ?)", userid, pwhash); err != nil {
+		return fmt.Errorf("failed to create user %s: %w", userid, err)
+	}
+	return nil
+}
+
+// GetUserPassword returns the password hash of a user and, for accounts
+// created by the old PHP pages, the plain text passwd column.
+func (d *Database) GetUserPassword(userid string) (string, string, error) {
+	var pwhash, legacy string
+	err := d.db.QueryRow("SELECT pwhash, passwd FROM users WHERE userid=?", userid).Scan(&pwhash, &legacy)
+	if err == sql.ErrNoRows {
+		return "", "", ErrNoUser
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get password of %s: %w", userid, err)
+	}
+	return pwhash, legacy, nil
+}
+
+// SetPasswordHash stores a new hash and wipes the plain text password.
+func (d *Database) SetPasswordHash(userid, pwhash string) error {
+	_, err := d.db.Exec("UPDATE users SET pwhash=?, passwd='' WHERE userid=?", pwhash, userid)
+	return err
+}
+
+// CreateSession drops old sessions of the user and creates a new one with
+// an unused session id.
+func (d *Database) CreateSession(userid, ip string, port int) (string, error) {
+	if _, err := d.db.Exec("DELETE FROM sessions WHERE lower(userid) = lower(?)", userid); err != nil {
+		return "", fmt.Errorf("failed to delete old sessions: %w", err)
+	}
+	for {
+		sessid, err := newSessionID()
+		if err != nil {
+			return "", err
+		}
+		var count int
+		if err := d.db.QueryRow("SELECT count(*) FROM sessions WHERE sessid=?", sessid).Scan(&count); err != nil {
+			return "", fmt.Errorf("failed to check session id: %w", err)
+		}
+		if count > 0 {
+			continue
+		}
+		_, err = d.db.Exec("INSERT INTO sessions (userid, ip, port, sessid, lastlogin) VALUES (lower(?), ?, ?, ?, now())", userid, ip, port, sessid)
+		if err != nil {
+			return "", fmt.Errorf("failed to create session: %w", err)
+		}
+		return sessid, nil
+	}
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bioserver/commands"
+	"bioserver/protocol"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// bytes of game data shown without -hex
+const DISSECT_GAME_PREVIEW = 16
+
+// Dissector prints lobby and game traffic packet by packet: command names,
+// the decoded payload with secret strings decrypted, and for the payloads
+// we don't know yet a hex dump with the strings it seems to contain.
+type Dissector struct {
+	out        *bufio.Writer
+	cmds       map[int]bool // only these commands, all when empty
+	hexDump    bool
+	lobbyPorts []int
+	gamePorts  []int
+	count      int
+	// packet, when set, gets the lobby format packets instead of them
+	// being printed, and CAPTURE_CLOSE without data when a capture shows
+	// a connection closing. Game data is dropped.
+	packet func(t time.Time, server, conn, dir string, data []byte)
+}
+
+// dissectFlow splits one direction of a connection into packets the way
+// the server reads it.
+type dissectFlow struct {
+	server  string // CAPTURE_LOBBY or CAPTURE_GAME
+	conn    string
+	buf     *ServerStreamBuffer
+	started bool
+	login   []byte // the game server login query, it isn't in game framing
+	inLogin bool
+	next    uint32 // expected TCP sequence number
+}
+
+func runDissect(args []string) int {
+	fs := flag.NewFlagSet("bioserver dissect", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: bioserver dissect [flags] [file ...]")
+		fmt.Fprintln(fs.Output(), "Reads packet traces (capture_dir), pcap/pcapng captures or raw TCP streams, stdin without files.")
+		fs.PrintDefaults()
+	}
+	game := fs.Bool("game", false, "raw streams are game server traffic")
+	cmds := fs.String("cmd", "", "only these commands, comma separated names or hex numbers")
+	hexDump := fs.Bool("hex", false, "hex dump every packet and all game data")
+	lobbyPorts := fs.String("lobby-ports", fmt.Sprintf("%d,%d", FILE1.LobbyPort, FILE2.LobbyPort), "lobby server ports in captures")
+	gamePorts := fs.String("game-ports", fmt.Sprintf("%d,%d", FILE1.GamePort, FILE2.GamePort), "game server ports in captures")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	d := &Dissector{out: bufio.NewWriter(os.Stdout), hexDump: *hexDump}
+	defer d.out.Flush()
+	var err error
+	if d.cmds, err = parseDissectCommands(*cmds); err != nil {
+		fmt.Fprintln(os.Stderr, "dissect:", err)
+		return 2
+	}
+	if d.lobbyPorts, err = parsePorts(*lobbyPorts); err != nil {
+		fmt.Fprintln(os.Stderr, "dissect: -lobby-ports:", err)
+		return 2
+	}
+	if d.gamePorts, err = parsePorts(*gamePorts); err != nil {
+		fmt.Fprintln(os.Stderr, "dissect: -game-ports:", err)
+		return 2
+	}
+
+	server := CAPTURE_LOBBY
+	if *game {
+		server = CAPTURE_GAME
+	}
+	files := fs.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	for _, name := range files {
+		if err := d.dissectFile(name, server); err != nil {
+			d.out.Flush()
+			fmt.Fprintf(os.Stderr, "dissect: %s: %v\n", name, err)
+			return 1
+		}
+	}
+	return 0
+}
+
+// parseDissectCommands reads the -cmd list, names or hex numbers.
+func parseDissectCommands(list string) (map[int]bool, error) {
+	cmds := make(map[int]bool)
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if n, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(s), "0x"), 16, 16); err == nil {
+			cmds[int(n)] = true
+			continue
+		}
+		cmd, ok := commands.GetConstValue(s)
+		if !ok {
+			return nil, fmt.Errorf("unknown command %q", s)
+		}
+		cmds[cmd] = true
+	}
+	return cmds, nil
+}
+
+func parsePorts(list string) ([]int, error) {
+	var ports []int
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		port, err := strconv.Atoi(s)
+		if err != nil || port < 1 || port > 0xffff {
+			return nil, fmt.Errorf("invalid port %q", s)
+		}
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+func (d *Dissector) dissectFile(name, server string) error {
+	var data []byte
+	var err error
+	if name == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(name)
+	}
+	if err != nil {
+		return err
+	}
+	switch {
+	case isPcap(data):
+		return d.dissectPcap(data)
+	case bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")):
+		return d.dissectTrace(data)
+	}
+	return d.dissectRaw(name, server, data)
+}
+
+// dissectTrace prints a trace written by the packet capture.
+func (d *Dissector) dissectTrace(data []byte) error {
+	lines := bufio.NewScanner(bytes.NewReader(data))
+	lines.Buffer(nil, 1<<20)
+	for n := 1; lines.Scan(); n++ {
+		if len(bytes.TrimSpace(lines.Bytes())) == 0 {
+			continue
+		}
+		var rec CaptureRecord
+		if err := json.Unmarshal(lines.Bytes(), &rec); err != nil {
+			return fmt.Errorf("line %d: %w", n, err)
+		}
+		raw, err := hex.DecodeString(rec.Raw)
+		if err != nil {
+			return fmt.Errorf("line %d: raw: %w", n, err)
+		}
+		conn := strconv.FormatUint(rec.Conn, 10)
+		if rec.UserID != "" {
+			conn += "/" + rec.UserID
+		}
+		if rec.Dir == CAPTURE_CLOSE {
+			if len(d.cmds) == 0 {
+				d.line(rec.Time, rec.Server, conn, "", "connection closed")
+			}
+			continue
+		}
+		if rec.Server == CAPTURE_LOBBY || rec.Cmd != "" {
+			d.lobbyPackets(rec.Time, rec.Server, conn, rec.Dir, raw)
+		} else {
+			d.gameData(rec.Time, conn, rec.Dir, raw)
+		}
+	}
+	return lines.Err()
+}
+
+// dissectRaw prints one direction of a connection saved as raw bytes, like
+// Wireshark's "Follow TCP Stream" as raw data.
+func (d *Dissector) dissectRaw(name, server string, data []byte) error {
+	flow := d.newFlow(server, name)
+	for len(data) > 0 {
+		// read in the size the server reads
+		n := min(len(data), 1024)
+		if err := flow.feed(d, time.Time{}, "", data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// dissectPcap follows the TCP connections to the lobby and game ports in a
+// capture.
+func (d *Dissector) dissectPcap(data []byte) error {
+	flows := make(map[[2]netip.AddrPort]*dissectFlow)
+	var err error
+	readErr := readPcap(bytes.NewReader(data), func(seg tcpSegment) {
+		if err != nil {
+			return
+		}
+		dir, server, client := "", "", seg.src
+		port := int(seg.dst.Port())
+		if slices.Contains(d.lobbyPorts, port) || slices.Contains(d.gamePorts, port) {
+			dir = CAPTURE_IN
+		} else {
+			port = int(seg.src.Port())
+			client = seg.dst
+			dir = CAPTURE_OUT
+		}
+		switch {
+		case slices.Contains(d.lobbyPorts, port):
+			server = CAPTURE_LOBBY
+		case slices.Contains(d.gamePorts, port):
+			server = CAPTURE_GAME
+		default:
+			return
+		}
+		key := [2]netip.AddrPort{seg.src, seg.dst}
+		flow, ok := flows[key]
+		if !ok || seg.syn {
+			flow = d.newFlow(server, client.String())
+			flows[key] = flow
+		}
+		if seg.syn {
+			flow.next = seg.seq + 1
+			return
+		}
+		if seg.fin && d.packet != nil {
+			defer d.packet(seg.time, server, client.String(), CAPTURE_CLOSE, nil)
+		}
+		payload := seg.payload
+		if len(payload) == 0 {
+			return
+		}
+		if !flow.started && flow.next == 0 {
+			flow.next = seg.seq
+		}
+		// drop what was retransmitted, a gap is lost data
+		switch ahead := int32(seg.seq - flow.next); {
+		case ahead < 0 && int(-ahead) >= len(payload):
+			return
+		case ahead < 0:
+			payload = payload[-ahead:]
+		case ahead > 0:
+			fmt.Fprintf(d.out, "!! %s %s: %d bytes missing from the capture\n", server, client, ahead)
+		}
+		flow.next = seg.seq + uint32(len(seg.payload))
+		err = flow.feed(d, seg.time, dir, payload)
+	})
+	if readErr != nil {
+		return readErr
+	}
+	return err
+}
+
+func (d *Dissector) newFlow(server, conn string) *dissectFlow {
+	return &dissectFlow{server: server, conn: conn, buf: NewServerStreamBuffer()}
+}
+
+// feed adds received bytes and prints the complete packets.
+func (f *dissectFlow) feed(d *Dissector, t time.Time, dir string, data []byte) error {
+	if !f.started {
+		f.started = true
+		// the game server starts with a lobby format login query
+		f.inLogin = f.server == CAPTURE_GAME && data[0] == commands.GAMESERVER
+	}
+	if f.inLogin {
+		f.login = append(f.login, data...)
+		if len(f.login) < HEADER_SIZE {
+			return nil
+		}
+		size := HEADER_SIZE + int(binary.BigEndian.Uint16(f.login[4:]))
+		if len(f.login) < size {
+			return nil
+		}
+		d.lobbyPackets(t, f.server, f.conn, dir, f.login[:size])
+		data, f.login, f.inLogin = f.login[size:], nil, false
+		if len(data) == 0 {
+			return nil
+		}
+	}
+	if err := f.buf.AppendData(data); err != nil {
+		return err
+	}
+	for {
+		var msg []byte
+		var err error
+		if f.server == CAPTURE_LOBBY {
+			msg, err = f.buf.GetCompleteMessages()
+		} else {
+			msg, err = f.buf.GetCompleteGameMessages()
+		}
+		if err != nil || msg == nil {
+			return err
+		}
+		if f.server == CAPTURE_LOBBY || len(msg) >= 2 && msg[0] == commands.GAMECLIENT && msg[1] == commands.TELL {
+			d.lobbyPackets(t, f.server, f.conn, dir, msg)
+		} else {
+			d.gameData(t, f.conn, dir, msg)
+		}
+	}
+}
+
+// lobbyPackets prints complete packets in the lobby format.
+func (d *Dissector) lobbyPackets(t time.Time, server, conn, dir string, data []byte) {
+	for len(data) >= HEADER_SIZE {
+		size := HEADER_SIZE + int(binary.BigEndian.Uint16(data[4:]))
+		if size > len(data) {
+			break
+		}
+		if d.packet != nil {
+			d.packet(t, server, conn, dir, data[:size])
+		} else {
+			d.lobbyPacket(t, server, conn, dir, data[:size])
+		}
+		data = data[size:]
+	}
+	if len(data) > 0 && d.packet == nil {
+		d.count++
+		d.line(t, server, conn, dir, "incomplete packet, %d bytes", len(data))
+		d.dump(data)
+	}
+}
+
+func (d *Dissector) lobbyPacket(t time.Time, server, conn, dir string, data []byte) {
+	h, m, err := protocol.Decode(data)
+	if len(d.cmds) > 0 && !d.cmds[h.Cmd] {
+		return
+	}
+	d.count++
+	if dir == "" {
+		dir = CAPTURE_OUT
+		if h.Who == commands.CLIENT || h.Who == commands.GAMECLIENT {
+			dir = CAPTURE_IN
+		}
+	}
+	d.line(t, server, conn, dir, "%s 0x%04X %s pid=%d len=%d",
+		commands.GetConstName(h.Cmd), h.Cmd, commands.GetConstName(h.Qsw), h.PID, h.Len)
+	if h.Err == protocol.ERR_FLAG {
+		fmt.Fprintf(d.out, "    error flag set\n")
+	}
+	if err != nil {
+		fmt.Fprintf(d.out, "    !! %v\n", err)
+	}
+	payload := data[HEADER_SIZE:]
+	if _, unknown := m.(*protocol.Raw); unknown || m == nil {
+		if len(payload) > 0 {
+			fmt.Fprintf(d.out, "    payload layout unknown\n")
+			d.dump(payload)
+			for _, s := range guessStrings(payload, h.PID) {
+				fmt.Fprintf(d.out, "    %s\n", s)
+			}
+		}
+		return
+	}
+	fmt.Fprintf(d.out, "    %s\n", strings.TrimPrefix(fmt.Sprintf("%T", m), "*protocol."))
+	printFields(d.out, protocol.Fields(m), "      ")
+	if d.hexDump || err != nil {
+		d.dump(data)
+	}
+}
+
+// gameData prints game messages, each starts with its length.
+func (d *Dissector) gameData(t time.Time, conn, dir string, data []byte) {
+	if len(d.cmds) > 0 || d.packet != nil {
+		return
+	}
+	for len(data) > 0 {
+		size := int(data[0])
+		if size == 0 || size > len(data) {
+			size = len(data)
+		}
+		d.count++
+		msg := data[:size]
+		if d.hexDump {
+			d.line(t, CAPTURE_GAME, conn, dir, "game data len=%d", size)
+			d.dump(msg)
+		} else {
+			preview := msg[:min(len(msg), DISSECT_GAME_PREVIEW)]
+			more := ""
+			if len(msg) > len(preview) {
+				more = " ..."
+			}
+			d.line(t, CAPTURE_GAME, conn, dir, "game data len=%d % x%s", size, preview, more)
+		}
+		data = data[size:]
+	}
+}
+
+func (d *Dissector) line(t time.Time, server, conn, dir, format string, v ...any) {
+	stamp := ""
+	if !t.IsZero() {
+		stamp = t.Format("15:04:05.000") + " "
+	}
+	fmt.Fprintf(d.out, "[%5d] %s%s %s %-3s %s\n", d.count, stamp, server, conn, dir, fmt.Sprintf(format, v...))
+}
+
+// dump writes a hex dump of data, 16 bytes a line.
+func (d *Dissector) dump(data []byte) {
+	for off := 0; off < len(data); off += 16 {
+		line := data[off:min(off+16, len(data))]
+		ascii := make([]byte, len(line))
+		for i, c := range line {
+			ascii[i] = '.'
+			if c >= 0x20 && c < 0x7f {
+				ascii[i] = c
+			}
+		}
+		fmt.Fprintf(d.out, "    %04x  %-47s  |%s|\n", off, fmt.Sprintf("% x", line), ascii)
+	}
+}
+
+// printFields writes decoded fields, nested ones indented.
+func printFields(w io.Writer, fields []protocol.Field, indent string) {
+	for _, f := range fields {
+		printValue(w, f.Name, f.Value, indent)
+	}
+}
+
+func printValue(w io.Writer, name string, value any, indent string) {
+	switch v := value.(type) {
+	case []protocol.Field:
+		fmt.Fprintf(w, "%s%s:\n", indent, name)
+		printFields(w, v, indent+"  ")
+	case []any:
+		fmt.Fprintf(w, "%s%s: %d entries\n", indent, name, len(v))
+		for i, e := range v {
+			printValue(w, fmt.Sprintf("[%d]", i), e, indent+"  ")
+		}
+	case string:
+		if strings.HasPrefix(v, "hex:") {
+			fmt.Fprintf(w, "%s%s: %s\n", indent, name, v)
+		} else {
+			fmt.Fprintf(w, "%s%s: %q\n", indent, name, v)
+		}
+	case int64:
+		fmt.Fprintf(w, "%s%s: %d (0x%X)\n", indent, name, v, v)
+	case uint64:
+		fmt.Fprintf(w, "%s%s: %d (0x%X)\n", indent, name, v, v)
+	default:
+		fmt.Fprintf(w, "%s%s: %v\n", indent, name, v)
+	}
+}
+
+// guessStrings looks for length prefixed strings in a payload we have no
+// layout for, plain and secret ones, which are XOR obfuscated with the key
+// of the packet id behind a checksum.
+func guessStrings(payload []byte, pid int) []string {
+	var found []string
+	for off := 0; off+2 < len(payload); off++ {
+		n := int(binary.BigEndian.Uint16(payload[off:]))
+		if n < 2 || off+2+n > len(payload) {
+			continue
+		}
+		if text := payload[off+2 : off+2+n]; printableText(text) {
+			found = append(found, fmt.Sprintf("string at 0x%02x: %q", off, bytes.TrimRight(text, "\x00")))
+			continue
+		}
+		if n < 4 {
+			continue
+		}
+		text := slices.Clone(payload[off+4 : off+2+n])
+		protocol.Crypt(text, pid)
+		if printableText(text) {
+			found = append(found, fmt.Sprintf("secret at 0x%02x: %q (checksum 0x%04X)",
+				off, bytes.TrimRight(text, "\x00"), binary.BigEndian.Uint16(payload[off+2:])))
+		}
+	}
+	return found
+}
+
+// printableText is at least two characters of ASCII text, padding NULs
+// allowed at the end.
+func printableText(b []byte) bool {
+	b = bytes.TrimRight(b, "\x00")
+	if len(b) < 2 {
+		return false
+	}
+	for _, c := range b {
+		if c < 0x20 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bioserver/commands"
+	"bioserver/protocol"
+	"bioserver/simclient"
+	"bytes"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// lobbyClient logs a new user in and picks a handle and character.
+func lobbyClient(t *testing.T, s *SimServer, userid, handle, nickname string, character byte) *simclient.Client {
+	t.Helper()
+	session, err := s.NewSession(userid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := simclient.Dial(s.addr, userid, session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	pairs, err := c.Login(simclient.VERSION)
+	if err != nil {
+		t.Fatalf("%s login: %v", userid, err)
+	}
+	if len(pairs) != 0 {
+		t.Fatalf("%s is new but has handles %v", userid, pairs)
+	}
+	if err := c.SelectHandle(handle, nickname); err != nil {
+		t.Fatalf("%s HNSELECT: %v", userid, err)
+	}
+	if string(c.Handle) != handle {
+		t.Fatalf("%s got handle %q, want %q", userid, c.Handle, handle)
+	}
+	if err := c.SelectCharacter(character); err != nil {
+		t.Fatalf("%s CHARSELECT: %v", userid, err)
+	}
+	return c
+}
+
+// await waits for a packet and checks its fields, see simclient.Match.
+func await(t *testing.T, c *simclient.Client, qsw byte, cmd int, fields ...string) simclient.Packet {
+	t.Helper()
+	p, err := c.Await(qsw, cmd)
+	if err != nil {
+		t.Fatalf("%s: %v", c.Name, err)
+	}
+	if err := simclient.Match(p, fields); err != nil {
+		t.Fatalf("%s: %v", c.Name, err)
+	}
+	return p
+}
+
+// startGame has alice host a game in slot 3 of room 1, bob join it and alice
+// start it.
+func startGame(t *testing.T, s *SimServer) (alice, bob *simclient.Client) {
+	t.Helper()
+	alice = lobbyClient(t, s, "alice", "ALICE1", "Alice", 1)
+	if err := alice.SelectArea(1); err != nil {
+		t.Fatalf("alice AREASELECT: %v", err)
+	}
+	if err := alice.EnterRoom(1); err != nil {
+		t.Fatalf("alice ENTERROOM: %v", err)
+	}
+	if err := alice.CreateSlot(3); err != nil {
+		t.Fatalf("alice CREATESLOT: %v", err)
+	}
+	await(t, alice, commands.BROADCAST, commands.SLOTPLRSTATUS, "Slot=3", "Players=1")
+	if err := alice.SelectScene(0x11, 1); err != nil {
+		t.Fatalf("alice SCENESELECT: %v", err)
+	}
+	if err := alice.SetSlotName("alice's game"); err != nil {
+		t.Fatalf("alice SLOTNAME: %v", err)
+	}
+	if err := alice.OpenSlot(); err != nil {
+		t.Fatalf("alice UNKN6504: %v", err)
+	}
+
+	bob = lobbyClient(t, s, "bob", "BOB001", "Bob", 2)
+	if err := bob.SelectArea(1); err != nil {
+		t.Fatalf("bob AREASELECT: %v", err)
+	}
+	if err := bob.EnterRoom(1); err != nil {
+		t.Fatalf("bob ENTERROOM: %v", err)
+	}
+	if err := bob.JoinGame(3, ""); err != nil {
+		t.Fatalf("bob JOINGAME: %v", err)
+	}
+	await(t, bob, commands.BROADCAST, commands.SLOTPLRSTATUS, "Slot=3", "Players=2")
+	await(t, alice, commands.BROADCAST, commands.PLAYERSTATBC, "Handle=BOB001", "Nickname=Bob")
+
+	if err := alice.StartGame(); err != nil {
+		t.Fatalf("alice STARTGAME: %v", err)
+	}
+	await(t, bob, commands.BROADCAST, commands.GETREADY)
+	return alice, bob
+}
+
+// TestLobbyToGameServer takes two players from the login to the game server
+// of File #1 and lets them exchange game data there.
+func TestLobbyToGameServer(t *testing.T) {
+	s, err := StartSimServer(FILE1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Stop)
+	alice, bob := startGame(t, s)
+
+	// both are told the same game and our game server
+	var game string
+	for _, c := range []*simclient.Client{alice, bob} {
+		session, err := c.GameSession()
+		if err != nil {
+			t.Fatalf("%s GAMESESSION: %v", c.Name, err)
+		}
+		if game == "" {
+			game = session
+		} else if session != game {
+			t.Fatalf("%s is in game %s, alice in %s", c.Name, session, game)
+		}
+		relay, err := c.GameServerInfo()
+		if err != nil {
+			t.Fatalf("%s GSINFO: %v", c.Name, err)
+		}
+		if want := net.JoinHostPort("127.0.0.1", strconv.Itoa(s.lobby.gameServer.Port())); relay != want {
+			t.Fatalf("%s sent to %s, want %s", c.Name, relay, want)
+		}
+		if _, err := c.GameLogin(); err != nil {
+			t.Fatalf("%s GSLOGIN: %v", c.Name, err)
+		}
+	}
+	gamenr, err := strconv.Atoi(game)
+	if err != nil {
+		t.Fatalf("game session %q: %v", game, err)
+	}
+	for deadline := time.Now().Add(2 * time.Second); s.lobby.gamePacketHandler.sessions.Count(gamenr) < 2; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("game %d has %d players on the game server, want 2", gamenr, s.lobby.gamePacketHandler.sessions.Count(gamenr))
+		}
+	}
+
+	// game data goes to the other player only
+	data := []byte{0x05, 0x01, 0x02, 0x03, 0x04}
+	if err := alice.Game().Send(data); err != nil {
+		t.Fatal(err)
+	}
+	got, err := bob.Game().Receive()
+	if err != nil {
+		t.Fatalf("bob: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("bob got %x, want %x", got, data)
+	}
+}
+
+// TestLobbyRejectsUnknownNumbers sends slot, rule and room numbers the
+// lobby doesn't have and expects error answers, not a lost connection.
+func TestLobbyRejectsUnknownNumbers(t *testing.T) {
+	s, err := StartSimServer(FILE1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Stop)
+
+	alice := lobbyClient(t, s, "alice", "ALICE1", "Alice", 1)
+	if err := alice.SelectArea(1); err != nil {
+		t.Fatalf("alice AREASELECT: %v", err)
+	}
+	if err := alice.EnterRoom(99); err == nil {
+		t.Fatal("alice entered room 99")
+	}
+	if err := alice.EnterRoom(1); err != nil {
+		t.Fatalf("alice ENTERROOM: %v", err)
+	}
+	for _, q := range []protocol.Message{
+		&protocol.NumberQuery{Cmd: commands.SLOTSTATUS, Number: 0},
+		&protocol.NumberQuery{Cmd: commands.SLOTSTATUS, Number: 21},
+		&protocol.NumberQuery{Cmd: commands.RULESCOUNT, Number: -1},
+		&protocol.RuleQuery{Cmd: commands.RULEVALUE, Slot: 3, Rule: 200},
+		&protocol.AttrQuery{Cmd: commands.ATTRDESCRIPT, Slot: 3, Rule: 0, Attr: 200},
+		&protocol.JoinGameQuery{Slot: 21},
+	} {
+		if err := alice.Send(commands.QUERY, q); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := alice.Answer(q.Command()); err == nil {
+			t.Fatalf("%s %+v was answered", protocol.Name(q.Command()), q)
+		}
+	}
+	if err := alice.CreateSlot(21); err == nil {
+		t.Fatal("alice created slot 21")
+	}
+	if err := alice.CreateSlot(3); err != nil {
+		t.Fatalf("alice CREATESLOT: %v", err)
+	}
+}
+
+// TestGSInfoRemoteRelayStalled sends players to a remote relay whose control
+// connection takes nothing, the lobby has to go on meanwhile.
+func TestGSInfoRemoteRelayStalled(t *testing.T) {
+	timeout := CONTROL_SEND_TIMEOUT
+	CONTROL_SEND_TIMEOUT = time.Second
+	t.Cleanup(func() { CONTROL_SEND_TIMEOUT = timeout })
+	s, err := StartSimServer(FILE1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Stop)
+	alice, bob := startGame(t, s)
+
+	lobbyEnd, relayEnd := net.Pipe()
+	t.Cleanup(func() { relayEnd.Close() })
+	remote := &Relay{Name: "remote", IP: []byte{127, 0, 0, 1}, Port: 8690, control: NewControlConn(lobbyEnd)}
+	ph := s.lobby.packetHandler
+	pool := NewRelayPool([]*Relay{remote}, s.db)
+	ph.Sync(func() { ph.relays = pool })
+
+	// the relay reads late, the lobby answers other events before
+	if err := alice.Send(commands.QUERY, &protocol.Empty{Cmd: commands.GSINFO}); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(2 * time.Second); len(pool.Games("")) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("game not assigned to the relay")
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		ph.Sync(func() {})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(CONTROL_SEND_TIMEOUT / 2):
+		t.Fatal("lobby waits for the relay")
+	}
+	m, err := NewControlConn(relayEnd).Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Type != CONTROL_GAME || len(m.Players) != 2 {
+		t.Fatalf("relay got %+v, want a game with 2 players", m)
+	}
+	if _, err := alice.Answer(commands.GSINFO); err != nil {
+		t.Fatalf("alice GSINFO: %v", err)
+	}
+
+	// the relay doesn't read at all, bob is told there is no game server
+	if _, err := bob.GameServerInfo(); err == nil {
+		t.Fatal("bob sent to a stalled relay")
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// ExpectedPlayer is a player the lobby sent to a game server.
+type ExpectedPlayer struct {
+	UserID  string `json:"userid"`
+	Session string `json:"session"`
+}
+
+type expectedGame struct {
+	players  map[string]string // userid by session
+	started  bool
+	expected time.Time
+}
+
+// ExpectedGames are the games a game server was told about by the lobby,
+// only their players are let in.
+type ExpectedGames struct {
+	games    map[int]*expectedGame
+	sessions map[string]int // game number by session
+	mu       sync.Mutex
+}
+
+func NewExpectedGames() *ExpectedGames {
+	return &ExpectedGames{games: make(map[int]*expectedGame), sessions: make(map[string]int)}
+}
+
+// Expect adds players to a game, a session already expected elsewhere
+// moves to this game.
+func (eg *ExpectedGames) Expect(gamenr int, players []ExpectedPlayer) {
+	eg.mu.Lock()
+	defer eg.mu.Unlock()
+	eg.expire()
+	g, ok := eg.games[gamenr]
+	if !ok {
+		g = &expectedGame{players: make(map[string]string), expected: time.Now()}
+		eg.games[gamenr] = g
+	}
+	for _, p := range players {
+		if old, ok := eg.sessions[p.Session]; ok && old != gamenr {
+			delete(eg.games[old].players, p.Session)
+		}
+		g.players[p.Session] = p.UserID
+		eg.sessions[p.Session] = gamenr
+	}
+}
+
+// Lookup finds the player and game of a session.
+func (eg *ExpectedGames) Lookup(session string) (userid string, gamenr int, ok bool) {
+	eg.mu.Lock()
+	defer eg.mu.Unlock()
+	gamenr, ok = eg.sessions[session]
+	if !ok {
+		return "", 0, false
+	}
+	return eg.games[gamenr].players[session], gamenr, true
+}
+
+// Start marks a game as running, running games don't expire.
+func (eg *ExpectedGames) Start(gamenr int) {
+	eg.mu.Lock()
+	if g, ok := eg.games[gamenr]; ok {
+		g.started = true
+	}
+	eg.mu.Unlock()
+}
+
+// Forget removes a game and its sessions.
+func (eg *ExpectedGames) Forget(gamenr int) {
+	eg.mu.Lock()
+	eg.forget(gamenr)
+	eg.mu.Unlock()
+}
+
+func (eg *ExpectedGames) forget(gamenr int) {
+	g, ok := eg.games[gamenr]
+	if !ok {
+		return
+	}
+	for session := range g.players {
+		delete(eg.sessions, session)
+	}
+	delete(eg.games, gamenr)
+}
+
+// expire drops games nobody joined in time, mu has to be held.
+func (eg *ExpectedGames) expire() {
+	for gamenr, g := range eg.games {
+		if !g.started && time.Since(g.expected) > RELAY_ASSIGN_TIMEOUT {
+			eg.forget(gamenr)
+		}
+	}
+}
@@ -1,13 +1,11 @@
 package main
 
 import (
-	"fmt"
-	"main/commands"
+	"bioserver/commands"
+	"bioserver/protocol"
+	"log/slog"
 	"net"
-	"log"
-	"os"
-	"path/filepath"
-	"runtime"
+	"sync/atomic"
 )
 
 type GameServerDataEvent struct {
@@ -18,54 +16,96 @@ type GameServerDataEvent struct {
 
 type GameServerPacketHandler struct {
 	clients         *ClientList
-	db              *Database
+	sessions        *GameSessions // clients by game and connection, for routing
+	expected        *ExpectedGames
 	packetidcounter int
 	queue           chan GameServerDataEvent
-	logger          *log.Logger
+	log             *slog.Logger
+	reporter        RelayReporter // told who is in which game, may be nil
+	title           string
+	relayedBytes    *atomic.Uint64
 }
 
-func NewGameServerPacketHandler() *GameServerPacketHandler {
-	db, err := NewDatabase("bioserver", "xxxxxxxxxxxxxxxx")
-	if err != nil {
-		fmt.Println("NewGameServerPacketHandler() Error opening database connection:", err)
-		return nil
-	}
-
+func NewGameServerPacketHandler(title string) *GameServerPacketHandler {
 	return &GameServerPacketHandler{
+		title:           title,
+		relayedBytes:    METRIC_RELAY_BYTES.With(title),
 		clients:         NewClientList(),
-		db:              db,
+		sessions:        NewGameSessions(),
+		expected:        NewExpectedGames(),
 		packetidcounter: 0,
 		queue:           make(chan GameServerDataEvent, 100), // buffered channel
-		logger:          log.New(os.Stdout, "", log.Ltime),
+		log:             NewLogger("game").With("title", title),
 	}
 }
 
-func (gsp *GameServerPacketHandler) debug(format string, v ...interface{}) {
-	pc, file, line, ok := runtime.Caller(2)
-	if !ok {
-		file = "???"
-		line = 0
+// SetReporter sets who gets told about players joining and leaving games.
+func (gsp *GameServerPacketHandler) SetReporter(r RelayReporter) {
+	gsp.reporter = r
+}
+
+// Expect lets the players of a game in, called by the lobby.
+func (gsp *GameServerPacketHandler) Expect(gamenr int, players []ExpectedPlayer) {
+	gsp.log.Debug("expecting players", "game", gamenr, "players", len(players))
+	gsp.expected.Expect(gamenr, players)
+}
+
+// Members lists the userids of the players in each game.
+func (gsp *GameServerPacketHandler) Members() map[int][]string {
+	return gsp.sessions.Members()
+}
+
+// join adds a checked client to its game, the first one starts it.
+func (gsp *GameServerPacketHandler) join(cl *Client) {
+	gsp.clients.Add(cl)
+	first := gsp.sessions.Add(cl)
+	if first {
+		gsp.expected.Start(cl.GameNumber)
+	}
+	if gsp.reporter == nil {
+		return
 	}
-	fn := runtime.FuncForPC(pc)
-	var funcName string
-	if fn != nil {
-		funcName = fn.Name()
-	} else {
-		funcName = "???"
+	if first {
+		gsp.reporter.SessionStarted(cl.GameNumber)
 	}
-	file = filepath.Base(file)
-	msg := fmt.Sprintf(format, v...)
+	gsp.reporter.SessionJoined(cl.GameNumber, cl.userID)
+}
 
-	gsp.logger.Printf("%s:%d %s() %s", file, line, funcName, msg)
+// leave removes a client from its game, the last one ends it.
+func (gsp *GameServerPacketHandler) leave(cl *Client, reason string) {
+	gsp.clients.Remove(cl)
+	removed, last := gsp.sessions.Remove(cl)
+	if !removed {
+		// left already, on another goroutine
+		return
+	}
+	if last {
+		gsp.expected.Forget(cl.GameNumber)
+	}
+	if gsp.reporter == nil {
+		return
+	}
+	gsp.reporter.SessionLeft(cl.GameNumber, cl.userID, reason)
+	if last {
+		gsp.reporter.SessionEnded(cl.GameNumber)
+	}
 }
 
+func (gsp *GameServerPacketHandler) debug(format string, v ...interface{}) {
+	logf(gsp.log, slog.LevelDebug, format, v...)
+}
 
-// func (gsp *GameServerPacketHandler) debug(format string, a ...interface{}) {
-// 	fmt.Printf(format, a...)
-// }
+// connLog is the logger for a game connection, with the player once known.
+func (gsp *GameServerPacketHandler) connLog(conn net.Conn) *slog.Logger {
+	l := gsp.log.With("remote", conn.RemoteAddr().String())
+	if cl := gsp.sessions.FindClientBySocket(conn); cl != nil {
+		l = l.With("userid", cl.userID, "game", cl.GameNumber)
+	}
+	return l
+}
 
 func (gsp *GameServerPacketHandler) Run() {
-	fmt.Println("GameServerPacketHandler started")
+	gsp.log.Debug("game packet handler started")
 
 	for dataEvent := range gsp.queue {
 		// Process the data event
@@ -90,42 +130,63 @@ func (gsp *GameServerPacketHandler) handleDataEvent(dataEvent GameServerDataEven
 func (gsp *GameServerPacketHandler) ProcessData(server *GameServerThread, conn net.Conn, data []byte, length int) {
 	switch data[0] {
 	case 0x82:
-		if data[1] == 0x02 {
+		if len(data) > 1 && data[1] == 0x02 {
+			if packetCapture.Enabled() {
+				packetCapture.RecordPacket(conn, CAPTURE_GAME, gsp.title, gsp.captureUserID(conn), CAPTURE_IN, data[:length])
+			}
 			// some session checking etc.
-			p := NewPacketFromBytes(data)
+			p, err := NewPacketFromBytes(data)
+			if err != nil {
+				gsp.connLog(conn).Warn("disconnecting after malformed packet", "err", err)
+				server.disconnect(conn)
+				return
+			}
 			if p.cmd == commands.GSLOGIN {
 				// check this session and if ok create client
 				if !gsp.checkSession(server, conn, p) {
-					gsp.debug("Session check failed for %s\n", conn.RemoteAddr().String())
+					gsp.connLog(conn).Info("session check failed")
 				}
 			}
 		}
 	default:
-		// broadcast to connected clients in gamesession but not the sender
-		acopy := make([]byte, length)
-		copy(acopy, data)
-
-		cl := gsp.clients.FindClientBySocket(conn)
-		cl.ConnAlive = true
-		gamenum := cl.GameNumber
-		cls := gsp.clients.GetList()
-		for _, client := range cls {
-			if client.GameNumber == gamenum && client.socket != conn {
-				gsp.queue <- GameServerDataEvent{server, client.socket, acopy}
+		// broadcast to connected clients in gamesession but not the sender,
+		// data is a fresh buffer of ours and shared by all of them
+		cl := gsp.sessions.FindClientBySocket(conn)
+		if cl == nil {
+			// game data before a session check
+			gsp.connLog(conn).Warn("disconnecting game data before the session check")
+			server.disconnect(conn)
+			return
+		}
+		cl.ConnAlive.Store(true)
+		capture := packetCapture.Enabled()
+		if capture {
+			packetCapture.RecordGameData(conn, gsp.title, cl.userID, CAPTURE_IN, data[:length])
+		}
+		for _, client := range gsp.sessions.Get(cl.GameNumber) {
+			if client.socket != conn {
+				gsp.queue <- GameServerDataEvent{server, client.socket, data[:length]}
+				gsp.relayedBytes.Add(uint64(length))
+				if capture {
+					packetCapture.RecordGameData(client.socket, gsp.title, client.userID, CAPTURE_OUT, data[:length])
+				}
 			}
 		}
 	}
 }
 
 func (gsp *GameServerPacketHandler) AddOutPacket(server *GameServerThread, conn net.Conn, packet *Packet) {
-	// TODO: LOGGING
-	gsp.queue <- GameServerDataEvent{server, conn, packet.GetPacketData()}
+	data := packet.GetPacketData()
+	if packetCapture.Enabled() {
+		packetCapture.RecordPacket(conn, CAPTURE_GAME, gsp.title, gsp.captureUserID(conn), CAPTURE_OUT, data)
+	}
+	gsp.queue <- GameServerDataEvent{server, conn, data}
 }
 
 func (gsp *GameServerPacketHandler) BroadcastPacket(server *GameServerThread, packet *Packet) {
 	cls := gsp.clients.GetList()
 	for _, client := range cls {
-		gsp.queue <- GameServerDataEvent{server, client.socket, packet.GetPacketData()}
+		gsp.AddOutPacket(server, client.socket, packet)
 	}
 }
 
@@ -148,99 +209,81 @@ func (gsp *GameServerPacketHandler) GSsendLogin(server *GameServerThread, conn n
 }
 
 func (gsp *GameServerPacketHandler) checkSession(server *GameServerThread, socket net.Conn, ps *Packet) bool {
-	seed := ps.pid
-
-	sessA := int(ps.pay[0]-0x30) * 10000
-	sessA += int(ps.pay[1]-0x30) * 1000
-	sessA += int(ps.pay[2]-0x30) * 100
-	sessA += int(ps.pay[3]-0x30) * 10
-	sessA += int(ps.pay[4] - 0x30)
-
-	sessB := int(ps.pay[5]-0x30) * 10000
-	sessB += int(ps.pay[6]-0x30) * 1000
-	sessB += int(ps.pay[7]-0x30) * 100
-	sessB += int(ps.pay[8]-0x30) * 10
-	sessB += int(ps.pay[9] - 0x30)
-
-	session := fmt.Sprintf("%04d%04d", sessA-seed, sessB-seed)
-
-	userid, err := gsp.db.GetUserID(session)
-	if err != nil {
-		gsp.debug("PacketHandler checkSession() Error getting user id:%v\n", err)
+	login := &protocol.GSLoginTell{}
+	if err := ps.Decode(login); err != nil {
+		gsp.connLog(socket).Warn("dropping malformed packet", "err", err)
 		return false
 	}
+	session := login.Session
 
-	gsp.debug("Session: %s with UserID: %s\n", session, userid)
-
-	if userid != "" {
-		// loop through clients and remove old connections
-		// then setup client object for this user/session
-		cl := gsp.clients.FindClientByUserID(userid)
-		if cl != nil {
-			gsp.debug("Found a client with UserID %s: %v\n", userid, cl)
-			for _, c := range gsp.clients.GetList() {
-				if c != nil && c.userID == userid {
-					gsp.debug("removing client with UserID %s & socket %p\n", userid, c.socket)
-					gsp.removeClient(server, c)
-				}
-			}
-		}
-
-		gsp.clients.Add(NewClient(socket, userid, session))
-		cl = gsp.clients.FindClientBySocket(socket)
-		if cl == nil {
-			gsp.debug("\n\n\nFailed to add client to client list!!! big problem!!!\n\n\n")
-			return false
-		}
-
-		err = gsp.db.UpdateClientOrigin(userid, STATUS_LOBBY, 0, 0, 0)
-		if err != nil {
-			gsp.debug("Error updating client origin: %v\n", err)
-			return false
-		}
-
-		gamenr, err := gsp.db.GetGameNumber(cl.userID)
-		if err != nil {
-			gsp.debug("Error getting game number: %v\n", err)
-			return false
-		}
-		cl.GameNumber = gamenr
-
-		gsp.db.UpdateClientOrigin(cl.userID, STATUS_GAME, 0, 0, 0)
-		return true
-	} else {
-		// session check failed; disconnect this client
-		gsp.debug("Session check failed!")
+	// only players the lobby sent here get in
+	userid, gamenr, ok := gsp.expected.Lookup(session)
+	if !ok {
+		gsp.connLog(socket).Info("rejecting unexpected session", "session", session)
 		server.disconnect(socket)
 		return false
 	}
+
+	gsp.connLog(socket).Debug("joining game", "session", session, "userid", userid, "game", gamenr)
+
+	cl := NewClient(socket, userid, session)
+	cl.GameNumber = gamenr
+
+	// a reconnecting player replaces the old connection
+	if old := gsp.clients.FindClientByUserID(userid); old != nil {
+		gsp.connLog(old.socket).Debug("replacing connection", "userid", userid)
+		if old.GameNumber == gamenr {
+			// still in the same game, nothing to report
+			gsp.clients.Remove(old)
+			gsp.sessions.Remove(old)
+			gsp.clients.Add(cl)
+			gsp.sessions.Add(cl)
+			server.disconnect(old.socket)
+			return true
+		}
+		gsp.removeClient(server, old, "replaced")
+	}
+
+	gsp.join(cl)
+	return true
 }
 
-func (gsp *GameServerPacketHandler) removeClient(server *GameServerThread, cl *Client) {
+func (gsp *GameServerPacketHandler) removeClient(server *GameServerThread, cl *Client, reason string) {
 	if cl == nil {
 		gsp.debug("removeClient() called with nil client\n")
 		return
 	}
 
 	sock := cl.socket
-	gsp.db.UpdateClientOrigin(cl.userID, STATUS_OFFLINE, -1, 0, 0)
-	gsp.clients.Remove(cl)
+	gsp.leave(cl, reason)
 	server.disconnect(sock)
 }
 
-func (gsp *GameServerPacketHandler) removeClientByID(server *GameServerThread, userid string) {
+// RemoveClientByID ends the game of a player, it tells if the player was
+// found.
+func (gsp *GameServerPacketHandler) RemoveClientByID(server *GameServerThread, userid string, reason string) bool {
 	cl := gsp.clients.FindClientByUserID(userid)
-	if cl != nil {
-		gsp.removeClient(server, cl)
+	if cl == nil {
+		return false
 	}
+	gsp.removeClient(server, cl, reason)
+	return true
 }
 
 func (gsp *GameServerPacketHandler) RemoveClientNoDisconnect(server *GameServerThread, conn net.Conn) {
-	cl := gsp.clients.FindClientBySocket(conn)
+	cl := gsp.sessions.FindClientBySocket(conn)
+	packetCapture.RecordClose(conn)
 	// set user to offline status in database
 	if cl != nil {
-		gsp.db.UpdateClientOrigin(cl.userID, STATUS_OFFLINE, -1, 0, 0)
-		gsp.clients.Remove(cl)
+		gsp.leave(cl, "disconnect")
+	}
+	packetCapture.Close(conn)
+}
+
+// DisconnectAll ends all games.
+func (gsp *GameServerPacketHandler) DisconnectAll(server *GameServerThread) {
+	for _, cl := range gsp.clients.GetList() {
+		gsp.removeClient(server, cl, "shutdown")
 	}
 }
 
@@ -250,10 +293,10 @@ func (gsp *GameServerPacketHandler) ConnCheck(server *GameServerThread) {
 		if cl == nil {
 			continue
 		}
-		if cl.ConnAlive {
-			cl.ConnAlive = false
-		} else { 
-			gsp.removeClient(server, cl)
+		if !cl.ConnAlive.Swap(false) {
+			METRIC_HEARTBEAT_TIMEOUTS.Inc(gsp.title, "game")
+			gsp.connLog(cl.socket).Info("keepalive timeout")
+			gsp.removeClient(server, cl, "timeout")
 		}
 	}
 }
\ No newline at end of file
@@ -2,12 +2,10 @@ package main
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
-	"os"
-	"path/filepath"
-	"runtime"
 	"sync"
+	"sync/atomic"
 )
 
 type GameServerThread struct {
@@ -20,11 +18,11 @@ type GameServerThread struct {
 	readBuffers    map[net.Conn]*ServerStreamBuffer
 	mu             sync.Mutex
 	initOK         bool
-	logger         *log.Logger
+	closing        atomic.Bool
+	log            *slog.Logger
 }
 
 func NewGameServerThread(hostAddress string, port int, packetHandler *GameServerPacketHandler) *GameServerThread {
-	log.Printf("Initializing GameServer at %s:%d\n", hostAddress, port)
 	return &GameServerThread{
 		hostAddress:    hostAddress,
 		port:           port,
@@ -33,43 +31,57 @@ func NewGameServerThread(hostAddress string, port int, packetHandler *GameServer
 		pendingData:    make(map[net.Conn][][]byte),
 		readBuffers:    make(map[net.Conn]*ServerStreamBuffer),
 		initOK:         true,
-		logger:         log.New(os.Stdout, "", log.Ltime),
+		log:            NewLogger("game").With("title", packetHandler.title),
 	}
 }
 
-func (g *GameServerThread) debug(format string, v ...interface{}) {
-	pc, file, line, ok := runtime.Caller(2)
-	if !ok {
-		file = "???"
-		line = 0
-	}
-	fn := runtime.FuncForPC(pc)
-	var funcName string
-	if fn != nil {
-		funcName = fn.Name()
-	} else {
-		funcName = "???"
-	}
-	file = filepath.Base(file)
-	msg := fmt.Sprintf(format, v...)
-
-	g.logger.Printf("%s:%d %s() %s", file, line, funcName, msg)
+func (g *GameServerThread) connLog(conn net.Conn) *slog.Logger {
+	return g.log.With("remote", conn.RemoteAddr().String())
 }
 
-func (g *GameServerThread) Run(wg *sync.WaitGroup) {
-	defer wg.Done()
+// Listen binds the game port before Run, port 0 picks a free one. Run
+// listens itself when this wasn't called.
+func (g *GameServerThread) Listen() error {
 	addr := fmt.Sprintf("%s:%d", g.hostAddress, g.port)
 	ln, err := net.Listen("tcp", addr)
 	if err != nil {
-		g.debug("Error starting server on %s: %v", addr, err)
+		return fmt.Errorf("listening on %s: %w", addr, err)
 	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
 	g.listener = ln
-	g.debug("Game server started on port %d\n", g.port)
+	g.port = ln.Addr().(*net.TCPAddr).Port
+	return nil
+}
+
+// Port is the port of the game server, the one picked by Listen for 0.
+func (g *GameServerThread) Port() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.port
+}
+
+func (g *GameServerThread) Run(wg *sync.WaitGroup) {
+	defer wg.Done()
+	g.mu.Lock()
+	ln := g.listener
+	g.mu.Unlock()
+	if ln == nil {
+		if err := g.Listen(); err != nil {
+			g.log.Error("starting game server", "err", err)
+			return
+		}
+		ln = g.listener
+	}
+	g.log.Info("game server started", "addr", ln.Addr().String())
 	go g.processChangeRequests()
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			g.debug("Accept error: %v", err)
+			if g.closing.Load() {
+				return
+			}
+			g.log.Error("accepting connection", "err", err)
 			continue
 		}
 		g.accept(conn)
@@ -88,24 +100,25 @@ func (g *GameServerThread) processChangeRequests() {
 }
 
 func (g *GameServerThread) accept(conn net.Conn) {
-	g.debug("New game connection from %s\n", conn.RemoteAddr())
+	g.connLog(conn).Debug("new connection")
 	g.mu.Lock()
 	if _, exists := g.readBuffers[conn]; !exists {
 		g.readBuffers[conn] = NewServerStreamBuffer()
 	}
 	g.mu.Unlock()
+	METRIC_CONNECTIONS.Inc(g.packetHandler.title, "game")
 	g.packetHandler.GSsendLogin(g, conn)
 	go g.read(conn)
 }
 
 func (g *GameServerThread) read(conn net.Conn) {
-	// defer g.close(conn)
 	buffer := make([]byte, 1024)
 	for {
 		n, err := conn.Read(buffer)
 		if err != nil {
-			// log.Println("game Error reading from", conn.RemoteAddr(), err)
-			g.debug("conn %p: Error reading from %s: %v\n", conn, conn.RemoteAddr(), err)
+			// the player is out of the game now, not at the next ConnCheck
+			g.connLog(conn).Debug("read error", "err", err)
+			g.close(conn)
 			return
 		}
 		if n == 0 {
@@ -126,12 +139,17 @@ func (g *GameServerThread) read(conn net.Conn) {
 		}
 
 		if err := rb.AppendData(data); err != nil {
-			log.Println("Buffer overflow for", conn.RemoteAddr())
+			g.connLog(conn).Warn("read buffer overflow")
 			g.close(conn)
 			return
 		}
 
-		msg := rb.GetCompleteGameMessages()
+		msg, err := rb.GetCompleteGameMessages()
+		if err != nil {
+			g.connLog(conn).Warn("dropping connection", "err", err)
+			g.close(conn)
+			return
+		}
 		if msg != nil && g.packetHandler != nil {
 			g.packetHandler.ProcessData(g, conn, msg, len(msg))
 		}
@@ -151,8 +169,7 @@ func (g *GameServerThread) write(conn net.Conn) {
 		g.mu.Unlock()
 		n, err := conn.Write(data)
 		if err != nil {
-			// log.Println("game Error writing to", conn.RemoteAddr(), err)
-			g.debug("conn %p: Error reading from %s: %v\n", conn, conn.RemoteAddr(), err)
+			g.connLog(conn).Debug("write error", "err", err)
 			g.close(conn)
 			return
 		}
@@ -175,12 +192,21 @@ func (g *GameServerThread) send(conn net.Conn, data []byte) {
 	go g.write(conn)
 }
 
+// StopAccepting closes the listener, players in games stay.
+func (g *GameServerThread) StopAccepting() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.listener != nil && !g.closing.Swap(true) {
+		g.listener.Close()
+	}
+}
+
 func (g *GameServerThread) disconnect(conn net.Conn) {
 	g.changeRequests <- ServerChangeEvent{conn: conn, EventType: FORCECLOSE, ops: 0}
 }
 
 func (g *GameServerThread) close(conn net.Conn) {
-	g.debug("Closing connection %s\n", conn.RemoteAddr())
+	g.connLog(conn).Debug("closing connection")
 	conn.Close()
 	g.mu.Lock()
 	delete(g.readBuffers, conn)
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bioserver/simclient"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// reportRecorder is a RelayReporter keeping the reports in order.
+type reportRecorder struct {
+	reports chan string
+}
+
+func (r *reportRecorder) SessionStarted(gamenr int) {
+	r.reports <- fmt.Sprintf("start %d", gamenr)
+}
+
+func (r *reportRecorder) SessionJoined(gamenr int, userid string) {
+	r.reports <- fmt.Sprintf("join %d %s", gamenr, userid)
+}
+
+func (r *reportRecorder) SessionLeft(gamenr int, userid string, reason string) {
+	r.reports <- fmt.Sprintf("leave %d %s %s", gamenr, userid, reason)
+}
+
+func (r *reportRecorder) SessionEnded(gamenr int) {
+	r.reports <- fmt.Sprintf("end %d", gamenr)
+}
+
+func (r *reportRecorder) expect(t *testing.T, want ...string) {
+	t.Helper()
+	for _, w := range want {
+		select {
+		case got := <-r.reports:
+			if got != w {
+				t.Fatalf("got report %q, want %q", got, w)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no report, want %q", w)
+		}
+	}
+}
+
+// TestGameServerReportsDisconnect checks that a player dropping the
+// connection leaves the game right away, without waiting for ConnCheck.
+func TestGameServerReportsDisconnect(t *testing.T) {
+	gsp := NewGameServerPacketHandler(FILE1.Name)
+	rec := &reportRecorder{reports: make(chan string, 10)}
+	gsp.SetReporter(rec)
+	g := NewGameServerThread("127.0.0.1", 0, gsp)
+	if err := g.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go g.Run(&wg)
+	go gsp.Run()
+	t.Cleanup(func() {
+		g.StopAccepting()
+		wg.Wait()
+	})
+
+	gsp.Expect(7, []ExpectedPlayer{{UserID: "alice", Session: "12345678"}})
+	c, err := simclient.DialGame(fmt.Sprintf("127.0.0.1:%d", g.Port()), "alice", "12345678")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.expect(t, "start 7", "join 7 alice")
+
+	c.Close()
+	rec.expect(t, "leave 7 alice disconnect", "end 7")
+	if n := gsp.sessions.Count(7); n != 0 {
+		t.Fatalf("game 7 has %d players after the disconnect", n)
+	}
+}
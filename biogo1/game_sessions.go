@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"sync"
+)
+
+// GameSessions indexes the clients of a game server by game number, so game
+// data only visits the players of its own game. The per game lists are
+// never changed in place: Get hands out a snapshot that stays valid without
+// holding the lock while the packet is fanned out.
+type GameSessions struct {
+	games map[int][]*Client
+	conns map[net.Conn]*Client
+	mu    sync.RWMutex
+}
+
+func NewGameSessions() *GameSessions {
+	return &GameSessions{games: make(map[int][]*Client), conns: make(map[net.Conn]*Client)}
+}
+
+// Add puts a client into the game of its GameNumber, it tells if the game
+// was started by this client.
+func (gs *GameSessions) Add(cl *Client) (first bool) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	gs.conns[cl.socket] = cl
+	old := gs.games[cl.GameNumber]
+	list := make([]*Client, len(old), len(old)+1)
+	copy(list, old)
+	gs.games[cl.GameNumber] = append(list, cl)
+	return len(old) == 0
+}
+
+// Remove takes a client out of its game, the game is dropped with its
+// last client. It tells if the client was in the game and if it was the
+// last one.
+func (gs *GameSessions) Remove(cl *Client) (removed, last bool) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	if gs.conns[cl.socket] == cl {
+		delete(gs.conns, cl.socket)
+	}
+	old := gs.games[cl.GameNumber]
+	i := slices.Index(old, cl)
+	if i < 0 {
+		return false, false
+	}
+	if len(old) == 1 {
+		delete(gs.games, cl.GameNumber)
+		return true, true
+	}
+	gs.games[cl.GameNumber] = slices.Concat(old[:i], old[i+1:])
+	return true, false
+}
+
+// Get returns the clients of a game, the slice must not be modified.
+func (gs *GameSessions) Get(gamenr int) []*Client {
+	gs.mu.RLock()
+	defer gs.mu.RUnlock()
+	return gs.games[gamenr]
+}
+
+// FindClientBySocket returns the client of a connection.
+func (gs *GameSessions) FindClientBySocket(conn net.Conn) *Client {
+	gs.mu.RLock()
+	defer gs.mu.RUnlock()
+	return gs.conns[conn]
+}
+
+// Count is the number of clients in a game.
+func (gs *GameSessions) Count(gamenr int) int {
+	return len(gs.Get(gamenr))
+}
+
+// Members lists the userids of the players in each game.
+func (gs *GameSessions) Members() map[int][]string {
+	gs.mu.RLock()
+	defer gs.mu.RUnlock()
+	members := make(map[int][]string, len(gs.games))
+	for gamenr, list := range gs.games {
+		for _, cl := range list {
+			members[gamenr] = append(members[gamenr], cl.userID)
+		}
+	}
+	return members
+}
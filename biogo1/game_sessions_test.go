@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// joinGame adds a player to a game of the game server, the connection is
+// one end of an in-memory pipe nothing is written to.
+func joinGame(tb testing.TB, gsp *GameServerPacketHandler, gamenr int, userid string) net.Conn {
+	conn, peer := net.Pipe()
+	tb.Cleanup(func() {
+		conn.Close()
+		peer.Close()
+	})
+	cl := NewClient(conn, userid, "")
+	cl.GameNumber = gamenr
+	gsp.join(cl)
+	return conn
+}
+
+func TestProcessDataRoutesToOwnGame(t *testing.T) {
+	gsp := NewGameServerPacketHandler(FILE1.Name)
+	alice := joinGame(t, gsp, 1, "alice")
+	bob := joinGame(t, gsp, 1, "bob")
+	carol := joinGame(t, gsp, 1, "carol")
+	dave := joinGame(t, gsp, 2, "dave")
+	names := map[net.Conn]string{alice: "alice", bob: "bob", carol: "carol", dave: "dave"}
+
+	data := []byte{0x04, 0x01, 0x02, 0x03}
+	gsp.ProcessData(nil, alice, data, len(data))
+
+	got := make(map[string]int)
+	for len(gsp.queue) > 0 {
+		ev := <-gsp.queue
+		if string(ev.data) != string(data) {
+			t.Errorf("%s got %x, want %x", names[ev.conn], ev.data, data)
+		}
+		got[names[ev.conn]]++
+	}
+	if len(got) != 2 || got["bob"] != 1 || got["carol"] != 1 {
+		t.Fatalf("game data of alice went to %v, want bob and carol once", got)
+	}
+}
+
+// TestJoinStartsGameOnce lets the players of a game join at the same time,
+// only one of them may start it.
+func TestJoinStartsGameOnce(t *testing.T) {
+	const players = 8
+	gsp := NewGameServerPacketHandler(FILE1.Name)
+	rec := &reportRecorder{reports: make(chan string, 2*players)}
+	gsp.SetReporter(rec)
+	var wg sync.WaitGroup
+	for p := 0; p < players; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			joinGame(t, gsp, 1, fmt.Sprintf("user%d", p))
+		}(p)
+	}
+	wg.Wait()
+	close(rec.reports)
+	starts := 0
+	for r := range rec.reports {
+		if r == "start 1" {
+			starts++
+		}
+	}
+	if starts != 1 {
+		t.Fatalf("game 1 started %d times", starts)
+	}
+}
+
+// TestConnCheckWhileRouting runs the keepalive check of the game server
+// while players send game data, run it with -race.
+func TestConnCheckWhileRouting(t *testing.T) {
+	gsp := NewGameServerPacketHandler(FILE1.Name)
+	alice := joinGame(t, gsp, 1, "alice")
+	joinGame(t, gsp, 1, "bob")
+	go func() {
+		for range gsp.queue {
+		}
+	}()
+	defer close(gsp.queue)
+
+	data := []byte{0x04, 0x01, 0x02, 0x03}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			gsp.ProcessData(nil, alice, data, len(data))
+		}
+	}()
+	server := NewGameServerThread("127.0.0.1", 0, gsp)
+	for i := 0; i < 100; i++ {
+		if cl := gsp.sessions.FindClientBySocket(alice); cl != nil {
+			cl.ConnAlive.Store(true)
+		}
+		gsp.ConnCheck(server)
+	}
+	<-done
+}
+
+// BenchmarkGameSessionsFanout routes game data between the players of many
+// concurrent games. Only routing and queueing is measured, the queue is
+// drained without writing.
+func BenchmarkGameSessionsFanout(b *testing.B) {
+	const players = 4
+	for _, games := range []int{10, 100, 500} {
+		b.Run(fmt.Sprintf("sessions=%d", games), func(b *testing.B) {
+			gsp := NewGameServerPacketHandler(FILE1.Name)
+			var conns []net.Conn
+			for gamenr := 1; gamenr <= games; gamenr++ {
+				for p := 0; p < players; p++ {
+					conns = append(conns, joinGame(b, gsp, gamenr, fmt.Sprintf("user%d-%d", gamenr, p)))
+				}
+			}
+			done := make(chan struct{})
+			go func() {
+				for range gsp.queue {
+				}
+				close(done)
+			}()
+
+			// the buffer is shared by all receivers, like one from the
+			// stream buffer
+			data := make([]byte, 64)
+			data[0] = byte(len(data))
+			var next atomic.Uint64
+			b.ReportAllocs()
+			b.ResetTimer()
+			// one sender per cpu, like the read goroutines of the connections
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					conn := conns[next.Add(1)%uint64(len(conns))]
+					gsp.ProcessData(nil, conn, data, len(data))
+				}
+			})
+			b.StopTimer()
+			close(gsp.queue)
+			<-done
+		})
+	}
+}
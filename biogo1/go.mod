@@ -1,4 +1,4 @@
-module main
+module bioserver
 
 go 1.24.1
 
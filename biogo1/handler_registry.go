@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// HandlerFunc handles one incoming client packet.
+type HandlerFunc func(server *ServerThread, socket net.Conn, p *Packet)
+
+// Middleware wraps the HandlerFunc of a route, e.g. to log, validate or
+// count packets.
+type Middleware func(r *Route, next HandlerFunc) HandlerFunc
+
+type routeKey struct {
+	qsw byte
+	cmd int
+}
+
+// Route is a registered command. Its middleware only runs for this command,
+// inside the registry wide middleware.
+type Route struct {
+	cmd        int
+	qsw        byte
+	handler    HandlerFunc
+	middleware []Middleware
+	states     []ClientState
+}
+
+// In sets the client states in which the command is legal.
+func (r *Route) In(states ...ClientState) *Route {
+	r.states = states
+	return r
+}
+
+// Use adds middleware to this route.
+func (r *Route) Use(mw ...Middleware) *Route {
+	r.middleware = append(r.middleware, mw...)
+	return r
+}
+
+// HandlerRegistry maps (qsw, cmd) of client packets to their handlers.
+type HandlerRegistry struct {
+	routes     map[routeKey]*Route
+	middleware []Middleware
+}
+
+func NewHandlerRegistry() *HandlerRegistry {
+	return &HandlerRegistry{
+		routes: make(map[routeKey]*Route),
+	}
+}
+
+// Register adds the handler for a command, a command can only be
+// registered once per qsw.
+func (hr *HandlerRegistry) Register(cmd int, qsw byte, fn HandlerFunc) *Route {
+	key := routeKey{qsw: qsw, cmd: cmd}
+	if _, exists := hr.routes[key]; exists {
+		panic(fmt.Sprintf("handler for command 0x%X qsw 0x%X registered twice", cmd, qsw))
+	}
+	r := &Route{cmd: cmd, qsw: qsw, handler: fn}
+	hr.routes[key] = r
+	return r
+}
+
+// Use adds middleware that runs for every command.
+func (hr *HandlerRegistry) Use(mw ...Middleware) {
+	hr.middleware = append(hr.middleware, mw...)
+}
+
+// Lookup returns the route for a command or nil.
+func (hr *HandlerRegistry) Lookup(qsw byte, cmd int) *Route {
+	return hr.routes[routeKey{qsw: qsw, cmd: cmd}]
+}
+
+// Dispatch runs the handler of p through its middleware, it returns false
+// if the command is not registered.
+func (hr *HandlerRegistry) Dispatch(server *ServerThread, socket net.Conn, p *Packet) bool {
+	r := hr.Lookup(p.qsw, p.cmd)
+	if r == nil {
+		return false
+	}
+	h := r.handler
+	for i := len(r.middleware) - 1; i >= 0; i-- {
+		h = r.middleware[i](r, h)
+	}
+	for i := len(hr.middleware) - 1; i >= 0; i-- {
+		h = hr.middleware[i](r, h)
+	}
+	h(server, socket, p)
+	return true
+}
@@ -24,19 +24,33 @@ func (hbt *HeartBeatThread) Run() {
 	counter := 0
 	counter2 := 0
 
+	// like the Java server, nothing happens in the first 10 seconds, so
+	// packet ids only depend on the clients
+	time.Sleep(10 * time.Second)
+
 	for {
-		hbt.packetHandler.BroadcastPing(hbt.lobbyServer)
+		connCheck := counter == 1
+		cleanRooms := counter2 == 9
+		// the lobby work runs on the lobby's event loop
+		hbt.packetHandler.Call(func() {
+			hbt.packetHandler.BroadcastPing(hbt.lobbyServer)
+			hbt.packetHandler.CheckAutoStart(hbt.lobbyServer)
+			if connCheck {
+				hbt.packetHandler.BroadcastConnCheck(hbt.lobbyServer)
+			}
+			if cleanRooms {
+				hbt.packetHandler.CleanGhostRooms(hbt.lobbyServer)
+			}
+		})
 		hbt.gamePacketHandler.ConnCheck(hbt.gameServer)
-		hbt.packetHandler.CheckAutoStart(hbt.lobbyServer)
-		if counter == 1 {
-			hbt.packetHandler.BroadcastConnCheck(hbt.lobbyServer)
+
+		if connCheck {
 			counter = 0
 		} else {
 			counter++
 		}
 
-		if counter2 == 9 {
-			hbt.packetHandler.CleanGhostRooms(hbt.lobbyServer)
+		if cleanRooms {
 			counter2 = 0
 		} else {
 			counter2++
@@ -1,15 +1,14 @@
 package main
 
 import (
+	"bioserver/protocol"
 	"io"
-	"log"
 	"math/rand"
 	"strings"
 
 	"golang.org/x/text/encoding/japanese"
 	"golang.org/x/text/transform"
 
-	"fmt"
 )
 
 type HNPair struct {
@@ -29,23 +28,16 @@ func NewHNPairFromStrings(handle, nickname string) *HNPair {
 	if err != nil {
 		// Fallback to "sjis" if encoding fails
 		nickBytes = []byte("sjis")
-		log.Printf("ShiftJIS encoding failed: %v", err)
+		serverLog.Warn("ShiftJIS encoding failed", "nickname", nickname, "err", err)
 	}
 	return &HNPair{handleBytes, nickBytes}
 }
 
-func (hnp *HNPair) GetHNPair() []byte {
-	hnpair := make([]byte, len(hnp.handle)+len(hnp.nickname)+4)
-	hnpair[0] = 0
-	hnpair[1] = 6
-	copy(hnpair[2:8], hnp.handle) // assuming handle is exactly 6 bytes
-	hnpair[8] = 0
-	hnpair[9] = byte(len(hnp.nickname))
-	copy(hnpair[10:], hnp.nickname)
-	return hnpair
+func (hnp *HNPair) GetHNPair() protocol.HNPair {
+	return protocol.HNPair{Handle: protocol.PadHandle(hnp.handle), Nickname: hnp.nickname}
 }
 
-func (hnp *HNPair) CreateHandle(db *Database) {
+func (hnp *HNPair) CreateHandle(db Store) {
 	allowed := []byte("0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ")
 
 	for {
@@ -56,7 +48,7 @@ func (hnp *HNPair) CreateHandle(db *Database) {
 
 		handleCheck, err := db.CheckHandle(string(handle))
 		if err != nil {
-			fmt.Printf("HNPair CreateHandle() error: %v\n", err)
+			dbLog.Error("checking new handle", "err", err)
 		}
 
 		if handleCheck == true {
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"log"
 	"os"
 	"strings"
 )
@@ -72,10 +71,10 @@ func (inf *Information) GetData(url string) []byte {
 	// Prepend "htm/" and sanitize the url
 	url = "htm/" + url
 	url = strings.ReplaceAll(url, "..", "X")
-	log.Println("requested url:", url)
+	lobbyLog.Debug("information page", "url", url)
 	data, err := os.ReadFile(url)
 	if err != nil {
-		log.Println("Error reading file:", url, err)
+		lobbyLog.Warn("reading information page", "url", url, "err", err)
 		return inf.defaultContents
 	}
 	return data
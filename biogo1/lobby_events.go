@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net"
+)
+
+// Everything that changes lobby state runs on the event loop of the
+// PacketHandler, one event after the other. The read goroutines of the
+// connections, the heartbeat and anybody else only post events, so the
+// handlers need no locks and see the events in the order they were posted.
+const (
+	LOBBY_CONNECT = iota // new connection, gets the LOGIN query
+	LOBBY_DATA           // complete packets from a connection
+	LOBBY_CLOSE          // connection is gone
+	LOBBY_CALL           // run fn on the loop
+)
+
+type LobbyEvent struct {
+	Type   int
+	server *ServerThread
+	socket net.Conn
+	data   []byte
+	fn     func()
+}
+
+func (ph *PacketHandler) post(ev LobbyEvent) {
+	ph.events <- ev
+}
+
+// Call runs fn on the event loop.
+func (ph *PacketHandler) Call(fn func()) {
+	ph.post(LobbyEvent{Type: LOBBY_CALL, fn: fn})
+}
+
+// Sync runs fn on the event loop and waits for it, it must not be called
+// from the loop itself.
+func (ph *PacketHandler) Sync(fn func()) {
+	done := make(chan struct{})
+	ph.Call(func() {
+		fn()
+		close(done)
+	})
+	<-done
+}
+
+// SendLogin greets a new connection.
+func (ph *PacketHandler) SendLogin(server *ServerThread, socket net.Conn) {
+	ph.post(LobbyEvent{Type: LOBBY_CONNECT, server: server, socket: socket})
+}
+
+// ProcessData handles packets read from a connection, data must not be
+// reused by the caller.
+func (ph *PacketHandler) ProcessData(server *ServerThread, socket net.Conn, data []byte) {
+	ph.post(LobbyEvent{Type: LOBBY_DATA, server: server, socket: socket, data: data})
+}
+
+// RemoveClientNoDisconnect removes the client of a closed connection.
+func (ph *PacketHandler) RemoveClientNoDisconnect(server *ServerThread, socket net.Conn) {
+	ph.post(LobbyEvent{Type: LOBBY_CLOSE, server: server, socket: socket})
+}
+
+// loop is the only goroutine touching lobby state.
+func (ph *PacketHandler) loop() {
+	for ev := range ph.events {
+		// log lines of the event carry its connection
+		if ev.socket != nil {
+			ph.log = ph.connLog(ev.socket)
+		}
+		switch ev.Type {
+		case LOBBY_CONNECT:
+			ph.sendLogin(ev.server, ev.socket)
+		case LOBBY_DATA:
+			ph.processData(ev.server, ev.socket, ev.data)
+		case LOBBY_CLOSE:
+			packetCapture.RecordClose(ev.socket)
+			ph.removeClientNoDisconnect(ev.server, ev.socket)
+			packetCapture.Close(ev.socket)
+			delete(ph.connLogs, ev.socket)
+		case LOBBY_CALL:
+			ev.fn()
+		}
+		ph.log = ph.baseLog
+	}
+}
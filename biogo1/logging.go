@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	LOG_FORMAT_TEXT = "text"
+	LOG_FORMAT_JSON = "json"
+)
+
+// parts of the server that log, each has its own level
+var LOG_SUBSYSTEMS = []string{"server", "lobby", "game", "relay", "db", "web", "admin"}
+
+var (
+	logHandler atomic.Pointer[slog.Handler]
+	logLevels  = func() map[string]*slog.LevelVar {
+		levels := make(map[string]*slog.LevelVar)
+		for _, s := range LOG_SUBSYSTEMS {
+			levels[s] = new(slog.LevelVar)
+		}
+		return levels
+	}()
+
+	serverLog = NewLogger("server")
+	lobbyLog  = NewLogger("lobby")
+	relayLog  = NewLogger("relay")
+	dbLog     = NewLogger("db")
+	webLog    = NewLogger("web")
+	adminLog  = NewLogger("admin")
+)
+
+func init() {
+	setLogOutput(os.Stdout, LOG_FORMAT_TEXT)
+}
+
+// NewLogger returns the logger of a subsystem. Its level and the output
+// format can be changed at any time, also for loggers made before.
+func NewLogger(subsystem string) *slog.Logger {
+	level, ok := logLevels[subsystem]
+	if !ok {
+		panic("unknown log subsystem " + subsystem)
+	}
+	return slog.New(&subsystemHandler{level: level}).With("sys", subsystem)
+}
+
+// SetupLogging sets the output format and the levels, given like
+// "info,lobby=debug,game=warn": a default for all subsystems followed by
+// the exceptions.
+func SetupLogging(format, levels string) error {
+	if format != LOG_FORMAT_TEXT && format != LOG_FORMAT_JSON {
+		return fmt.Errorf("log_format: unknown format %q", format)
+	}
+	for _, part := range strings.Split(levels, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		subsystem, level, found := strings.Cut(part, "=")
+		if !found {
+			subsystem, level = "", part
+		}
+		if err := SetLogLevel(subsystem, level); err != nil {
+			return fmt.Errorf("log_level: %w", err)
+		}
+	}
+	setLogOutput(os.Stdout, format)
+	return nil
+}
+
+// SetLogLevel changes the level of a subsystem, of all of them for "".
+func SetLogLevel(subsystem, level string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("unknown level %q", level)
+	}
+	if subsystem == "" {
+		for _, v := range logLevels {
+			v.Set(l)
+		}
+		return nil
+	}
+	v, ok := logLevels[subsystem]
+	if !ok {
+		return fmt.Errorf("unknown subsystem %q", subsystem)
+	}
+	v.Set(l)
+	return nil
+}
+
+// LogLevels returns the level of every subsystem.
+func LogLevels() map[string]string {
+	levels := make(map[string]string, len(logLevels))
+	for s, v := range logLevels {
+		levels[s] = strings.ToLower(v.Level().String())
+	}
+	return levels
+}
+
+func setLogOutput(w io.Writer, format string) {
+	opts := &slog.HandlerOptions{
+		AddSource: true,
+		Level:     slog.LevelDebug, // the subsystems filter
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if src, ok := a.Value.Any().(*slog.Source); ok && a.Key == slog.SourceKey {
+				if src.Line == 0 {
+					return slog.Attr{}
+				}
+				a.Value = slog.StringValue(fmt.Sprintf("%s:%d", filepath.Base(src.File), src.Line))
+			}
+			return a
+		},
+	}
+	var h slog.Handler
+	if format == LOG_FORMAT_JSON {
+		h = slog.NewJSONHandler(w, opts)
+	} else {
+		h = slog.NewTextHandler(w, opts)
+	}
+	logHandler.Store(&h)
+}
+
+// subsystemHandler filters by the level of its subsystem and passes the
+// records on to the current output. The attributes and groups of With are
+// applied to an output once, when it's first used.
+type subsystemHandler struct {
+	level  *slog.LevelVar
+	parent *subsystemHandler               // nil for NewLogger
+	derive func(slog.Handler) slog.Handler // attributes or group added to parent
+	out    atomic.Pointer[derivedHandler]
+}
+
+// derivedHandler is an output with the attributes and groups applied.
+type derivedHandler struct {
+	base *slog.Handler // the output it was derived from
+	h    slog.Handler
+}
+
+// output returns base with the attributes and groups of h applied.
+func (h *subsystemHandler) output(base *slog.Handler) slog.Handler {
+	if d := h.out.Load(); d != nil && d.base == base {
+		return d.h
+	}
+	out := *base
+	if h.parent != nil {
+		out = h.derive(h.parent.output(base))
+	}
+	h.out.Store(&derivedHandler{base: base, h: out})
+	return out
+}
+
+func (h *subsystemHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *subsystemHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.output(logHandler.Load()).Handle(ctx, r)
+}
+
+func (h *subsystemHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &subsystemHandler{level: h.level, parent: h,
+		derive: func(out slog.Handler) slog.Handler { return out.WithAttrs(attrs) }}
+}
+
+func (h *subsystemHandler) WithGroup(name string) slog.Handler {
+	return &subsystemHandler{level: h.level, parent: h,
+		derive: func(out slog.Handler) slog.Handler { return out.WithGroup(name) }}
+}
+
+// logf logs a printf style message as if from the caller of the function
+// calling logf. Nothing is formatted when the level is off.
+func logf(logger *slog.Logger, level slog.Level, format string, v ...any) {
+	ctx := context.Background()
+	if !logger.Enabled(ctx, level) {
+		return
+	}
+	var pcs [1]uintptr
+	runtime.Callers(3, pcs[:]) // skip Callers, logf and the helper
+	r := slog.NewRecord(time.Now(), level, strings.TrimSuffix(fmt.Sprintf(format, v...), "\n"), pcs[0])
+	logger.Handler().Handle(ctx, r)
+}
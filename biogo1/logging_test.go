@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestLoggerFollowsOutput checks that a logger made before the output is
+// changed logs to the new output, with its attributes.
+func TestLoggerFollowsOutput(t *testing.T) {
+	t.Cleanup(func() { setLogOutput(os.Stdout, LOG_FORMAT_TEXT) })
+	var text, json bytes.Buffer
+	setLogOutput(&text, LOG_FORMAT_TEXT)
+	l := NewLogger("lobby").With("remote", "10.0.0.1:1234").WithGroup("packet")
+	l.Info("first", "pid", 1)
+	l.Info("second", "pid", 2)
+	setLogOutput(&json, LOG_FORMAT_JSON)
+	l.Info("third", "pid", 3)
+
+	for _, want := range []string{
+		`sys=lobby remote=10.0.0.1:1234 packet.pid=1`,
+		`sys=lobby remote=10.0.0.1:1234 packet.pid=2`,
+	} {
+		if !strings.Contains(text.String(), want) {
+			t.Errorf("text output %q lacks %q", text.String(), want)
+		}
+	}
+	if want := `"sys":"lobby","remote":"10.0.0.1:1234","packet":{"pid":3}`; !strings.Contains(json.String(), want) {
+		t.Errorf("json output %q lacks %q", json.String(), want)
+	}
+	if strings.Contains(text.String(), "third") {
+		t.Error("logged to the old output")
+	}
+}
@@ -2,60 +2,185 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"os/signal"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
-const (
-	LOBBYPORT = 8300
-	GAMEPORT  = 8690
-)
-
 func main() {
+	// subcommands, everything else starts the server
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			os.Exit(runMigrate(os.Args[2:]))
+		case "relay":
+			os.Exit(runRelay(os.Args[2:]))
+		case "dissect":
+			os.Exit(runDissect(os.Args[2:]))
+		case "simulate":
+			os.Exit(runSimulate(os.Args[2:]))
+		case "replay":
+			os.Exit(runReplay(os.Args[2:]))
+		}
+	}
+	runServer(os.Args[1:])
+}
+
+func runServer(args []string) {
+	conf, err := LoadConfiguration(args)
+	if err != nil {
+		fmt.Println("Error loading configuration:", err)
+		os.Exit(2)
+	}
+	if err := SetupLogging(conf.LogFormat, conf.LogLevel); err != nil {
+		fmt.Println("Error loading configuration:", err)
+		os.Exit(2)
+	}
+	served, _ := ParseVariants(conf.Variants)
+	packetCapture.SetDir(conf.CaptureDir)
+	for _, userid := range strings.Split(conf.CaptureUsers, ",") {
+		if userid = strings.TrimSpace(userid); userid != "" {
+			packetCapture.Start(userid)
+		}
+	}
+
 	fmt.Println("------------------------------")
 	fmt.Println("-     fanmade server for     -")
-	fmt.Println("- biohazard outbreak file #1 -")
+	for _, v := range served {
+		fmt.Printf("- %-26s -\n", strings.ToLower(v.Title))
+	}
 	fmt.Println("-                            -")
 	fmt.Println("-         corbin.zip         -")
 	fmt.Println("-        go prototype        -")
 	fmt.Println("------------------------------")
 
+	// lobby and gameserver share one store
+	db, err := NewStore(conf)
+	if err != nil {
+		serverLog.Error("opening database connection", "err", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+	checkSchema(db)
+
+	// login and registration pages for the PS2 browser
+	if conf.WebPort != 0 {
+		go NewWebServer(conf, db).Run()
+	}
+
 	// for thread-like stuff
 	// go routines are like lightweight threads
+	// the wait group holds the listeners
 	var wg sync.WaitGroup
 
-	// set up the packethandler in its own thread
-	wg.Add(1)
-	packetHandler := NewPacketHandler()
-	go packetHandler.Run()
+	// every title gets its own lobby and game server
+	control := NewRelayControl(conf.RelaySecret)
+	var lobbies []*Lobby
+	for _, v := range served {
+		lobby, err := startLobby(conf, db, v, control, &wg)
+		if err != nil {
+			serverLog.Error("creating lobby server", "err", err)
+			return
+		}
+		lobbies = append(lobbies, lobby)
+	}
+
+	// remote game servers of all titles report here
+	if conf.RelayControl != 0 {
+		go control.Run(fmt.Sprintf("%s:%d", conf.LobbyHost, conf.RelayControl))
+	}
+
+	time.Sleep(1 * time.Second)
+	serverLog.Info("server started")
+
+	maintenance := NewMaintenance(lobbies, time.Duration(conf.ShutdownTimeout)*time.Second)
+
+	if conf.MetricsPort != 0 {
+		go RunMetrics(fmt.Sprintf("%s:%d", conf.MetricsHost, conf.MetricsPort))
+	}
 
-	// create the lobby server thread
-	lobbyServer, err := NewServerThread("192.168.1.135", LOBBYPORT, packetHandler)
+	// live state and actions for the operators
+	if conf.AdminPort != 0 {
+		go NewAdminServer(conf, lobbies, maintenance).Run()
+	}
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	restart := false
+	timeout := time.Duration(conf.ShutdownTimeout) * time.Second
+	select {
+	case <-signals:
+	case <-maintenance.Due():
+		// the games had their time while the lobbies were locked
+		restart, timeout = true, 0
+	}
+	shutdown(conf, db, lobbies, signals, timeout)
+	wg.Wait()
+	serverLog.Info("server stopped")
+	if restart {
+		db.Close()
+		restartServer()
+	}
+}
+
+func startLobby(conf *Configuration, db Store, v *Variant, control *RelayControl, wg *sync.WaitGroup) (*Lobby, error) {
+	lobbyPort, gamePort := conf.Ports(v)
+	serverLog.Info("starting lobby", "title", v.Name, "lobby_port", lobbyPort, "game_port", gamePort)
+
+	// game servers the lobby sends games to, the first is our own
+	relays, err := conf.GetRelays(v)
 	if err != nil {
-		fmt.Println("Error creating lobby server:", err)
-		return
+		return nil, err
+	}
+	relayPool := NewRelayPool(relays, db)
+	control.AddPool(v, relayPool)
+
+	// set up the packethandler and the lobby server, listening before
+	// anything runs so GSINFO knows the game port when it was 0
+	packetHandler := NewPacketHandler(conf, db, v, relayPool)
+	lobbyServer, err := NewServerThread(conf.LobbyHost, lobbyPort, packetHandler)
+	if err != nil {
+		return nil, err
+	}
+	if err := lobbyServer.Listen(); err != nil {
+		return nil, fmt.Errorf("lobby server: %w", err)
 	}
-	wg.Add(1)
-	go lobbyServer.Run(&wg)
 
-	// create the game server thread
-	gamePacketHandler := NewGameServerPacketHandler()
-	gameServer := NewGameServerThread("192.168.1.135", GAMEPORT, gamePacketHandler)
+	// create the game server
+	gamePacketHandler := NewGameServerPacketHandler(v.Name)
+	relayPool.AttachLocal(gamePacketHandler)
+	gameServer := NewGameServerThread(conf.GameHost, gamePort, gamePacketHandler)
+	if err := gameServer.Listen(); err != nil {
+		return nil, fmt.Errorf("game server: %w", err)
+	}
+	relays[0].Port = gameServer.Port()
+
+	// allow usage
+	packetHandler.SetGameServerPacketHandler(gamePacketHandler)
+
+	// each in its own thread
+	go packetHandler.Run()
 	wg.Add(1)
+	go lobbyServer.Run(wg)
 	go gamePacketHandler.Run()
 	wg.Add(1)
-	go gameServer.Run(&wg)
+	go gameServer.Run(wg)
 
-	// allow usage
-	packetHandler.SetGameServerPacketHandler(gamePacketHandler)
+	// gauges read on every /metrics scrape
+	collectLobbyMetrics(packetHandler)
+	collectGameMetrics(gamePacketHandler)
 
 	// thread for the keepalivepings and cleanups
-	wg.Add(1)
 	heartbeat := NewHeartBeatThread(lobbyServer, packetHandler, gameServer, gamePacketHandler)
 	go heartbeat.Run()
-
-	time.Sleep(1 * time.Second)
-	fmt.Println(time.Now().String(), "server started")
-
-	wg.Wait()
+	return &Lobby{
+		variant:           v,
+		packetHandler:     packetHandler,
+		lobbyServer:       lobbyServer,
+		gamePacketHandler: gamePacketHandler,
+		gameServer:        gameServer,
+	}, nil
 }
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bioserver/protocol"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// announcements before a maintenance starts
+var MAINTENANCE_COUNTDOWN = []time.Duration{
+	60 * time.Minute, 30 * time.Minute, 15 * time.Minute, 10 * time.Minute,
+	5 * time.Minute, 2 * time.Minute, 1 * time.Minute,
+}
+
+// how often the players in games are counted while they finish
+var MAINTENANCE_POLL = time.Second
+
+// sender of server announcements in the chat
+var ANNOUNCER = NewHNPairFromStrings("SERVER", "Server")
+
+// Maintenance takes all lobbies down for a restart at a scheduled time.
+// Until then the players are told in the chat at the countdown times and
+// with the MOTD. When it is due the areas are locked and no new slots can
+// be created. Running games get up to grace to finish, then Due fires so
+// the server shuts down and restarts.
+type Maintenance struct {
+	lobbies []*Lobby
+	grace   time.Duration
+	at      time.Time
+	reason  string
+	cancel  chan struct{}
+	due     chan struct{}
+	mu      sync.Mutex
+}
+
+func NewMaintenance(lobbies []*Lobby, grace time.Duration) *Maintenance {
+	return &Maintenance{lobbies: lobbies, grace: grace, due: make(chan struct{})}
+}
+
+// Schedule plans a maintenance, only one can be scheduled at a time.
+func (m *Maintenance) Schedule(at time.Time, reason string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.at.IsZero() {
+		return fmt.Errorf("maintenance already scheduled for %s", m.at.Format(time.DateTime))
+	}
+	if !at.After(time.Now()) {
+		return fmt.Errorf("maintenance time %s is not in the future", at.Format(time.DateTime))
+	}
+	m.at, m.reason = at, reason
+	m.cancel = make(chan struct{})
+	go m.run(at, reason, m.cancel)
+	serverLog.Info("maintenance scheduled", "at", at, "reason", reason)
+	return nil
+}
+
+// Cancel calls off a scheduled maintenance that hasn't started yet.
+func (m *Maintenance) Cancel() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.at.IsZero() {
+		return fmt.Errorf("no maintenance scheduled")
+	}
+	if !time.Now().Before(m.at) {
+		return fmt.Errorf("maintenance already started")
+	}
+	close(m.cancel)
+	m.at, m.reason = time.Time{}, ""
+	serverLog.Info("maintenance cancelled")
+	return nil
+}
+
+// Status returns the scheduled maintenance, a zero time if there is none.
+func (m *Maintenance) Status() (at time.Time, reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.at, m.reason
+}
+
+// Due is closed when the maintenance starts.
+func (m *Maintenance) Due() <-chan struct{} {
+	return m.due
+}
+
+func (m *Maintenance) run(at time.Time, reason string, cancel chan struct{}) {
+	notice := fmt.Sprintf("Maintenance at %s", at.Format("15:04"))
+	if reason != "" {
+		notice += ": " + reason
+	}
+	m.each(func(ph *PacketHandler, server *ServerThread) { ph.announceMaintenance(server, notice, notice) })
+
+	for _, before := range MAINTENANCE_COUNTDOWN {
+		wait := time.Until(at.Add(-before))
+		if wait <= 0 {
+			continue
+		}
+		select {
+		case <-time.After(wait):
+		case <-cancel:
+			m.each(func(ph *PacketHandler, server *ServerThread) { ph.cancelMaintenance(server) })
+			return
+		}
+		message := fmt.Sprintf("Maintenance in %d minutes", int(before.Minutes()))
+		m.each(func(ph *PacketHandler, server *ServerThread) { ph.announceMaintenance(server, notice, message) })
+	}
+	select {
+	case <-time.After(time.Until(at)):
+	case <-cancel:
+		m.each(func(ph *PacketHandler, server *ServerThread) { ph.cancelMaintenance(server) })
+		return
+	}
+
+	m.mu.Lock()
+	cancelled := m.at.IsZero()
+	m.mu.Unlock()
+	if cancelled {
+		return
+	}
+	serverLog.Info("maintenance started")
+	m.each(func(ph *PacketHandler, server *ServerThread) { ph.lockForMaintenance(server) })
+	m.waitForGames()
+	close(m.due)
+}
+
+// waitForGames returns when no player is in a game any more, or after
+// grace.
+func (m *Maintenance) waitForGames() {
+	deadline := time.After(m.grace)
+	ticker := time.NewTicker(MAINTENANCE_POLL)
+	defer ticker.Stop()
+	for {
+		players := 0
+		for _, l := range m.lobbies {
+			players += l.packetHandler.relays.CountPlayers()
+		}
+		if players == 0 {
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			serverLog.Info("maintenance grace over, ending games", "players", players)
+			return
+		}
+	}
+}
+
+// each runs fn on the event loop of every lobby.
+func (m *Maintenance) each(fn func(ph *PacketHandler, server *ServerThread)) {
+	for _, l := range m.lobbies {
+		ph, server := l.packetHandler, l.lobbyServer
+		ph.Call(func() { fn(ph, server) })
+	}
+}
+
+// announceMaintenance keeps the notice for the MOTD and tells everybody in
+// the lobby.
+func (ph *PacketHandler) announceMaintenance(server *ServerThread, notice, message string) {
+	ph.maintenance = notice
+	ph.broadcastAnnouncement(server, message)
+}
+
+func (ph *PacketHandler) cancelMaintenance(server *ServerThread) {
+	ph.maintenance = ""
+	ph.broadcastAnnouncement(server, "Maintenance cancelled")
+}
+
+// lockForMaintenance closes the areas and slot creation, players already in
+// an area or slot stay.
+func (ph *PacketHandler) lockForMaintenance(server *ServerThread) {
+	ph.maintenanceLock = true
+	ph.areas.SetLocked(true)
+	ph.broadcastAnnouncement(server, "Maintenance starts now, no new games")
+}
+
+// broadcastAnnouncement is a chat message from the server to every client.
+func (ph *PacketHandler) broadcastAnnouncement(server *ServerThread, message string) {
+	chat := &protocol.ChatOutBroadcast{Sender: ANNOUNCER.GetHNPair(), Message: []byte(message)}
+	ph.broadcastPacket(server, ph.newBroadcast(chat))
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// startMaintenance schedules a maintenance of the sim server that is due
+// right away and waits for the lobby to be locked.
+func startMaintenance(t *testing.T, s *SimServer, grace time.Duration) *Maintenance {
+	t.Helper()
+	poll := MAINTENANCE_POLL
+	MAINTENANCE_POLL = 10 * time.Millisecond
+	t.Cleanup(func() { MAINTENANCE_POLL = poll })
+
+	m := NewMaintenance([]*Lobby{s.lobby}, grace)
+	if err := m.Schedule(time.Now().Add(50*time.Millisecond), "test"); err != nil {
+		t.Fatal(err)
+	}
+	ph := s.lobby.packetHandler
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		locked := false
+		ph.Sync(func() { locked = ph.maintenanceLock })
+		if locked {
+			return m
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("lobby not locked for the maintenance")
+		}
+	}
+}
+
+func TestMaintenanceLetsRunningGamesFinish(t *testing.T) {
+	s, err := StartSimServer(FILE1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Stop)
+	gsp := s.lobby.gamePacketHandler
+	joinGame(t, gsp, 5, "alice")
+	joinGame(t, gsp, 5, "bob")
+
+	m := startMaintenance(t, s, time.Minute)
+	select {
+	case <-m.Due():
+		t.Fatal("maintenance due while a game is running")
+	case <-time.After(20 * MAINTENANCE_POLL):
+	}
+	if n := gsp.sessions.Count(5); n != 2 {
+		t.Fatalf("game 5 has %d players after the lock, want 2", n)
+	}
+
+	// the game ends
+	gsp.RemoveClientByID(s.lobby.gameServer, "alice", "finished")
+	gsp.RemoveClientByID(s.lobby.gameServer, "bob", "finished")
+	select {
+	case <-m.Due():
+	case <-time.After(2 * time.Second):
+		t.Fatal("maintenance not due after the last game ended")
+	}
+}
+
+func TestMaintenanceGraceEndsWait(t *testing.T) {
+	s, err := StartSimServer(FILE1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Stop)
+	joinGame(t, s.lobby.gamePacketHandler, 5, "alice")
+
+	m := startMaintenance(t, s, 100*time.Millisecond)
+	select {
+	case <-m.Due():
+	case <-time.After(2 * time.Second):
+		t.Fatal("maintenance not due after the grace time")
+	}
+}
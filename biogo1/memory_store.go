@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+type memorySession struct {
+	userID   string
+	gamesess int
+	area     int
+	room     int
+	slot     int
+	state    int
+}
+
+type memoryUser struct {
+	pwhash string
+	legacy string
+}
+
+type memoryHNPair struct {
+	userID   string
+	handle   string
+	nickname string
+}
+
+// MemoryStore is a Store without a database daemon. Nothing survives a
+// restart, sessions have to be added with AddSession.
+type MemoryStore struct {
+	sessions map[string]*memorySession // keyed by session id
+	users    map[string]*memoryUser    // keyed by userid
+	hnpairs  []*memoryHNPair
+	motd     []string
+	mu       sync.Mutex
+}
+
+func NewMemoryStore() *MemoryStore {
+	dbLog.Warn("using the in-memory store, nothing will be persisted")
+	return &MemoryStore{
+		sessions: make(map[string]*memorySession),
+		users:    make(map[string]*memoryUser),
+		motd:     []string{"Welcome to the fanmade Outbreak server!"},
+	}
+}
+
+// AddSession registers a login session, like the login pages do with the
+// sessions table. An older session of the same user is dropped.
+func (m *MemoryStore) AddSession(userid, session string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.addSession(userid, session)
+}
+
+// addSession is AddSession for callers holding m.mu.
+func (m *MemoryStore) addSession(userid, session string) {
+	for sessid, s := range m.sessions {
+		if s.userID == userid {
+			delete(m.sessions, sessid)
+		}
+	}
+	m.sessions[session] = &memorySession{userID: userid, area: -1}
+}
+
+// AddHNPair gives userid a handle, nickname as the client sends it. A
+// handle that exists already is left alone.
+func (m *MemoryStore) AddHNPair(userid string, handle, nickname []byte) {
+	name, err := decodeSJIS(nickname)
+	if err != nil {
+		name = "sjis"
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, p := range m.hnpairs {
+		if p.handle == string(handle) {
+			return
+		}
+	}
+	m.hnpairs = append(m.hnpairs, &memoryHNPair{userID: userid, handle: string(handle), nickname: name})
+}
+
+// AddMOTD makes message the active message of the day.
+func (m *MemoryStore) AddMOTD(message string) {
+	m.mu.Lock()
+	m.motd = append(m.motd, message)
+	m.mu.Unlock()
+}
+
+func (m *MemoryStore) sessionByUser(userid string) *memorySession {
+	for _, s := range m.sessions {
+		if s.userID == userid {
+			return s
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) GetUserID(session string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[session]
+	if !ok {
+		return "", fmt.Errorf("failed to get user id: no session %s", session)
+	}
+	return s.userID, nil
+}
+
+func (m *MemoryStore) UpdateClientOrigin(userid string, state, area, room, slot int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s := m.sessionByUser(userid); s != nil {
+		s.state, s.area, s.room, s.slot = state, area, room, slot
+	}
+	return nil
+}
+
+func (m *MemoryStore) GetGameNumber(userid string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.sessionByUser(userid)
+	if s == nil {
+		return 0, fmt.Errorf("failed to get game number: no session for %s", userid)
+	}
+	return s.gamesess, nil
+}
+
+func (m *MemoryStore) UpdateClientGame(userid string, gameNumber int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s := m.sessionByUser(userid); s != nil {
+		s.gamesess = gameNumber
+	}
+	return nil
+}
+
+func (m *MemoryStore) CheckHandle(handle string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, hn := range m.hnpairs {
+		if hn.handle == handle {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (m *MemoryStore) CreateNewHNPair(cl *Client) {
+	nickname, err := decodeSJIS(cl.hnPair.nickname)
+	if err != nil {
+		nickname = "sjis"
+		dbLog.Warn("ShiftJIS decoding failed", "userid", cl.userID, "err", err)
+	}
+	m.mu.Lock()
+	m.hnpairs = append(m.hnpairs, &memoryHNPair{
+		userID:   cl.userID,
+		handle:   string(cl.hnPair.handle),
+		nickname: nickname,
+	})
+	m.mu.Unlock()
+}
+
+func (m *MemoryStore) UpdateHNPair(cl *Client) {
+	nickname, err := decodeSJIS(cl.hnPair.nickname)
+	if err != nil {
+		nickname = "sjis"
+		dbLog.Warn("ShiftJIS decoding failed", "userid", cl.userID, "err", err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, hn := range m.hnpairs {
+		if hn.userID == cl.userID && hn.handle == string(cl.hnPair.handle) {
+			hn.nickname = nickname
+		}
+	}
+}
+
+func (m *MemoryStore) GetHNPairs(userid string) *HNPairs {
+	hnpairs := NewHNPairs()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, hn := range m.hnpairs {
+		if hn.userID == userid {
+			hnpairs.Add(NewHNPairFromStrings(hn.handle, hn.nickname))
+		}
+	}
+	return hnpairs
+}
+
+func (m *MemoryStore) GetMOTD() (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.motd) == 0 {
+		return "", fmt.Errorf("failed to get MOTD: none set")
+	}
+	return m.motd[len(m.motd)-1], nil
+}
+
+func (m *MemoryStore) CreateUser(userid, pwhash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[userid]; ok {
+		return ErrUserExists
+	}
+	m.users[userid] = &memoryUser{pwhash: pwhash}
+	return nil
+}
+
+func (m *MemoryStore) GetUserPassword(userid string) (string, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[userid]
+	if !ok {
+		return "", "", ErrNoUser
+	}
+	return u.pwhash, u.legacy, nil
+}
+
+func (m *MemoryStore) SetPasswordHash(userid, pwhash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[userid]
+	if !ok {
+		return ErrNoUser
+	}
+	u.pwhash = pwhash
+	u.legacy = ""
+	return nil
+}
+
+func (m *MemoryStore) CreateSession(userid, ip string, port int) (string, error) {
+	for {
+		sessid, err := newSessionID()
+		if err != nil {
+			return "", err
+		}
+		m.mu.Lock()
+		if _, taken := m.sessions[sessid]; !taken {
+			m.addSession(userid, sessid)
+			m.mu.Unlock()
+			return sessid, nil
+		}
+		m.mu.Unlock()
+	}
+}
+
+func (m *MemoryStore) ResetSessions() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, s := range m.sessions {
+		s.gamesess, s.area, s.room, s.slot, s.state = 0, -1, 0, 0, 0
+	}
+	return nil
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics are served in the Prometheus text format. Counters are bumped
+// where things happen, gauges are read from the lobbies and game servers
+// when /metrics is scraped.
+var (
+	METRIC_CONNECTIONS = NewCounterVec("bioserver_connections_accepted_total",
+		"Connections accepted.", "title", "server")
+	METRIC_PACKETS = NewCounterVec("bioserver_lobby_packets_total",
+		"Packets received by the lobby, by command.", "title", "command")
+	METRIC_QUEUE_DROPS = NewCounterVec("bioserver_lobby_queue_dropped_total",
+		"Packets dropped because the lobby send queue was full.", "title")
+	METRIC_RELAY_BYTES = NewCounterVec("bioserver_relay_bytes_total",
+		"Game data bytes forwarded to players by the game server.", "title")
+	METRIC_HEARTBEAT_TIMEOUTS = NewCounterVec("bioserver_heartbeat_timeouts_total",
+		"Clients disconnected for not answering the keepalive.", "title", "server")
+
+	METRIC_QUEUE_DEPTH = NewGaugeVec("bioserver_queue_depth",
+		"Packets waiting in the send queue.", "title", "server")
+	METRIC_PLAYERS = NewGaugeVec("bioserver_players",
+		"Players in the lobby by area and room, room 0 is the area itself.", "title", "area", "room")
+	METRIC_SLOTS = NewGaugeVec("bioserver_slots",
+		"Slots by status.", "title", "status")
+	METRIC_GAMES = NewGaugeVec("bioserver_games",
+		"Games running on the game server.", "title")
+	METRIC_GAME_PLAYERS = NewGaugeVec("bioserver_game_players",
+		"Players connected to the game server.", "title")
+
+	METRICS_REGISTRY = []metric{
+		METRIC_CONNECTIONS, METRIC_PACKETS, METRIC_QUEUE_DROPS, METRIC_RELAY_BYTES,
+		METRIC_HEARTBEAT_TIMEOUTS, METRIC_QUEUE_DEPTH, METRIC_PLAYERS, METRIC_SLOTS,
+		METRIC_GAMES, METRIC_GAME_PLAYERS,
+	}
+)
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+type metric interface {
+	write(b *strings.Builder)
+}
+
+// CounterVec is a counter for every combination of label values.
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+	values map[string]*atomic.Uint64
+	mu     sync.Mutex
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{name: name, help: help, labels: labels, values: make(map[string]*atomic.Uint64)}
+}
+
+// With returns the counter of the label values, hot paths should keep it
+// instead of looking it up every time.
+func (c *CounterVec) With(values ...string) *atomic.Uint64 {
+	key := formatLabels(c.labels, values)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.values[key]
+	if !ok {
+		v = new(atomic.Uint64)
+		c.values[key] = v
+	}
+	return v
+}
+
+// Inc adds one to the counter of the label values.
+func (c *CounterVec) Inc(values ...string) {
+	c.With(values...).Add(1)
+}
+
+func (c *CounterVec) write(b *strings.Builder) {
+	c.mu.Lock()
+	values := make(map[string]*atomic.Uint64, len(c.values))
+	for k, v := range c.values {
+		values[k] = v
+	}
+	c.mu.Unlock()
+
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, k := range slices.Sorted(maps.Keys(values)) {
+		fmt.Fprintf(b, "%s%s %d\n", c.name, k, values[k].Load())
+	}
+}
+
+// GaugeVec asks its collectors for the current values on every scrape.
+type GaugeVec struct {
+	name       string
+	help       string
+	labels     []string
+	collectors []func(set func(value float64, labels ...string))
+	mu         sync.Mutex
+}
+
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{name: name, help: help, labels: labels}
+}
+
+// Collect adds a collector, it calls set for every value it knows.
+func (g *GaugeVec) Collect(fn func(set func(value float64, labels ...string))) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.collectors = append(g.collectors, fn)
+}
+
+func (g *GaugeVec) write(b *strings.Builder) {
+	g.mu.Lock()
+	collectors := g.collectors
+	g.mu.Unlock()
+
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	for _, fn := range collectors {
+		fn(func(value float64, labels ...string) {
+			fmt.Fprintf(b, "%s%s %s\n", g.name, formatLabels(g.labels, labels),
+				strconv.FormatFloat(value, 'g', -1, 64))
+		})
+	}
+}
+
+// formatLabels builds {name="value",...}, empty without labels.
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(value))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+	for _, m := range METRICS_REGISTRY {
+		m.write(&b)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
+
+// RunMetrics blocks serving /metrics on addr.
+func RunMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", handleMetrics)
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	serverLog.Info("metrics served", "url", "http://"+addr+"/metrics")
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		serverLog.Error("metrics stopped", "err", err)
+	}
+}
+
+// collectLobbyMetrics registers the gauges of a lobby.
+func collectLobbyMetrics(ph *PacketHandler) {
+	title := ph.variant.Name
+	METRIC_QUEUE_DEPTH.Collect(func(set func(float64, ...string)) {
+		set(float64(len(ph.queue)), title, "lobby")
+	})
+	METRIC_PLAYERS.Collect(func(set func(float64, ...string)) {
+		// counted on the event loop, the clients' places and afterGame
+		// belong to it; rooms of an area are counts[area][1:]
+		var counts [][]int
+		ph.Sync(func() {
+			for area := 1; area <= ph.areas.GetAreaCount(); area++ {
+				rooms := []int{ph.clients.CountPlayersInArea(area)[0]}
+				for room := 1; room <= ph.rooms.GetRoomCount(); room++ {
+					rooms = append(rooms, ph.clients.CountPlayersInRoom(area, room))
+				}
+				counts = append(counts, rooms)
+			}
+		})
+		for i, rooms := range counts {
+			a := strconv.Itoa(i + 1)
+			for room, n := range rooms {
+				set(float64(n), title, a, strconv.Itoa(room))
+			}
+		}
+	})
+	METRIC_SLOTS.Collect(func(set func(float64, ...string)) {
+		count := make(map[byte]int)
+		ph.Sync(func() {
+			for area := 1; area <= ph.areas.GetAreaCount(); area++ {
+				for room := 1; room <= ph.rooms.GetRoomCount(); room++ {
+					for slot := 1; slot <= ph.slots.GetSlotCount(); slot++ {
+						count[ph.slots.GetStatus(area, room, slot)]++
+					}
+				}
+			}
+		})
+		for _, status := range []byte{STATUS_DISABLED, STATUS_FREE, STATUS_INCREATE, STATUS_GAMESET, STATUS_BUSY} {
+			set(float64(count[status]), title, slotStatusName(status))
+		}
+	})
+}
+
+// collectGameMetrics registers the gauges of a game server.
+func collectGameMetrics(gsp *GameServerPacketHandler) {
+	title := gsp.title
+	METRIC_QUEUE_DEPTH.Collect(func(set func(float64, ...string)) {
+		set(float64(len(gsp.queue)), title, "game")
+	})
+	METRIC_GAMES.Collect(func(set func(float64, ...string)) {
+		set(float64(len(gsp.Members())), title)
+	})
+	METRIC_GAME_PLAYERS.Collect(func(set func(float64, ...string)) {
+		set(float64(gsp.CountInGamePlayers()), title)
+	})
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Migration is one versioned step of the database schema. Up and Down are
+// executed statement by statement inside a transaction where MySQL allows it
+// (DDL commits implicitly, so keep each migration small).
+type Migration struct {
+	Version int
+	Name    string
+	Up      []string
+	Down    []string
+}
+
+// MigrationState is one line of "migrate status".
+type MigrationState struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// Migrator is implemented by stores that own a schema.
+type Migrator interface {
+	SchemaVersion() (int, error)
+	MigrateUp() error
+	MigrateDown(steps int) error
+	MigrationStatus() ([]MigrationState, error)
+}
+
+// migrations must stay ordered by version, new features append here.
+// Version 1 matches bioserv1/database/bioserver.sql, so databases that were
+// set up with the Java server can be adopted without losing data.
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "initial schema",
+		Up: []string{
+			"CREATE TABLE IF NOT EXISTS `sessions` (" +
+				"`userid` varchar(14) NOT NULL," +
+				"`ip` varchar(15) NOT NULL," +
+				"`port` int(11) NOT NULL," +
+				"`sessid` varchar(8) NOT NULL," +
+				"`gamesess` bigint(20) NOT NULL DEFAULT '0'," +
+				"`lastlogin` timestamp NULL DEFAULT NULL," +
+				"`area` int(11) DEFAULT '-1'," +
+				"`room` int(11) DEFAULT '0'," +
+				"`slot` int(11) DEFAULT '0'," +
+				"`state` int(11) DEFAULT '0'," +
+				"KEY `gamesess` (`gamesess`)" +
+				") ENGINE=InnoDB DEFAULT CHARSET=latin1",
+			"CREATE TABLE IF NOT EXISTS `hnpairs` (" +
+				"`userid` varchar(14) NOT NULL," +
+				"`handle` varchar(6) NOT NULL," +
+				"`nickname` varchar(100) CHARACTER SET utf8 COLLATE utf8_bin NOT NULL," +
+				"KEY `userid` (`userid`)," +
+				"KEY `handle` (`handle`)" +
+				") ENGINE=InnoDB DEFAULT CHARSET=latin1",
+			"CREATE TABLE IF NOT EXISTS `motd` (" +
+				"`id` int(11) NOT NULL AUTO_INCREMENT," +
+				"`message` varchar(2000) NOT NULL," +
+				"`active` int(11) NOT NULL DEFAULT '0'," +
+				"PRIMARY KEY (`id`)" +
+				") ENGINE=InnoDB DEFAULT CHARSET=latin1",
+			"CREATE TABLE IF NOT EXISTS `users` (" +
+				"`userid` varchar(14) NOT NULL," +
+				"`passwd` varchar(32) NOT NULL," +
+				"PRIMARY KEY (`userid`)" +
+				") ENGINE=InnoDB DEFAULT CHARSET=latin1",
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS `users`",
+			"DROP TABLE IF EXISTS `motd`",
+			"DROP TABLE IF EXISTS `hnpairs`",
+			"DROP TABLE IF EXISTS `sessions`",
+		},
+	},
+	{
+		Version: 2,
+		Name:    "hashed passwords",
+		Up: []string{
+			"ALTER TABLE `users` ADD COLUMN `pwhash` varchar(128) NOT NULL DEFAULT ''",
+			"ALTER TABLE `users` MODIFY `passwd` varchar(32) NOT NULL DEFAULT ''",
+		},
+		Down: []string{
+			"ALTER TABLE `users` DROP COLUMN `pwhash`",
+			"ALTER TABLE `users` MODIFY `passwd` varchar(32) NOT NULL",
+		},
+	},
+}
+
+func latestSchemaVersion() int {
+	if len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].Version
+}
+
+func (d *Database) ensureMigrationTable() error {
+	_, err := d.db.Exec("CREATE TABLE IF NOT EXISTS `schema_migrations` (" +
+		"`version` int(11) NOT NULL," +
+		"`name` varchar(100) NOT NULL," +
+		"`applied_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"PRIMARY KEY (`version`)" +
+		") ENGINE=InnoDB DEFAULT CHARSET=latin1")
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+	return nil
+}
+
+func (d *Database) appliedMigrations() (map[int]time.Time, error) {
+	if err := d.ensureMigrationTable(); err != nil {
+		return nil, err
+	}
+	rows, err := d.db.Query("SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema_migrations: %w", err)
+	}
+	defer rows.Close()
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var at sql.NullString
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, fmt.Errorf("failed to scan schema_migrations: %w", err)
+		}
+		t, _ := time.Parse(time.DateTime, at.String)
+		applied[version] = t
+	}
+	return applied, rows.Err()
+}
+
+// SchemaVersion returns the highest applied migration, 0 for an empty database.
+func (d *Database) SchemaVersion() (int, error) {
+	applied, err := d.appliedMigrations()
+	if err != nil {
+		return 0, err
+	}
+	version := 0
+	for v := range applied {
+		version = max(version, v)
+	}
+	return version, nil
+}
+
+func (d *Database) runMigration(m Migration, statements []string, up bool) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+		}
+	}
+	if up {
+		_, err = tx.Exec("INSERT INTO schema_migrations (version, name) VALUES (?, ?)", m.Version, m.Name)
+	} else {
+		_, err = tx.Exec("DELETE FROM schema_migrations WHERE version=?", m.Version)
+	}
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+	}
+	return tx.Commit()
+}
+
+// MigrateUp applies every migration that is not applied yet.
+func (d *Database) MigrateUp() error {
+	applied, err := d.appliedMigrations()
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		dbLog.Info("applying migration", "version", m.Version, "name", m.Name)
+		if err := d.runMigration(m, m.Up, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MigrateDown reverts the last steps applied migrations.
+func (d *Database) MigrateDown(steps int) error {
+	applied, err := d.appliedMigrations()
+	if err != nil {
+		return err
+	}
+	for i := len(migrations) - 1; i >= 0 && steps > 0; i-- {
+		m := migrations[i]
+		if _, ok := applied[m.Version]; !ok {
+			continue
+		}
+		dbLog.Info("reverting migration", "version", m.Version, "name", m.Name)
+		if err := d.runMigration(m, m.Down, false); err != nil {
+			return err
+		}
+		steps--
+	}
+	return nil
+}
+
+func (d *Database) MigrationStatus() ([]MigrationState, error) {
+	applied, err := d.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+	states := make([]MigrationState, 0, len(migrations))
+	for _, m := range migrations {
+		state := MigrationState{Migration: m}
+		if at, ok := applied[m.Version]; ok {
+			state.AppliedAt = &at
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+// checkSchema warns when the database is behind the migrations of this build.
+func checkSchema(db Store) {
+	m, ok := db.(Migrator)
+	if !ok {
+		return
+	}
+	version, err := m.SchemaVersion()
+	if err != nil {
+		dbLog.Warn("reading schema version", "err", err)
+		return
+	}
+	if version < latestSchemaVersion() {
+		dbLog.Warn("database schema is behind, run \"migrate up\"", "version", version, "expected", latestSchemaVersion())
+	}
+}
+
+// runMigrate implements "bioserver migrate up|down [n]|status [flags]".
+func runMigrate(args []string) int {
+	usage := func() int {
+		fmt.Fprintln(os.Stderr, "usage: bioserver migrate up|down [steps]|status [flags]")
+		return 2
+	}
+	if len(args) < 1 {
+		return usage()
+	}
+	action := args[0]
+	args = args[1:]
+	steps := 1
+	if action == "down" && len(args) > 0 {
+		if n, err := strconv.Atoi(args[0]); err == nil {
+			steps = n
+			args = args[1:]
+		}
+	}
+
+	conf, err := LoadConfiguration(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error loading configuration:", err)
+		return 2
+	}
+	if conf.DBDriver != DB_DRIVER_MYSQL && conf.DBDriver != "" {
+		fmt.Fprintf(os.Stderr, "db_driver %s has no schema to migrate\n", conf.DBDriver)
+		return 1
+	}
+	// not NewStore, that resets the sessions of a live server and needs
+	// the tables of migration 1
+	db, err := openDatabase(conf)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error opening database connection:", err)
+		return 1
+	}
+	defer db.Close()
+	var m Migrator = db
+
+	switch action {
+	case "up":
+		err = m.MigrateUp()
+	case "down":
+		err = m.MigrateDown(steps)
+	case "status":
+		var states []MigrationState
+		states, err = m.MigrationStatus()
+		for _, s := range states {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = "applied " + s.AppliedAt.Format(time.DateTime)
+			}
+			fmt.Printf("%4d  %-40s %s\n", s.Version, s.Name, applied)
+		}
+	default:
+		return usage()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Migration failed:", err)
+		return 1
+	}
+	if version, err := m.SchemaVersion(); err == nil {
+		fmt.Printf("schema version %d (latest %d)\n", version, latestSchemaVersion())
+	}
+	return 0
+}
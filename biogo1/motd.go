@@ -1,5 +1,7 @@
 package main
 
+import "bioserver/protocol"
+
 type MOTD struct {
 	number  byte
 	message string
@@ -12,15 +14,10 @@ func NewMOTD(number int, message string) *MOTD {
 	}
 }
 
-func (m *MOTD) GetPacket() []byte {
-	mlen := len(m.message)
-	retval := make([]byte, mlen+3)
-	retval[0] = m.number
-	if mlen == 0 {
-		retval[0] = 0
+func (m *MOTD) GetPacket() *protocol.MOTDTell {
+	number := m.number
+	if len(m.message) == 0 {
+		number = 0
 	}
-	retval[1] = byte(mlen >> 8)
-	retval[2] = byte(mlen & 0xFF)
-	copy(retval[3:], []byte(m.message))
-	return retval
+	return &protocol.MOTDTell{Number: number, Message: []byte(m.message)}
 }
@@ -1,7 +1,7 @@
 package main
 
-// data holds the packet data arrays; here only a sample is shown.
-var data = []byte{
+// data6881File1 is the only 6881 data block of File #1.
+var data6881File1 = []byte{
 	0x01, 0x01, 0x01, 0x94, 0xAD, 0x90, 0xB6, 0x20, 0x20, 0x6F, 0x75, 0x74, 0x62, 0x72, 0x65, 0x61, 0x6B, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
 	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x09, 0x02, 0x03, 0x04, 0x02, 0x03, 0x04, 0x02, 0x03, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0x05, 0x05, 0x00,
 	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0x01, 0x02, 0x97, 0xEB, 0x89, 0xBA, 0x20, 0x20, 0x62, 0x65, 0x6C,
@@ -173,10 +173,20 @@ var data = []byte{
 }
 
 // Packet6881GetData returns a slice of bytes constructed based on the given
-// parameters. It mimics the behavior of the Java getData() method.
-func Packet6881GetData(nr, offset, sizeL int) []byte {
-	// ph.debug("Packet6881GetData() nr %d requested; ignoring it though. Problem?\n", nr)
-	// Check if the requested size exceeds the available bytes.
+// parameters. It mimics the behavior of the Java getData() method, tables
+// are the data blocks of the title.
+func Packet6881GetData(tables [][]byte, nr, offset, sizeL int) []byte {
+	var data []byte
+	if nr >= 0 && nr < len(tables) {
+		data = tables[nr]
+	}
+	// Check if the requested range lies within the available bytes.
+	if offset < 0 || offset > len(data) {
+		offset = len(data)
+	}
+	if sizeL < 0 {
+		sizeL = 0
+	}
 	avail := len(data) - offset
 	if sizeL > avail {
 		sizeL = avail
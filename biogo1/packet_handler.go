@@ -1,17 +1,14 @@
 package main
 
 import (
+	"bioserver/commands"
+	"bioserver/protocol"
 	"bytes"
-	"encoding/binary"
 	"fmt"
-	"log"
-	"main/commands"
+	"log/slog"
 	"net"
-	"os"
-
+	"slices"
 	// "time"
-	"path/filepath"
-	"runtime"
 )
 
 const (
@@ -25,72 +22,101 @@ type PacketHandler struct {
 	gameServerPacketHandler *GameServerPacketHandler
 	packetIDCounter         int
 	queue                   chan ServerDataEvent
+	events                  chan LobbyEvent
 	gameNumber              int
-	db                      *Database
+	db                      Store
 	clients                 *ClientList
 	areas                   *Areas
 	rooms                   *Rooms
 	slots                   *Slots
-	logger                  *log.Logger
+	baseLog                 *slog.Logger
+	log                     *slog.Logger // with the connection and packet being handled
+	connLogs                map[net.Conn]*connLogger
+	handlers                *HandlerRegistry
 	information             *Information
-	gsIP                    []byte
+	conf                    *Configuration
+	relays                  *RelayPool
+	patch                   *Patch
+	variant                 *Variant
+	maintenance             string // notice of scheduled maintenance, shown with the MOTD
+	maintenanceLock         bool   // no new slots during maintenance
 }
 
-func NewPacketHandler() *PacketHandler {
+// NewPacketHandler creates the lobby of one title.
+func NewPacketHandler(conf *Configuration, db Store, v *Variant, relays *RelayPool) *PacketHandler {
 	ph := &PacketHandler{}
+	ph.db = db
+	ph.variant = v
 	ph.gameServerPacketHandler = nil
 	ph.packetIDCounter = 0
 	ph.queue = make(chan ServerDataEvent, 100)
+	ph.events = make(chan LobbyEvent, 100)
 	ph.gameNumber = 1
 	ph.clients = NewClientList()
-	ph.areas = NewAreas()
-	ph.rooms = NewRooms(ph.areas.GetAreaCount())
-	ph.slots = NewSlots(ph.areas.GetAreaCount(), ph.rooms.GetRoomCount())
-	ph.logger = log.New(os.Stdout, "", log.Ltime)
+	ph.areas = NewAreas(v.areas)
+	ph.rooms = NewRooms(ph.areas.GetAreaCount(), v.rooms)
+	ph.slots = NewSlots(ph.areas.GetAreaCount(), ph.rooms.GetRoomCount(), v.newRuleSet)
+	ph.baseLog = NewLogger("lobby").With("title", v.Name)
+	ph.log = ph.baseLog
+	ph.connLogs = make(map[net.Conn]*connLogger)
 	ph.information = NewInformation()
-	ph.gsIP = []byte{192, 168, 1, 135}
+	ph.conf = conf
+	ph.relays = relays
+	if v.patchable && conf.PatchFile != "" {
+		patch, err := LoadPatch(conf.PatchFile, conf.PatchVersion)
+		if err != nil {
+			ph.log.Warn("patching disabled", "err", err)
+		}
+		ph.patch = patch
+	}
+	ph.handlers = NewHandlerRegistry()
+	ph.registerHandlers()
 	return ph
 }
 
 func (ph *PacketHandler) debug(format string, v ...interface{}) {
-	pc, file, line, ok := runtime.Caller(2)
+	logf(ph.log, slog.LevelDebug, format, v...)
+}
+
+// connLogger is the logger of a connection and the player it was made for.
+type connLogger struct {
+	remote *slog.Logger
+	log    *slog.Logger
+	client *Client
+	handle string
+}
+
+// connLog is the logger for everything done for a connection, with the
+// player's userid and handle once known. It's kept until the connection
+// closes and only made again when the player changes.
+func (ph *PacketHandler) connLog(socket net.Conn) *slog.Logger {
+	c, ok := ph.connLogs[socket]
 	if !ok {
-		file = "???"
-		line = 0
+		l := ph.baseLog.With("remote", socket.RemoteAddr().String())
+		c = &connLogger{remote: l, log: l}
+		ph.connLogs[socket] = c
 	}
-	fn := runtime.FuncForPC(pc)
-	var funcName string
-	if fn != nil {
-		funcName = fn.Name()
-	} else {
-		funcName = "???"
+	cl := ph.clients.FindClientBySocket(socket)
+	var handle string
+	if cl != nil {
+		handle = handleOf(cl)
 	}
-	file = filepath.Base(file)
-	msg := fmt.Sprintf(format, v...)
-
-	ph.logger.Printf("%s:%d %s() %s", file, line, funcName, msg)
+	if cl != c.client || handle != c.handle {
+		c.log, c.client, c.handle = c.remote, cl, handle
+		if cl != nil {
+			c.log = c.log.With("userid", cl.userID)
+			if handle != "" {
+				c.log = c.log.With("handle", handle)
+			}
+		}
+	}
+	return c.log
 }
 
 func (ph *PacketHandler) Run() {
-	// // Get configuration
-	// conf := NewConfiguration() // Assuming a function to get config
-
-	// // Resolve gameserver IP
-	// tmpIP, err := net.ResolveIPAddr("ip", conf.gsIP)
-	// if err != nil {
-	// 	fmt.Println("Unknown Host, check properties file!")
-	// } else {
-	// 	ph.gsIP = tmpIP.IP
-	// 	fmt.Println("Gameserver IP:", ph.gsIP)
-	// }
-
-	// // Open database connection
-	db, err := NewDatabase("bioserver", "xxxxxxxxxxxxxxxx")
-	if err != nil {
-		fmt.Println("PacketHandler Run() Error opening database connection:", err)
-		return
+	for _, r := range ph.relays.relays {
+		ph.log.Info("game server", "relay", r.Name, "addr", fmt.Sprintf("%s:%d", net.IP(r.IP), r.Port))
 	}
-	ph.db = db
 
 	// // Initialize counters
 	ph.packetIDCounter = 0
@@ -104,6 +130,9 @@ func (ph *PacketHandler) Run() {
 	// ph.rooms = NewRooms(ph.areas.GetAreaCount())
 	// ph.slots = NewSlots(ph.areas.GetAreaCount(), ph.rooms.GetRoomCount())
 
+	// all lobby state belongs to the event loop
+	go ph.loop()
+
 	// Process the queue in a loop
 	// (this loops forever)
 	for event := range ph.queue {
@@ -115,13 +144,69 @@ func (p *PacketHandler) SetGameServerPacketHandler(handler *GameServerPacketHand
 	p.gameServerPacketHandler = handler
 }
 
-func (p *PacketHandler) SendLogin(st *ServerThread, sc net.Conn) {
+func (p *PacketHandler) sendLogin(st *ServerThread, sc net.Conn) {
 	// after connection the server sends its first packet, client answers
-	seed := []byte{0x28, 0x37}
-	pk := NewPacket(commands.LOGIN, commands.QUERY, commands.SERVER, p.getNextPacketID(), seed)
+	login := &protocol.LoginQuery{Seed: []byte{0x28, 0x37}}
+	pk := NewMessagePacket(commands.QUERY, commands.SERVER, p.getNextPacketID(), login)
 	p.addOutPacket(st, sc, pk)
 }
 
+// tell answers the query ps with a typed message
+func (ph *PacketHandler) tell(server *ServerThread, socket net.Conn, ps *Packet, m protocol.Message) {
+	ph.addOutPacket(server, socket, NewMessagePacket(commands.TELL, commands.SERVER, ps.pid, m))
+}
+
+// newBroadcast builds a broadcast packet with the next server packet id
+func (ph *PacketHandler) newBroadcast(m protocol.Message) *Packet {
+	return NewMessagePacket(commands.BROADCAST, commands.SERVER, ph.getNextPacketID(), m)
+}
+
+// decode unmarshals the payload of ps into m. A malformed query is answered
+// with an error message, any other malformed packet disconnects the client.
+func (ph *PacketHandler) decode(server *ServerThread, socket net.Conn, ps *Packet, m protocol.Message) bool {
+	err := ps.Decode(m)
+	if err == nil {
+		return true
+	}
+	if ps.qsw == commands.QUERY {
+		ph.rejectQuery(server, socket, ps, "rejecting malformed packet", "err", err)
+	} else {
+		ph.log.Warn("disconnecting after malformed packet", "err", err)
+		server.Disconnect(socket)
+	}
+	return false
+}
+
+// rejectQuery answers a query with an error and logs why.
+func (ph *PacketHandler) rejectQuery(server *ServerThread, socket net.Conn, ps *Packet, msg string, args ...any) {
+	ph.log.Warn(msg, args...)
+	ph.tell(server, socket, ps, &protocol.ErrorTell{Cmd: ps.cmd, Message: []byte("<BODY><SIZE=3>invalid request<END>")})
+}
+
+// checkSlot tells if a slot number sent by a client names a slot of its
+// room, the query is rejected if not.
+func (ph *PacketHandler) checkSlot(server *ServerThread, socket net.Conn, ps *Packet, area, room, slotnr int) bool {
+	if ph.slots.Exists(area, room, slotnr) {
+		return true
+	}
+	ph.rejectQuery(server, socket, ps, "rejecting query for unknown slot", "area", area, "room", room, "slot", slotnr)
+	return false
+}
+
+// checkRule is checkSlot for a rule of the slot and, unless attnr is
+// negative, an attribute option of that rule.
+func (ph *PacketHandler) checkRule(server *ServerThread, socket net.Conn, ps *Packet, area, room, slotnr, rulenr, attnr int) bool {
+	if !ph.checkSlot(server, socket, ps, area, room, slotnr) {
+		return false
+	}
+	rules := ph.slots.GetSlot(area, room, slotnr).GetRuleSet()
+	if rules.HasRule(rulenr) && (attnr < 0 || rules.HasRuleAtt(rulenr, attnr)) {
+		return true
+	}
+	ph.rejectQuery(server, socket, ps, "rejecting query for unknown rule", "slot", slotnr, "rule", rulenr, "attribute", attnr)
+	return false
+}
+
 // increase the server packet id
 func (ph *PacketHandler) getNextPacketID() int {
 	ph.packetIDCounter++
@@ -135,22 +220,26 @@ func (ph *PacketHandler) getNextGameNumber() int {
 
 func (ph *PacketHandler) addOutPacket(server *ServerThread, socket net.Conn, p *Packet) {
 	// ph.debug("PacketHandler addOutPacket() 0x%X - who: %s cmd: %s qsw: %s\n", p.cmd, commands.GetConstName(p.who), commands.GetConstName(p.cmd), commands.GetConstName(p.qsw))
-	ph.debug("0x%X - who: %s cmd: %s qsw: %s\n", p.cmd, commands.GetConstName(p.who), commands.GetConstName(p.cmd), commands.GetConstName(p.qsw))
+	ph.debug("out 0x%X - who: %s cmd: %s qsw: %s to %s\n", p.cmd, commands.GetConstName(p.who), commands.GetConstName(p.cmd), commands.GetConstName(p.qsw), socket.RemoteAddr())
 
 	event := ServerDataEvent{
 		server: server,
 		socket: socket,
 		data:   p.GetPacketData(),
 	}
+	if packetCapture.Enabled() {
+		packetCapture.RecordPacket(socket, CAPTURE_LOBBY, ph.variant.Name, ph.captureUserID(socket), CAPTURE_OUT, event.data)
+	}
 	select {
 	case ph.queue <- event:
 	default:
-		ph.debug("PacketHandler queue full\n")
+		METRIC_QUEUE_DROPS.Inc(ph.variant.Name)
+		ph.log.Warn("send queue full, dropping packet", "cmd", commands.GetConstName(p.cmd), "to", socket.RemoteAddr().String())
 	}
 
 }
 
-func (ph *PacketHandler) ProcessData(server *ServerThread, socket net.Conn, data []byte) {
+func (ph *PacketHandler) processData(server *ServerThread, socket net.Conn, data []byte) {
 	offset := 0
 	remaining := len(data)
 
@@ -169,13 +258,27 @@ func (ph *PacketHandler) ProcessData(server *ServerThread, socket net.Conn, data
 			break // incomplete packet; wait for more data
 		}
 		packetData := data[offset : offset+packetSize]
-		p := NewPacketFromBytes(packetData)
+		p, err := NewPacketFromBytes(packetData)
+		if err != nil {
+			ph.log.Warn("disconnecting after malformed packet", "err", err)
+			server.Disconnect(socket)
+			return
+		}
 
 		// ph.debug("PacketHandler ProcessData() - In cmd: 0x%X (%s)\n", p.cmd, commands.GetConstName(p.cmd))
 		// if p.cmd == commands.LOGIN && ph.clients.FindClientBySocket(socket) != nil {
 		// fmt.Println("PacketHandler ProcessData() Dropping duplicate login packet")
 		// } else {
-		ph.HandleInPacket(server, socket, p)
+		if packetCapture.Enabled() {
+			packetCapture.RecordPacket(socket, CAPTURE_LOBBY, ph.variant.Name, ph.captureUserID(socket), CAPTURE_IN, packetData)
+		}
+		connLog := ph.log
+		ph.log = connLog.With("cmd", commands.GetConstName(p.cmd), "pid", p.pid)
+		ok := ph.handleInPacketSafe(server, socket, p)
+		ph.log = connLog
+		if !ok {
+			return
+		}
 		// }
 
 		offset += packetSize
@@ -186,230 +289,198 @@ func (ph *PacketHandler) ProcessData(server *ServerThread, socket net.Conn, data
 
 }
 
-func (ph *PacketHandler) HandleInPacket(server *ServerThread, socket net.Conn, packet *Packet) {
-	p := packet
-	// ph.debug("PacketHandler HandleInPacket() 0x%X - who: %s cmd: %s qsw: %s\n", p.cmd, commands.GetConstName(p.who), commands.GetConstName(p.cmd), commands.GetConstName(p.qsw))
-	ph.debug("0x%X - who: %s cmd: %s qsw: %s\n", p.cmd, commands.GetConstName(p.who), commands.GetConstName(p.cmd), commands.GetConstName(p.qsw))
-
-	switch packet.who {
-	case commands.CLIENT:
-		switch packet.qsw {
-		case commands.QUERY:
-			switch packet.cmd {
-			case commands.UNKN61A0:
-				ph.sendTimeout(server, socket, packet)
-			case commands.CHECKRND:
-				ph.sendCheckRnd(server, socket, packet)
-			case commands.UNKN61A1:
-				ph.send61A1(server, socket, packet)
-			case commands.HNSELECT:
-				ph.sendHNSelect(server, socket, packet)
-			case commands.UNKN6002:
-				ph.send6002(server, socket, packet)
-			case commands.MOTHEDAY:
-				ph.sendMotheday(server, socket, packet)
-			case commands.CHARSELECT:
-				ph.sendCharSelect(server, socket, packet)
-			case commands.UNKN6881:
-				ph.send6881(server, socket, packet)
-			case commands.UNKN6882:
-				ph.send6882(server, socket, packet)
-			case commands.RANKINGS:
-				ph.sendRankings(server, socket, packet)
-			case commands.AREACOUNT:
-				ph.sendAreaCount(server, socket, packet)
-			case commands.AREAPLAYERCNT:
-				ph.sendAreaPlayerCnt(server, socket, packet)
-			case commands.AREASTATUS:
-				ph.sendAreaStatus(server, socket, packet)
-			case commands.AREANAME:
-				ph.sendAreaName(server, socket, packet)
-			case commands.AREADESCRIPT:
-				ph.sendAreaDescript(server, socket, packet)
-			case commands.AREASELECT:
-				ph.sendAreaSelect(server, socket, packet)
-			case commands.ROOMSCOUNT:
-				ph.sendRoomsCount(server, socket, packet)
-			case commands.ROOMPLAYERCNT:
-				ph.sendRoomPlayerCnt(server, socket, packet)
-			case commands.ROOMSTATUS:
-				ph.sendRoomStatus(server, socket, packet)
-			case commands.ROOMNAME:
-				ph.sendRoomName(server, socket, packet)
-			case commands.UNKN6308:
-				ph.send6308(server, socket, packet)
-			case commands.ENTERROOM:
-				ph.sendEnterRoom(server, socket, packet)
-			case commands.SLOTCOUNT:
-				ph.sendSlotCount(server, socket, packet)
-			case commands.SLOTSTATUS:
-				ph.sendSlotStatus(server, socket, packet)
-			case commands.SLOTPLRSTATUS:
-				ph.sendSlotPlayerStatus(server, socket, packet)
-			case commands.SLOTTITLE:
-				ph.sendSlotTitle(server, socket, packet)
-			case commands.SLOTATTRIB2:
-				ph.sendSlotAttrib2(server, socket, packet)
-			case commands.SLOTPWDPROT:
-				ph.sendPasswdProtect(server, socket, packet)
-			case commands.SLOTSCENTYPE:
-				ph.sendSlotSceneType(server, socket, packet)
-			case commands.RULESCOUNT:
-				ph.sendRulesCount(server, socket, packet)
-			case commands.RULEATTCOUNT:
-				ph.sendRuleAttCount(server, socket, packet)
-			case commands.UNKN6601:
-				ph.send6601(server, socket, packet)
-			case commands.UNKN6602:
-				ph.send6602(server, socket, packet)
-			case commands.RULEDESCRIPT:
-				ph.sendRuleDescript(server, socket, packet)
-			case commands.RULEVALUE:
-				ph.sendRuleValue(server, socket, packet)
-			case commands.RULEATTRIB:
-				ph.sendRuleAttrib(server, socket, packet)
-			case commands.ATTRDESCRIPT:
-				ph.sendAttrDescript(server, socket, packet)
-			case commands.ATTRATTRIB:
-				ph.sendAttrAttrib(server, socket, packet)
-			case commands.PLAYERSTATS:
-				ph.sendPlayerStats(server, socket, packet)
-			case commands.EXITSLOTLIST:
-				ph.sendExitSlotlist(server, socket, packet)
-			case commands.EXITAREA:
-				ph.sendExitArea(server, socket, packet)
-			case commands.CREATESLOT:
-				ph.sendCreateSlot(server, socket, packet)
-			case commands.SCENESELECT:
-				ph.sendSceneSelect(server, socket, packet)
-			case commands.SLOTNAME:
-				ph.sendSlotName(server, socket, packet)
-			case commands.SETRULE:
-				ph.sendSetRule(server, socket, packet)
-			case commands.UNKN660C:
-				ph.send660C(server, socket, packet)
-			case commands.SLOTTIMER:
-				ph.sendSlotTimer(server, socket, packet)
-			case 0x6412:
-				ph.send6412(server, socket, packet)
-			case 0x6504:
-				ph.send6504(server, socket, packet)
-			case commands.CANCELSLOT:
-				ph.sendCancelSlot(server, socket, packet)
-			case commands.SLOTPASSWD:
-				ph.sendSlotPasswd(server, socket, packet)
-			case commands.PLAYERCOUNT:
-				ph.sendPlayerCount(server, socket, packet)
-			case commands.PLAYERNUMBER:
-				ph.sendPlayerNumber(server, socket, packet)
-			case commands.PLAYERSTAT:
-				ph.sendPlayerStat(server, socket, packet)
-			case commands.PLAYERSCORE:
-				ph.sendPlayerScore(server, socket, packet)
-			case commands.GAMESESSION:
-				ph.sendGameSession(server, socket, packet)
-			case commands.GAMEDIFF:
-				ph.sendDifficulty(server, socket, packet)
-			case commands.GSINFO:
-				ph.sendGSinfo(server, socket, packet)
-			case commands.ENTERAGL:
-				ph.sendEnterAGL(server, socket, packet)
-			case commands.AGLSTATS:
-				ph.sendAGLstats(server, socket, packet)
-			case commands.AGLPLAYERCNT:
-				ph.sendAGLplayerCnt(server, socket, packet)
-			case commands.LEAVEAGL:
-				ph.sendLeaveAGL(server, socket, packet)
-			case commands.JOINGAME:
-				ph.sendJoinGame(server, socket, packet)
-			case commands.GETINFO:
-				ph.sendGetInfo(server, socket, packet)
-			case commands.EVENTDAT:
-				ph.sendEventDat(server, socket, packet)
-			case commands.BUDDYLIST:
-				ph.sendBuddyList(server, socket, packet)
-			case commands.CHECKBUDDY:
-				ph.sendCheckBuddy(server, socket, packet)
-			case commands.PRIVATEMSG:
-				ph.sendPrivateMsg(server, socket, packet)
-			case commands.UNKN6181:
-				ph.send6181(server, socket, packet)
-			case commands.LOGOUT:
-				ph.sendLogout(server, socket, packet)
-			default:
-				ph.debug("Unknown or unimplemented command on query: 0x%X (%s)\n", packet.cmd, commands.GetConstName(packet.cmd))
-			}
-		case commands.TELL:
-			switch packet.cmd {
-			case commands.CONNCHECK:
-				cl := ph.clients.FindClientBySocket(socket)
-				if cl != nil {
-					cl.ConnAlive = true
-				}
-			case commands.LOGIN:
-				if ph.checkSession(server, socket, packet) {
-					ph.debug("Session check passed!\n")
-					// correct session established
-					// next step is the version check for File#1 updates
-					ph.sendVersionCheck(server, socket)
-				} else {
-					ph.debug("Session check failed!")
-				}
-			case commands.CHECKVERSION:
-				if ph.checkPatchLevel(server, socket, packet) {
-					// if version is older than actual patch, send patch
-					ph.debug("literally never reaches here....")
-					// ph.beginPatch(server, socket)
-				} else {
-					// next step is to offer the registered handle/name pairs
-					ph.sendIDHNPairs(server, socket)
-				}
-			// case commands.PATCHLINECHECK:
-			//     continuePatch(server, socket, packet)
-			// case commands.PATCHFINISH:
-			//     sendShutdown(server, socket)
-			default:
-				ph.debug("Unknown command on answer: %d (0x%X)\n", packet.cmd, packet.cmd)
-			}
-		case commands.BROADCAST:
-			switch packet.cmd {
-			case commands.STARTGAME:
-				ph.broadcastGetReady(server, socket)
-			case commands.CHATIN:
-			    ph.broadcastChatOut(server, socket, packet)
-			default:
-				ph.debug("Unknown command on broadcast: %d (0x%X)\n", packet.cmd, packet.cmd)
+// handleInPacketSafe runs HandleInPacket and disconnects the client if a
+// handler panics on its input, the other clients stay connected.
+func (ph *PacketHandler) handleInPacketSafe(server *ServerThread, socket net.Conn, p *Packet) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			ph.log.Error("disconnecting after the handler panicked", "panic", r)
+			server.Disconnect(socket)
+			ok = false
+		}
+	}()
+	ph.HandleInPacket(server, socket, p)
+	return true
+}
+
+// registerHandlers sets up the handlers for all client packets
+func (ph *PacketHandler) registerHandlers() {
+	ph.handlers.Use(ph.logInPacket, ph.checkState)
+
+	// queries, answered with a TELL of the same command
+	ph.handlers.Register(commands.UNKN61A0, commands.QUERY, ph.sendTimeout).In(anyState...)
+	ph.handlers.Register(commands.CHECKRND, commands.QUERY, ph.sendCheckRnd).In(anyState...)
+	ph.handlers.Register(commands.UNKN61A1, commands.QUERY, ph.send61A1).In(anyState...)
+	ph.handlers.Register(commands.HNSELECT, commands.QUERY, ph.sendHNSelect).In(STATE_AUTHENTICATED, STATE_HANDLE)
+	ph.handlers.Register(commands.UNKN6002, commands.QUERY, ph.send6002).In(loggedInState...)
+	ph.handlers.Register(commands.MOTHEDAY, commands.QUERY, ph.sendMotheday).In(loggedInState...)
+	ph.handlers.Register(commands.CHARSELECT, commands.QUERY, ph.sendCharSelect).In(STATE_HANDLE, STATE_CHARACTER)
+	ph.handlers.Register(commands.UNKN6881, commands.QUERY, ph.send6881).In(loggedInState...)
+	ph.handlers.Register(commands.UNKN6882, commands.QUERY, ph.send6882).In(loggedInState...)
+	ph.handlers.Register(commands.RANKINGS, commands.QUERY, ph.sendRankings).In(loggedInState...)
+	ph.handlers.Register(commands.AREACOUNT, commands.QUERY, ph.sendAreaCount).In(loggedInState...)
+	ph.handlers.Register(commands.AREAPLAYERCNT, commands.QUERY, ph.sendAreaPlayerCnt).In(loggedInState...)
+	ph.handlers.Register(commands.AREASTATUS, commands.QUERY, ph.sendAreaStatus).In(loggedInState...)
+	ph.handlers.Register(commands.AREANAME, commands.QUERY, ph.sendAreaName).In(loggedInState...)
+	ph.handlers.Register(commands.AREADESCRIPT, commands.QUERY, ph.sendAreaDescript).In(loggedInState...)
+	ph.handlers.Register(commands.AREASELECT, commands.QUERY, ph.sendAreaSelect).In(STATE_CHARACTER, STATE_AREA)
+	ph.handlers.Register(commands.ROOMSCOUNT, commands.QUERY, ph.sendRoomsCount).In(loggedInState...)
+	ph.handlers.Register(commands.ROOMPLAYERCNT, commands.QUERY, ph.sendRoomPlayerCnt).In(loggedInState...)
+	ph.handlers.Register(commands.ROOMSTATUS, commands.QUERY, ph.sendRoomStatus).In(loggedInState...)
+	ph.handlers.Register(commands.ROOMNAME, commands.QUERY, ph.sendRoomName).In(loggedInState...)
+	ph.handlers.Register(commands.UNKN6308, commands.QUERY, ph.send6308).In(loggedInState...)
+	ph.handlers.Register(commands.ENTERROOM, commands.QUERY, ph.sendEnterRoom).In(STATE_AREA, STATE_ROOM)
+	ph.handlers.Register(commands.SLOTCOUNT, commands.QUERY, ph.sendSlotCount).In(roomState...)
+	ph.handlers.Register(commands.SLOTSTATUS, commands.QUERY, ph.sendSlotStatus).In(roomState...)
+	ph.handlers.Register(commands.SLOTPLRSTATUS, commands.QUERY, ph.sendSlotPlayerStatus).In(roomState...)
+	ph.handlers.Register(commands.SLOTTITLE, commands.QUERY, ph.sendSlotTitle).In(roomState...)
+	ph.handlers.Register(commands.SLOTATTRIB2, commands.QUERY, ph.sendSlotAttrib2).In(roomState...)
+	ph.handlers.Register(commands.SLOTPWDPROT, commands.QUERY, ph.sendPasswdProtect).In(roomState...)
+	ph.handlers.Register(commands.SLOTSCENTYPE, commands.QUERY, ph.sendSlotSceneType).In(roomState...)
+	ph.handlers.Register(commands.RULESCOUNT, commands.QUERY, ph.sendRulesCount).In(roomState...)
+	ph.handlers.Register(commands.RULEATTCOUNT, commands.QUERY, ph.sendRuleAttCount).In(roomState...)
+	ph.handlers.Register(commands.UNKN6601, commands.QUERY, ph.send6601).In(roomState...)
+	ph.handlers.Register(commands.UNKN6602, commands.QUERY, ph.send6602).In(roomState...)
+	ph.handlers.Register(commands.RULEDESCRIPT, commands.QUERY, ph.sendRuleDescript).In(roomState...)
+	ph.handlers.Register(commands.RULEVALUE, commands.QUERY, ph.sendRuleValue).In(roomState...)
+	ph.handlers.Register(commands.RULEATTRIB, commands.QUERY, ph.sendRuleAttrib).In(roomState...)
+	ph.handlers.Register(commands.ATTRDESCRIPT, commands.QUERY, ph.sendAttrDescript).In(roomState...)
+	ph.handlers.Register(commands.ATTRATTRIB, commands.QUERY, ph.sendAttrAttrib).In(roomState...)
+	ph.handlers.Register(commands.PLAYERSTATS, commands.QUERY, ph.sendPlayerStats).In(roomState...)
+	ph.handlers.Register(commands.EXITSLOTLIST, commands.QUERY, ph.sendExitSlotlist).In(STATE_ROOM)
+	ph.handlers.Register(commands.EXITAREA, commands.QUERY, ph.sendExitArea).In(STATE_AREA)
+	ph.handlers.Register(commands.CREATESLOT, commands.QUERY, ph.sendCreateSlot).In(STATE_ROOM)
+	ph.handlers.Register(commands.SCENESELECT, commands.QUERY, ph.sendSceneSelect).In(STATE_SLOT)
+	ph.handlers.Register(commands.SLOTNAME, commands.QUERY, ph.sendSlotName).In(STATE_SLOT)
+	ph.handlers.Register(commands.SETRULE, commands.QUERY, ph.sendSetRule).In(STATE_SLOT)
+	ph.handlers.Register(commands.UNKN660C, commands.QUERY, ph.send660C).In(STATE_SLOT)
+	ph.handlers.Register(commands.SLOTTIMER, commands.QUERY, ph.sendSlotTimer).In(STATE_SLOT)
+	ph.handlers.Register(commands.UNKN6412, commands.QUERY, ph.send6412).In(STATE_SLOT)
+	ph.handlers.Register(commands.UNKN6504, commands.QUERY, ph.send6504).In(STATE_SLOT)
+	ph.handlers.Register(commands.CANCELSLOT, commands.QUERY, ph.sendCancelSlot).In(STATE_ROOM, STATE_SLOT)
+	ph.handlers.Register(commands.SLOTPASSWD, commands.QUERY, ph.sendSlotPasswd).In(STATE_SLOT)
+	ph.handlers.Register(commands.PLAYERCOUNT, commands.QUERY, ph.sendPlayerCount).In(slotState...)
+	ph.handlers.Register(commands.PLAYERNUMBER, commands.QUERY, ph.sendPlayerNumber).In(slotState...)
+	ph.handlers.Register(commands.PLAYERSTAT, commands.QUERY, ph.sendPlayerStat).In(slotState...)
+	ph.handlers.Register(commands.PLAYERSCORE, commands.QUERY, ph.sendPlayerScore).In(slotState...)
+	ph.handlers.Register(commands.GAMESESSION, commands.QUERY, ph.sendGameSession).In(slotState...)
+	ph.handlers.Register(commands.GAMEDIFF, commands.QUERY, ph.sendDifficulty).In(slotState...)
+	ph.handlers.Register(commands.GSINFO, commands.QUERY, ph.sendGSinfo).In(slotState...)
+	ph.handlers.Register(commands.ENTERAGL, commands.QUERY, ph.sendEnterAGL).In(STATE_HANDLE, STATE_CHARACTER)
+	ph.handlers.Register(commands.AGLSTATS, commands.QUERY, ph.sendAGLstats).In(STATE_AGL)
+	ph.handlers.Register(commands.AGLPLAYERCNT, commands.QUERY, ph.sendAGLplayerCnt).In(STATE_AGL)
+	ph.handlers.Register(commands.LEAVEAGL, commands.QUERY, ph.sendLeaveAGL).In(STATE_AGL)
+	ph.handlers.Register(commands.JOINGAME, commands.QUERY, ph.sendJoinGame).In(STATE_ROOM)
+	ph.handlers.Register(commands.GETINFO, commands.QUERY, ph.sendGetInfo).In(loggedInState...)
+	ph.handlers.Register(commands.EVENTDAT, commands.QUERY, ph.sendEventDat).In(handleState...)
+	ph.handlers.Register(commands.BUDDYLIST, commands.QUERY, ph.sendBuddyList).In(loggedInState...)
+	ph.handlers.Register(commands.CHECKBUDDY, commands.QUERY, ph.sendCheckBuddy).In(loggedInState...)
+	ph.handlers.Register(commands.PRIVATEMSG, commands.QUERY, ph.sendPrivateMsg).In(handleState...)
+	ph.handlers.Register(commands.UNKN6181, commands.QUERY, ph.send6181).In(loggedInState...)
+	ph.handlers.Register(commands.LOGOUT, commands.QUERY, ph.sendLogout).In(loggedInState...)
+
+	// answers to server queries
+	ph.handlers.Register(commands.CONNCHECK, commands.TELL, ph.handleConnCheck).In(anyState...)
+	ph.handlers.Register(commands.LOGIN, commands.TELL, ph.handleLogin).In(STATE_CONNECTED)
+	ph.handlers.Register(commands.CHECKVERSION, commands.TELL, ph.handleCheckVersion).In(STATE_AUTHENTICATED)
+	if ph.variant.patchable {
+		ph.handlers.Register(commands.PATCHLINECHECK, commands.TELL, ph.continuePatch).In(STATE_AUTHENTICATED)
+		ph.handlers.Register(commands.PATCHFINISH, commands.TELL, ph.handlePatchFinish).In(STATE_AUTHENTICATED)
+	}
+	ph.handlers.Register(commands.POSTGAMEINFO, commands.TELL, ph.handlePostGameInfo).In(handleState...)
+
+	// broadcasts from the client
+	ph.handlers.Register(commands.STARTGAME, commands.BROADCAST, ph.handleStartGame).In(slotState...)
+	ph.handlers.Register(commands.CHATIN, commands.BROADCAST, ph.broadcastChatOut).In(handleState...)
+}
+
+// logInPacket logs every dispatched packet
+func (ph *PacketHandler) logInPacket(r *Route, next HandlerFunc) HandlerFunc {
+	return func(server *ServerThread, socket net.Conn, p *Packet) {
+		ph.debug("in 0x%X - who: %s cmd: %s qsw: %s\n", p.cmd, commands.GetConstName(p.who), commands.GetConstName(p.cmd), commands.GetConstName(p.qsw))
+		next(server, socket, p)
+	}
+}
+
+// checkState rejects commands the client may not send in its current state
+func (ph *PacketHandler) checkState(r *Route, next HandlerFunc) HandlerFunc {
+	return func(server *ServerThread, socket net.Conn, p *Packet) {
+		state := STATE_CONNECTED
+		if cl := ph.clients.FindClientBySocket(socket); cl != nil {
+			state = cl.state
+		}
+		if !slices.Contains(r.states, state) {
+			ph.debug("Rejecting %s in state %s\n", commands.GetConstName(p.cmd), state)
+			if p.qsw == commands.QUERY {
+				ph.tell(server, socket, p, &protocol.ErrorTell{Cmd: p.cmd, Message: []byte("<BODY><SIZE=3>not possible now<END>")})
 			}
-		default:
-			ph.debug("Unknown qsw type on incoming packet! 0x%X\n", packet.qsw)
+			return
 		}
-	default:
-		fmt.Println("PacketHandler HandleInPacket() Not a client who on incoming packet!")
+		next(server, socket, p)
 	}
 }
 
-func (ph *PacketHandler) checkSession(server *ServerThread, socket net.Conn, p *Packet) bool {
-	// this should probably be renamed or broken into different functions
-	// since it does more than just check the session
-	seed := p.pid
+func (ph *PacketHandler) HandleInPacket(server *ServerThread, socket net.Conn, packet *Packet) {
+	METRIC_PACKETS.Inc(ph.variant.Name, commands.GetConstName(packet.cmd))
+	if packet.who != commands.CLIENT {
+		ph.debug("Not a client who on incoming packet! 0x%X\n", packet.who)
+		return
+	}
+	if !ph.handlers.Dispatch(server, socket, packet) {
+		ph.debug("Unhandled command 0x%X (%s) on %s\n", packet.cmd, commands.GetConstName(packet.cmd), commands.GetConstName(packet.qsw))
+	}
+}
+
+func (ph *PacketHandler) handleConnCheck(server *ServerThread, socket net.Conn, packet *Packet) {
+	cl := ph.clients.FindClientBySocket(socket)
+	if cl != nil {
+		cl.ConnAlive.Store(true)
+	}
+}
+
+func (ph *PacketHandler) handleLogin(server *ServerThread, socket net.Conn, packet *Packet) {
+	if ph.checkSession(server, socket, packet) {
+		ph.debug("Session check passed!\n")
+		// correct session established
+		// next step is the version check for File#1 updates
+		ph.sendVersionCheck(server, socket)
+	} else {
+		ph.log.Info("session check failed")
+	}
+}
+
+func (ph *PacketHandler) handleCheckVersion(server *ServerThread, socket net.Conn, packet *Packet) {
+	if ph.checkPatchLevel(server, socket, packet) {
+		// if version is older than actual patch, send patch
+		ph.beginPatch(server, socket)
+	} else {
+		// next step is to offer the registered handle/name pairs
+		ph.sendIDHNPairs(server, socket)
+	}
+}
 
-	sessA := int(p.pay[2]-0x30) * 10000
-	sessA += int(p.pay[3]-0x30) * 1000
-	sessA += int(p.pay[4]-0x30) * 100
-	sessA += int(p.pay[5]-0x30) * 10
-	sessA += int(p.pay[6] - 0x30)
+func (ph *PacketHandler) handlePatchFinish(server *ServerThread, socket net.Conn, packet *Packet) {
+	// since this is the only time we use shutdown for a single client, message can be hardcoded.
+	message := "<LF=2><BODY><CENTER>Update completed.<BR><BODY>You were disconnected from server.<LF=3><BODY>From now,<C=3>no connection from<BR><BODY>\"PlayStation 2\" network<BR><BODY>can be made.<BR><BODY><C=7>Please notice.<END>"
+	ph.sendShutdown(server, socket, message)
+}
 
-	sessB := int(p.pay[7]-0x30) * 10000
-	sessB += int(p.pay[8]-0x30) * 1000
-	sessB += int(p.pay[9]-0x30) * 100
-	sessB += int(p.pay[10]-0x30) * 10
-	sessB += int(p.pay[11] - 0x30)
+func (ph *PacketHandler) handleStartGame(server *ServerThread, socket net.Conn, packet *Packet) {
+	ph.broadcastGetReady(server, socket)
+}
 
-	session := fmt.Sprintf("%04d%04d", sessA-seed, sessB-seed)
+func (ph *PacketHandler) checkSession(server *ServerThread, socket net.Conn, p *Packet) bool {
+	// this should probably be renamed or broken into different functions
+	// since it does more than just check the session
+	login := &protocol.LoginTell{}
+	if !ph.decode(server, socket, p, login) {
+		return false
+	}
+	session := login.Session
 
 	userid, err := ph.db.GetUserID(session)
 	if err != nil {
-		ph.debug("PacketHandler checkSession() Error getting user id:%v\n", err)
+		ph.log.Error("getting user id of session", "err", err)
 		return false
 	}
 
@@ -433,46 +504,53 @@ func (ph *PacketHandler) checkSession(server *ServerThread, socket net.Conn, p *
 		ph.clients.Add(NewClient(socket, userid, session))
 		cl = ph.clients.FindClientBySocket(socket)
 		if cl == nil {
-			fmt.Println("HandleInPacket checkSession() Failed to add client to client list!!! big problem!!!")
+			ph.log.Error("client missing from the client list after adding it", "userid", userid)
 			return false
 		}
+		ph.log = ph.log.With("userid", userid)
 
 		err = ph.db.UpdateClientOrigin(userid, STATUS_LOBBY, 0, 0, 0)
 		if err != nil {
-			fmt.Println("HandleInPacket checkSession() Error updating client origin:", err)
+			ph.log.Error("updating client origin", "err", err)
 			return false
 		}
 
 		gamenr, err := ph.db.GetGameNumber(cl.userID)
 		if err != nil {
-			fmt.Println("HandleInPacket checkSession() Error getting game number:", err)
+			ph.log.Error("getting game number", "err", err)
 			return false
 		}
 		if gamenr > 0 {
 			// we are in meeting room then
 			// game number not set yet because needed for broadcast packets in AGL!
-			cl.area = 51
-			ph.db.UpdateClientOrigin(userid, STATUS_AGLOBBY, 51, 0, 0)
+			cl.afterGame = true
+			ph.db.UpdateClientOrigin(userid, STATUS_AGLOBBY, 0, 0, 0)
 		}
 		return true
 	} else {
 		// session check failed; disconnect this client
-		fmt.Println("HandleInPacket checkSession() Session check failed!")
+		ph.log.Info("unknown session", "session", session)
 		return false
 	}
 }
 
 func (ph *PacketHandler) sendVersionCheck(server *ServerThread, socket net.Conn) {
-	pk := NewPacket(commands.CHECKVERSION, commands.QUERY, commands.SERVER, ph.getNextPacketID(), []byte{0x00, 0x00})
+	check := &protocol.NumberQuery{Cmd: commands.CHECKVERSION}
+	pk := NewMessagePacket(commands.QUERY, commands.SERVER, ph.getNextPacketID(), check)
 	ph.addOutPacket(server, socket, pk)
 }
 
 func (ph *PacketHandler) sendCheckRnd(server *ServerThread, socket net.Conn, p *Packet) {
-	teststring := []byte{0x00, 0x01, 0x30}
-	p.CryptString()
-	teststring[2] = p.pay[4]
-	pk := NewPacket(commands.CHECKRND, commands.TELL, commands.SERVER, p.pid, teststring)
-	ph.addOutPacket(server, socket, pk)
+	q := &protocol.SecretQuery{Cmd: commands.CHECKRND}
+	if !ph.decode(server, socket, p, q) {
+		return
+	}
+	// answer with the first decrypted byte
+	answer := &protocol.CheckRndTell{Value: 0x30}
+	if len(q.Text) > 0 {
+		answer.Value = q.Text[0]
+	}
+	ph.tell(server, socket, p, answer)
 }
 
 func (ph *PacketHandler) checkPatchLevel(server *ServerThread, socket net.Conn, p *Packet) bool {
@@ -480,12 +558,77 @@ func (ph *PacketHandler) checkPatchLevel(server *ServerThread, socket net.Conn,
 
 	packetData := p.GetPacketData()
 	ph.debug("Packet data: %+v\n", packetData)
-	version := p.GetVersion()
-	ph.debug("Decrypted client version: %s\n", version)
+	version := &protocol.CheckVersionTell{}
+	if !ph.decode(server, socket, p, version) {
+		return false
+	}
+	ph.debug("Decrypted client version: %s\n", version.Version)
 
 	// check if the client has the latest patch level
 	// if not, send patch
-	return false
+	return ph.patch != nil && ph.patch.IsOutdated(version.Version)
+}
+
+// sendShutdown disconnects a client with a notice on its screen
+func (ph *PacketHandler) sendShutdown(server *ServerThread, socket net.Conn, message string) {
+	p := ph.newBroadcast(&protocol.TextBroadcast{Cmd: commands.SHUTDOWN, Message: []byte(message)})
+	ph.addOutPacket(server, socket, p)
+}
+
+// BroadcastShutdown sends every client the shutdown notice
+func (ph *PacketHandler) BroadcastShutdown(server *ServerThread, message string) {
+	p := ph.newBroadcast(&protocol.TextBroadcast{Cmd: commands.SHUTDOWN, Message: []byte(message)})
+	ph.broadcastPacket(server, p)
+}
+
+// DisconnectAll closes the connections of all clients
+func (ph *PacketHandler) DisconnectAll(server *ServerThread) {
+	for _, cl := range ph.clients.GetList() {
+		server.Disconnect(cl.socket)
+	}
+}
+
+func (ph *PacketHandler) sendPatchData(server *ServerThread, socket net.Conn, chunk int) {
+	p := ph.newBroadcast(&protocol.PatchDataBroadcast{Chunk: chunk, Data: ph.patch.GetData(chunk)})
+	ph.addOutPacket(server, socket, p)
+}
+
+// sendPatchLineCheck asks the client to confirm all chunks up to chunk
+func (ph *PacketHandler) sendPatchLineCheck(server *ServerThread, socket net.Conn, chunk int) {
+	q := &protocol.NumberQuery{Cmd: commands.PATCHLINECHECK, Number: chunk}
+	ph.addOutPacket(server, socket, NewMessagePacket(commands.QUERY, commands.SERVER, ph.getNextPacketID(), q))
+}
+
+func (ph *PacketHandler) beginPatch(server *ServerThread, socket net.Conn) {
+	// notify about the patch
+	ph.addOutPacket(server, socket, ph.newBroadcast(ph.patch.GetStart()))
+
+	// send the first line of chunks
+	ph.sendPatchLines(server, socket, 0)
+}
+
+// continuePatch resumes after the last chunk the client confirmed
+func (ph *PacketHandler) continuePatch(server *ServerThread, socket net.Conn, ps *Packet) {
+	q := &protocol.NumberTell{Cmd: commands.PATCHLINECHECK}
+	if ph.patch == nil || !ph.decode(server, socket, ps, q) {
+		return
+	}
+	ph.sendPatchLines(server, socket, q.Number+1)
+}
+
+func (ph *PacketHandler) sendPatchLines(server *ServerThread, socket net.Conn, chunk int) {
+	cnt := ph.patch.CntChunks(chunk)
+	for t := 0; t < cnt; t++ {
+		ph.sendPatchData(server, socket, chunk+t)
+	}
+
+	if cnt != PATCH_LINE {
+		// this is the end of the patching
+		ph.addOutPacket(server, socket, NewPacketWithoutPayload(commands.PATCHFOOTER, commands.BROADCAST, commands.SERVER, ph.getNextPacketID()))
+		ph.addOutPacket(server, socket, NewPacketWithoutPayload(commands.PATCHFINISH, commands.QUERY, commands.SERVER, ph.getNextPacketID()))
+	} else {
+		ph.sendPatchLineCheck(server, socket, chunk+PATCH_LINE-1)
+	}
 }
 
 func (ph *PacketHandler) sendIDHNPairs(server *ServerThread, socket net.Conn) {
@@ -496,7 +639,7 @@ func (ph *PacketHandler) sendIDHNPairs(server *ServerThread, socket net.Conn) {
 
 	ph.debug("Sending HNPairs: %v\n", hn)
 
-	pk := NewPacket(commands.IDHNPAIRS, commands.BROADCAST, commands.SERVER, ph.getNextPacketID(), hn.GetArray())
+	pk := ph.newBroadcast(&protocol.IDHNPairsBroadcast{Pairs: hn.GetPairs()})
 	ph.addOutPacket(server, socket, pk)
 
 }
@@ -504,10 +647,14 @@ func (ph *PacketHandler) sendIDHNPairs(server *ServerThread, socket net.Conn) {
 func (ph *PacketHandler) sendHNSelect(server *ServerThread, socket net.Conn, ps *Packet) {
 	//TODO: optimize FindClient[...] calls; can we just pass in a client or no?
 	var p *Packet
-	chosen := make([]byte, 8)
-	hn := ps.GetDecryptedHNPair()
+	q := &protocol.HNSelectQuery{}
+	if !ph.decode(server, socket, ps, q) {
+		return
+	}
+	hn := NewHNPairFromBytes(q.Handle, q.Nickname)
 
-	ph.clients.FindClientBySocket(socket).hnPair = hn
+	ph.clients.SetHNPair(ph.clients.FindClientBySocket(socket), hn)
+	ph.clients.FindClientBySocket(socket).state = STATE_HANDLE
 
 	if string(hn.handle) == "******" {
 		hn.CreateHandle(ph.db)
@@ -518,18 +665,12 @@ func (ph *PacketHandler) sendHNSelect(server *ServerThread, socket net.Conn, ps
 	ph.db.UpdateHNPair(ph.clients.FindClientBySocket(socket))
 
 	//send chosen handle as answer
-
-	chosen[0] = 0
-	chosen[1] = 6
-
-	copy(chosen[2:8], hn.handle[:6])
-	p = NewPacket(commands.HNSELECT, commands.TELL, commands.SERVER, ps.pid, chosen)
-	ph.addOutPacket(server, socket, p)
+	ph.tell(server, socket, ps, &protocol.HNSelectTell{Handle: hn.handle})
 
 	userid := ph.clients.FindClientBySocket(socket).userID
 	gamenr, err := ph.db.GetGameNumber(userid)
 	if err != nil {
-		ph.debug("Error getting game number for userid %s: %v\n", userid, err)
+		ph.log.Error("getting game number", "userid", userid, "err", err)
 	}
 
 	// ask for info if user is coming from a game
@@ -548,40 +689,42 @@ func (ph *PacketHandler) sendMotheday(server *ServerThread, socket net.Conn, p *
 	message, err := ph.db.GetMOTD()
 	if err != nil {
 		message = "error getting motd..."
-		ph.debug("Failed to get MOTD: %v\n", err)
+		ph.log.Error("getting MOTD", "err", err)
 	}
-	// TODO note to self: ip.addr == 192.168.1.135 and not ssh and data.data contains 61:4C
 	// should be 1 byte number (1 apparently), 2 byte length (only of motd apparently), then motd
+	if ph.maintenance != "" {
+		message = ph.maintenance + "<BR><BODY>" + message
+	}
 	message = fmt.Sprintf("<LF=6><BODY><CENTER>%s<END>", message)
 	ph.debug("sending MOTD message: %s\n", message)
 	motd := NewMOTD(1, message)
-	motdp := NewPacket(commands.MOTHEDAY, commands.TELL, commands.SERVER, p.pid, motd.GetPacket())
-	ph.addOutPacket(server, socket, motdp)
+	ph.tell(server, socket, p, motd.GetPacket())
 }
 
 func (ph *PacketHandler) sendCharSelect(server *ServerThread, socket net.Conn, p *Packet) {
+	q := &protocol.CharSelectQuery{}
+	if !ph.decode(server, socket, p, q) {
+		return
+	}
 	cl := ph.clients.FindClientBySocket(socket)
-	cl.SetCharacterStats(p.GetCharacterStats())
+	cl.SetCharacterStats(q.Stats)
+	cl.state = STATE_CHARACTER
 
 	outp := NewPacketWithoutPayload(commands.CHARSELECT, commands.TELL, commands.SERVER, p.pid)
 	ph.addOutPacket(server, socket, outp)
 }
 
 func (ph *PacketHandler) send6881(server *ServerThread, socket net.Conn, p *Packet) {
-	datacount := []byte{0x01, 0, 0, 0x12, 0x5D}
-
-	outp := NewPacket(commands.UNKN6881, commands.TELL, commands.SERVER, p.pid, datacount)
-	ph.addOutPacket(server, socket, outp)
+	ph.tell(server, socket, p, &protocol.Unkn6881Tell{Sizes: ph.variant.Get6881Sizes()})
 }
 
 func (ph *PacketHandler) send6882(server *ServerThread, socket net.Conn, p *Packet) {
-	pl := p.pay // []byte containing the packet payload
-	nr := int(pl[0])
-	offset := int(pl[1])<<24 | int(pl[2])<<16 | int(pl[3])<<8 | int(pl[4])
-	sizeL := int(pl[5])<<24 | int(pl[6])<<16 | int(pl[7])<<8 | int(pl[8])
-	data := Packet6881GetData(nr, offset, sizeL)
-	outp := NewPacket(commands.UNKN6882, commands.TELL, commands.SERVER, p.pid, data)
-	ph.addOutPacket(server, socket, outp)
+	q := &protocol.Unkn6882Query{}
+	if !ph.decode(server, socket, p, q) {
+		return
+	}
+	data := Packet6881GetData(ph.variant.data6881, int(q.Number), int(q.Offset), int(q.Size))
+	ph.tell(server, socket, p, &protocol.Raw{Cmd: commands.UNKN6882, Data: data})
 }
 
 // sendRankings requests player rankings per area.
@@ -590,284 +733,222 @@ func (ph *PacketHandler) send6882(server *ServerThread, socket net.Conn, p *Pack
 // areanumber, x1, x2, x3, x4, points rank 7204th, cleartime rank 16998th, 13500 points, x8, x9, x10
 // status(1 alive), character, sizeid, id, size handle, handle
 func (ph *PacketHandler) sendRankings(server *ServerThread, socket net.Conn, ps *Packet) {
-	emptyRankings := []byte{
-		0x00, 0x00,
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
-		0x00, 0x00, 0x00, 0x06, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20,
-		0x00, 0x10, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20,
-		0x00, 0x00, 0x00, 0x06, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20,
-		0x00, 0x10, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20,
-		0x00, 0x00, 0x00, 0x06, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20,
-		0x00, 0x10, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20,
-		0x00, 0x00, 0x00, 0x06, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20,
-		0x00, 0x10, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20,
-		0x00, 0x00, 0x00, 0x06, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20,
-		0x00, 0x10, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20,
-	}
-
 	// ranking for which area is requested
-	emptyRankings[0] = ps.pay[0]
-	emptyRankings[1] = ps.pay[1]
-
-	// Create a byte slice of fixed size: 2+8+1+7*4+6*(1+1+2+6+2+16) = 207 bytes.
-	buf := make([]byte, 207)
-	r := bytes.NewBuffer(buf[:0]) // empty buffer with capacity 207
-
-	// Write values using big-endian order:
-	// Write short: scenario from ps.Payload[1]
-	if err := binary.Write(r, binary.BigEndian, uint16(ps.pay[1])); err != nil {
-		log.Printf("binary.Write error: %v", err)
-	}
-	// Write int: 111*100
-	binary.Write(r, binary.BigEndian, int32(111*100))
-	// Write int: ps.Payload[1] as int32
-	binary.Write(r, binary.BigEndian, int32(ps.pay[1]))
-	// Write byte: 0
-	r.WriteByte(0)
-	// Write int: 310*10
-	binary.Write(r, binary.BigEndian, int32(310*10))
-	// Write int: 320*10
-	binary.Write(r, binary.BigEndian, int32(320*10))
-	// Write int: 330*100 (rank cleartime)
-	binary.Write(r, binary.BigEndian, int32(330*100))
-	// Write int: 340*100
-	binary.Write(r, binary.BigEndian, int32(340*100))
-	// Write int: 350
-	binary.Write(r, binary.BigEndian, int32(350))
-	// Write int: 360*100
-	binary.Write(r, binary.BigEndian, int32(360*100))
-	// Write int: 370
-	binary.Write(r, binary.BigEndian, int32(370))
-
-	// For each of the 6 ranking entries:
+	q := &protocol.NumberQuery{Cmd: commands.RANKINGS}
+	if !ph.decode(server, socket, ps, q) {
+		return
+	}
+	scenario := q.Number & 0xff
+
+	rankings := &protocol.RankingsTell{
+		Scenario: scenario,
+		Points:   111 * 100,
+		Unknown:  uint32(scenario),
+		Flag:     0,
+		// 330*100 is the rank cleartime
+		Ranks: [7]uint32{310 * 10, 320 * 10, 330 * 100, 340 * 100, 350, 360 * 100, 370},
+	}
 	for t := 0; t < 6; t++ {
-		r.WriteByte(1)                                // status: 1 = alive
-		r.WriteByte(byte(t))                          // character
-		binary.Write(r, binary.BigEndian, uint16(6))  // handle length: 6
-		r.Write([]byte("HANDLE"))                     // handle (6 bytes)
-		binary.Write(r, binary.BigEndian, uint16(16)) // fixed, rest is spaced 0x20
-		r.WriteByte(byte(0x41 + t))                   // 1st byte of name to mark
-		r.Write([]byte("- RANKTEST     "))            // name (assumed to be 16 bytes)
+		rankings.Entries = append(rankings.Entries, protocol.RankingEntry{
+			Status:    1, // alive
+			Character: byte(t),
+			Handle:    []byte("HANDLE"),
+			// 1st byte of name to mark, rest is spaced 0x20
+			Name: append([]byte{byte(0x41 + t)}, "- RANKTEST     "...),
+		})
 	}
 
 	// Looks like first half = ranking with resultpoints
 	// second half = ranking with cleartimepoints
-	emptyRankings = r.Bytes()
-
-	p := NewPacket(commands.RANKINGS, commands.TELL, commands.SERVER, ps.pid, emptyRankings)
-	ph.addOutPacket(server, socket, p)
+	ph.tell(server, socket, ps, rankings)
+}
+
+// handlePostGameInfo logs the statistics a player brought back from a game.
+// Nothing is ranked on them: only the layout up to the co-players is known,
+// status, points and clear time are somewhere in the rest, which is logged
+// raw until their offsets are read off a captured packet.
+func (ph *PacketHandler) handlePostGameInfo(server *ServerThread, socket net.Conn, ps *Packet) {
+	// a packet we can't read is logged instead of disconnecting the player
+	t := &protocol.PostGameInfoTell{}
+	if err := ps.Decode(t); err != nil {
+		ph.log.Warn("unreadable POSTGAMEINFO", "err", err)
+		return
+	}
+	cl := ph.clients.FindClientBySocket(socket)
+	ph.log.Info("game result not stored", "user", cl.userID, "game", string(t.Session), "rest", fmt.Sprintf("%x", t.Rest))
 }
 
 func (ph *PacketHandler) sendAreaCount(server *ServerThread, socket net.Conn, ps *Packet) {
-	areacount := []byte{0, 10}
-
-	areacount[0] = byte((ph.areas.GetAreaCount() >> 8) & 0xFF)
-	areacount[1] = byte((ph.areas.GetAreaCount()) & 0xFF)
-
-	outp := NewPacket(commands.AREACOUNT, commands.TELL, commands.SERVER, ps.pid, areacount)
-	ph.addOutPacket(server, socket, outp)
+	ph.tell(server, socket, ps, &protocol.NumberTell{Cmd: commands.AREACOUNT, Number: ph.areas.GetAreaCount()})
 }
 
 func (ph *PacketHandler) sendAreaPlayerCnt(server *ServerThread, socket net.Conn, ps *Packet) {
-	// 0,0; 0,0; 0xff, 0xff; 0,0
-	areaplayercount := []byte{0, 0, 0, 0, 0, 0, 0xff, 0xff, 0, 0}
-	nr := ps.GetNumber()
+	q := &protocol.NumberQuery{Cmd: commands.AREAPLAYERCNT}
+	if !ph.decode(server, socket, ps, q) {
+		return
+	}
+	nr := q.Number
 	cnt := ph.clients.CountPlayersInArea(nr)
 
-	areaplayercount[0] = byte(nr>>8) & 0xff
-	areaplayercount[1] = byte(nr) & 0xff
-	areaplayercount[2] = byte(cnt[0]>>8) & 0xff
-	areaplayercount[3] = byte(cnt[0]) & 0xff
-	areaplayercount[4] = byte(cnt[1]>>8) & 0xff
-	areaplayercount[5] = byte(cnt[1]) & 0xff
-	areaplayercount[8] = byte(cnt[2]>>8) & 0xff
-	areaplayercount[9] = byte(cnt[2]) & 0xff
-
-	p := NewPacket(commands.AREAPLAYERCNT, commands.TELL, commands.SERVER, ps.pid, areaplayercount)
-	ph.addOutPacket(server, socket, p)
+	ph.tell(server, socket, ps, &protocol.PlayerCountTell{
+		Cmd:    commands.AREAPLAYERCNT,
+		Number: nr,
+		Count:  cnt[0],
+		Count2: cnt[1],
+		Count3: cnt[2],
+	})
 }
 
 func (ph *PacketHandler) sendAreaStatus(server *ServerThread, socket net.Conn, ps *Packet) {
-	// 0,0; 0;
-	areastatus := []byte{0, 0, 0}
-	nr := ps.GetNumber()
-
-	areastatus[0] = byte(nr>>8) & 0xff
-	areastatus[1] = byte(nr) & 0xff
-	areastatus[2] = ph.areas.GetStatus(nr)
-
-	p := NewPacket(commands.AREASTATUS, commands.TELL, commands.SERVER, ps.pid, areastatus)
-	ph.addOutPacket(server, socket, p)
+	q := &protocol.NumberQuery{Cmd: commands.AREASTATUS}
+	if !ph.decode(server, socket, ps, q) {
+		return
+	}
+	nr := q.Number
+	ph.tell(server, socket, ps, &protocol.StatusTell{Cmd: commands.AREASTATUS, Number: nr, Status: ph.areas.GetStatus(nr)})
 }
 
 func (ph *PacketHandler) sendAreaSelect(server *ServerThread, socket net.Conn, ps *Packet) {
-	retval := []byte{0, 0}
-	nr := ps.GetNumber()
+	q := &protocol.NumberQuery{Cmd: commands.AREASELECT}
+	if !ph.decode(server, socket, ps, q) {
+		return
+	}
+	nr := q.Number
+	if ph.areas.GetStatus(nr) != STATUS_ACTIVE {
+		ph.tell(server, socket, ps, &protocol.ErrorTell{Cmd: commands.AREASELECT, Message: []byte("<LF=6><BODY><CENTER>area is closed<END>")})
+		return
+	}
 	cl := ph.clients.FindClientBySocket(socket)
-	cl.area = nr
+	ph.clients.Move(cl, nr, cl.room, cl.slot)
+	cl.state = STATE_AREA
 	ph.db.UpdateClientOrigin(cl.userID, STATUS_LOBBY, nr, 0, 0)
-	retval[0] = byte(nr>>8) & 0xff
-	retval[1] = byte(nr) & 0xff
 
-	p := NewPacket(commands.AREASELECT, commands.TELL, commands.SERVER, ps.pid, retval)
-	ph.addOutPacket(server, socket, p)
+	ph.tell(server, socket, ps, &protocol.NumberTell{Cmd: commands.AREASELECT, Number: nr})
 
 	ph.broadcastAreaPlayerCnt(server, socket, nr)
 }
 
 func (ph *PacketHandler) sendAreaName(server *ServerThread, socket net.Conn, ps *Packet) {
-	nr := ps.GetNumber()
+	q := &protocol.NumberQuery{Cmd: commands.AREANAME}
+	if !ph.decode(server, socket, ps, q) {
+		return
+	}
+	nr := q.Number
 	name := ph.areas.GetName(nr)
-	ph.debug("\n\n\n\n\nRequested area name for area %d: %s\n\n\n\n\n", nr, name)
-	namebytes := make([]byte, len(name)+4)
-	namebytes[0] = byte(nr>>8) & 0xff
-	namebytes[1] = byte(nr) & 0xff
-	namebytes[2] = byte(len(name)>>8) & 0xff
-	namebytes[3] = byte(len(name)) & 0xff
-	copy(namebytes[4:], []byte(name))
-	p := NewPacket(commands.AREANAME, commands.TELL, commands.SERVER, ps.pid, namebytes)
-	ph.addOutPacket(server, socket, p)
+	ph.debug("Requested area name for area %d: %s\n", nr, name)
+	ph.tell(server, socket, ps, &protocol.NameTell{Cmd: commands.AREANAME, Number: nr, Name: []byte(name)})
 }
 
 func (ph *PacketHandler) sendAreaDescript(server *ServerThread, socket net.Conn, ps *Packet) {
-	nr := ps.GetNumber()
+	q := &protocol.NumberQuery{Cmd: commands.AREADESCRIPT}
+	if !ph.decode(server, socket, ps, q) {
+		return
+	}
+	nr := q.Number
 	desc := ph.areas.GetDescription(nr)
-	descbytes := make([]byte, len(desc)+4)
-	descbytes[0] = byte(nr>>8) & 0xff
-	descbytes[1] = byte(nr) & 0xff
-	descbytes[2] = byte(len(desc)>>8) & 0xff
-	descbytes[3] = byte(len(desc)) & 0xff
-	copy(descbytes[4:], []byte(desc))
-	p := NewPacket(commands.AREADESCRIPT, commands.TELL, commands.SERVER, ps.pid, descbytes)
-	ph.addOutPacket(server, socket, p)
+	ph.tell(server, socket, ps, &protocol.NameTell{Cmd: commands.AREADESCRIPT, Number: nr, Name: []byte(desc)})
 }
 
 func (ph *PacketHandler) sendRoomPlayerCnt(server *ServerThread, socket net.Conn, ps *Packet) {
-	// 0x00,0x01; 0x00,0x00; 0x00,0x03; 0xff,0xff; 0,0
+	q := &protocol.NumberQuery{Cmd: commands.ROOMPLAYERCNT}
+	if !ph.decode(server, socket, ps, q) {
+		return
+	}
 	area := ph.clients.FindClientBySocket(socket).area
-	room := ps.GetNumber()
-	roomplayercount := []byte{0x00, 0x01, 0x00, 0x00, 0x00, 0x03, 0xff, 0xff, 0, 0}
-	roomplayercount[0] = byte(room>>8) & 0xff
-	roomplayercount[1] = byte(room) & 0xff
-	cnt := ph.clients.CountPlayersInRoom(area, room)
-	roomplayercount[2] = byte(cnt>>8) & 0xff
-	roomplayercount[3] = byte(cnt) & 0xff
-	cnt = ph.gameServerPacketHandler.CountInGamePlayers() + ph.clients.CountPlayersInRoom(51, 0)
-	roomplayercount[4] = byte(cnt>>8) & 0xff
-	roomplayercount[5] = byte(cnt) & 0xff
-	p := NewPacket(commands.ROOMPLAYERCNT, commands.TELL, commands.SERVER, ps.pid, roomplayercount)
-	ph.addOutPacket(server, socket, p)
+	ph.tell(server, socket, ps, ph.roomPlayerCnt(area, q.Number))
+}
+
+// roomPlayerCnt counts the players in a room, the second counter are all
+// players in games and after game lobbies
+func (ph *PacketHandler) roomPlayerCnt(area, room int) *protocol.PlayerCountTell {
+	return &protocol.PlayerCountTell{
+		Cmd:    commands.ROOMPLAYERCNT,
+		Number: room,
+		Count:  ph.clients.CountPlayersInRoom(area, room),
+		Count2: ph.relays.CountPlayers() + ph.clients.CountPlayersInAgl(),
+	}
 }
 
 func (ph *PacketHandler) sendRoomStatus(server *ServerThread, socket net.Conn, ps *Packet) {
-	// 0x00,0x00; 0x00
-	retval := []byte{0x00, 0x00, 0x00}
-	roomnr := ps.GetNumber()
+	q := &protocol.NumberQuery{Cmd: commands.ROOMSTATUS}
+	if !ph.decode(server, socket, ps, q) {
+		return
+	}
+	roomnr := q.Number
 	area := ph.clients.FindClientBySocket(socket).area
-	retval[0] = byte(roomnr>>8) & 0xff
-	retval[1] = byte(roomnr) & 0xff
-	retval[2] = ph.rooms.GetStatus(area, roomnr)
-	p := NewPacket(commands.ROOMSTATUS, commands.TELL, commands.SERVER, ps.pid, retval)
-	ph.addOutPacket(server, socket, p)
+	ph.tell(server, socket, ps, &protocol.StatusTell{Cmd: commands.ROOMSTATUS, Number: roomnr, Status: ph.rooms.GetStatus(area, roomnr)})
 }
 
 func (ph *PacketHandler) sendRoomName(server *ServerThread, socket net.Conn, ps *Packet) {
-	roomnr := ps.GetNumber()
+	q := &protocol.NumberQuery{Cmd: commands.ROOMNAME}
+	if !ph.decode(server, socket, ps, q) {
+		return
+	}
+	roomnr := q.Number
 	area := ph.clients.FindClientBySocket(socket).area
 	name := ph.rooms.GetName(area, roomnr)
-	namebytes := make([]byte, len(name)+4)
-	namebytes[0] = byte(roomnr>>8) & 0xff
-	namebytes[1] = byte(roomnr) & 0xff
-	namebytes[2] = byte(len(name)>>8) & 0xff
-	namebytes[3] = byte(len(name)) & 0xff
-	copy(namebytes[4:], []byte(name))
-	p := NewPacket(commands.ROOMNAME, commands.TELL, commands.SERVER, ps.pid, namebytes)
-	ph.addOutPacket(server, socket, p)
+	ph.tell(server, socket, ps, &protocol.NameTell{Cmd: commands.ROOMNAME, Number: roomnr, Name: []byte(name)})
 }
 
 func (ph *PacketHandler) send6308(server *ServerThread, socket net.Conn, ps *Packet) {
-	// 0x00,0x01; 0x00,0x02; 0x81,0x40
-	retval := []byte{0x00, 0x01, 0x00, 0x02, 0x81, 0x40}
-	retval[0] = ps.pay[0]
-	retval[1] = ps.pay[1]
-	p := NewPacket(commands.UNKN6308, commands.TELL, commands.SERVER, ps.pid, retval)
-	ph.addOutPacket(server, socket, p)
+	q := &protocol.NumberQuery{Cmd: commands.UNKN6308}
+	if !ph.decode(server, socket, ps, q) {
+		return
+	}
+	ph.tell(server, socket, ps, &protocol.Unkn6308Tell{Number: q.Number, Data: ph.variant.unkn6308})
 }
 
 func (ph *PacketHandler) sendRoomsCount(server *ServerThread, socket net.Conn, ps *Packet) {
-	countbytes := []byte{0, 0}
-	count := ph.rooms.GetRoomCount()
-
-	countbytes[0] = byte(count>>8) & 0xff
-	countbytes[1] = byte(count) & 0xff
-
-	p := NewPacket(commands.ROOMSCOUNT, commands.TELL, commands.SERVER, ps.pid, countbytes)
-	ph.addOutPacket(server, socket, p)
+	ph.tell(server, socket, ps, &protocol.NumberTell{Cmd: commands.ROOMSCOUNT, Number: ph.rooms.GetRoomCount()})
 }
 
 func (ph *PacketHandler) sendEnterRoom(server *ServerThread, socket net.Conn, ps *Packet) {
-	// 0x00,0x00
-	retval := []byte{0, 0}
-	roomnr := ps.GetNumber()
+	q := &protocol.NumberQuery{Cmd: commands.ENTERROOM}
+	if !ph.decode(server, socket, ps, q) {
+		return
+	}
+	roomnr := q.Number
 	cl := ph.clients.FindClientBySocket(socket)
 	area := cl.area
-	cl.room = roomnr
+	if ph.rooms.GetStatus(area, roomnr) != STATUS_ACTIVE {
+		ph.tell(server, socket, ps, &protocol.ErrorTell{Cmd: commands.ENTERROOM, Message: []byte("<LF=6><BODY><CENTER>room is closed<END>")})
+		return
+	}
+	ph.clients.Move(cl, area, roomnr, cl.slot)
+	cl.state = STATE_ROOM
 	ph.db.UpdateClientOrigin(cl.userID, STATUS_LOBBY, area, roomnr, 0)
-	ph.debug("\nentering area %d room %d\n\n", area, roomnr)
-	retval[0] = byte(roomnr>>8) & 0xff
-	retval[1] = byte(roomnr) & 0xff
-	p := NewPacket(commands.ENTERROOM, commands.TELL, commands.SERVER, ps.pid, retval)
-	ph.addOutPacket(server, socket, p)
+	ph.debug("entering area %d room %d\n", area, roomnr)
+	ph.tell(server, socket, ps, &protocol.NumberTell{Cmd: commands.ENTERROOM, Number: roomnr})
 	ph.broadcastRoomPlayerCnt(server, area, roomnr)
 }
 
 // this is closer to how the java code does the bytebuffer stuff
 // TODO: maybe look at replacing other areas of the go code with this strategy
 func (ph *PacketHandler) broadcastChatOut(server *ServerThread, socket net.Conn, ps *Packet) {
-    cl := ph.clients.FindClientBySocket(socket)
-    area := cl.area
-    room := cl.room
-    slot := cl.slot
-
-    var broadcast bytes.Buffer
-
-    // who is sending the message
-	broadcast.Write(cl.hnPair.GetHNPair())
-
-    // copy message and save to database
-    mess := ps.GetChatOutData()
-
-    binary.Write(&broadcast, binary.BigEndian, int16(len(mess)))
-    broadcast.Write(mess)
-    broadcast.WriteByte(0)
-    binary.Write(&broadcast, binary.BigEndian, int32(0x000000ff))
-
-    r := broadcast.Bytes()
+	q := &protocol.SecretQuery{Cmd: commands.CHATIN}
+	if !ph.decode(server, socket, ps, q) {
+		return
+	}
+	cl := ph.clients.FindClientBySocket(socket)
+	area := cl.area
+	room := cl.room
+	slot := cl.slot
 
-	p := NewPacket(commands.CHATOUT, commands.BROADCAST, commands.SERVER, ph.getNextPacketID(), r)
+	// who is sending the message
+	chat := &protocol.ChatOutBroadcast{Sender: cl.hnPair.GetHNPair(), Message: q.Text}
+	p := ph.newBroadcast(chat)
 
-    if slot > 0 {
-        ph.broadcastInSlot(server, p, area, room, slot)
-    } else if area != 0 && area != 51 {
-        ph.broadcastInArea(server, p, area)
-    } else if cl.GameNumber > 0 {
-        ph.broadcastInAgl(server, p, cl.GameNumber)
-    }
+	if slot > 0 {
+		ph.broadcastInSlot(server, p, area, room, slot)
+	} else if cl.state == STATE_AGL {
+		ph.broadcastInAgl(server, p, cl.GameNumber)
+	} else if area != 0 {
+		ph.broadcastInArea(server, p, area)
+	}
 }
 
 func (ph *PacketHandler) broadcastRoomPlayerCnt(server *ServerThread, area, room int) {
-	// 0x00,0x01; 0x00,0x00; 0x00,0x03; 0xff,0xff; 0,0
-	roomplayercount := []byte{0x00, 0x01, 0x00, 0x00, 0x00, 0x03, 0xff, 0xff, 0, 0}
-	roomplayercount[0] = byte(room>>8) & 0xff
-	roomplayercount[1] = byte(room) & 0xff
-	cnt := ph.clients.CountPlayersInRoom(area, room)
-	roomplayercount[2] = byte(cnt>>8) & 0xff
-	roomplayercount[3] = byte(cnt) & 0xff
-	cnt = ph.gameServerPacketHandler.CountInGamePlayers() + ph.clients.CountPlayersInRoom(51, 0)
-	roomplayercount[4] = byte(cnt>>8) & 0xff
-	roomplayercount[5] = byte(cnt) & 0xff
-	p := NewPacket(commands.ROOMPLAYERCNT, commands.BROADCAST, commands.SERVER, ph.getNextPacketID(), roomplayercount)
+	p := ph.newBroadcast(ph.roomPlayerCnt(area, room))
 	ph.broadcastInArea(server, p, area)
 }
 
@@ -881,142 +962,141 @@ func (ph *PacketHandler) broadcastInArea(server *ServerThread, p *Packet, area i
 }
 
 func (ph *PacketHandler) sendSlotCount(server *ServerThread, socket net.Conn, ps *Packet) {
-	// 0,0
-	slotcount := []byte{0, 0}
-	cnt := ph.slots.GetSlotCount()
-	slotcount[0] = byte(cnt>>8) & 0xff
-	slotcount[1] = byte(cnt) & 0xff
-	p := NewPacket(commands.SLOTCOUNT, commands.TELL, commands.SERVER, ps.pid, slotcount)
-	ph.addOutPacket(server, socket, p)
+	ph.tell(server, socket, ps, &protocol.NumberTell{Cmd: commands.SLOTCOUNT, Number: ph.slots.GetSlotCount()})
 }
 
 func (ph *PacketHandler) sendSlotPlayerStatus(server *ServerThread, socket net.Conn, ps *Packet) {
-	//0x00,0x00; 0x00,0x00; 0x00,0x00; 0x00,0x00, 0x00,0x00
-	retval := []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	q := &protocol.NumberQuery{Cmd: commands.SLOTPLRSTATUS}
+	if !ph.decode(server, socket, ps, q) {
+		return
+	}
 	cl := ph.clients.FindClientBySocket(socket)
-	area := cl.area
-	room := cl.room
-	slotnr := ps.GetNumber()
-	retval[0] = byte(slotnr>>8) & 0xff
-	retval[1] = byte(slotnr) & 0xff
-	retval[3] = byte(ph.clients.CountPlayersInSlot(area, room, slotnr))
-	retval[5] = byte(0) // TODO: what is this value?
-	retval[7] = byte(ph.slots.GetMaximumPlayers(area, room, slotnr))
-	retval[9] = retval[3] // TODO: what is playin2?
-	p := NewPacket(commands.SLOTPLRSTATUS, commands.TELL, commands.SERVER, ps.pid, retval)
-	ph.addOutPacket(server, socket, p)
+	if !ph.checkSlot(server, socket, ps, cl.area, cl.room, q.Number) {
+		return
+	}
+	ph.tell(server, socket, ps, ph.slotPlayerStatus(cl.area, cl.room, q.Number))
+}
+
+func (ph *PacketHandler) slotPlayerStatus(area, room, slotnr int) *protocol.SlotPlayerStatusTell {
+	players := int(byte(ph.clients.CountPlayersInSlot(area, room, slotnr)))
+	return &protocol.SlotPlayerStatusTell{
+		Slot:       slotnr,
+		Players:    players,
+		Unknown:    0, // TODO: what is this value?
+		MaxPlayers: int(ph.slots.GetMaximumPlayers(area, room, slotnr)),
+		Players2:   players, // TODO: what is playin2?
+	}
 }
 
 func (ph *PacketHandler) sendSlotTitle(server *ServerThread, socket net.Conn, ps *Packet) {
-	slotnr := ps.GetNumber()
+	q := &protocol.NumberQuery{Cmd: commands.SLOTTITLE}
+	if !ph.decode(server, socket, ps, q) {
+		return
+	}
+	slotnr := q.Number
 	cl := ph.clients.FindClientBySocket(socket)
 	area := cl.area
 	room := cl.room
+	if !ph.checkSlot(server, socket, ps, area, room, slotnr) {
+		return
+	}
 
 	var slotname []byte
 	// character test slot. maybe remove? not sure TODO
-	if area == 0x002 && room == 0x001 && slotnr == 0x003 {
+	if ph.variant.testSlot && area == 0x002 && room == 0x001 && slotnr == 0x003 {
 		slotname = []byte("Testgame")
 	} else {
 		slotname = ph.slots.GetName(area, room, slotnr)
 	}
 
-	slotnamebytes := make([]byte, len(slotname)+4)
-	slotnamebytes[0] = byte(slotnr>>8) & 0xff
-	slotnamebytes[1] = byte(slotnr) & 0xff
-	slotnamebytes[2] = byte(len(slotname)>>8) & 0xff
-	slotnamebytes[3] = byte(len(slotname)) & 0xff
-	copy(slotnamebytes[4:], []byte(slotname))
-	p := NewPacket(commands.SLOTTITLE, commands.TELL, commands.SERVER, ps.pid, slotnamebytes)
-	ph.addOutPacket(server, socket, p)
+	ph.tell(server, socket, ps, &protocol.NameTell{Cmd: commands.SLOTTITLE, Number: slotnr, Name: slotname})
 }
 
 func (ph *PacketHandler) sendSlotAttrib2(server *ServerThread, socket net.Conn, ps *Packet) {
-	retval := []byte{
-		0, 1, // slot nr
-		0, 4, // max players for slot
-		0, 4,
-		0, 1,
-		0, 4,
-		0, 1,
-	}
-	slotnr := ps.GetNumber()
+	q := &protocol.NumberQuery{Cmd: commands.SLOTATTRIB2}
+	if !ph.decode(server, socket, ps, q) {
+		return
+	}
 	cl := ph.clients.FindClientBySocket(socket)
-	area := cl.area
-	room := cl.room
-	retval[0] = byte(slotnr>>8) & 0xff
-	retval[1] = byte(slotnr) & 0xff
-	retval[3] = ph.slots.GetMaximumPlayers(area, room, slotnr)
+	if !ph.checkSlot(server, socket, ps, cl.area, cl.room, q.Number) {
+		return
+	}
+	ph.tell(server, socket, ps, ph.slotAttrib2(cl.area, cl.room, q.Number))
+}
+
+func (ph *PacketHandler) slotAttrib2(area, room, slotnr int) *protocol.SlotAttrib2Tell {
 	// TODO: what do these attributes mean? extend slots get/set with those
-	p := NewPacket(commands.SLOTATTRIB2, commands.TELL, commands.SERVER, ps.pid, retval)
-	ph.addOutPacket(server, socket, p)
+	return &protocol.SlotAttrib2Tell{
+		Slot:       slotnr,
+		MaxPlayers: int(ph.slots.GetMaximumPlayers(area, room, slotnr)),
+		Unknown:    protocol.DefaultSlotAttrib2,
+	}
 }
 
 func (ph *PacketHandler) broadcastSlotAttrib2(server *ServerThread, area, room, slotnr int) {
-	retval := []byte{
-		0, 1, // slot nr
-		0, 4, // max players for slot
-		0, 4,
-		0, 1,
-		0, 4,
-		0, 1,
-	}
-	retval[0] = byte(slotnr>>8) & 0xff
-	retval[1] = byte(slotnr) & 0xff
-	retval[3] = ph.slots.GetMaximumPlayers(area, room, slotnr)
-	// TODO: what do these attributes mean? extend slots get/set with those
-	p := NewPacket(commands.SLOTATTRIB2, commands.TELL, commands.SERVER, ph.getNextPacketID(), retval)
+	p := NewMessagePacket(commands.TELL, commands.SERVER, ph.getNextPacketID(), ph.slotAttrib2(area, room, slotnr))
 	ph.broadcastInSlotNRoom(server, p, area, room, slotnr)
 }
 
 func (ph *PacketHandler) sendPasswdProtect(server *ServerThread, socket net.Conn, ps *Packet) {
-	//0,1; 0
-	retval := []byte{0, 1, 0}
-	slotnr := ps.GetNumber()
+	q := &protocol.NumberQuery{Cmd: commands.SLOTPWDPROT}
+	if !ph.decode(server, socket, ps, q) {
+		return
+	}
+	slotnr := q.Number
 	cl := ph.clients.FindClientBySocket(socket)
-	area := cl.area
-	room := cl.room
-	retval[0] = byte(slotnr>>8) & 0xff
-	retval[1] = byte(slotnr) & 0xff
-	retval[2] = ph.slots.GetProtection(area, room, slotnr)
-	p := NewPacket(commands.SLOTPWDPROT, commands.TELL, commands.SERVER, ps.pid, retval)
-	ph.addOutPacket(server, socket, p)
+	if !ph.checkSlot(server, socket, ps, cl.area, cl.room, slotnr) {
+		return
+	}
+	protection := ph.slots.GetProtection(cl.area, cl.room, slotnr)
+	ph.tell(server, socket, ps, &protocol.StatusTell{Cmd: commands.SLOTPWDPROT, Number: slotnr, Status: protection})
 }
 
 func (ph *PacketHandler) sendSlotSceneType(server *ServerThread, socket net.Conn, ps *Packet) {
-	// 0,0; 0,0; 0,0
-	retval := []byte{0, 0, 0, 0, 0, 0}
-	slotnr := ps.GetNumber()
+	q := &protocol.NumberQuery{Cmd: commands.SLOTSCENTYPE}
+	if !ph.decode(server, socket, ps, q) {
+		return
+	}
 	cl := ph.clients.FindClientBySocket(socket)
-	area := cl.area
-	room := cl.room
-	retval[0] = byte(slotnr>>8) & 0xff
-	retval[1] = byte(slotnr) & 0xff
-	retval[3] = ph.slots.GetSlotType(area, room, slotnr)
-	retval[5] = ph.slots.GetScenario(area, room, slotnr)
-	p := NewPacket(commands.SLOTSCENTYPE, commands.TELL, commands.SERVER, ps.pid, retval)
-	ph.addOutPacket(server, socket, p)
+	if !ph.checkSlot(server, socket, ps, cl.area, cl.room, q.Number) {
+		return
+	}
+	ph.tell(server, socket, ps, ph.slotSceneType(cl.area, cl.room, q.Number))
+}
+
+func (ph *PacketHandler) slotSceneType(area, room, slotnr int) *protocol.SceneTypeTell {
+	return &protocol.SceneTypeTell{
+		Cmd:      commands.SLOTSCENTYPE,
+		Slot:     slotnr,
+		Type:     int(ph.slots.GetSlotType(area, room, slotnr)),
+		Scenario: int(ph.slots.GetScenario(area, room, slotnr)),
+	}
 }
 
 func (ph *PacketHandler) broadcastSlotSceneType(server *ServerThread, area, room, slotnr int) {
-	// 0,0; 0,0; 0,0
-	retval := []byte{0, 0, 0, 0, 0, 0}
-	retval[0] = byte(slotnr>>8) & 0xff
-	retval[1] = byte(slotnr) & 0xff
-	retval[3] = ph.slots.GetSlotType(area, room, slotnr)
-	retval[5] = ph.slots.GetScenario(area, room, slotnr)
-	p := NewPacket(commands.SLOTSCENTYPE, commands.TELL, commands.SERVER, ph.getNextPacketID(), retval)
+	p := NewMessagePacket(commands.TELL, commands.SERVER, ph.getNextPacketID(), ph.slotSceneType(area, room, slotnr))
 	ph.broadcastInSlotNRoom(server, p, area, room, slotnr)
 }
 
 func (ph *PacketHandler) sendCreateSlot(server *ServerThread, socket net.Conn, ps *Packet) {
+	q := &protocol.NumberQuery{Cmd: commands.CREATESLOT}
+	if !ph.decode(server, socket, ps, q) {
+		return
+	}
+	if ph.maintenanceLock {
+		ph.tell(server, socket, ps, &protocol.ErrorTell{Cmd: commands.CREATESLOT, Message: []byte("<LF=6><BODY><CENTER>no new games<BR><BODY>during maintenance<END>")})
+		return
+	}
 	cl := ph.clients.FindClientBySocket(socket)
 	area := cl.area
 	room := cl.room
-	slotnr := ps.GetNumber()
+	slotnr := q.Number
+	if !ph.checkSlot(server, socket, ps, area, room, slotnr) {
+		return
+	}
 
-	answer := []byte{0, 0}
-	cl.slot = slotnr
+	ph.clients.Move(cl, area, room, slotnr)
+	cl.state = STATE_SLOT
 	ph.db.UpdateClientOrigin(cl.userID, STATUS_LOBBY, area, room, slotnr)
 	cl.host = 1
 	cl.player = 1
@@ -1028,168 +1108,147 @@ func (ph *PacketHandler) sendCreateSlot(server *ServerThread, socket net.Conn, p
 	ph.broadcastSlotPlayerStatus(server, area, room, slotnr)
 	ph.broadcastSlotStatus(server, area, room, slotnr)
 
-	answer[1] = byte(slotnr) & 0xff
-	p := NewPacket(commands.CREATESLOT, commands.TELL, commands.SERVER, ps.pid, answer)
-	ph.addOutPacket(server, socket, p)
+	ph.tell(server, socket, ps, &protocol.NumberTell{Cmd: commands.CREATESLOT, Number: slotnr & 0xff})
 }
 
 func (ph *PacketHandler) sendRulesCount(server *ServerThread, socket net.Conn, ps *Packet) {
-	// 0
-	rulescount := []byte{0}
+	q := &protocol.NumberQuery{Cmd: commands.RULESCOUNT}
+	if !ph.decode(server, socket, ps, q) {
+		return
+	}
 	cl := ph.clients.FindClientBySocket(socket)
-	area := cl.area
-	room := cl.room
-	slotnr := ps.GetNumber()
-	rulescount[0] = byte(ph.slots.GetRulesCount(area, room, slotnr))
-	p := NewPacket(commands.RULESCOUNT, commands.TELL, commands.SERVER, ps.pid, rulescount)
-	ph.addOutPacket(server, socket, p)
+	if !ph.checkSlot(server, socket, ps, cl.area, cl.room, q.Number) {
+		return
+	}
+	count := byte(ph.slots.GetRulesCount(cl.area, cl.room, q.Number))
+	ph.tell(server, socket, ps, &protocol.ByteTell{Cmd: commands.RULESCOUNT, Value: count})
 }
 
 func (ph *PacketHandler) sendRuleAttCount(server *ServerThread, socket net.Conn, ps *Packet) {
-	// 0,0
-
-	ruleattcount := []byte{0, 0}
-	slotnr := ps.GetNumber()
+	q := &protocol.RuleQuery{Cmd: commands.RULEATTCOUNT}
+	if !ph.decode(server, socket, ps, q) {
+		return
+	}
 	cl := ph.clients.FindClientBySocket(socket)
-	area := cl.area
-	room := cl.room
-	ruleattcount[0] = ps.pay[2]
-	ruleattcount[1] = ph.slots.GetRulesAttCount(area, room, slotnr, int(ps.pay[2]))
-	p := NewPacket(commands.RULEATTCOUNT, commands.TELL, commands.SERVER, ps.pid, ruleattcount)
-	ph.addOutPacket(server, socket, p)
+	if !ph.checkRule(server, socket, ps, cl.area, cl.room, q.Slot, int(q.Rule), -1) {
+		return
+	}
+	count := ph.slots.GetRulesAttCount(cl.area, cl.room, q.Slot, int(q.Rule))
+	ph.tell(server, socket, ps, &protocol.RuleTell{Cmd: commands.RULEATTCOUNT, Rule: q.Rule, Value: count})
 }
 
 func (ph *PacketHandler) send6602(server *ServerThread, socket net.Conn, ps *Packet) {
-	//1; 0,0
-	retval := []byte{1, 0, 0}
-	nr := ps.GetNumber()
-	retval[1] = byte(nr>>8) & 0xff
-	retval[2] = byte(nr) & 0xff
-	p := NewPacket(commands.UNKN6602, commands.TELL, commands.SERVER, ps.pid, retval)
-	ph.addOutPacket(server, socket, p)
+	q := &protocol.NumberQuery{Cmd: commands.UNKN6602}
+	if !ph.decode(server, socket, ps, q) {
+		return
+	}
+	ph.tell(server, socket, ps, &protocol.Unkn66Tell{Cmd: commands.UNKN6602, Number: q.Number})
 }
 
 func (ph *PacketHandler) send6601(server *ServerThread, socket net.Conn, ps *Packet) {
-	//1; 0,0
-	retval := []byte{1, 0, 0}
-	nr := ps.GetNumber()
-	retval[1] = byte(nr>>8) & 0xff
-	retval[2] = byte(nr) & 0xff
-	p := NewPacket(commands.UNKN6601, commands.TELL, commands.SERVER, ps.pid, retval)
-	ph.addOutPacket(server, socket, p)
+	q := &protocol.NumberQuery{Cmd: commands.UNKN6601}
+	if !ph.decode(server, socket, ps, q) {
+		return
+	}
+	ph.tell(server, socket, ps, &protocol.Unkn66Tell{Cmd: commands.UNKN6601, Number: q.Number})
 }
 
 func (ph *PacketHandler) sendRuleDescript(server *ServerThread, socket net.Conn, ps *Packet) {
-	slotnr := ps.GetNumber()
+	q := &protocol.RuleQuery{Cmd: commands.RULEDESCRIPT}
+	if !ph.decode(server, socket, ps, q) {
+		return
+	}
 	cl := ph.clients.FindClientBySocket(socket)
-	area := cl.area
-	room := cl.room
-	rule := ps.pay[2]
-	rulename := ph.slots.GetRuleName(area, room, slotnr, int(rule))
-	rulenamebytes := make([]byte, len(rulename)+3)
-	rulenamebytes[0] = rule
-	rulenamebytes[1] = byte(len(rulename)>>8) & 0xff
-	rulenamebytes[2] = byte(len(rulename)) & 0xff
-	copy(rulenamebytes[3:], []byte(rulename))
-	p := NewPacket(commands.RULEDESCRIPT, commands.TELL, commands.SERVER, ps.pid, rulenamebytes)
-	ph.addOutPacket(server, socket, p)
+	if !ph.checkRule(server, socket, ps, cl.area, cl.room, q.Slot, int(q.Rule), -1) {
+		return
+	}
+	rulename := ph.slots.GetRuleName(cl.area, cl.room, q.Slot, int(q.Rule))
+	ph.tell(server, socket, ps, &protocol.RuleDescriptTell{Rule: q.Rule, Name: []byte(rulename)})
 }
 
 func (ph *PacketHandler) sendRuleValue(server *ServerThread, socket net.Conn, ps *Packet) {
-	// 0,0
-	retval := []byte{0, 0}
-	slotnr := ps.GetNumber()
+	q := &protocol.RuleQuery{Cmd: commands.RULEVALUE}
+	if !ph.decode(server, socket, ps, q) {
+		return
+	}
 	cl := ph.clients.FindClientBySocket(socket)
-	area := cl.area
-	room := cl.room
-	rule := ps.pay[2]
-	retval[0] = rule
-	retval[1] = ph.slots.GetRuleValue(area, room, slotnr, int(rule))
-	p := NewPacket(commands.RULEVALUE, commands.TELL, commands.SERVER, ps.pid, retval)
-	ph.addOutPacket(server, socket, p)
+	if !ph.checkRule(server, socket, ps, cl.area, cl.room, q.Slot, int(q.Rule), -1) {
+		return
+	}
+	value := ph.slots.GetRuleValue(cl.area, cl.room, q.Slot, int(q.Rule))
+	ph.tell(server, socket, ps, &protocol.RuleTell{Cmd: commands.RULEVALUE, Rule: q.Rule, Value: value})
 }
 
 func (ph *PacketHandler) sendRuleAttrib(server *ServerThread, socket net.Conn, ps *Packet) {
-	// 0,0
-	retval := []byte{0, 0}
-	slotnr := ps.GetNumber()
+	q := &protocol.RuleQuery{Cmd: commands.RULEATTRIB}
+	if !ph.decode(server, socket, ps, q) {
+		return
+	}
 	cl := ph.clients.FindClientBySocket(socket)
-	area := cl.area
-	room := cl.room
-	rule := ps.pay[2]
-	ruleatt := ph.slots.GetRuleAttribute(area, room, slotnr, int(rule))
-	retval[0] = rule
-	retval[1] = ruleatt
-	p := NewPacket(commands.RULEATTRIB, commands.TELL, commands.SERVER, ps.pid, retval)
-	ph.addOutPacket(server, socket, p)
+	if !ph.checkRule(server, socket, ps, cl.area, cl.room, q.Slot, int(q.Rule), -1) {
+		return
+	}
+	ruleatt := ph.slots.GetRuleAttribute(cl.area, cl.room, q.Slot, int(q.Rule))
+	ph.tell(server, socket, ps, &protocol.RuleTell{Cmd: commands.RULEATTRIB, Rule: q.Rule, Value: ruleatt})
 }
 
 func (ph *PacketHandler) sendAttrAttrib(server *ServerThread, socket net.Conn, ps *Packet) {
-	// 0,0, 0
-	retval := []byte{0, 0, 0}
-	slotnr := ps.GetNumber()
+	q := &protocol.AttrQuery{Cmd: commands.ATTRATTRIB}
+	if !ph.decode(server, socket, ps, q) {
+		return
+	}
 	cl := ph.clients.FindClientBySocket(socket)
-	area := cl.area
-	room := cl.room
-	rule := ps.pay[2]
-	attnr := ps.pay[3]
-	attr := ph.slots.GetRuleAttributeAtt(area, room, slotnr, int(rule), int(attnr))
-	retval[0] = rule
-	retval[1] = attnr
-	retval[2] = attr
-	p := NewPacket(commands.ATTRATTRIB, commands.TELL, commands.SERVER, ps.pid, retval)
-	ph.addOutPacket(server, socket, p)
+	if !ph.checkRule(server, socket, ps, cl.area, cl.room, q.Slot, int(q.Rule), int(q.Attr)) {
+		return
+	}
+	attr := ph.slots.GetRuleAttributeAtt(cl.area, cl.room, q.Slot, int(q.Rule), int(q.Attr))
+	ph.tell(server, socket, ps, &protocol.AttrAttribTell{Rule: q.Rule, Attr: q.Attr, Value: attr})
 }
 
 func (ph *PacketHandler) sendAttrDescript(server *ServerThread, socket net.Conn, ps *Packet) {
-	slotnr := ps.GetNumber()
+	q := &protocol.AttrQuery{Cmd: commands.ATTRDESCRIPT}
+	if !ph.decode(server, socket, ps, q) {
+		return
+	}
 	cl := ph.clients.FindClientBySocket(socket)
-	area := cl.area
-	room := cl.room
-	rulenr := ps.pay[2]
-	attnr := ps.pay[3]
-	attdesc := ph.slots.GetRuleAttributeDescription(area, room, slotnr, int(rulenr), int(attnr))
-	retbytes := make([]byte, len(attdesc)+4)
-	retbytes[0] = rulenr
-	retbytes[1] = attnr
-	retbytes[2] = byte(len(attdesc)>>8) & 0xff
-	retbytes[3] = byte(len(attdesc)) & 0xff
-	copy(retbytes[4:], []byte(attdesc))
-	p := NewPacket(commands.ATTRDESCRIPT, commands.TELL, commands.SERVER, ps.pid, retbytes)
-	ph.addOutPacket(server, socket, p)
+	if !ph.checkRule(server, socket, ps, cl.area, cl.room, q.Slot, int(q.Rule), int(q.Attr)) {
+		return
+	}
+	attdesc := ph.slots.GetRuleAttributeDescription(cl.area, cl.room, q.Slot, int(q.Rule), int(q.Attr))
+	ph.tell(server, socket, ps, &protocol.AttrDescriptTell{Rule: q.Rule, Attr: q.Attr, Name: []byte(attdesc)})
 }
 
 func (ph *PacketHandler) sendPlayerStats(server *ServerThread, socket net.Conn, ps *Packet) {
+	q := &protocol.NumberQuery{Cmd: commands.PLAYERSTATS}
+	if !ph.decode(server, socket, ps, q) {
+		return
+	}
 	cl := ph.clients.FindClientBySocket(socket)
 	area := cl.area
 	room := cl.room
-	slotnr := ps.GetNumber()
-	playerstats := ph.clients.GetPlayerStats(area, room, slotnr)
+	slotnr := q.Number
+	players := ph.clients.GetPlayerStats(area, room, slotnr)
 
 	// Special character test slot handling TODO
-	if area == 0x002 && room == 0x001 && slotnr == 0x003 {
-		c := playerstats[3]
-		ptr := 4
-		for t := 0; t < int(c); t++ {
-			off := int(playerstats[ptr+1])
-			ptr = ptr + 2 + off // handle
-			off = int(playerstats[ptr+1])
-			ptr = ptr + 2 + off // nickname
-			off = int(playerstats[ptr+1] & 0xff)
-			ptr = ptr + 2 + off       // statistics
-			playerstats[ptr-8] = 0xff // 0x6a; // dummy value
+	if ph.variant.testSlot && area == 0x002 && room == 0x001 && slotnr == 0x003 {
+		for t := range players {
+			stats := append([]byte(nil), players[t].Stats...)
+			if len(stats) >= 8 {
+				stats[len(stats)-8] = 0xff // 0x6a; // dummy value
+			}
+			players[t].Stats = stats
 		}
 	}
 
-	p := NewPacket(commands.PLAYERSTATS, commands.TELL, commands.SERVER, ps.pid, playerstats)
-	ph.addOutPacket(server, socket, p)
+	ph.tell(server, socket, ps, &protocol.PlayerStatsTell{Cmd: commands.PLAYERSTATS, Slot: slotnr, Players: players})
 }
 
 func (ph *PacketHandler) sendExitSlotlist(server *ServerThread, socket net.Conn, ps *Packet) {
 	cl := ph.clients.FindClientBySocket(socket)
 	area := cl.area
 	room := cl.room
-	cl.room = 0
+	ph.clients.Move(cl, area, 0, cl.slot)
+	cl.state = STATE_AREA
 	ph.db.UpdateClientOrigin(cl.userID, STATUS_LOBBY, area, room, 0)
 
 	p := NewPacketWithoutPayload(commands.EXITSLOTLIST, commands.TELL, commands.SERVER, ps.pid)
@@ -1201,7 +1260,8 @@ func (ph *PacketHandler) sendExitSlotlist(server *ServerThread, socket net.Conn,
 func (ph *PacketHandler) sendExitArea(server *ServerThread, socket net.Conn, ps *Packet) {
 	cl := ph.clients.FindClientBySocket(socket)
 	area := cl.area
-	cl.area = 0
+	ph.clients.Move(cl, 0, cl.room, cl.slot)
+	cl.state = STATE_CHARACTER
 
 	ph.db.UpdateClientOrigin(cl.userID, STATUS_LOBBY, 0, 0, 0)
 
@@ -1217,85 +1277,75 @@ func (ph *PacketHandler) sendSlotName(server *ServerThread, socket net.Conn, ps
 	area := cl.area
 	room := cl.room
 	slotnr := cl.slot
-	slottitle := ps.GetDecryptedString()
-	ph.debug("\nSetting slot title for area %d room %d slot %d to %s\n\n", area, room, slotnr, slottitle)
-	ph.slots.GetSlot(area, room, slotnr).SetName(slottitle)
-	p := NewPacket(commands.SLOTNAME, commands.TELL, commands.SERVER, ps.pid, ps.pay)
-	ph.addOutPacket(server, socket, p)
+	q := &protocol.SecretQuery{Cmd: commands.SLOTNAME}
+	if !ph.decode(server, socket, ps, q) {
+		return
+	}
+	ph.debug("Setting slot title for area %d room %d slot %d to %s\n", area, room, slotnr, q.Text)
+	ph.slots.GetSlot(area, room, slotnr).SetName(q.Text)
+	// the title is echoed unencrypted
+	ph.tell(server, socket, ps, &protocol.SecretEchoTell{Cmd: commands.SLOTNAME, Text: q.Text, Sum: q.Sum})
 	ph.broadcastSlotTitle(server, area, room, slotnr)
 
 }
 
 func (ph *PacketHandler) broadcastSlotTitle(server *ServerThread, area, room, slot int) {
-	// 0x00,0x00; 0x00,0x00; 0x00,0x00; 0x00,0x00, 0x00,0x00
 	slottitle := ph.slots.GetSlot(area, room, slot).name
-	broadcast := make([]byte, len(slottitle)+4)
-	broadcast[0] = byte(slot>>8) & 0xff
-	broadcast[1] = byte(slot) & 0xff
-	broadcast[2] = byte(len(slottitle)>>8) & 0xff
-	broadcast[3] = byte(len(slottitle)) & 0xff
-	copy(broadcast[4:], []byte(slottitle))
-	p := NewPacket(commands.SLOTTITLE, commands.BROADCAST, commands.SERVER, ph.getNextPacketID(), broadcast)
+	p := ph.newBroadcast(&protocol.NameTell{Cmd: commands.SLOTTITLE, Number: slot, Name: slottitle})
 	ph.broadcastInSlotNRoom(server, p, area, room, slot)
 }
 
 func (ph *PacketHandler) sendSetRule(server *ServerThread, socket net.Conn, ps *Packet) {
-	retval := []byte{0}
+	q := &protocol.RuleTell{Cmd: commands.SETRULE}
+	if !ph.decode(server, socket, ps, q) {
+		return
+	}
 	cl := ph.clients.FindClientBySocket(socket)
-	area := cl.area
-	room := cl.room
-	slotnr := cl.slot
-	rulenr := ps.pay[0]
-	ruleval := ps.pay[1]
-
-	slot := ph.slots.GetSlot(area, room, slotnr)
-	slot.SetRuleValue(int(rulenr), ruleval)
+	if !ph.checkRule(server, socket, ps, cl.area, cl.room, cl.slot, int(q.Rule), -1) {
+		return
+	}
+	slot := ph.slots.GetSlot(cl.area, cl.room, cl.slot)
+	slot.SetRuleValue(int(q.Rule), q.Value)
 
-	p := NewPacket(commands.SETRULE, commands.TELL, commands.SERVER, ps.pid, retval)
-	ph.addOutPacket(server, socket, p)
+	ph.tell(server, socket, ps, &protocol.ByteTell{Cmd: commands.SETRULE, Value: 0})
 }
 
 func (ph *PacketHandler) send660C(server *ServerThread, socket net.Conn, ps *Packet) {
-	p := NewPacket(commands.UNKN660C, commands.TELL, commands.SERVER, ps.pid, ps.pay)
-	ph.addOutPacket(server, socket, p)
+	ph.tell(server, socket, ps, &protocol.Raw{Cmd: commands.UNKN660C, Data: ps.pay})
 }
 
 // 1st word is slottype: 0011 = dvd, 0012 = hdd
 // 2nd word are the scenes: wild things 0001, underbelly 0002, flashback 0003, desperate times 0004
 func (ph *PacketHandler) sendSceneSelect(server *ServerThread, socket net.Conn, ps *Packet) {
-	// 0,0; 0,0x12; 0,2
-	scenetype := []byte{0, 0, 0, 0x12, 0, 2}
+	q := &protocol.SceneSelectQuery{}
+	if !ph.decode(server, socket, ps, q) {
+		return
+	}
 	cl := ph.clients.FindClientBySocket(socket)
-	area := cl.area
-	room := cl.room
 	slotnr := cl.slot
+	slottype := byte(q.Type)
+	scenario := byte(q.Scenario)
 
-	scenetype[1] = byte(slotnr) & 0xff // slot
-	scenetype[3] = ps.pay[1]           // type
-	scenetype[5] = ps.pay[3]           // scenario
-
-	slot := ph.slots.GetSlot(area, room, slotnr)
-	slot.SetSlotType(scenetype[3])
-	slot.SetScenario(scenetype[5])
+	slot := ph.slots.GetSlot(cl.area, cl.room, slotnr)
+	slot.SetSlotType(slottype)
+	slot.SetScenario(scenario)
 
-	p := NewPacket(commands.SCENESELECT, commands.TELL, commands.SERVER, ps.pid, scenetype)
-	ph.addOutPacket(server, socket, p)
+	ph.tell(server, socket, ps, &protocol.SceneTypeTell{
+		Cmd:      commands.SCENESELECT,
+		Slot:     slotnr & 0xff,
+		Type:     int(slottype),
+		Scenario: int(scenario),
+	})
 }
 
 func (ph *PacketHandler) sendSlotTimer(server *ServerThread, socket net.Conn, ps *Packet) {
-	timing := []byte{0, 0, 7, 8}
 	cl := ph.clients.FindClientBySocket(socket)
 	area := cl.area
 	room := cl.room
 	slotnr := cl.slot
 	livetime := ph.slots.GetSlot(area, room, slotnr).GetLivetime()
 
-	timing[0] = byte(slotnr) & 0xff
-	timing[2] = byte(livetime>>8) & 0xff
-	timing[3] = byte(livetime) & 0xff
-
-	p := NewPacket(commands.SLOTTIMER, commands.TELL, commands.SERVER, ps.pid, timing)
-	ph.addOutPacket(server, socket, p)
+	ph.tell(server, socket, ps, &protocol.SlotTimerTell{Slot: byte(slotnr), Livetime: int(livetime)})
 
 	if livetime == 0 {
 		ph.broadcastGetReady(server, socket)
@@ -1318,6 +1368,7 @@ func (ph *PacketHandler) broadcastGetReady(server *ServerThread, socket net.Conn
 			// TODO double check this
 			if c.area == area && c.room == room && c.slot == slotnr {
 				c.GameNumber = gamenr
+				c.state = STATE_INGAME
 				ph.db.UpdateClientGame(c.userID, gamenr)
 			}
 		}
@@ -1341,12 +1392,11 @@ func (ph *PacketHandler) broadcastInSlot(server *ServerThread, p *Packet, area,
 }
 
 func (ph *PacketHandler) send6412(server *ServerThread, socket net.Conn, ps *Packet) {
-	// 0,1; 0,0,0,0
-	answer := []byte{0, 1, 0, 0, 0, 0}
-	nr := ps.GetNumber()
-	answer[1] = byte(nr) & 0xff
-	p := NewPacket(commands.UNKN6412, commands.TELL, commands.SERVER, ps.pid, answer)
-	ph.addOutPacket(server, socket, p)
+	q := &protocol.NumberQuery{Cmd: commands.UNKN6412}
+	if !ph.decode(server, socket, ps, q) {
+		return
+	}
+	ph.tell(server, socket, ps, &protocol.Unkn6412Tell{Number: q.Number & 0xff})
 }
 
 // last packet from slot creator !!
@@ -1356,10 +1406,10 @@ func (ph *PacketHandler) send6504(server *ServerThread, socket net.Conn, ps *Pac
 	room := cl.room
 	slotnr := cl.slot
 
-	retval := []byte{1}
-
-	// just in case
-	retval[0] = ps.pay[0]
+	q := &protocol.ByteQuery{Cmd: commands.UNKN6504}
+	if !ph.decode(server, socket, ps, q) {
+		return
+	}
 
 	// set usage and playerstatus
 
@@ -1375,26 +1425,27 @@ func (ph *PacketHandler) send6504(server *ServerThread, socket net.Conn, ps *Pac
 	ph.broadcastSlotStatus(server, area, room, slotnr)
 	ph.broadcastPlayerOK(server, socket)
 
-	p := NewPacket(commands.UNKN6504, commands.TELL, commands.SERVER, ps.pid, retval)
-	ph.addOutPacket(server, socket, p)
+	// just in case
+	ph.tell(server, socket, ps, &protocol.ByteTell{Cmd: commands.UNKN6504, Value: q.Value})
 }
 
 func (ph *PacketHandler) sendJoinGame(server *ServerThread, socket net.Conn, ps *Packet) {
+	q := &protocol.JoinGameQuery{}
+	if !ph.decode(server, socket, ps, q) {
+		return
+	}
 	cl := ph.clients.FindClientBySocket(socket)
 	area := cl.area
 	room := cl.room
-
-	retslot := []byte{0, 1}
-	slotnr := ps.GetNumber()
-	ph.debug("\n\n!!!!!!!!!!!!!!!!\n\nJoining game in area %d room %d slot %d\n\n!!!!!!!!!!!!\n\n", area, room, slotnr)
-	ph.debug("our packet pay[0] and pay[1] were %d and %d\n\n\n\n", ps.pay[0], ps.pay[1])
+	slotnr := q.Slot
+	ph.debug("Joining game in area %d room %d slot %d\n", area, room, slotnr)
+	if !ph.checkSlot(server, socket, ps, area, room, slotnr) {
+		return
+	}
 
 	// check if slot is free
 	if ph.slots.GetStatus(area, room, slotnr) == STATUS_BUSY {
-		mess := NewPacketString("<LF=6><BODY><CENTER>game is full<END>").GetData()
-		p := NewPacket(commands.JOINGAME, commands.TELL, commands.SERVER, ps.pid, mess)
-		p.SetErr()
-		ph.addOutPacket(server, socket, p)
+		ph.tell(server, socket, ps, &protocol.ErrorTell{Cmd: commands.JOINGAME, Message: []byte("<LF=6><BODY><CENTER>game is full<END>")})
 		return
 	}
 
@@ -1402,30 +1453,21 @@ func (ph *PacketHandler) sendJoinGame(server *ServerThread, socket net.Conn, ps
 
 	// check if we can join the slot
 	if slot.GetStatus() != STATUS_GAMESET {
-		mess := NewPacketString("<LF=6><BODY><CENTER>not possible<END>").GetData()
-		p := NewPacket(commands.JOINGAME, commands.TELL, commands.SERVER, ps.pid, mess)
-		p.SetErr()
-		ph.addOutPacket(server, socket, p)
+		ph.tell(server, socket, ps, &protocol.ErrorTell{Cmd: commands.JOINGAME, Message: []byte("<LF=6><BODY><CENTER>not possible<END>")})
 		return
 	}
 
-	// hostuser := ph.slots.GetSlot(area, room, slotnr).GetHost()
-	// clntuser := cl.userID
-
-	// get password, check it
-	pass := ps.GetPassword()
-	if bytes.Equal(pass, slot.GetPassword()) || slot.GetProtection() == PROTECTION_OFF {
-		retslot[1] = byte(slotnr) & 0xff
-
+	// check the password
+	if bytes.Equal(q.Password, slot.GetPassword()) || slot.GetProtection() == PROTECTION_OFF {
 		// assign a player number, set slot
 		player := ph.clients.GetFreePlayerNum(area, room, slotnr)
-		ph.debug("!!!!!!!!!!!!!!!!!!!!!!!!\n\n\nfree player number is %d\n", player)
-		cl.slot = slotnr
+		ph.debug("free player number is %d\n", player)
+		ph.clients.Move(cl, area, room, slotnr)
+		cl.state = STATE_SLOT
 		cl.player = byte(player)
 		ph.db.UpdateClientOrigin(cl.userID, STATUS_LOBBY, area, room, slotnr)
 
-		p := NewPacket(commands.JOINGAME, commands.TELL, commands.SERVER, ps.pid, retslot)
-		ph.addOutPacket(server, socket, p)
+		ph.tell(server, socket, ps, &protocol.NumberTell{Cmd: commands.JOINGAME, Number: slotnr & 0xff})
 
 		n := ph.clients.CountPlayersInSlot(area, room, slotnr)
 		if n >= int(ph.slots.GetMaximumPlayers(area, room, slotnr)) {
@@ -1437,40 +1479,23 @@ func (ph *PacketHandler) sendJoinGame(server *ServerThread, socket net.Conn, ps
 		ph.broadcastSlotAttrib2(server, area, room, slotnr)
 
 		// broadcast stats of new player
-		status := cl.GetCharacterStat()
-
-		p2 := NewPacket(commands.PLAYERSTATBC, commands.BROADCAST, commands.SERVER, ph.getNextPacketID(), status)
-
-		ph.broadcastInSlot(server, p2, area, room, slotnr)
+		p := ph.newBroadcast(&protocol.CharacterStatBroadcast{Cmd: commands.PLAYERSTATBC, CharacterStat: cl.GetCharacterStat()})
+		ph.broadcastInSlot(server, p, area, room, slotnr)
 	} else {
-		mess := NewPacketString("<LF=6><BODY><CENTER>wrong password<END>").GetData()
-		p := NewPacket(commands.JOINGAME, commands.TELL, commands.SERVER, ps.pid, mess)
-		p.SetErr()
-		ph.addOutPacket(server, socket, p)
+		ph.tell(server, socket, ps, &protocol.ErrorTell{Cmd: commands.JOINGAME, Message: []byte("<LF=6><BODY><CENTER>wrong password<END>")})
 	}
 
 }
 func (ph *PacketHandler) broadcastPasswdProtect(server *ServerThread, area, room, slot int) {
-	// 0,1; 0
-	retval := []byte{0, 1, 0}
-	retval[0] = byte(slot>>8) & 0xff
-	retval[1] = byte(slot) & 0xff
-	retval[2] = ph.slots.GetProtection(area, room, slot)
-	p := NewPacket(commands.SLOTPWDPROT, commands.BROADCAST, commands.SERVER, ph.getNextPacketID(), retval)
+	protection := ph.slots.GetProtection(area, room, slot)
+	p := ph.newBroadcast(&protocol.StatusTell{Cmd: commands.SLOTPWDPROT, Number: slot, Status: protection})
 	ph.broadcastInRoom(server, p, area, room, slot)
 }
 
 func (ph *PacketHandler) broadcastPlayerOK(server *ServerThread, socket net.Conn) {
 	cl := ph.clients.FindClientBySocket(socket)
-	area := cl.area
-	room := cl.room
-	slotnr := cl.slot
-
-	// 0,0; 0,0
-	playerok := []byte{0, 0, 0, 0}
-	playerok[1] = cl.player
-	p := NewPacket(commands.PLAYEROK, commands.BROADCAST, commands.SERVER, ph.getNextPacketID(), playerok)
-	ph.broadcastInSlot(server, p, area, room, slotnr)
+	p := ph.newBroadcast(&protocol.PlayerOKBroadcast{Player: cl.player})
+	ph.broadcastInSlot(server, p, cl.area, cl.room, cl.slot)
 }
 
 /* 3/17 - this function is currently broken, or maybe
@@ -1487,20 +1512,22 @@ but i have a suspicion that there's a reason it was 1-indexed
 in the original java code...*/
 
 func (ph *PacketHandler) sendSlotStatus(server *ServerThread, socket net.Conn, ps *Packet) {
-	// 0x00,0x00; 0x00
-	slotnr := ps.GetNumber()
-	slotstatus := []byte{0x00, 0x00, 0x00}
+	q := &protocol.NumberQuery{Cmd: commands.SLOTSTATUS}
+	if !ph.decode(server, socket, ps, q) {
+		return
+	}
+	slotnr := q.Number
 	cl := ph.clients.FindClientBySocket(socket)
 	area := cl.area
 	room := cl.room
 	// TODO: selecting eg area 5 causes this to output area 0 room 5.
 	// not really clear what "area" is actually aligning with here.
 	ph.debug("area: %d, room: %d, slot: %d\n", area, room, slotnr) // Debug print
-	slotstatus[0] = byte(slotnr>>8) & 0xff
-	slotstatus[1] = byte(slotnr) & 0xff
-	slotstatus[2] = ph.slots.GetStatus(area, room, slotnr)
-	p := NewPacket(commands.SLOTSTATUS, commands.TELL, commands.SERVER, ps.pid, slotstatus)
-	ph.addOutPacket(server, socket, p)
+	if !ph.checkSlot(server, socket, ps, area, room, slotnr) {
+		return
+	}
+	status := ph.slots.GetStatus(area, room, slotnr)
+	ph.tell(server, socket, ps, &protocol.StatusTell{Cmd: commands.SLOTSTATUS, Number: slotnr, Status: status})
 }
 
 // this is send when a client gets the rules but decides not to join
@@ -1527,7 +1554,8 @@ func (ph *PacketHandler) sendCancelSlot(server *ServerThread, socket net.Conn, p
 	// normal players just leave
 	ph.broadcastLeaveSlot(server, socket)
 	cl.player = 0
-	cl.slot = 0
+	ph.clients.Move(cl, area, room, 0)
+	cl.state = STATE_ROOM
 	ph.db.UpdateClientOrigin(cl.userID, STATUS_LOBBY, area, room, 0)
 
 	ph.broadcastSlotAttrib2(server, area, room, slotnr)
@@ -1548,53 +1576,34 @@ func (ph *PacketHandler) sendCancelSlot(server *ServerThread, socket net.Conn, p
 
 func (ph *PacketHandler) broadcastLeaveSlot(server *ServerThread, socket net.Conn) {
 	cl := ph.clients.FindClientBySocket(socket)
-	area := cl.area
-	room := cl.room
-	slotnr := cl.slot
-
-	// 0,6; 0,0,0,0,0,0
-	wholeaves := []byte{0, 6, 0, 0, 0, 0, 0, 0}
-	who := cl.hnPair.handle
-
-	copy(wholeaves[2:], who)
-	p := NewPacket(commands.LEAVESLOT, commands.BROADCAST, commands.SERVER, ph.getNextPacketID(), wholeaves)
-	ph.broadcastInSlot(server, p, area, room, slotnr)
+	p := ph.newBroadcast(&protocol.HandleMessage{Cmd: commands.LEAVESLOT, Handle: protocol.PadHandle(cl.hnPair.handle)})
+	ph.broadcastInSlot(server, p, cl.area, cl.room, cl.slot)
 
 }
 
 func (ph *PacketHandler) broadcastCancelSlot(server *ServerThread, area, room, slot int) {
-	mess := NewPacketString("<LF=6><BODY><CENTER>host cancelled game<END>").GetData()
-	p := NewPacket(commands.CANCELSLOTBC, commands.BROADCAST, commands.SERVER, ph.getNextPacketID(), mess)
+	p := ph.newBroadcast(&protocol.TextBroadcast{Cmd: commands.CANCELSLOTBC, Message: []byte("<LF=6><BODY><CENTER>host cancelled game<END>")})
 	ph.broadcastInSlot(server, p, area, room, slot)
 }
 
 func (ph *PacketHandler) sendSlotPasswd(server *ServerThread, socket net.Conn, ps *Packet) {
+	q := &protocol.SecretQuery{Cmd: commands.SLOTPASSWD}
+	if !ph.decode(server, socket, ps, q) {
+		return
+	}
 	cl := ph.clients.FindClientBySocket(socket)
-	area := cl.area
-	room := cl.room
-	slotnr := cl.slot
-	slot := ph.slots.GetSlot(area, room, slotnr)
-	slot.SetPassword(ps.GetDecryptedString()) // TODO: apparently not GetDecryptedPassword()
-	p := NewPacket(commands.SLOTPASSWD, commands.TELL, commands.SERVER, ps.pid, ps.pay)
-	ph.addOutPacket(server, socket, p)
+	slot := ph.slots.GetSlot(cl.area, cl.room, cl.slot)
+	slot.SetPassword(q.Text)
+	ph.tell(server, socket, ps, &protocol.SecretEchoTell{Cmd: commands.SLOTPASSWD, Text: q.Text, Sum: q.Sum})
 }
 
 func (ph *PacketHandler) sendGetInfo(server *ServerThread, socket net.Conn, ps *Packet) {
-	url := ps.GetDecryptedString()
-	d := ph.information.GetData(string(url))
-
-	mess := make([]byte, len(d)+len(url)+4)
-
-	// putShort
-	binary.BigEndian.PutUint16(mess[0:2], uint16(len(url)))
-	// put
-	copy(mess[2:2+len(url)], url)
-	off := 2 + len(url)
-	binary.BigEndian.PutUint16(mess[off:off+2], uint16(len(d)))
-	copy(mess[off+2:], d)
-
-	p := NewPacket(commands.GETINFO, commands.TELL, commands.SERVER, ps.pid, mess)
-	ph.addOutPacket(server, socket, p)
+	q := &protocol.SecretQuery{Cmd: commands.GETINFO}
+	if !ph.decode(server, socket, ps, q) {
+		return
+	}
+	d := ph.information.GetData(string(q.Text))
+	ph.tell(server, socket, ps, &protocol.GetInfoTell{URL: q.Text, Data: d})
 }
 
 // unknown, simply accept it
@@ -1605,122 +1614,68 @@ func (ph *PacketHandler) send6181(server *ServerThread, socket net.Conn, ps *Pac
 
 func (ph *PacketHandler) sendPlayerCount(server *ServerThread, socket net.Conn, ps *Packet) {
 	cl := ph.clients.FindClientBySocket(socket)
-	area := cl.area
-	room := cl.room
-	slotnr := cl.slot
-	playercount := []byte{0}
-	playercount[0] = byte(ph.clients.CountPlayersInSlot(area, room, slotnr))
-	p := NewPacket(commands.PLAYERCOUNT, commands.TELL, commands.SERVER, ps.pid, playercount)
-	ph.addOutPacket(server, socket, p)
+	count := byte(ph.clients.CountPlayersInSlot(cl.area, cl.room, cl.slot))
+	ph.tell(server, socket, ps, &protocol.ByteTell{Cmd: commands.PLAYERCOUNT, Value: count})
 }
 
 func (ph *PacketHandler) sendPlayerNumber(server *ServerThread, socket net.Conn, ps *Packet) {
-	num := []byte{0}
-	num[0] = ph.clients.FindClientBySocket(socket).player
-	p := NewPacket(commands.PLAYERNUMBER, commands.TELL, commands.SERVER, ps.pid, num)
-	ph.addOutPacket(server, socket, p)
+	player := ph.clients.FindClientBySocket(socket).player
+	ph.tell(server, socket, ps, &protocol.ByteTell{Cmd: commands.PLAYERNUMBER, Value: player})
 }
 
 func (ph *PacketHandler) sendPlayerStat(server *ServerThread, socket net.Conn, ps *Packet) {
-	status := []byte{0, 0}
+	q := &protocol.ByteQuery{Cmd: commands.PLAYERSTAT} // query which player ?
+	if !ph.decode(server, socket, ps, q) {
+		return
+	}
 	cl := ph.clients.FindClientBySocket(socket)
-	area := cl.area
-	room := cl.room
-	slotnr := cl.slot
-	player := ps.pay[0] // query which player ?
-	cl = ph.clients.FindClientBySlot(area, room, slotnr, int(player))
+	cl = ph.clients.FindClientBySlot(cl.area, cl.room, cl.slot, int(q.Value))
 
+	status := &protocol.PlayerStatTell{}
 	if cl != nil {
-		status = cl.GetPreGameStat(player)
-	} else { // client left us :(
-		status[0] = 0 // TODO: not sure if this will help
-	}
+		status = cl.GetPreGameStat(q.Value)
+	} // else client left us :( TODO: not sure if this will help
 
-	p := NewPacket(commands.PLAYERSTAT, commands.TELL, commands.SERVER, ps.pid, status)
-	ph.addOutPacket(server, socket, p)
+	ph.tell(server, socket, ps, status)
 }
 
 func (ph *PacketHandler) sendPlayerScore(server *ServerThread, socket net.Conn, ps *Packet) {
-	score := []byte{0x01, 0x00, 0x00, 0x00, 0x00,
-		0x00, 0x00, 0x00, 0x00, 0x00,
-		0x00, 0x00, 0x00, 0x00, 0x00,
-		0x00, 0x00, 0x00, 0x00, 0x00,
-		0x00, 0x00, 0x00}
-
+	q := &protocol.ByteQuery{Cmd: commands.PLAYERSCORE}
+	if !ph.decode(server, socket, ps, q) {
+		return
+	}
 	cl := ph.clients.FindClientBySocket(socket)
-	area := cl.area
-	room := cl.room
-	slotnr := cl.slot
-	player := ps.pay[0]
+	scenario := ph.slots.GetScenario(cl.area, cl.room, cl.slot)
 
 	// TESTpacket. where can i see those ?
-	r := make([]byte, (1+2)+(5*4))
-	off := 0
-	r[off] = player
-	off++
-
-	scenario := ph.slots.GetScenario(area, room, slotnr)
-	binary.BigEndian.PutUint16(r[off:off+2], uint16(scenario))
-	off += 2
-
-	binary.BigEndian.PutUint32(r[off:off+4], uint32(110))
-	off += 4
-
-	binary.BigEndian.PutUint32(r[off:off+4], uint32(220))
-	off += 4
-
-	binary.BigEndian.PutUint32(r[off:off+4], uint32(330))
-	off += 4
-
-	binary.BigEndian.PutUint32(r[off:off+4], uint32(440))
-	off += 4
-
-	binary.BigEndian.PutUint32(r[off:off+4], uint32(550))
-	off += 4
-
-	copy(score, r)
-
 	// TODO: send the scoring from ranklist for this player
-	score[0] = player
-	// score[1] = byte(scenario>>8) & 0xff
-	// score[2] = byte(scenario) & 0xff
-	p := NewPacket(commands.PLAYERSCORE, commands.TELL, commands.SERVER, ps.pid, score)
-	ph.addOutPacket(server, socket, p)
+	ph.tell(server, socket, ps, &protocol.PlayerScoreTell{
+		Player:   q.Value,
+		Scenario: int(scenario),
+		Scores:   [5]uint32{110, 220, 330, 440, 550},
+	})
 }
 
 func (ph *PacketHandler) sendGameSession(server *ServerThread, socket net.Conn, ps *Packet) {
 	cl := ph.clients.FindClientBySocket(socket)
-	gameno := cl.GameNumber
-	sess := fmt.Sprintf("%015d", gameno)
-
-	buff := make([]byte, 19)
-	off := 0
-	binary.BigEndian.PutUint16(buff[off:off+2], uint16(0x0f))
-	off += 2
-	copy(buff[off:], []byte(sess))
-	off += 15
-	binary.BigEndian.PutUint16(buff[off:off+2], uint16(0x00))
-
-	p := NewPacket(commands.GAMESESSION, commands.TELL, commands.SERVER, ps.pid, buff)
-	ph.addOutPacket(server, socket, p)
+	sess := fmt.Sprintf("%015d", cl.GameNumber)
+	ph.tell(server, socket, ps, &protocol.GameSessionTell{Session: []byte(sess)})
 }
 
 func (ph *PacketHandler) sendDifficulty(server *ServerThread, socket net.Conn, ps *Packet) {
-	difficulty := []byte{0x00, 0x10,
-		0x01, 0x03, 0x00, 0x00, 0x00, 0x00,
-		0x00, 0x00, 0x00, 0x00,
-		0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
-
 	cl := ph.clients.FindClientBySocket(socket)
 	area := cl.area
 	room := cl.room
 	slotnr := cl.slot
 
 	// TODO: here is sent more (different game modes). more tests!
-	difficulty[3] = ph.slots.GetDifficulty(area, room, slotnr)
-	difficulty[4] = ph.slots.GetFriendlyFire(area, room, slotnr)
-	p := NewPacket(commands.GAMEDIFF, commands.TELL, commands.SERVER, ps.pid, difficulty)
-	ph.addOutPacket(server, socket, p)
+	ph.tell(server, socket, ps, &protocol.GameDiffTell{
+		Size:         ph.variant.gameDiff,
+		Difficulty:   ph.slots.GetDifficulty(area, room, slotnr),
+		FriendlyFire: ph.slots.GetFriendlyFire(area, room, slotnr),
+		Nightmare:    ph.slots.GetNightmare(area, room, slotnr),
+		Infinity:     ph.slots.GetInfinity(area, room, slotnr),
+	})
 }
 
 func (ph *PacketHandler) sendLogout(server *ServerThread, socket net.Conn, ps *Packet) {
@@ -1735,32 +1690,62 @@ func (ph *PacketHandler) sendLogout(server *ServerThread, socket net.Conn, ps *P
 }
 
 func (ph *PacketHandler) sendGSinfo(server *ServerThread, socket net.Conn, ps *Packet) {
-	// 0x00,0x04; 192,168,7,77; 0x00,0x02; 0x21; 0xF2(port)
-	// 0x00; 0x00; 0x1e; 0x00
-	gsinfo := []byte{0x00, 0x04, byte(192), byte(168), byte(7), byte(77),
-		0x00, 0x02, 0x21, byte(0xF2), // port 8690
-		0x00, 0x00, 0x1e, 0x00}
-
-	gsinfo[2] = ph.gsIP[0]
-	gsinfo[3] = ph.gsIP[1]
-	gsinfo[4] = ph.gsIP[2]
-	gsinfo[5] = ph.gsIP[3]
-
-	// todo: usage of multiple gameservers (why?)
-	p := NewPacket(commands.GSINFO, commands.TELL, commands.SERVER, ps.pid, gsinfo)
-	ph.addOutPacket(server, socket, p)
+	cl := ph.clients.FindClientBySocket(socket)
+	var ip net.IP
+	if addr, ok := socket.RemoteAddr().(*net.TCPAddr); ok {
+		ip = addr.IP
+	}
+	relay, err := ph.relays.Assign(cl.GameNumber, ip)
+	if err != nil {
+		ph.log.Warn("no game server for game", "game", cl.GameNumber, "err", err)
+		ph.tell(server, socket, ps, &protocol.ErrorTell{Cmd: commands.GSINFO, Message: []byte("<LF=6><BODY><CENTER>no game server available<END>")})
+		return
+	}
+	ph.debug("Game %d is on gameserver %s\n", cl.GameNumber, relay.Name)
+
+	// the gameserver only lets in the players it was told about
+	var players []ExpectedPlayer
+	for _, c := range ph.clients.GetList() {
+		if c.GameNumber == cl.GameNumber {
+			players = append(players, ExpectedPlayer{UserID: c.userID, Session: c.session})
+		}
+	}
+	gamenr := cl.GameNumber
+	reply := func(err error) {
+		if err != nil {
+			ph.log.Error("telling game server about game", "relay", relay.Name, "game", gamenr, "err", err)
+			ph.tell(server, socket, ps, &protocol.ErrorTell{Cmd: commands.GSINFO, Message: []byte("<LF=6><BODY><CENTER>no game server available<END>")})
+			return
+		}
+		ph.tell(server, socket, ps, &protocol.GSInfoTell{IP: relay.IP, Port: relay.Port})
+	}
+	if relay.Local {
+		reply(ph.relays.Expect(relay, gamenr, players))
+		return
+	}
+	// a remote relay is told over the network, the lobby goes on meanwhile
+	// and the player is answered when the relay knows the game
+	go func() {
+		err := ph.relays.Expect(relay, gamenr, players)
+		ph.Call(func() {
+			if ph.clients.FindClientBySocket(socket) != cl {
+				return // left while waiting
+			}
+			reply(err)
+		})
+	}()
 }
 
 func (ph *PacketHandler) sendEnterAGL(server *ServerThread, socket net.Conn, ps *Packet) {
 	cl := ph.clients.FindClientBySocket(socket)
 	gamenum, err := ph.db.GetGameNumber(cl.userID)
 	if err != nil {
-		ph.debug("Error getting game number: %s\n", err)
+		ph.log.Error("getting game number", "err", err)
 		return
 	}
 	cl.GameNumber = gamenum
-	cl.area = 51
-	ph.db.UpdateClientOrigin(cl.userID, STATUS_LOBBY, 51, cl.room, cl.slot)
+	cl.state = STATE_AGL
+	ph.db.UpdateClientOrigin(cl.userID, STATUS_AGLOBBY, 0, cl.room, cl.slot)
 
 	p := NewPacketWithoutPayload(commands.ENTERAGL, commands.TELL, commands.SERVER, ps.pid)
 	ph.addOutPacket(server, socket, p)
@@ -1768,8 +1753,7 @@ func (ph *PacketHandler) sendEnterAGL(server *ServerThread, socket net.Conn, ps
 	// broadcast new playercount
 	ph.broadcastAglPlayerCnt(server, cl.GameNumber)
 
-	status := cl.GetCharacterStat()
-	p = NewPacket(commands.AGLJOIN, commands.BROADCAST, commands.SERVER, ph.getNextPacketID(), status)
+	p = ph.newBroadcast(&protocol.CharacterStatBroadcast{Cmd: commands.AGLJOIN, CharacterStat: cl.GetCharacterStat()})
 	ph.broadcastInAgl(server, p, gamenum)
 
 }
@@ -1779,14 +1763,13 @@ func (ph *PacketHandler) sendLeaveAGL(server *ServerThread, socket net.Conn, ps
 	gamenum := cl.GameNumber
 
 	// broadcast leaving of player
-	wholeave := []byte{0, 6, 0, 0, 0, 0, 0, 0}
-	who := cl.hnPair.handle
-	copy(wholeave[2:], who)
-	p := NewPacket(commands.LEAVEAGL, commands.BROADCAST, commands.SERVER, ph.getNextPacketID(), wholeave)
+	p := ph.newBroadcast(&protocol.HandleMessage{Cmd: commands.LEAVEAGL, Handle: protocol.PadHandle(cl.hnPair.handle)})
 	ph.broadcastInAgl(server, p, gamenum)
 
 	// set player back into area selection
-	cl.area = 0
+	cl.state = STATE_CHARACTER
+	cl.afterGame = false
+	ph.clients.Move(cl, 0, cl.room, cl.slot)
 	cl.GameNumber = 0
 	ph.db.UpdateClientGame(cl.userID, 0)
 	ph.db.UpdateClientOrigin(cl.userID, STATUS_LOBBY, 0, 0, 0)
@@ -1804,107 +1787,67 @@ func (ph *PacketHandler) sendLeaveAGL(server *ServerThread, socket net.Conn, ps
 func (ph *PacketHandler) sendAGLstats(server *ServerThread, socket net.Conn, ps *Packet) {
 	cl := ph.clients.FindClientBySocket(socket)
 	gamenum := cl.GameNumber
-	aglstats := make([]byte, 1024)
-	off := 0
-	binary.BigEndian.PutUint16(aglstats[off:off+2], 0)
-	off += 2
-	aglstats[off] = byte(3) // unknown what this is
-	off++
-	aglstats[off] = byte(ph.clients.GetPlayerCountAgl(gamenum))
-	off++
+	var players []protocol.CharacterStat
 	for _, c := range ph.clients.GetList() {
 		if c.GameNumber == gamenum {
-			stats := c.GetCharacterStat()
-			statlen := len(stats)
-			copy(aglstats[off:], stats)
-			off += statlen
+			players = append(players, c.GetCharacterStat())
 		}
 	}
-	status := aglstats[:off]
-	p := NewPacket(commands.AGLSTATS, commands.TELL, commands.SERVER, ps.pid, status)
-	ph.addOutPacket(server, socket, p)
+	ph.tell(server, socket, ps, &protocol.PlayerStatsTell{Cmd: commands.AGLSTATS, Slot: 0, Players: players})
 }
 
 func (ph *PacketHandler) sendAGLplayerCnt(server *ServerThread, socket net.Conn, ps *Packet) {
-	cnt := []byte{0, 1}
 	cl := ph.clients.FindClientBySocket(socket)
-	cnt[1] = byte(ph.clients.GetPlayerCountAgl(cl.GameNumber))
-	p := NewPacket(commands.AGLPLAYERCNT, commands.TELL, commands.SERVER, ps.pid, cnt)
-	ph.addOutPacket(server, socket, p)
+	count := int(ph.clients.GetPlayerCountAgl(cl.GameNumber))
+	ph.tell(server, socket, ps, &protocol.NumberTell{Cmd: commands.AGLPLAYERCNT, Number: count})
 }
 
 func (ph *PacketHandler) sendEventDat(server *ServerThread, socket net.Conn, ps *Packet) {
+	q := &protocol.EventDatQuery{Cmd: commands.EVENTDAT}
+	if !ph.decode(server, socket, ps, q) {
+		return
+	}
 	cl := ph.clients.FindClientBySocket(socket)
-	// area := cl.area
-	// room := cl.room
-	// slotnr := cl.slot
-	// game := cl.GameNumber
+	recpt := protocol.PadHandle(q.Recipient)
 
-	// 0,6; 0,0,0,0,0,0
-	rcpthandle := []byte{0, 6, 0, 0, 0, 0, 0, 0}
-	recpt := []byte{0, 0, 0, 0, 0, 0}
-	event := ps.GetEventData()
-	copy(rcpthandle[2:], event[2:8])
-	copy(recpt, event[2:8])
-
-	eventlen := (int(event[8]) << 8) + int(event[9])&0xff
-
-	// create the event packet: sender, eventdat, and their lengths
-	eventpacket := make([]byte, eventlen+2+6+2)
-	off := 0
-	binary.BigEndian.PutUint16(eventpacket[off:off+2], uint16(6))
-	off += 2
-	copy(eventpacket[off:], cl.hnPair.handle)
-	off += 6
-	binary.BigEndian.PutUint16(eventpacket[off:off+2], uint16(eventlen))
-	off += 2
-	copy(eventpacket[off:], event[10:10+eventlen])
-	off += eventlen
-
-	// p := NewPacket(commands.EVENTDATBC, commands.TELL, commands.SERVER, ps.pid, eventpacket)
-	p := NewPacket(commands.EVENTDATBC, commands.BROADCAST, commands.SERVER, ph.getNextPacketID(), eventpacket)
+	// create the event packet: sender and eventdat
+	event := &protocol.EventDatBroadcast{Sender: protocol.PadHandle(cl.hnPair.handle), Data: q.Data}
 	rcl := ph.clients.FindClientByHandle(string(recpt))
 	if rcl != nil {
-		ph.addOutPacket(server, rcl.socket, p)
+		ph.addOutPacket(server, rcl.socket, ph.newBroadcast(event))
 	}
 
 	// accept event data by sending back unencrypted recipient
-	p = NewPacket(commands.EVENTDAT, commands.TELL, commands.SERVER, ps.pid, rcpthandle)
-	ph.addOutPacket(server, socket, p)
+	ph.tell(server, socket, ps, &protocol.HandleMessage{Cmd: commands.EVENTDAT, Handle: recpt})
 }
 
 func (ph *PacketHandler) sendBuddyList(server *ServerThread, socket net.Conn, ps *Packet) {
-	var p *Packet
-	offline := NewPacketString("<BODY><SIZE=3>not connected<END>").GetData()
-
-	//0,0; 0,0; 0,0; 0
-	online := []byte{0, 0, 0, 0, 0, 0, 0}
-	ingame := []byte{0, 0, 0, 0, 0, 0, 1}
-
-	handle := ps.GetDecryptedString()
-
-	status := ph.clients.GetClientStatus(handle)
+	q := &protocol.SecretQuery{Cmd: commands.BUDDYLIST}
+	if !ph.decode(server, socket, ps, q) {
+		return
+	}
 
-	switch status {
+	var answer protocol.Message
+	switch ph.clients.GetClientStatus(q.Text) {
 	case 1:
-		p = NewPacket(commands.BUDDYLIST, commands.TELL, commands.SERVER, ps.pid, online)
+		answer = &protocol.BuddyListTell{InGame: 0}
 	case 3:
-		p = NewPacket(commands.BUDDYLIST, commands.TELL, commands.SERVER, ps.pid, ingame)
+		answer = &protocol.BuddyListTell{InGame: 1}
 	default:
-		p = NewPacket(commands.BUDDYLIST, commands.TELL, commands.SERVER, ps.pid, offline)
-		p.SetErr()
+		answer = &protocol.ErrorTell{Cmd: commands.BUDDYLIST, Message: []byte("<BODY><SIZE=3>not connected<END>")}
 	}
 
-	ph.addOutPacket(server, socket, p)
+	ph.tell(server, socket, ps, answer)
 }
 
 func (ph *PacketHandler) sendCheckBuddy(server *ServerThread, socket net.Conn, ps *Packet) {
-	var p *Packet
-	offline := NewPacketString("<BODY><SIZE=3><CENTER>not connected<END>").GetData()
+	q := &protocol.SecretQuery{Cmd: commands.CHECKBUDDY}
+	if !ph.decode(server, socket, ps, q) {
+		return
+	}
+	offline := []byte("<BODY><SIZE=3><CENTER>not connected<END>")
 	online := []byte{
-		0x00, 0x0c, 0x30, 0x61, 0x64, 0x36, 0x30, 0x31, 0x30, 0x38, 0x32, 0x30, 0x30, 0x38, // 0ad601082008
-		0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x03,
-		0x00, 0x29, 0x3c, 0x42, 0x4f, 0x44, 0x59, 0x3e, // <BODY>
+		0x3c, 0x42, 0x4f, 0x44, 0x59, 0x3e, // <BODY>
 		0x3c, 0x53, 0x49, 0x5a, 0x45, 0x3d, 0x33, 0x3e, // <SIZE=3>
 		0x82, 0x65, 0x82, 0x71, 0x82, 0x64,
 		0x82, 0x64, 0x83, 0x47, 0x83, 0x8a,
@@ -1913,7 +1856,6 @@ func (ph *PacketHandler) sendCheckBuddy(server *ServerThread, socket net.Conn, p
 		0x3c, 0x45, 0x4e, 0x44, 0x3e, // <END>
 	}
 	ingame := []byte{
-		0x00, 0x2b,
 		0x3c, 0x42, 0x4f, 0x44, 0x59, 0x3e,
 		0x3c, 0x53, 0x49, 0x5a, 0x45, 0x3d, 0x33, 0x3e,
 		0x8c, 0xbb, 0x8d, 0xdd,
@@ -1922,40 +1864,40 @@ func (ph *PacketHandler) sendCheckBuddy(server *ServerThread, socket net.Conn, p
 		0x82, 0xc5, 0x82, 0xb7,
 		0x3c, 0x45, 0x4e, 0x44, 0x3e,
 	}
-	handle := ps.GetDecryptedString()
-	status := ph.clients.GetClientStatus(handle)
-	switch status {
+
+	var answer protocol.Message
+	switch ph.clients.GetClientStatus(q.Text) {
 	case 1:
-		p = NewPacket(commands.CHECKBUDDY, commands.TELL, commands.SERVER, ps.pid, online)
+		answer = &protocol.CheckBuddyTell{
+			Lobby:   []byte("0ad601082008"),
+			Unknown: [4]int{1, 0, 0, 3},
+			Message: online,
+		}
 	case 3:
-		p = NewPacket(commands.CHECKBUDDY, commands.TELL, commands.SERVER, ps.pid, ingame)
-		p.SetErr()
+		answer = &protocol.ErrorTell{Cmd: commands.CHECKBUDDY, Message: ingame}
 	default:
-		p = NewPacket(commands.CHECKBUDDY, commands.TELL, commands.SERVER, ps.pid, offline)
-		p.SetErr()
+		answer = &protocol.ErrorTell{Cmd: commands.CHECKBUDDY, Message: offline}
 	}
-	ph.addOutPacket(server, socket, p)
+	ph.tell(server, socket, ps, answer)
 }
 
 func (ph *PacketHandler) sendPrivateMsg(server *ServerThread, socket net.Conn, ps *Packet) {
-	offline := NewPacketString("<BODY><SIZE=3>not connected<END>").GetData()
-	var p *Packet
+	q := &protocol.EventDatQuery{Cmd: commands.PRIVATEMSG}
+	if !ph.decode(server, socket, ps, q) {
+		return
+	}
 	cl := ph.clients.FindClientBySocket(socket)
-	mess := ps.GetDecryptedPvtMess(cl)
-	cl = ph.clients.FindClientByHandle(string(mess.Recipient))
-	if cl != nil {
-		broadcast := mess.GetPacketData()
+	mess := NewPrivateMessage(cl.hnPair.handle, cl.hnPair.nickname, q.Recipient, q.Data)
+	rcl := ph.clients.FindClientByHandle(string(mess.Recipient))
+	if rcl != nil {
 		// Accept the message packet
-		p = NewPacket(commands.PRIVATEMSG, commands.TELL, commands.SERVER, ps.pid, nil)
+		p := NewPacketWithoutPayload(commands.PRIVATEMSG, commands.TELL, commands.SERVER, ps.pid)
 		ph.addOutPacket(server, socket, p)
 		// Broadcast message to recipient
-		p = NewPacket(commands.PRIVATEMSGBC, commands.BROADCAST, commands.SERVER, ph.getNextPacketID(), broadcast)
-		ph.addOutPacket(server, socket, p)
+		ph.addOutPacket(server, rcl.socket, ph.newBroadcast(mess.GetPacketData()))
 	} else {
 		// Tell sender that recipient is offline
-		p = NewPacket(commands.PRIVATEMSG, commands.TELL, commands.SERVER, ps.pid, offline)
-		p.SetErr()
-		ph.addOutPacket(server, socket, p)
+		ph.tell(server, socket, ps, &protocol.ErrorTell{Cmd: commands.PRIVATEMSG, Message: []byte("<BODY><SIZE=3>not connected<END>")})
 	}
 }
 
@@ -1963,41 +1905,31 @@ func (ph *PacketHandler) sendTimeout(server *ServerThread, socket net.Conn, ps *
 	// set default timeout to 590124 seconds (~10K minutes): 0x9012C
 	// other options: 0x708 = 30min
 	// 				  0x258 = 10min
-	timeout := []byte{0x00, 0x09, 0x01, 0x2C, 0x00, 0x00, 0x02, 0x58}
-	p := NewPacket(commands.UNKN61A0, commands.TELL, commands.SERVER, ps.pid, timeout)
-	ph.addOutPacket(server, socket, p)
+	ph.tell(server, socket, ps, &protocol.Unkn61A0Tell{Timeout: 0x9012C, Timeout2: 0x258})
 }
 
 func (ph *PacketHandler) send61A1(server *ServerThread, socket net.Conn, ps *Packet) {
 	// not 100% sure what this does yet; presumed to be latency
-	latency := []byte{0x00, 0x00, 0x03, byte(0x84), 0x00, 0x00, 0x07, 0x08, 0x00, 0x00}
-	p := NewPacket(commands.UNKN61A1, commands.TELL, commands.SERVER, ps.pid, latency)
-	ph.addOutPacket(server, socket, p)
+	ph.tell(server, socket, ps, &protocol.Unkn61A1Tell{Value1: 0x384, Value2: 0x708})
 }
 
 func (ph *PacketHandler) broadcastAreaPlayerCnt(server *ServerThread, socket net.Conn, nr int) {
-	// 0,0; 0,0; 0xff,0xff; 0,0
-	areaplayercount := []byte{0, 0, 0, 0, 0, 0, 0xff, 0xff, 0, 0}
 	cnt := ph.clients.CountPlayersInArea(nr)
-	cnt[2] = cnt[2] + ph.clients.CountPlayersInRoom(51, 0) + ph.gameServerPacketHandler.CountInGamePlayers()
-
-	areaplayercount[0] = byte(nr>>8) & 0xff
-	areaplayercount[1] = byte(nr) & 0xff
-	areaplayercount[2] = byte(cnt[0]>>8) & 0xff
-	areaplayercount[3] = byte(cnt[0]) & 0xff
-	areaplayercount[4] = byte(cnt[1]>>8) & 0xff
-	areaplayercount[5] = byte(cnt[1]) & 0xff
-	areaplayercount[8] = byte(cnt[2]>>8) & 0xff
-	areaplayercount[9] = byte(cnt[2]) & 0xff
-
-	p := NewPacket(commands.AREAPLAYERCNT, commands.BROADCAST, commands.SERVER, ph.getNextPacketID(), areaplayercount)
+	cnt[2] = cnt[2] + ph.clients.CountPlayersInAgl() + ph.relays.CountPlayers()
+
+	p := ph.newBroadcast(&protocol.PlayerCountTell{
+		Cmd:    commands.AREAPLAYERCNT,
+		Number: nr,
+		Count:  cnt[0],
+		Count2: cnt[1],
+		Count3: cnt[2],
+	})
 	ph.broadcastInAreaNAreaSelect(server, p, nr)
 }
 
 func (ph *PacketHandler) broadcastAglPlayerCnt(server *ServerThread, gamenr int) {
-	cnt := []byte{0, 1}
-	cnt[1] = byte(ph.clients.GetPlayerCountAgl(gamenr))
-	p := NewPacket(commands.AGLPLAYERCNT, commands.BROADCAST, commands.SERVER, ph.getNextPacketID(), cnt)
+	count := int(ph.clients.GetPlayerCountAgl(gamenr))
+	p := ph.newBroadcast(&protocol.NumberTell{Cmd: commands.AGLPLAYERCNT, Number: count})
 	ph.broadcastInAgl(server, p, gamenr)
 }
 
@@ -2022,15 +1954,7 @@ func (ph *PacketHandler) broadcastInAreaNAreaSelect(server *ServerThread, p *Pac
 }
 
 func (ph *PacketHandler) broadcastSlotPlayerStatus(server *ServerThread, area, room, slot int) {
-	// 0x00,0x00; 0x00,0x00; 0x00,0x00; 0x00,0x00, 0x00,0x00
-	retval := []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
-	retval[0] = byte(slot>>8) & 0xff
-	retval[1] = byte(slot) & 0xff
-	retval[3] = byte(ph.clients.CountPlayersInSlot(area, room, slot))
-	retval[5] = 0 // TODO: what is this value?
-	retval[7] = byte(ph.slots.GetMaximumPlayers(area, room, slot))
-	retval[9] = retval[3] // TODO: what is playin2?
-	p := NewPacket(commands.SLOTPLRSTATUS, commands.BROADCAST, commands.SERVER, ph.getNextPacketID(), retval)
+	p := ph.newBroadcast(ph.slotPlayerStatus(area, room, slot))
 	ph.broadcastInSlotNRoom(server, p, area, room, slot)
 }
 
@@ -2055,20 +1979,15 @@ func (ph *PacketHandler) broadcastInRoom(server *ServerThread, p *Packet, area,
 }
 
 func (ph *PacketHandler) broadcastSlotStatus(server *ServerThread, area, room, slot int) {
-	// 0x00,0x00; 0x00
-	retval := []byte{0x00, 0x00, 0x00}
-	retval[0] = byte(slot>>8) & 0xff
-	retval[1] = byte(slot) & 0xff
-	retval[2] = ph.slots.GetStatus(area, room, slot)
-	p := NewPacket(commands.SLOTSTATUS, commands.BROADCAST, commands.SERVER, ph.getNextPacketID(), retval)
+	status := ph.slots.GetStatus(area, room, slot)
+	p := ph.newBroadcast(&protocol.StatusTell{Cmd: commands.SLOTSTATUS, Number: slot, Status: status})
 	ph.broadcastInSlotNRoom(server, p, area, room, slot)
 }
 
 // send this every 30 seconds to all clients; handled by heartbeatthread
 // TODO: what does the payload mean ?
 func (ph *PacketHandler) BroadcastPing(server *ServerThread) {
-	data := []byte{0x00, 0x02, 0x00, 0x01, 0x03, byte(0xe7), 0x00, 0x01}
-	p := NewPacket(commands.HEARTBEAT, commands.BROADCAST, commands.SERVER, ph.getNextPacketID(), data)
+	p := ph.newBroadcast(&protocol.HeartbeatBroadcast{Values: [4]int{2, 1, 999, 1}})
 	ph.broadcastPacket(server, p)
 }
 
@@ -2085,20 +2004,21 @@ func (ph *PacketHandler) removeClient(server *ServerThread, cl *Client) {
 		return
 	}
 	ph.debug("Removing client %s\n", cl.userID)
-	// // If needed, lock the client (e.g., cl.mu.Lock(); defer cl.mu.Unlock())
-	cl.mu.Lock()
-	defer cl.mu.Unlock()
 	area := cl.area
 	room := cl.room
 	slot := cl.slot
 	// game := cl.gamenumber
 	socket := cl.socket
 	host := cl.host
-	who := cl.hnPair.handle
+	// no handle yet when the connection drops during the login
+	var who []byte
+	if cl.hnPair != nil {
+		who = cl.hnPair.handle
+	}
 
 	// Set the client status to offline.
 	if err := ph.db.UpdateClientOrigin(cl.userID, STATUS_OFFLINE, -1, 0, 0); err != nil {
-		fmt.Println("Error updating client origin to offline:", err)
+		ph.log.Error("updating client origin to offline", "userid", cl.userID, "err", err)
 	}
 
 	// Remove the client from the list.
@@ -2119,9 +2039,7 @@ func (ph *PacketHandler) removeClient(server *ServerThread, cl *Client) {
 	// If the client was not a host but still in a slot.
 	if slot != 0 && host == 0 {
 		// Prepare a broadcast packet to notify other players in the slot.
-		wholeaves := []byte{0, 6, 0, 0, 0, 0, 0, 0}
-		copy(wholeaves[2:], who)
-		p := NewPacket(commands.LEAVESLOT, commands.BROADCAST, commands.SERVER, ph.getNextPacketID(), wholeaves)
+		p := ph.newBroadcast(&protocol.HandleMessage{Cmd: commands.LEAVESLOT, Handle: protocol.PadHandle(who)})
 		ph.broadcastInSlot(server, p, area, room, slot)
 
 		// If there is room for additional players and a host is still present, update slot status.
@@ -2146,8 +2064,8 @@ func (ph *PacketHandler) removeClient(server *ServerThread, cl *Client) {
 		ph.broadcastSlotStatus(server, area, room, slot)
 	}
 
-	// // In the after-game lobby (area 51) with a valid game number, you might need extra handling.
-	// if area == 51 && game != 0 {
+	// // In the after-game lobby with a valid game number, you might need extra handling.
+	// if cl.state == STATE_AGL && game != 0 {
 	// 	// TODO: is this really necessary?
 	// }
 
@@ -2167,10 +2085,11 @@ func (ph *PacketHandler) send6002(server *ServerThread, socket net.Conn, ps *Pac
 
 	// reset client's area/slot
 
-	cl.area = 0
-	cl.room = 0
-	cl.slot = 0
+	ph.clients.Move(cl, 0, 0, 0)
 	cl.player = 0
+	if cl.state > STATE_CHARACTER {
+		cl.state = STATE_CHARACTER
+	}
 
 	//free slot for other players when last player left
 	// need to implement theese:
@@ -2194,41 +2113,41 @@ func (ph *PacketHandler) send6002(server *ServerThread, socket net.Conn, ps *Pac
 func (ph *PacketHandler) BroadcastConnCheck(server *ServerThread) {
 	p := NewPacketWithoutPayload(commands.CONNCHECK, commands.QUERY, commands.SERVER, ph.getNextPacketID())
 	for _, cl := range ph.clients.GetList() {
-		if cl.area != 51 {
-			if cl.ConnAlive {
-				cl.ConnAlive = false
+		if !cl.afterGame {
+			if cl.ConnAlive.Swap(false) {
 				ph.addOutPacket(server, cl.socket, p)
 			} else {
-				ph.debug("Client %s did not respond to CONNCHECK; it's OUTTA HERE\n", cl.userID)
+				ph.log.Info("keepalive timeout", "userid", cl.userID, "remote", cl.socket.RemoteAddr().String())
+				METRIC_HEARTBEAT_TIMEOUTS.Inc(ph.variant.Name, "lobby")
 				ph.removeClient(server, cl)
 			}
 		}
 	}
 }
 
-func (ph *PacketHandler) RemoveClientNoDisconnect(server *ServerThread, socket net.Conn) {
+func (ph *PacketHandler) removeClientNoDisconnect(server *ServerThread, socket net.Conn) {
 	cl := ph.clients.FindClientBySocket(socket)
 
 	if cl == nil {
 		return
 	}
-	cl.ConnAlive = false
+	cl.ConnAlive.Store(false)
 
 	ph.debug("client: %s socket: %p\n", cl.userID, socket)
-	// locking becauset his function can be called by both
-	// server and handlerthread
-	cl.mu.Lock()
-	defer cl.mu.Unlock()
 	area := cl.area
 	room := cl.room
 	slot := cl.slot
 	// game := cl.GameNumber
 	host := cl.host
-	who := cl.hnPair.handle
+	// no handle yet when the connection drops during the login
+	var who []byte
+	if cl.hnPair != nil {
+		who = cl.hnPair.handle
+	}
 
 	// Set the client status to offline.
 	if err := ph.db.UpdateClientOrigin(cl.userID, STATUS_OFFLINE, -1, 0, 0); err != nil {
-		ph.debug("Error updating client origin to offline: %v\n", err)
+		ph.log.Error("updating client origin to offline", "userid", cl.userID, "err", err)
 	}
 
 	// Remove the client from the list.
@@ -2250,9 +2169,7 @@ func (ph *PacketHandler) RemoveClientNoDisconnect(server *ServerThread, socket n
 	// If the client was not a host but still in a slot.
 	if slot != 0 && host == 0 {
 		// Prepare a broadcast packet to notify other players in the slot.
-		wholeaves := []byte{0, 6, 0, 0, 0, 0, 0, 0}
-		copy(wholeaves[2:], who)
-		p := NewPacket(commands.LEAVESLOT, commands.BROADCAST, commands.SERVER, ph.getNextPacketID(), wholeaves)
+		p := ph.newBroadcast(&protocol.HandleMessage{Cmd: commands.LEAVESLOT, Handle: protocol.PadHandle(who)})
 		ph.broadcastInSlot(server, p, area, room, slot)
 
 		// If there is room for additional players and a host is still present, update slot status.
@@ -2277,8 +2194,8 @@ func (ph *PacketHandler) RemoveClientNoDisconnect(server *ServerThread, socket n
 		ph.broadcastSlotStatus(server, area, room, slot)
 	}
 
-	// // In the after-game lobby (area 51) with a valid game number, you might need extra handling.
-	// if area == 51 && game != 0 {
+	// // In the after-game lobby with a valid game number, you might need extra handling.
+	// if cl.state == STATE_AGL && game != 0 {
 	// 	// TODO: is this really necessary?
 	// }
 
@@ -2290,6 +2207,9 @@ func (ph *PacketHandler) RemoveClientNoDisconnect(server *ServerThread, socket n
 // broadcast the autostart on zero
 // used for the East Town (area 0x001)
 func (ph *PacketHandler) CheckAutoStart(server *ServerThread) {
+	if !ph.variant.autoStart {
+		return
+	}
 	cls := ph.clients.GetList()
 	for _, cl := range cls {
 		area := cl.area
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func FuzzNewPacketFromBytes(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{0x18, 0x01, 0x61, 0x00, 0x00, 0x00, 0x00, 0x01, 0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte{0x18, 0x01, 0x61, 0x00, 0x00, 0x04, 0x00, 0x01, 0xff, 0xff, 0xff, 0xff, 0x00, 0x02})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		p, err := NewPacketFromBytes(data)
+		if err != nil {
+			return
+		}
+		if p.len != len(p.pay) {
+			t.Fatalf("length %d, payload of %d bytes", p.len, len(p.pay))
+		}
+		// the packet is written back the way it came in, the trailing
+		// header bytes are always 0xff
+		got := p.GetPacketData()
+		want := bytes.Clone(data[:HEADER_SIZE+p.len])
+		copy(want[9:HEADER_SIZE], []byte{0xff, 0xff, 0xff})
+		if !bytes.Equal(got, want) {
+			t.Fatalf("GetPacketData %x, want %x", got, want)
+		}
+	})
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	PASSWORD_ITERATIONS = 210000
+	PASSWORD_SALT_LEN   = 16
+	PASSWORD_KEY_LEN    = 32
+)
+
+// dummyPasswordHash is checked when there is no hash to check, a login of
+// an unknown user takes as long as one with a wrong password.
+var dummyPasswordHash = fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", PASSWORD_ITERATIONS,
+	base64.RawStdEncoding.EncodeToString(make([]byte, PASSWORD_SALT_LEN)),
+	base64.RawStdEncoding.EncodeToString(make([]byte, PASSWORD_KEY_LEN)))
+
+// HashPassword returns a self describing PBKDF2-SHA256 hash:
+// pbkdf2-sha256$<iterations>$<salt>$<key>, salt and key base64 encoded.
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, PASSWORD_SALT_LEN)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, PASSWORD_ITERATIONS, PASSWORD_KEY_LEN)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", PASSWORD_ITERATIONS,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// CheckPassword compares password against a hash made by HashPassword.
+func CheckPassword(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(want) == 0 {
+		return false
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(want))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(key, want) == 1
+}
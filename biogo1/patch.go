@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bioserver/protocol"
+	"bytes"
+	"fmt"
+	"os"
+)
+
+const (
+	PATCH_CHUNK_SIZE = 0x100 // bytes per PATCHDATA packet
+	PATCH_LINE       = 8     // chunks between two PATCHLINECHECKs
+)
+
+// Patch holds the File #1 1.01 patch. It's copyrighted and DNAS protected,
+// so operators have to provide their own patch.raw (0x7aa0 bytes).
+type Patch struct {
+	data    []byte
+	version []byte
+}
+
+// LoadPatch reads the patch data, version is the version string the client
+// reports once the patch is applied.
+func LoadPatch(filename string, version string) (*Patch, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("loading patch: %w", err)
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("loading patch: %s is empty", filename)
+	}
+	serverLog.Info("patch loaded", "file", filename, "bytes", len(data))
+	return &Patch{data: data, version: []byte(version)}, nil
+}
+
+// IsOutdated tells if a client with this version needs the patch. Versions
+// start with the release number ("101 0311172500"), so they sort as text.
+func (p *Patch) IsOutdated(version []byte) bool {
+	version = bytes.TrimRight(version, "\x00")
+	return bytes.Compare(version, p.version) < 0
+}
+
+// GetData returns chunk nr, the last chunk might be shorter
+func (p *Patch) GetData(nr int) []byte {
+	start := nr * PATCH_CHUNK_SIZE
+	if nr < 0 || start >= len(p.data) {
+		return nil
+	}
+	end := min(start+PATCH_CHUNK_SIZE, len(p.data))
+	return p.data[start:end]
+}
+
+// CntChunks calculates the amount of chunks we can send starting at nr,
+// less than PATCH_LINE means the patch ends with them
+func (p *Patch) CntChunks(nr int) int {
+	left := (len(p.data) - nr*PATCH_CHUNK_SIZE + PATCH_CHUNK_SIZE - 1) / PATCH_CHUNK_SIZE
+	return max(min(left, PATCH_LINE), 0)
+}
+
+// GetStart is the PATCHSTART announcement. The sum is a guess, see
+// PatchStartBroadcast.
+func (p *Patch) GetStart() *protocol.PatchStartBroadcast {
+	var sum uint32
+	for _, b := range p.data {
+		sum += uint32(b)
+	}
+	return &protocol.PatchStartBroadcast{
+		Version: p.version,
+		Chunks:  (len(p.data) + PATCH_CHUNK_SIZE - 1) / PATCH_CHUNK_SIZE,
+		Size:    uint32(len(p.data)),
+		Sum:     sum,
+	}
+}
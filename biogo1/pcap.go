@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"time"
+)
+
+// link types of the captures we can read
+const (
+	LINKTYPE_NULL      = 0
+	LINKTYPE_ETHERNET  = 1
+	LINKTYPE_RAW       = 101
+	LINKTYPE_LINUX_SLL = 113
+	LINKTYPE_IPV4      = 228
+	LINKTYPE_IPV6      = 229
+
+	PCAPNG_SHB = 0x0a0d0d0a // section header block
+	PCAPNG_IDB = 1          // interface description block
+	PCAPNG_EPB = 6          // enhanced packet block
+)
+
+// tcpSegment is the part of a captured TCP packet the dissector needs.
+type tcpSegment struct {
+	time    time.Time
+	src     netip.AddrPort
+	dst     netip.AddrPort
+	seq     uint32
+	syn     bool
+	fin     bool // or reset
+	payload []byte
+}
+
+// pcapInterface is a capture interface, pcapng files can have several.
+type pcapInterface struct {
+	linkType int
+	tsUnit   time.Duration // per timestamp tick
+}
+
+// readPcap calls fn for every TCP segment in a pcap or pcapng capture, as
+// saved by Wireshark or tcpdump. Other packets are skipped.
+func readPcap(r io.Reader, fn func(tcpSegment)) error {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint32(magic) == PCAPNG_SHB {
+		return readPcapNG(br, fn)
+	}
+	return readPcapClassic(br, fn)
+}
+
+// isPcap tells if data starts like a pcap or pcapng file.
+func isPcap(data []byte) bool {
+	if len(data) < 4 {
+		return false
+	}
+	switch binary.LittleEndian.Uint32(data) {
+	case PCAPNG_SHB, 0xa1b2c3d4, 0xd4c3b2a1, 0xa1b23c4d, 0x4d3cb2a1:
+		return true
+	}
+	return false
+}
+
+func readPcapClassic(r io.Reader, fn func(tcpSegment)) error {
+	var hdr [24]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return fmt.Errorf("pcap header: %w", err)
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	unit := time.Microsecond
+	switch binary.LittleEndian.Uint32(hdr[:]) {
+	case 0xa1b2c3d4:
+	case 0xa1b23c4d:
+		unit = time.Nanosecond
+	case 0xd4c3b2a1:
+		order = binary.BigEndian
+	case 0x4d3cb2a1:
+		order, unit = binary.BigEndian, time.Nanosecond
+	default:
+		return errors.New("not a pcap file")
+	}
+	linkType := int(order.Uint32(hdr[20:]) & 0xffff)
+
+	var rec [16]byte
+	for {
+		if _, err := io.ReadFull(r, rec[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("pcap record: %w", err)
+		}
+		ts := time.Unix(int64(order.Uint32(rec[0:])), int64(order.Uint32(rec[4:]))*int64(unit))
+		data := make([]byte, order.Uint32(rec[8:]))
+		if _, err := io.ReadFull(r, data); err != nil {
+			return fmt.Errorf("pcap record: %w", err)
+		}
+		if seg, ok := parseLinkFrame(linkType, data); ok {
+			seg.time = ts
+			fn(seg)
+		}
+	}
+}
+
+func readPcapNG(r io.Reader, fn func(tcpSegment)) error {
+	var order binary.ByteOrder = binary.LittleEndian
+	var interfaces []pcapInterface
+	var hdr [8]byte
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("pcapng block: %w", err)
+		}
+		blockType := binary.LittleEndian.Uint32(hdr[:])
+		if blockType == PCAPNG_SHB {
+			// the byte order magic follows, every section can have its own
+			var bom [4]byte
+			if _, err := io.ReadFull(r, bom[:]); err != nil {
+				return fmt.Errorf("pcapng section: %w", err)
+			}
+			if binary.LittleEndian.Uint32(bom[:]) == 0x1a2b3c4d {
+				order = binary.LittleEndian
+			} else {
+				order = binary.BigEndian
+			}
+			interfaces = nil
+			length := int(order.Uint32(hdr[4:]))
+			if length < 12 {
+				return errors.New("pcapng section: bad block length")
+			}
+			if _, err := io.CopyN(io.Discard, r, int64(length-12)); err != nil {
+				return fmt.Errorf("pcapng section: %w", err)
+			}
+			continue
+		}
+		blockType = order.Uint32(hdr[:])
+		length := int(order.Uint32(hdr[4:]))
+		if length < 12 || length%4 != 0 {
+			return fmt.Errorf("pcapng block: bad length %d", length)
+		}
+		body := make([]byte, length-8)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return fmt.Errorf("pcapng block: %w", err)
+		}
+		body = body[:len(body)-4] // trailing length
+
+		switch blockType {
+		case PCAPNG_IDB:
+			if len(body) < 8 {
+				return errors.New("pcapng interface: short block")
+			}
+			iface := pcapInterface{linkType: int(order.Uint16(body)), tsUnit: time.Microsecond}
+			// options: if_tsresol changes the timestamp unit
+			for opts := body[8:]; len(opts) >= 4; {
+				code, n := order.Uint16(opts), int(order.Uint16(opts[2:]))
+				if code == 0 || 4+n > len(opts) {
+					break
+				}
+				if code == 9 && n == 1 {
+					iface.tsUnit = pcapTimestampUnit(opts[4])
+				}
+				opts = opts[4+(n+3)&^3:]
+			}
+			interfaces = append(interfaces, iface)
+		case PCAPNG_EPB:
+			if len(body) < 20 {
+				return errors.New("pcapng packet: short block")
+			}
+			id := int(order.Uint32(body))
+			if id >= len(interfaces) {
+				return fmt.Errorf("pcapng packet: unknown interface %d", id)
+			}
+			ticks := uint64(order.Uint32(body[4:]))<<32 | uint64(order.Uint32(body[8:]))
+			captured := int(order.Uint32(body[12:]))
+			if 20+captured > len(body) {
+				return errors.New("pcapng packet: short block")
+			}
+			if seg, ok := parseLinkFrame(interfaces[id].linkType, body[20:20+captured]); ok {
+				seg.time = time.Unix(0, 0).Add(time.Duration(ticks) * interfaces[id].tsUnit)
+				fn(seg)
+			}
+		}
+	}
+}
+
+// pcapTimestampUnit decodes if_tsresol, a power of 10 or, with the high
+// bit set, of 2.
+func pcapTimestampUnit(res byte) time.Duration {
+	exp := int(res & 0x7f)
+	if res&0x80 != 0 {
+		return time.Second >> exp
+	}
+	unit := time.Second
+	for i := 0; i < exp && unit > 1; i++ {
+		unit /= 10
+	}
+	return unit
+}
+
+// parseLinkFrame finds the TCP segment in a captured frame.
+func parseLinkFrame(linkType int, frame []byte) (tcpSegment, bool) {
+	switch linkType {
+	case LINKTYPE_ETHERNET:
+		if len(frame) < 14 {
+			return tcpSegment{}, false
+		}
+		etherType, frame := binary.BigEndian.Uint16(frame[12:]), frame[14:]
+		for etherType == 0x8100 && len(frame) >= 4 { // VLAN tag
+			etherType, frame = binary.BigEndian.Uint16(frame[2:]), frame[4:]
+		}
+		if etherType != 0x0800 && etherType != 0x86dd {
+			return tcpSegment{}, false
+		}
+		return parseIPPacket(frame)
+	case LINKTYPE_LINUX_SLL:
+		if len(frame) < 16 {
+			return tcpSegment{}, false
+		}
+		return parseIPPacket(frame[16:])
+	case LINKTYPE_NULL:
+		if len(frame) < 4 {
+			return tcpSegment{}, false
+		}
+		return parseIPPacket(frame[4:])
+	case LINKTYPE_RAW, LINKTYPE_IPV4, LINKTYPE_IPV6:
+		return parseIPPacket(frame)
+	}
+	return tcpSegment{}, false
+}
+
+// parseIPPacket reads an IPv4 or IPv6 packet carrying TCP. IPv6 extension
+// headers and IP fragments are not supported.
+func parseIPPacket(packet []byte) (tcpSegment, bool) {
+	if len(packet) < 1 {
+		return tcpSegment{}, false
+	}
+	var src, dst netip.Addr
+	var tcp []byte
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 20 {
+			return tcpSegment{}, false
+		}
+		ihl := int(packet[0]&0x0f) * 4
+		total := int(binary.BigEndian.Uint16(packet[2:]))
+		if packet[9] != 6 || ihl < 20 || total < ihl || total > len(packet) {
+			return tcpSegment{}, false
+		}
+		src = netip.AddrFrom4([4]byte(packet[12:16]))
+		dst = netip.AddrFrom4([4]byte(packet[16:20]))
+		tcp = packet[ihl:total]
+	case 6:
+		if len(packet) < 40 {
+			return tcpSegment{}, false
+		}
+		length := int(binary.BigEndian.Uint16(packet[4:]))
+		if packet[6] != 6 || 40+length > len(packet) {
+			return tcpSegment{}, false
+		}
+		src = netip.AddrFrom16([16]byte(packet[8:24]))
+		dst = netip.AddrFrom16([16]byte(packet[24:40]))
+		tcp = packet[40 : 40+length]
+	default:
+		return tcpSegment{}, false
+	}
+	if len(tcp) < 20 {
+		return tcpSegment{}, false
+	}
+	offset := int(tcp[12]>>4) * 4
+	if offset < 20 || offset > len(tcp) {
+		return tcpSegment{}, false
+	}
+	return tcpSegment{
+		src:     netip.AddrPortFrom(src, binary.BigEndian.Uint16(tcp[0:])),
+		dst:     netip.AddrPortFrom(dst, binary.BigEndian.Uint16(tcp[2:])),
+		seq:     binary.BigEndian.Uint32(tcp[4:]),
+		syn:     tcp[13]&0x02 != 0,
+		fin:     tcp[13]&0x05 != 0,
+		payload: tcp[offset:],
+	}, true
+}
@@ -0,0 +1,224 @@
+// Package protocol defines the wire format of the Outbreak lobby: the
+// 12 byte packet header and one struct per command payload.
+//
+// Payloads are big-endian. Strings are prefixed with a 2 byte length.
+// Strings typed in by the player (handles, chat, passwords, ...) are
+// "secret": the length includes a 2 byte checksum that follows it, and the
+// text is XOR obfuscated with a key stream derived from the packet id, see
+// CalcShift.
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrShortPayload = errors.New("payload too short")
+	ErrBadLength    = errors.New("inconsistent length field")
+)
+
+// CalcShift returns the XOR key for byte i of a secret string in a packet
+// whose id ends in pb.
+func CalcShift(i byte, pb byte) byte {
+	fixval := []byte{21, 23, 10, 17, 23, 19, 6, 13}
+	masks := []byte{0x33, 0x30, 0x3c, 0x34, 0x2d, 0x30, 0x3c, 0x34}
+	return byte(fixval[i&7] - (i & 0xf8) - pb + ((pb-9+i)&masks[i&7])*2)
+}
+
+// Crypt obfuscates or deobfuscates data in place, the operation is its own
+// inverse.
+func Crypt(data []byte, pid int) {
+	for i := range data {
+		data[i] ^= CalcShift(byte(i), byte(pid&0xff))
+	}
+}
+
+// Checksum is what the client puts in front of a secret string. The server
+// never verifies it, the simulator only needs something plausible.
+func Checksum(plain []byte) uint16 {
+	var sum uint16
+	for _, b := range plain {
+		sum += uint16(b)
+	}
+	return sum
+}
+
+// Reader decodes a payload. The first error sticks: once a read runs past
+// the end every following read returns zero values, so a decoder can read
+// all its fields and check Err once at the end.
+type Reader struct {
+	buf []byte
+	off int
+	pid int
+	err error
+}
+
+func NewReader(payload []byte, pid int) *Reader {
+	return &Reader{buf: payload, pid: pid}
+}
+
+func (r *Reader) fail(err error) {
+	if r.err == nil {
+		r.err = fmt.Errorf("%w at offset %d of %d", err, r.off, len(r.buf))
+	}
+}
+
+func (r *Reader) need(n int) bool {
+	if r.err != nil {
+		return false
+	}
+	if n < 0 || r.off+n > len(r.buf) {
+		r.fail(ErrShortPayload)
+		return false
+	}
+	return true
+}
+
+// Err returns the first decoding error.
+func (r *Reader) Err() error {
+	return r.err
+}
+
+// Offset is the number of bytes consumed so far.
+func (r *Reader) Offset() int {
+	return r.off
+}
+
+// Remaining is the number of unread bytes.
+func (r *Reader) Remaining() int {
+	return len(r.buf) - r.off
+}
+
+func (r *Reader) U8() byte {
+	if !r.need(1) {
+		return 0
+	}
+	v := r.buf[r.off]
+	r.off++
+	return v
+}
+
+func (r *Reader) U16() int {
+	if !r.need(2) {
+		return 0
+	}
+	v := int(binary.BigEndian.Uint16(r.buf[r.off:]))
+	r.off += 2
+	return v
+}
+
+func (r *Reader) U32() uint32 {
+	if !r.need(4) {
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.buf[r.off:])
+	r.off += 4
+	return v
+}
+
+// Bytes returns a copy of the next n bytes.
+func (r *Reader) Bytes(n int) []byte {
+	if !r.need(n) {
+		return nil
+	}
+	v := make([]byte, n)
+	copy(v, r.buf[r.off:r.off+n])
+	r.off += n
+	return v
+}
+
+// Rest returns a copy of everything not read yet.
+func (r *Reader) Rest() []byte {
+	return r.Bytes(r.Remaining())
+}
+
+// String reads a length prefixed string.
+func (r *Reader) String() []byte {
+	n := r.U16()
+	return r.Bytes(n)
+}
+
+// Secret reads an obfuscated string and returns the plain text and the
+// checksum the client sent with it.
+func (r *Reader) Secret() ([]byte, uint16) {
+	n := r.U16()
+	if r.err == nil && n < 2 {
+		r.fail(ErrBadLength)
+		return nil, 0
+	}
+	sum := r.U16()
+	data := r.Bytes(n - 2)
+	if data == nil {
+		return nil, 0
+	}
+	Crypt(data, r.pid)
+	return data, uint16(sum)
+}
+
+// Writer encodes a payload.
+type Writer struct {
+	buf []byte
+	pid int
+}
+
+func NewWriter(pid int) *Writer {
+	return &Writer{pid: pid}
+}
+
+// Bytes returns the encoded payload.
+func (w *Writer) Bytes() []byte {
+	return w.buf
+}
+
+func (w *Writer) Len() int {
+	return len(w.buf)
+}
+
+func (w *Writer) U8(v byte) {
+	w.buf = append(w.buf, v)
+}
+
+func (w *Writer) U16(v int) {
+	w.buf = binary.BigEndian.AppendUint16(w.buf, uint16(v))
+}
+
+func (w *Writer) U32(v uint32) {
+	w.buf = binary.BigEndian.AppendUint32(w.buf, v)
+}
+
+func (w *Writer) Raw(v []byte) {
+	w.buf = append(w.buf, v...)
+}
+
+// Zero appends n zero bytes.
+func (w *Writer) Zero(n int) {
+	for i := 0; i < n; i++ {
+		w.buf = append(w.buf, 0)
+	}
+}
+
+// String writes a length prefixed string.
+func (w *Writer) String(v []byte) {
+	w.U16(len(v))
+	w.Raw(v)
+}
+
+// Secret writes an obfuscated string the way the client does.
+func (w *Writer) Secret(plain []byte) {
+	w.U16(len(plain) + 2)
+	w.U16(int(Checksum(plain)))
+	data := make([]byte, len(plain))
+	copy(data, plain)
+	Crypt(data, w.pid)
+	w.Raw(data)
+}
+
+// PlainSecret writes a secret string layout without obfuscation. The
+// server echoes some secret strings back like that.
+func (w *Writer) PlainSecret(plain []byte, sum uint16) {
+	w.U16(len(plain) + 2)
+	w.U16(int(sum))
+	w.Raw(plain)
+}
@@ -0,0 +1,218 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Field is one decoded payload field, for traces and the dissector.
+type Field struct {
+	Name string
+	// Value is an int or uint, a string, a []Field for nested structs or an
+	// []any for lists.
+	Value any
+}
+
+// Fields lists the payload fields of m in declaration order. Byte strings
+// are shown as text when they are printable (secret strings are already
+// decrypted by the decoder) and as "hex:..." otherwise. Embedded structs
+// are flattened and the command number is left out.
+func Fields(m Message) []Field {
+	v := reflect.ValueOf(m)
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+	return structFields(v)
+}
+
+func structFields(v reflect.Value) []Field {
+	var fields []Field
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() || f.Name == "Cmd" {
+			continue
+		}
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			fields = append(fields, structFields(v.Field(i))...)
+			continue
+		}
+		fields = append(fields, Field{Name: f.Name, Value: fieldValue(v.Field(i))})
+	}
+	return fields
+}
+
+func fieldValue(v reflect.Value) any {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint()
+	case reflect.Bool:
+		return v.Bool()
+	case reflect.String:
+		return v.String()
+	case reflect.Pointer:
+		if v.IsNil() {
+			return nil
+		}
+		return fieldValue(v.Elem())
+	case reflect.Struct:
+		return structFields(v)
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			return FormatBytes(b)
+		}
+		list := make([]any, v.Len())
+		for i := range list {
+			list[i] = fieldValue(v.Index(i))
+		}
+		return list
+	}
+	return v.Interface()
+}
+
+// FlatFields lists the fields of m like Fields, with nested structs and
+// lists flattened into dotted names like Sender.Handle or Players.0.Stats,
+// the names SetField takes.
+func FlatFields(m Message) []Field {
+	return flatten(nil, "", Fields(m))
+}
+
+func flatten(flat []Field, prefix string, fields []Field) []Field {
+	for _, f := range fields {
+		flat = flattenValue(flat, prefix+f.Name, f.Value)
+	}
+	return flat
+}
+
+func flattenValue(flat []Field, name string, value any) []Field {
+	switch v := value.(type) {
+	case []Field:
+		return flatten(flat, name+".", v)
+	case []any:
+		for i, e := range v {
+			flat = flattenValue(flat, name+"."+strconv.Itoa(i), e)
+		}
+		return flat
+	}
+	return append(flat, Field{Name: name, Value: value})
+}
+
+// SetField sets a payload field of m from its text form as shown by Fields:
+// numbers in decimal or with 0x, byte strings as text or "hex:...". name is
+// a field name or a dotted path as listed by FlatFields.
+func SetField(m Message, name, value string) error {
+	v := reflect.ValueOf(m)
+	if v.Kind() != reflect.Pointer || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("%T has no fields", m)
+	}
+	v = v.Elem()
+	for _, part := range strings.Split(name, ".") {
+		if v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		switch v.Kind() {
+		case reflect.Struct:
+			f, ok := v.Type().FieldByName(part)
+			if !ok || !f.IsExported() || part == "Cmd" {
+				return fmt.Errorf("%s has no field %s", Name(m.Command()), name)
+			}
+			v = v.FieldByIndex(f.Index)
+		case reflect.Slice, reflect.Array:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 {
+				return fmt.Errorf("%s: bad index %q", name, part)
+			}
+			if i >= v.Len() {
+				if v.Kind() == reflect.Array {
+					return fmt.Errorf("%s: index %d out of range", name, i)
+				}
+				v.Set(reflect.AppendSlice(v, reflect.MakeSlice(v.Type(), i+1-v.Len(), i+1-v.Len())))
+			}
+			v = v.Index(i)
+		default:
+			return fmt.Errorf("%s has no field %s", Name(m.Command()), name)
+		}
+	}
+	if err := setValue(v, value); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+func setValue(v reflect.Value, s string) error {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 0, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 0, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() != reflect.Uint8 {
+			return fmt.Errorf("can't set a list from %q", s)
+		}
+		b, err := ParseBytes(s)
+		if err != nil {
+			return err
+		}
+		if v.Kind() == reflect.Array {
+			reflect.Copy(v, reflect.ValueOf(b))
+		} else {
+			v.SetBytes(b)
+		}
+	default:
+		return fmt.Errorf("can't set a %s", v.Type())
+	}
+	return nil
+}
+
+// FormatBytes shows b as text when it is printable ASCII, trailing NULs of
+// padded handles ignored, and as "hex:..." otherwise.
+func FormatBytes(b []byte) string {
+	text := bytes.TrimRight(b, "\x00")
+	for _, c := range text {
+		if c < 0x20 || c > 0x7e {
+			return "hex:" + hex.EncodeToString(b)
+		}
+	}
+	return string(text)
+}
+
+// ParseBytes is FormatBytes backwards.
+func ParseBytes(s string) ([]byte, error) {
+	if h, ok := strings.CutPrefix(s, "hex:"); ok {
+		return hex.DecodeString(h)
+	}
+	return []byte(s), nil
+}
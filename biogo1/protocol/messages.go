@@ -0,0 +1,1249 @@
+package protocol
+
+import (
+	"fmt"
+
+	"bioserver/commands"
+)
+
+const (
+	CHARACTER_STATS_SIZE = 0xD0 // size of the statistics sent with CHARSELECT
+	HANDLE_SIZE          = 6
+)
+
+// Message is the payload of one command. Most commands have a Query sent
+// by the client and a Tell answered by the server; both have their own
+// type. Broadcasts are named after the command as well.
+type Message interface {
+	Command() int
+	MarshalPayload(w *Writer)
+	UnmarshalPayload(r *Reader)
+}
+
+// HNPair is a handle and nickname as sent in most player related packets.
+type HNPair struct {
+	Handle   []byte
+	Nickname []byte
+}
+
+func (p *HNPair) marshal(w *Writer) {
+	w.String(p.Handle)
+	w.String(p.Nickname)
+}
+
+func (p *HNPair) unmarshal(r *Reader) {
+	p.Handle = r.String()
+	p.Nickname = r.String()
+}
+
+// CharacterStat is a player with the statistics of the chosen character.
+type CharacterStat struct {
+	HNPair
+	Stats []byte
+}
+
+func (c *CharacterStat) marshal(w *Writer) {
+	c.HNPair.marshal(w)
+	w.String(c.Stats)
+}
+
+func (c *CharacterStat) unmarshal(r *Reader) {
+	c.HNPair.unmarshal(r)
+	c.Stats = r.String()
+}
+
+// PadHandle returns a handle of exactly HANDLE_SIZE bytes.
+func PadHandle(handle []byte) []byte {
+	h := make([]byte, HANDLE_SIZE)
+	copy(h, handle)
+	return h
+}
+
+// Empty is a command without payload.
+type Empty struct {
+	Cmd int
+}
+
+func (m *Empty) Command() int               { return m.Cmd }
+func (m *Empty) MarshalPayload(w *Writer)   {}
+func (m *Empty) UnmarshalPayload(r *Reader) {}
+
+// Raw is a command whose payload is not understood (yet) or just echoed.
+type Raw struct {
+	Cmd  int
+	Data []byte
+}
+
+func (m *Raw) Command() int               { return m.Cmd }
+func (m *Raw) MarshalPayload(w *Writer)   { w.Raw(m.Data) }
+func (m *Raw) UnmarshalPayload(r *Reader) { m.Data = r.Rest() }
+
+// ErrorTell is the answer to any query that failed, the header carries the
+// error flag and the payload is a message shown to the player.
+type ErrorTell struct {
+	Cmd     int
+	Message []byte
+}
+
+func (m *ErrorTell) Command() int               { return m.Cmd }
+func (m *ErrorTell) MarshalPayload(w *Writer)   { w.String(m.Message) }
+func (m *ErrorTell) UnmarshalPayload(r *Reader) { m.Message = r.String() }
+
+// TextBroadcast is a message shown to the players, like a cancelled slot
+// or a server shutdown.
+type TextBroadcast struct {
+	Cmd     int
+	Message []byte
+}
+
+func (m *TextBroadcast) Command() int               { return m.Cmd }
+func (m *TextBroadcast) MarshalPayload(w *Writer)   { w.String(m.Message) }
+func (m *TextBroadcast) UnmarshalPayload(r *Reader) { m.Message = r.String() }
+
+// NumberQuery is the common query for one area, room or slot.
+type NumberQuery struct {
+	Cmd    int
+	Number int
+}
+
+func (m *NumberQuery) Command() int               { return m.Cmd }
+func (m *NumberQuery) MarshalPayload(w *Writer)   { w.U16(m.Number) }
+func (m *NumberQuery) UnmarshalPayload(r *Reader) { m.Number = r.U16() }
+
+// NumberTell answers with a single number: counts, the selected area, ...
+type NumberTell struct {
+	Cmd    int
+	Number int
+}
+
+func (m *NumberTell) Command() int               { return m.Cmd }
+func (m *NumberTell) MarshalPayload(w *Writer)   { w.U16(m.Number) }
+func (m *NumberTell) UnmarshalPayload(r *Reader) { m.Number = r.U16() }
+
+// ByteTell answers with a single byte.
+type ByteTell struct {
+	Cmd   int
+	Value byte
+}
+
+func (m *ByteTell) Command() int               { return m.Cmd }
+func (m *ByteTell) MarshalPayload(w *Writer)   { w.U8(m.Value) }
+func (m *ByteTell) UnmarshalPayload(r *Reader) { m.Value = r.U8() }
+
+// ByteQuery asks with a single byte, a player number mostly.
+type ByteQuery struct {
+	Cmd   int
+	Value byte
+}
+
+func (m *ByteQuery) Command() int               { return m.Cmd }
+func (m *ByteQuery) MarshalPayload(w *Writer)   { w.U8(m.Value) }
+func (m *ByteQuery) UnmarshalPayload(r *Reader) { m.Value = r.U8() }
+
+// NameTell is the name or description of an area, room or slot.
+type NameTell struct {
+	Cmd    int
+	Number int
+	Name   []byte
+}
+
+func (m *NameTell) Command() int { return m.Cmd }
+func (m *NameTell) MarshalPayload(w *Writer) {
+	w.U16(m.Number)
+	w.String(m.Name)
+}
+func (m *NameTell) UnmarshalPayload(r *Reader) {
+	m.Number = r.U16()
+	m.Name = r.String()
+}
+
+// Unkn6308Tell answers 6308 for a room, what follows the room number
+// differs between the titles.
+type Unkn6308Tell struct {
+	Number int
+	Data   []byte
+}
+
+func (m *Unkn6308Tell) Command() int { return commands.UNKN6308 }
+func (m *Unkn6308Tell) MarshalPayload(w *Writer) {
+	w.U16(m.Number)
+	w.Raw(m.Data)
+}
+func (m *Unkn6308Tell) UnmarshalPayload(r *Reader) {
+	m.Number = r.U16()
+	m.Data = r.Rest()
+}
+
+// StatusTell is the status byte of an area, room or slot, also used for
+// the password protection flag of a slot.
+type StatusTell struct {
+	Cmd    int
+	Number int
+	Status byte
+}
+
+func (m *StatusTell) Command() int { return m.Cmd }
+func (m *StatusTell) MarshalPayload(w *Writer) {
+	w.U16(m.Number)
+	w.U8(m.Status)
+}
+func (m *StatusTell) UnmarshalPayload(r *Reader) {
+	m.Number = r.U16()
+	m.Status = r.U8()
+}
+
+// PlayerCountTell are the player counters of an area or room. For areas
+// Count3 holds the players in games and after game lobbies, for rooms it
+// is Count2.
+type PlayerCountTell struct {
+	Cmd    int
+	Number int
+	Count  int
+	Count2 int
+	Count3 int
+}
+
+func (m *PlayerCountTell) Command() int { return m.Cmd }
+func (m *PlayerCountTell) MarshalPayload(w *Writer) {
+	w.U16(m.Number)
+	w.U16(m.Count)
+	w.U16(m.Count2)
+	w.U16(0xffff)
+	w.U16(m.Count3)
+}
+func (m *PlayerCountTell) UnmarshalPayload(r *Reader) {
+	m.Number = r.U16()
+	m.Count = r.U16()
+	m.Count2 = r.U16()
+	r.U16()
+	m.Count3 = r.U16()
+}
+
+// HandleMessage tells which player left a slot or after game lobby, it
+// also confirms the recipient of EVENTDAT.
+type HandleMessage struct {
+	Cmd    int
+	Handle []byte
+}
+
+func (m *HandleMessage) Command() int               { return m.Cmd }
+func (m *HandleMessage) MarshalPayload(w *Writer)   { w.String(m.Handle) }
+func (m *HandleMessage) UnmarshalPayload(r *Reader) { m.Handle = r.String() }
+
+// CharacterStatBroadcast shows a joining player to the others.
+type CharacterStatBroadcast struct {
+	Cmd int
+	CharacterStat
+}
+
+func (m *CharacterStatBroadcast) Command() int               { return m.Cmd }
+func (m *CharacterStatBroadcast) MarshalPayload(w *Writer)   { m.CharacterStat.marshal(w) }
+func (m *CharacterStatBroadcast) UnmarshalPayload(r *Reader) { m.CharacterStat.unmarshal(r) }
+
+// SecretQuery carries a single string typed in by the player.
+type SecretQuery struct {
+	Cmd  int
+	Text []byte
+	Sum  uint16
+}
+
+func (m *SecretQuery) Command() int               { return m.Cmd }
+func (m *SecretQuery) MarshalPayload(w *Writer)   { w.Secret(m.Text) }
+func (m *SecretQuery) UnmarshalPayload(r *Reader) { m.Text, m.Sum = r.Secret() }
+
+// SecretEchoTell confirms a SecretQuery by sending the text back in plain.
+type SecretEchoTell struct {
+	Cmd  int
+	Text []byte
+	Sum  uint16
+}
+
+func (m *SecretEchoTell) Command() int             { return m.Cmd }
+func (m *SecretEchoTell) MarshalPayload(w *Writer) { w.PlainSecret(m.Text, m.Sum) }
+func (m *SecretEchoTell) UnmarshalPayload(r *Reader) {
+	n := r.U16()
+	m.Sum = uint16(r.U16())
+	m.Text = r.Bytes(n - 2)
+}
+
+// ---- login
+
+// LoginQuery opens the connection, the client answers with its session.
+type LoginQuery struct {
+	Seed []byte
+}
+
+func (m *LoginQuery) Command() int               { return commands.LOGIN }
+func (m *LoginQuery) MarshalPayload(w *Writer)   { w.Raw(m.Seed) }
+func (m *LoginQuery) UnmarshalPayload(r *Reader) { m.Seed = r.Rest() }
+
+// LoginTell carries the session id from the login pages. It is sent as
+// two 5 digit numbers, each increased by the packet id.
+type LoginTell struct {
+	Unknown int
+	Session string
+}
+
+func (m *LoginTell) Command() int { return commands.LOGIN }
+func (m *LoginTell) MarshalPayload(w *Writer) {
+	w.U16(m.Unknown)
+	w.Raw(EncodeSession(m.Session, w.pid))
+}
+func (m *LoginTell) UnmarshalPayload(r *Reader) {
+	m.Unknown = r.U16()
+	m.Session = decodeSession(r)
+}
+
+// GSLoginTell is the session check on the game server, same digits as
+// LoginTell but without the leading word.
+type GSLoginTell struct {
+	Session string
+}
+
+func (m *GSLoginTell) Command() int               { return commands.GSLOGIN }
+func (m *GSLoginTell) MarshalPayload(w *Writer)   { w.Raw(EncodeSession(m.Session, w.pid)) }
+func (m *GSLoginTell) UnmarshalPayload(r *Reader) { m.Session = decodeSession(r) }
+
+// EncodeSession turns an 8 digit session id into the 10 digits the client
+// sends in a packet with the given id.
+func EncodeSession(session string, pid int) []byte {
+	var a, b int
+	fmt.Sscanf(fmt.Sprintf("%08s", session), "%4d%4d", &a, &b)
+	return []byte(fmt.Sprintf("%05d%05d", a+pid, b+pid))
+}
+
+func decodeSession(r *Reader) string {
+	digits := r.Bytes(10)
+	if digits == nil {
+		return ""
+	}
+	var sess [2]int
+	for i, d := range digits {
+		if d < '0' || d > '9' {
+			r.fail(fmt.Errorf("session digit %q: %w", d, ErrBadLength))
+			return ""
+		}
+		sess[i/5] = sess[i/5]*10 + int(d-'0')
+	}
+	return fmt.Sprintf("%04d%04d", sess[0]-r.pid, sess[1]-r.pid)
+}
+
+// CheckVersionTell is the version string of the game disc or patch.
+type CheckVersionTell struct {
+	Unknown []byte
+	Version []byte
+	Sum     uint16
+}
+
+func (m *CheckVersionTell) Command() int { return commands.CHECKVERSION }
+func (m *CheckVersionTell) MarshalPayload(w *Writer) {
+	unknown := make([]byte, 3)
+	copy(unknown, m.Unknown)
+	w.Raw(unknown)
+	w.Secret(m.Version)
+}
+func (m *CheckVersionTell) UnmarshalPayload(r *Reader) {
+	m.Unknown = r.Bytes(3)
+	m.Version, m.Sum = r.Secret()
+}
+
+// CheckRndTell answers a CHECKRND query with the first random byte.
+type CheckRndTell struct {
+	Value byte
+}
+
+func (m *CheckRndTell) Command() int             { return commands.CHECKRND }
+func (m *CheckRndTell) MarshalPayload(w *Writer) { w.String([]byte{m.Value}) }
+func (m *CheckRndTell) UnmarshalPayload(r *Reader) {
+	if v := r.String(); len(v) > 0 {
+		m.Value = v[0]
+	}
+}
+
+// Unkn61A0Tell sets the client timeouts in seconds.
+type Unkn61A0Tell struct {
+	Timeout  uint32
+	Timeout2 uint32
+}
+
+func (m *Unkn61A0Tell) Command() int { return commands.UNKN61A0 }
+func (m *Unkn61A0Tell) MarshalPayload(w *Writer) {
+	w.U32(m.Timeout)
+	w.U32(m.Timeout2)
+}
+func (m *Unkn61A0Tell) UnmarshalPayload(r *Reader) {
+	m.Timeout = r.U32()
+	m.Timeout2 = r.U32()
+}
+
+// Unkn61A1Tell is presumed to be latency related.
+type Unkn61A1Tell struct {
+	Value1  uint32
+	Value2  uint32
+	Unknown int
+}
+
+func (m *Unkn61A1Tell) Command() int { return commands.UNKN61A1 }
+func (m *Unkn61A1Tell) MarshalPayload(w *Writer) {
+	w.U32(m.Value1)
+	w.U32(m.Value2)
+	w.U16(m.Unknown)
+}
+func (m *Unkn61A1Tell) UnmarshalPayload(r *Reader) {
+	m.Value1 = r.U32()
+	m.Value2 = r.U32()
+	m.Unknown = r.U16()
+}
+
+// IDHNPairsBroadcast offers the handles registered for this user.
+type IDHNPairsBroadcast struct {
+	Pairs []HNPair
+}
+
+func (m *IDHNPairsBroadcast) Command() int { return commands.IDHNPAIRS }
+func (m *IDHNPairsBroadcast) MarshalPayload(w *Writer) {
+	w.U8(byte(len(m.Pairs)))
+	for i := range m.Pairs {
+		m.Pairs[i].marshal(w)
+		w.U16(0)
+	}
+}
+func (m *IDHNPairsBroadcast) UnmarshalPayload(r *Reader) {
+	n := int(r.U8())
+	m.Pairs = nil
+	for i := 0; i < n && r.Err() == nil; i++ {
+		var p HNPair
+		p.unmarshal(r)
+		r.U16()
+		m.Pairs = append(m.Pairs, p)
+	}
+}
+
+// HNSelectQuery is the chosen handle and nickname, "******" as handle
+// asks for a new one.
+type HNSelectQuery struct {
+	HNPair
+}
+
+func (m *HNSelectQuery) Command() int { return commands.HNSELECT }
+func (m *HNSelectQuery) MarshalPayload(w *Writer) {
+	w.Secret(m.Handle)
+	w.Secret(m.Nickname)
+}
+func (m *HNSelectQuery) UnmarshalPayload(r *Reader) {
+	m.Handle, _ = r.Secret()
+	m.Nickname, _ = r.Secret()
+}
+
+// HNSelectTell confirms the handle, a new one when it was created.
+type HNSelectTell struct {
+	Handle []byte
+}
+
+func (m *HNSelectTell) Command() int               { return commands.HNSELECT }
+func (m *HNSelectTell) MarshalPayload(w *Writer)   { w.String(PadHandle(m.Handle)) }
+func (m *HNSelectTell) UnmarshalPayload(r *Reader) { m.Handle = r.String() }
+
+// MOTDTell is the message of the day, number 0 means there is none.
+type MOTDTell struct {
+	Number  byte
+	Message []byte
+}
+
+func (m *MOTDTell) Command() int { return commands.MOTHEDAY }
+func (m *MOTDTell) MarshalPayload(w *Writer) {
+	w.U8(m.Number)
+	w.String(m.Message)
+}
+func (m *MOTDTell) UnmarshalPayload(r *Reader) {
+	m.Number = r.U8()
+	m.Message = r.String()
+}
+
+// CharSelectQuery carries the statistics of the chosen character.
+type CharSelectQuery struct {
+	Stats []byte
+	Sum   uint16
+}
+
+func (m *CharSelectQuery) Command() int             { return commands.CHARSELECT }
+func (m *CharSelectQuery) MarshalPayload(w *Writer) { w.Secret(m.Stats) }
+func (m *CharSelectQuery) UnmarshalPayload(r *Reader) {
+	m.Stats, m.Sum = r.Secret()
+	if r.Err() == nil && len(m.Stats) < CHARACTER_STATS_SIZE {
+		r.fail(fmt.Errorf("character stats of %d bytes: %w", len(m.Stats), ErrBadLength))
+	}
+	if len(m.Stats) > CHARACTER_STATS_SIZE {
+		m.Stats = m.Stats[:CHARACTER_STATS_SIZE]
+	}
+}
+
+// Unkn6881Tell announces the data blocks fetched with UNKN6882.
+type Unkn6881Tell struct {
+	Sizes []uint32 // one per data block
+}
+
+func (m *Unkn6881Tell) Command() int { return commands.UNKN6881 }
+func (m *Unkn6881Tell) MarshalPayload(w *Writer) {
+	w.U8(byte(len(m.Sizes)))
+	for _, size := range m.Sizes {
+		w.U32(size)
+	}
+}
+func (m *Unkn6881Tell) UnmarshalPayload(r *Reader) {
+	m.Sizes = make([]uint32, r.U8())
+	for i := range m.Sizes {
+		m.Sizes[i] = r.U32()
+	}
+}
+
+// Unkn6882Query asks for a part of a 6881 data block.
+type Unkn6882Query struct {
+	Number byte
+	Offset uint32
+	Size   uint32
+}
+
+func (m *Unkn6882Query) Command() int { return commands.UNKN6882 }
+func (m *Unkn6882Query) MarshalPayload(w *Writer) {
+	w.U8(m.Number)
+	w.U32(m.Offset)
+	w.U32(m.Size)
+}
+func (m *Unkn6882Query) UnmarshalPayload(r *Reader) {
+	m.Number = r.U8()
+	m.Offset = r.U32()
+	m.Size = r.U32()
+}
+
+// ---- rankings
+
+// RankingEntry is one player of a ranked game.
+type RankingEntry struct {
+	Status    byte // 1 alive
+	Character byte
+	Handle    []byte
+	Name      []byte
+}
+
+// RankingsTell is the ranking of a scenario shown in the area lobby.
+// Looks like the first ranks are by result points, the second by clear time.
+type RankingsTell struct {
+	Scenario int
+	Points   uint32
+	Unknown  uint32
+	Flag     byte
+	Ranks    [7]uint32
+	Entries  []RankingEntry
+}
+
+func (m *RankingsTell) Command() int { return commands.RANKINGS }
+func (m *RankingsTell) MarshalPayload(w *Writer) {
+	w.U16(m.Scenario)
+	w.U32(m.Points)
+	w.U32(m.Unknown)
+	w.U8(m.Flag)
+	for _, v := range m.Ranks {
+		w.U32(v)
+	}
+	for _, e := range m.Entries {
+		w.U8(e.Status)
+		w.U8(e.Character)
+		w.String(e.Handle)
+		w.String(e.Name)
+	}
+}
+func (m *RankingsTell) UnmarshalPayload(r *Reader) {
+	m.Scenario = r.U16()
+	m.Points = r.U32()
+	m.Unknown = r.U32()
+	m.Flag = r.U8()
+	for i := range m.Ranks {
+		m.Ranks[i] = r.U32()
+	}
+	m.Entries = nil
+	for r.Remaining() > 0 && r.Err() == nil {
+		var e RankingEntry
+		e.Status = r.U8()
+		e.Character = r.U8()
+		e.Handle = r.String()
+		e.Name = r.String()
+		m.Entries = append(m.Entries, e)
+	}
+}
+
+// PostGamePlayer is a co-player listed in POSTGAMEINFO.
+type PostGamePlayer struct {
+	Handle   []byte
+	Nickname []byte
+	Unknown  int
+}
+
+// PostGameInfoTell are the statistics of the last game, the client sends
+// them when asked after coming back to the lobby. Up to the co-players the
+// layout is known from the File #2 server. Status, points and clear time
+// are somewhere in the rest, which is kept raw until their offsets are
+// read off a captured packet.
+type PostGameInfoTell struct {
+	Unknown  int
+	Handle   []byte
+	Session  []byte // game number as 15 digits
+	Unknown2 int
+	Players  [3]PostGamePlayer
+	Rest     []byte
+}
+
+func (m *PostGameInfoTell) Command() int { return commands.POSTGAMEINFO }
+func (m *PostGameInfoTell) MarshalPayload(w *Writer) {
+	w.U16(m.Unknown)
+	w.Secret(m.Handle)
+	w.Raw(m.Session)
+	w.U16(m.Unknown2)
+	for _, p := range m.Players {
+		w.Secret(p.Handle)
+		w.Secret(p.Nickname)
+		w.U16(p.Unknown)
+	}
+	w.Raw(m.Rest)
+}
+func (m *PostGameInfoTell) UnmarshalPayload(r *Reader) {
+	m.Unknown = r.U16()
+	m.Handle, _ = r.Secret()
+	m.Session = r.Bytes(15)
+	m.Unknown2 = r.U16()
+	for i := range m.Players {
+		m.Players[i].Handle, _ = r.Secret()
+		m.Players[i].Nickname, _ = r.Secret()
+		m.Players[i].Unknown = r.U16()
+	}
+	m.Rest = r.Rest()
+}
+
+// ---- slots
+
+// SlotPlayerStatusTell shows how many players are in a slot.
+type SlotPlayerStatusTell struct {
+	Slot       int
+	Players    int
+	Unknown    int
+	MaxPlayers int
+	Players2   int
+}
+
+func (m *SlotPlayerStatusTell) Command() int { return commands.SLOTPLRSTATUS }
+func (m *SlotPlayerStatusTell) MarshalPayload(w *Writer) {
+	w.U16(m.Slot)
+	w.U16(m.Players)
+	w.U16(m.Unknown)
+	w.U16(m.MaxPlayers)
+	w.U16(m.Players2)
+}
+func (m *SlotPlayerStatusTell) UnmarshalPayload(r *Reader) {
+	m.Slot = r.U16()
+	m.Players = r.U16()
+	m.Unknown = r.U16()
+	m.MaxPlayers = r.U16()
+	m.Players2 = r.U16()
+}
+
+// SlotAttrib2Tell, the meaning of the trailing words is unknown.
+type SlotAttrib2Tell struct {
+	Slot       int
+	MaxPlayers int
+	Unknown    [4]int
+}
+
+// DefaultSlotAttrib2 are the unknown words the server always sends.
+var DefaultSlotAttrib2 = [4]int{4, 1, 4, 1}
+
+func (m *SlotAttrib2Tell) Command() int { return commands.SLOTATTRIB2 }
+func (m *SlotAttrib2Tell) MarshalPayload(w *Writer) {
+	w.U16(m.Slot)
+	w.U16(m.MaxPlayers)
+	for _, v := range m.Unknown {
+		w.U16(v)
+	}
+}
+func (m *SlotAttrib2Tell) UnmarshalPayload(r *Reader) {
+	m.Slot = r.U16()
+	m.MaxPlayers = r.U16()
+	for i := range m.Unknown {
+		m.Unknown[i] = r.U16()
+	}
+}
+
+// SceneTypeTell is the slot type (0x11 DVD, 0x12 HDD) and scenario of a
+// slot. SLOTSCENTYPE and the SCENESELECT answer share it.
+type SceneTypeTell struct {
+	Cmd      int
+	Slot     int
+	Type     int
+	Scenario int
+}
+
+func (m *SceneTypeTell) Command() int { return m.Cmd }
+func (m *SceneTypeTell) MarshalPayload(w *Writer) {
+	w.U16(m.Slot)
+	w.U16(m.Type)
+	w.U16(m.Scenario)
+}
+func (m *SceneTypeTell) UnmarshalPayload(r *Reader) {
+	m.Slot = r.U16()
+	m.Type = r.U16()
+	m.Scenario = r.U16()
+}
+
+// SceneSelectQuery, 1st word is slottype: 0011 = dvd, 0012 = hdd
+// 2nd word are the scenes: wild things 0001, underbelly 0002, flashback
+// 0003, desperate times 0004
+type SceneSelectQuery struct {
+	Type     int
+	Scenario int
+}
+
+func (m *SceneSelectQuery) Command() int { return commands.SCENESELECT }
+func (m *SceneSelectQuery) MarshalPayload(w *Writer) {
+	w.U16(m.Type)
+	w.U16(m.Scenario)
+}
+func (m *SceneSelectQuery) UnmarshalPayload(r *Reader) {
+	m.Type = r.U16()
+	m.Scenario = r.U16()
+}
+
+// PlayerStatsTell lists the players of a slot, AGLSTATS uses the same
+// layout with slot 0 for the after game lobby.
+type PlayerStatsTell struct {
+	Cmd     int
+	Slot    int
+	Players []CharacterStat
+}
+
+func (m *PlayerStatsTell) Command() int { return m.Cmd }
+func (m *PlayerStatsTell) MarshalPayload(w *Writer) {
+	w.U16(m.Slot)
+	w.U8(3) // TODO why ???
+	w.U8(byte(len(m.Players)))
+	for i := range m.Players {
+		m.Players[i].marshal(w)
+	}
+}
+func (m *PlayerStatsTell) UnmarshalPayload(r *Reader) {
+	m.Slot = r.U16()
+	r.U8()
+	n := int(r.U8())
+	m.Players = nil
+	for i := 0; i < n && r.Err() == nil; i++ {
+		var c CharacterStat
+		c.unmarshal(r)
+		m.Players = append(m.Players, c)
+	}
+}
+
+// ---- rules
+
+// RuleQuery asks about a rule of a slot.
+type RuleQuery struct {
+	Cmd  int
+	Slot int
+	Rule byte
+}
+
+func (m *RuleQuery) Command() int { return m.Cmd }
+func (m *RuleQuery) MarshalPayload(w *Writer) {
+	w.U16(m.Slot)
+	w.U8(m.Rule)
+}
+func (m *RuleQuery) UnmarshalPayload(r *Reader) {
+	m.Slot = r.U16()
+	m.Rule = r.U8()
+}
+
+// RuleTell answers with a value of a rule, also the SETRULE query.
+type RuleTell struct {
+	Cmd   int
+	Rule  byte
+	Value byte
+}
+
+func (m *RuleTell) Command() int { return m.Cmd }
+func (m *RuleTell) MarshalPayload(w *Writer) {
+	w.U8(m.Rule)
+	w.U8(m.Value)
+}
+func (m *RuleTell) UnmarshalPayload(r *Reader) {
+	m.Rule = r.U8()
+	m.Value = r.U8()
+}
+
+// RuleDescriptTell is the name of a rule.
+type RuleDescriptTell struct {
+	Rule byte
+	Name []byte
+}
+
+func (m *RuleDescriptTell) Command() int { return commands.RULEDESCRIPT }
+func (m *RuleDescriptTell) MarshalPayload(w *Writer) {
+	w.U8(m.Rule)
+	w.String(m.Name)
+}
+func (m *RuleDescriptTell) UnmarshalPayload(r *Reader) {
+	m.Rule = r.U8()
+	m.Name = r.String()
+}
+
+// AttrQuery asks about a choice of a rule.
+type AttrQuery struct {
+	Cmd  int
+	Slot int
+	Rule byte
+	Attr byte
+}
+
+func (m *AttrQuery) Command() int { return m.Cmd }
+func (m *AttrQuery) MarshalPayload(w *Writer) {
+	w.U16(m.Slot)
+	w.U8(m.Rule)
+	w.U8(m.Attr)
+}
+func (m *AttrQuery) UnmarshalPayload(r *Reader) {
+	m.Slot = r.U16()
+	m.Rule = r.U8()
+	m.Attr = r.U8()
+}
+
+// AttrDescriptTell is the name of a choice.
+type AttrDescriptTell struct {
+	Rule byte
+	Attr byte
+	Name []byte
+}
+
+func (m *AttrDescriptTell) Command() int { return commands.ATTRDESCRIPT }
+func (m *AttrDescriptTell) MarshalPayload(w *Writer) {
+	w.U8(m.Rule)
+	w.U8(m.Attr)
+	w.String(m.Name)
+}
+func (m *AttrDescriptTell) UnmarshalPayload(r *Reader) {
+	m.Rule = r.U8()
+	m.Attr = r.U8()
+	m.Name = r.String()
+}
+
+// AttrAttribTell is the attribute of a choice (always 0?).
+type AttrAttribTell struct {
+	Rule  byte
+	Attr  byte
+	Value byte
+}
+
+func (m *AttrAttribTell) Command() int { return commands.ATTRATTRIB }
+func (m *AttrAttribTell) MarshalPayload(w *Writer) {
+	w.U8(m.Rule)
+	w.U8(m.Attr)
+	w.U8(m.Value)
+}
+func (m *AttrAttribTell) UnmarshalPayload(r *Reader) {
+	m.Rule = r.U8()
+	m.Attr = r.U8()
+	m.Value = r.U8()
+}
+
+// Unkn66Tell answers UNKN6601 and UNKN6602.
+type Unkn66Tell struct {
+	Cmd    int
+	Number int
+}
+
+func (m *Unkn66Tell) Command() int { return m.Cmd }
+func (m *Unkn66Tell) MarshalPayload(w *Writer) {
+	w.U8(1)
+	w.U16(m.Number)
+}
+func (m *Unkn66Tell) UnmarshalPayload(r *Reader) {
+	r.U8()
+	m.Number = r.U16()
+}
+
+// SlotTimerTell is the time left until the game in the slot starts.
+type SlotTimerTell struct {
+	Slot     byte
+	Livetime int
+}
+
+func (m *SlotTimerTell) Command() int { return commands.SLOTTIMER }
+func (m *SlotTimerTell) MarshalPayload(w *Writer) {
+	w.U8(m.Slot)
+	w.U8(0)
+	w.U16(m.Livetime)
+}
+func (m *SlotTimerTell) UnmarshalPayload(r *Reader) {
+	m.Slot = r.U8()
+	r.U8()
+	m.Livetime = r.U16()
+}
+
+// Unkn6412Tell, unknown.
+type Unkn6412Tell struct {
+	Number  int
+	Unknown uint32
+}
+
+func (m *Unkn6412Tell) Command() int { return commands.UNKN6412 }
+func (m *Unkn6412Tell) MarshalPayload(w *Writer) {
+	w.U16(m.Number)
+	w.U32(m.Unknown)
+}
+func (m *Unkn6412Tell) UnmarshalPayload(r *Reader) {
+	m.Number = r.U16()
+	m.Unknown = r.U32()
+}
+
+// PlayerOKBroadcast is sent when a player is "unlocked".
+type PlayerOKBroadcast struct {
+	Player byte
+}
+
+func (m *PlayerOKBroadcast) Command() int { return commands.PLAYEROK }
+func (m *PlayerOKBroadcast) MarshalPayload(w *Writer) {
+	w.U8(0)
+	w.U8(m.Player)
+	w.U16(0)
+}
+func (m *PlayerOKBroadcast) UnmarshalPayload(r *Reader) {
+	r.U8()
+	m.Player = r.U8()
+	r.U16()
+}
+
+// JoinGameQuery asks to join a slot with its password.
+type JoinGameQuery struct {
+	Slot     int
+	Password []byte
+	Sum      uint16
+}
+
+func (m *JoinGameQuery) Command() int { return commands.JOINGAME }
+func (m *JoinGameQuery) MarshalPayload(w *Writer) {
+	w.U16(m.Slot)
+	w.Secret(m.Password)
+}
+func (m *JoinGameQuery) UnmarshalPayload(r *Reader) {
+	m.Slot = r.U16()
+	m.Password, m.Sum = r.Secret()
+}
+
+// ---- game start
+
+// PlayerStatTell describes a player of the starting game, Stat is nil
+// when the player left in the meantime.
+type PlayerStatTell struct {
+	Player byte
+	Stat   *CharacterStat
+}
+
+func (m *PlayerStatTell) Command() int { return commands.PLAYERSTAT }
+func (m *PlayerStatTell) MarshalPayload(w *Writer) {
+	w.U8(m.Player)
+	if m.Stat == nil {
+		w.U8(0)
+		return
+	}
+	w.U8(1)
+	m.Stat.marshal(w)
+	w.U8(0)
+	w.U8(0)
+	w.U8(6)
+}
+func (m *PlayerStatTell) UnmarshalPayload(r *Reader) {
+	m.Player = r.U8()
+	m.Stat = nil
+	if r.U8() == 1 {
+		m.Stat = &CharacterStat{}
+		m.Stat.unmarshal(r)
+		r.Bytes(3)
+	}
+}
+
+// PlayerScoreTell is the scoring from the ranklist for a player.
+type PlayerScoreTell struct {
+	Player   byte
+	Scenario int
+	Scores   [5]uint32
+}
+
+func (m *PlayerScoreTell) Command() int { return commands.PLAYERSCORE }
+func (m *PlayerScoreTell) MarshalPayload(w *Writer) {
+	w.U8(m.Player)
+	w.U16(m.Scenario)
+	for _, v := range m.Scores {
+		w.U32(v)
+	}
+}
+func (m *PlayerScoreTell) UnmarshalPayload(r *Reader) {
+	m.Player = r.U8()
+	m.Scenario = r.U16()
+	for i := range m.Scores {
+		m.Scores[i] = r.U32()
+	}
+}
+
+// GameSessionTell is the game number as 15 digits, the game server groups
+// the players with it.
+type GameSessionTell struct {
+	Session []byte
+}
+
+func (m *GameSessionTell) Command() int { return commands.GAMESESSION }
+func (m *GameSessionTell) MarshalPayload(w *Writer) {
+	w.String(m.Session)
+	w.U16(0)
+}
+func (m *GameSessionTell) UnmarshalPayload(r *Reader) {
+	m.Session = r.String()
+	r.U16()
+}
+
+// GameDiffTell, more is sent here (different game modes).
+type GameDiffTell struct {
+	Size         int // 0x10 for File #1, 0x20 for File #2
+	Difficulty   byte
+	FriendlyFire byte
+	Nightmare    byte // File #2
+	Infinity     byte // File #2
+}
+
+func (m *GameDiffTell) Command() int { return commands.GAMEDIFF }
+func (m *GameDiffTell) MarshalPayload(w *Writer) {
+	block := make([]byte, max(m.Size, 0x10))
+	block[0] = 1
+	block[1] = m.Difficulty
+	block[2] = m.FriendlyFire
+	if m.Size >= 0x20 {
+		block[5] = m.Nightmare
+		block[6] = m.Infinity
+	}
+	w.U16(len(block))
+	w.Raw(block)
+}
+func (m *GameDiffTell) UnmarshalPayload(r *Reader) {
+	m.Size = r.U16()
+	block := r.Bytes(m.Size)
+	if len(block) < 3 {
+		r.fail(ErrBadLength)
+		return
+	}
+	m.Difficulty = block[1]
+	m.FriendlyFire = block[2]
+	if len(block) >= 7 {
+		m.Nightmare = block[5]
+		m.Infinity = block[6]
+	}
+}
+
+// GSInfoTell is the address of the game server.
+type GSInfoTell struct {
+	IP   []byte
+	Port int
+}
+
+func (m *GSInfoTell) Command() int { return commands.GSINFO }
+func (m *GSInfoTell) MarshalPayload(w *Writer) {
+	w.String(m.IP)
+	w.U16(2)
+	w.U16(m.Port)
+	w.U32(0x1e00)
+}
+func (m *GSInfoTell) UnmarshalPayload(r *Reader) {
+	m.IP = r.String()
+	r.U16()
+	m.Port = r.U16()
+	r.U32()
+}
+
+// ---- chat, events and buddies
+
+// ChatOutBroadcast delivers a chat message.
+type ChatOutBroadcast struct {
+	Sender  HNPair
+	Message []byte
+}
+
+func (m *ChatOutBroadcast) Command() int { return commands.CHATOUT }
+func (m *ChatOutBroadcast) MarshalPayload(w *Writer) {
+	m.Sender.marshal(w)
+	w.String(m.Message)
+	w.U8(0)
+	w.U32(0xff)
+}
+func (m *ChatOutBroadcast) UnmarshalPayload(r *Reader) {
+	m.Sender.unmarshal(r)
+	m.Message = r.String()
+	r.U8()
+	r.U32()
+}
+
+// GetInfoTell is a page of the information menu.
+type GetInfoTell struct {
+	URL  []byte
+	Data []byte
+}
+
+func (m *GetInfoTell) Command() int { return commands.GETINFO }
+func (m *GetInfoTell) MarshalPayload(w *Writer) {
+	w.String(m.URL)
+	w.String(m.Data)
+}
+func (m *GetInfoTell) UnmarshalPayload(r *Reader) {
+	m.URL = r.String()
+	m.Data = r.String()
+}
+
+// EventDatQuery sends event data to another player. PRIVATEMSG has the
+// same layout with the message as Data.
+type EventDatQuery struct {
+	Cmd       int
+	Recipient []byte
+	Data      []byte
+}
+
+func (m *EventDatQuery) Command() int { return m.Cmd }
+func (m *EventDatQuery) MarshalPayload(w *Writer) {
+	w.Secret(m.Recipient)
+	w.Secret(m.Data)
+}
+func (m *EventDatQuery) UnmarshalPayload(r *Reader) {
+	m.Recipient, _ = r.Secret()
+	m.Data, _ = r.Secret()
+}
+
+// EventDatBroadcast delivers event data from Sender.
+type EventDatBroadcast struct {
+	Sender []byte
+	Data   []byte
+}
+
+func (m *EventDatBroadcast) Command() int { return commands.EVENTDATBC }
+func (m *EventDatBroadcast) MarshalPayload(w *Writer) {
+	w.String(m.Sender)
+	w.String(m.Data)
+}
+func (m *EventDatBroadcast) UnmarshalPayload(r *Reader) {
+	m.Sender = r.String()
+	m.Data = r.String()
+}
+
+// PrivateMsgBroadcast delivers a private message.
+type PrivateMsgBroadcast struct {
+	Sender  HNPair
+	Message []byte
+}
+
+func (m *PrivateMsgBroadcast) Command() int { return commands.PRIVATEMSGBC }
+func (m *PrivateMsgBroadcast) MarshalPayload(w *Writer) {
+	m.Sender.marshal(w)
+	w.String(m.Message)
+}
+func (m *PrivateMsgBroadcast) UnmarshalPayload(r *Reader) {
+	m.Sender.unmarshal(r)
+	m.Message = r.String()
+}
+
+// BuddyListTell, InGame is 1 when the buddy is in a game.
+type BuddyListTell struct {
+	InGame byte
+}
+
+func (m *BuddyListTell) Command() int { return commands.BUDDYLIST }
+func (m *BuddyListTell) MarshalPayload(w *Writer) {
+	w.Zero(6)
+	w.U8(m.InGame)
+}
+func (m *BuddyListTell) UnmarshalPayload(r *Reader) {
+	r.Bytes(6)
+	m.InGame = r.U8()
+}
+
+// CheckBuddyTell tells where an online buddy is.
+type CheckBuddyTell struct {
+	Lobby   []byte
+	Unknown [4]int
+	Message []byte
+}
+
+func (m *CheckBuddyTell) Command() int { return commands.CHECKBUDDY }
+func (m *CheckBuddyTell) MarshalPayload(w *Writer) {
+	w.String(m.Lobby)
+	for _, v := range m.Unknown {
+		w.U16(v)
+	}
+	w.String(m.Message)
+}
+func (m *CheckBuddyTell) UnmarshalPayload(r *Reader) {
+	m.Lobby = r.String()
+	for i := range m.Unknown {
+		m.Unknown[i] = r.U16()
+	}
+	m.Message = r.String()
+}
+
+// HeartbeatBroadcast is sent every 30 seconds, meaning of the words unknown.
+type HeartbeatBroadcast struct {
+	Values [4]int
+}
+
+func (m *HeartbeatBroadcast) Command() int { return commands.HEARTBEAT }
+func (m *HeartbeatBroadcast) MarshalPayload(w *Writer) {
+	for _, v := range m.Values {
+		w.U16(v)
+	}
+}
+func (m *HeartbeatBroadcast) UnmarshalPayload(r *Reader) {
+	for i := range m.Values {
+		m.Values[i] = r.U16()
+	}
+}
+
+// ---- File #1 1.01 patch
+
+// PatchStartBroadcast announces a patch. Sum is unverified: the Java
+// server sends a fixed 0x003cdae2 ("checksum perhaps???"), it's assumed to
+// be the byte sum of the patch data. Nobody checked what the client does
+// with it.
+type PatchStartBroadcast struct {
+	Version []byte
+	Chunks  int
+	Size    uint32
+	Sum     uint32
+}
+
+func (m *PatchStartBroadcast) Command() int { return commands.PATCHSTART }
+func (m *PatchStartBroadcast) MarshalPayload(w *Writer) {
+	w.String(m.Version)
+	w.U16(m.Chunks)
+	w.U32(m.Size)
+	w.U32(m.Sum)
+}
+func (m *PatchStartBroadcast) UnmarshalPayload(r *Reader) {
+	m.Version = r.String()
+	m.Chunks = r.U16()
+	m.Size = r.U32()
+	m.Sum = r.U32()
+}
+
+// PatchDataBroadcast is one chunk of at most 0x100 bytes of the patch.
+type PatchDataBroadcast struct {
+	Chunk int
+	Data  []byte
+}
+
+func (m *PatchDataBroadcast) Command() int { return commands.PATCHDATA }
+func (m *PatchDataBroadcast) MarshalPayload(w *Writer) {
+	w.U16(m.Chunk)
+	w.String(m.Data)
+}
+func (m *PatchDataBroadcast) UnmarshalPayload(r *Reader) {
+	m.Chunk = r.U16()
+	m.Data = r.String()
+}
@@ -0,0 +1,97 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	HEADER_SIZE = 12
+	ERR_FLAG    = 0xff // set in the header when the payload is an error message
+)
+
+// Header is the 12 byte packet header:
+//
+//	who(1) qsw(1) cmd(2) len(2) pid(2) err(1) 0xff 0xff 0xff
+//
+// len is the payload length without the header.
+type Header struct {
+	Who byte
+	Qsw byte
+	Cmd int
+	Len int
+	PID int
+	Err byte
+}
+
+// ParseHeader decodes the header at the start of data.
+func ParseHeader(data []byte) (Header, error) {
+	if len(data) < HEADER_SIZE {
+		return Header{}, fmt.Errorf("header: %w (%d bytes)", ErrShortPayload, len(data))
+	}
+	return Header{
+		Who: data[0],
+		Qsw: data[1],
+		Cmd: int(binary.BigEndian.Uint16(data[2:])),
+		Len: int(binary.BigEndian.Uint16(data[4:])),
+		PID: int(binary.BigEndian.Uint16(data[6:])),
+		Err: data[8],
+	}, nil
+}
+
+// AppendHeader appends the encoded header to dst.
+func (h Header) AppendHeader(dst []byte) []byte {
+	dst = append(dst, h.Who, h.Qsw)
+	dst = binary.BigEndian.AppendUint16(dst, uint16(h.Cmd))
+	dst = binary.BigEndian.AppendUint16(dst, uint16(h.Len))
+	dst = binary.BigEndian.AppendUint16(dst, uint16(h.PID))
+	return append(dst, h.Err, 0xff, 0xff, 0xff)
+}
+
+// Encode builds a complete packet carrying m.
+func Encode(who, qsw byte, pid int, m Message) []byte {
+	payload := Marshal(m, pid)
+	h := Header{Who: who, Qsw: qsw, Cmd: m.Command(), Len: len(payload), PID: pid}
+	if e, ok := m.(*ErrorTell); ok && e != nil {
+		h.Err = ERR_FLAG
+	}
+	return append(h.AppendHeader(make([]byte, 0, HEADER_SIZE+len(payload))), payload...)
+}
+
+// Decode parses one complete packet and its payload. Unknown commands are
+// returned as *Raw so they can still be inspected.
+func Decode(data []byte) (Header, Message, error) {
+	h, err := ParseHeader(data)
+	if err != nil {
+		return h, nil, err
+	}
+	if HEADER_SIZE+h.Len > len(data) {
+		return h, nil, fmt.Errorf("%s: %w (need %d, have %d)", Name(h.Cmd), ErrShortPayload, HEADER_SIZE+h.Len, len(data))
+	}
+	m := New(h.Who, h.Qsw, h.Cmd)
+	if h.Err == ERR_FLAG {
+		m = &ErrorTell{Cmd: h.Cmd}
+	}
+	if err := Unmarshal(data[HEADER_SIZE:HEADER_SIZE+h.Len], h.PID, m); err != nil {
+		return h, m, err
+	}
+	return h, m, nil
+}
+
+// Marshal encodes the payload of m. pid is needed for secret strings.
+func Marshal(m Message, pid int) []byte {
+	w := NewWriter(pid)
+	m.MarshalPayload(w)
+	return w.Bytes()
+}
+
+// Unmarshal decodes payload into m. Trailing bytes are not an error, the
+// client pads some packets.
+func Unmarshal(payload []byte, pid int, m Message) error {
+	r := NewReader(payload, pid)
+	m.UnmarshalPayload(r)
+	if err := r.Err(); err != nil {
+		return fmt.Errorf("%s: %w", Name(m.Command()), err)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package protocol
+
+import (
+	"bioserver/commands"
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"slices"
+	"testing"
+)
+
+// registeredPackets returns a packet of every registered payload with its
+// zero value, and the same packets with the payload cut short at every
+// length, the header adjusted to match.
+func registeredPackets() [][]byte {
+	kinds := make([]kind, 0, len(registry))
+	for k := range registry {
+		kinds = append(kinds, k)
+	}
+	slices.SortFunc(kinds, func(a, b kind) int {
+		if a.fromServer != b.fromServer {
+			if a.fromServer {
+				return 1
+			}
+			return -1
+		}
+		return cmp.Or(cmp.Compare(a.cmd, b.cmd), cmp.Compare(a.qsw, b.qsw))
+	})
+	var packets [][]byte
+	for _, k := range kinds {
+		who := byte(commands.CLIENT)
+		if k.fromServer {
+			who = commands.SERVER
+		}
+		full := Encode(who, k.qsw, 1, registry[k]())
+		for n := HEADER_SIZE; n <= len(full); n++ {
+			p := bytes.Clone(full[:n])
+			binary.BigEndian.PutUint16(p[4:], uint16(n-HEADER_SIZE))
+			packets = append(packets, p)
+		}
+	}
+	return packets
+}
+
+func FuzzDecode(f *testing.F) {
+	for _, p := range registeredPackets() {
+		f.Add(p)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		h, m, err := Decode(data)
+		if m == nil {
+			if err == nil {
+				t.Fatalf("no message and no error for %x", data)
+			}
+			return
+		}
+		// what the dissector and the capture do with it
+		FlatFields(m)
+		if err != nil {
+			return
+		}
+		// a decoded payload encodes and decodes again
+		again := Encode(h.Who, h.Qsw, h.PID, m)
+		if _, _, err := Decode(again); err != nil {
+			t.Fatalf("%s decoded from %x, encoded %x: %v", Name(h.Cmd), data, again, err)
+		}
+	})
+}
@@ -0,0 +1,247 @@
+package protocol
+
+import (
+	"bioserver/commands"
+)
+
+type kind struct {
+	fromServer bool
+	qsw        byte
+	cmd        int
+}
+
+// payloads of the lobby commands by sender and packet type
+var registry = map[kind]func() Message{}
+
+func register(fromServer bool, qsw byte, cmd int, f func() Message) {
+	registry[kind{fromServer, qsw, cmd}] = f
+}
+
+func client(qsw byte, cmd int, f func() Message) { register(false, qsw, cmd, f) }
+func server(qsw byte, cmd int, f func() Message) { register(true, qsw, cmd, f) }
+
+func init() {
+	const Q, T, B = commands.QUERY, commands.TELL, commands.BROADCAST
+
+	empty := func(cmd int) func() Message { return func() Message { return &Empty{Cmd: cmd} } }
+	number := func(cmd int) func() Message { return func() Message { return &NumberQuery{Cmd: cmd} } }
+	numberTell := func(cmd int) func() Message { return func() Message { return &NumberTell{Cmd: cmd} } }
+	byteQuery := func(cmd int) func() Message { return func() Message { return &ByteQuery{Cmd: cmd} } }
+	byteTell := func(cmd int) func() Message { return func() Message { return &ByteTell{Cmd: cmd} } }
+	name := func(cmd int) func() Message { return func() Message { return &NameTell{Cmd: cmd} } }
+	status := func(cmd int) func() Message { return func() Message { return &StatusTell{Cmd: cmd} } }
+	count := func(cmd int) func() Message { return func() Message { return &PlayerCountTell{Cmd: cmd} } }
+	secret := func(cmd int) func() Message { return func() Message { return &SecretQuery{Cmd: cmd} } }
+	echo := func(cmd int) func() Message { return func() Message { return &SecretEchoTell{Cmd: cmd} } }
+	handle := func(cmd int) func() Message { return func() Message { return &HandleMessage{Cmd: cmd} } }
+	stat := func(cmd int) func() Message { return func() Message { return &CharacterStatBroadcast{Cmd: cmd} } }
+	rule := func(cmd int) func() Message { return func() Message { return &RuleQuery{Cmd: cmd} } }
+	ruleTell := func(cmd int) func() Message { return func() Message { return &RuleTell{Cmd: cmd} } }
+	attr := func(cmd int) func() Message { return func() Message { return &AttrQuery{Cmd: cmd} } }
+	text := func(cmd int) func() Message { return func() Message { return &TextBroadcast{Cmd: cmd} } }
+	scene := func(cmd int) func() Message { return func() Message { return &SceneTypeTell{Cmd: cmd} } }
+	stats := func(cmd int) func() Message { return func() Message { return &PlayerStatsTell{Cmd: cmd} } }
+	unkn66 := func(cmd int) func() Message { return func() Message { return &Unkn66Tell{Cmd: cmd} } }
+	message := func(cmd int) func() Message { return func() Message { return &EventDatQuery{Cmd: cmd} } }
+
+	// login
+	server(Q, commands.LOGIN, func() Message { return &LoginQuery{} })
+	client(T, commands.LOGIN, func() Message { return &LoginTell{} })
+	server(Q, commands.CHECKVERSION, func() Message { return &NumberQuery{Cmd: commands.CHECKVERSION} })
+	client(T, commands.CHECKVERSION, func() Message { return &CheckVersionTell{} })
+	client(Q, commands.CHECKRND, secret(commands.CHECKRND))
+	server(T, commands.CHECKRND, func() Message { return &CheckRndTell{} })
+	client(Q, commands.UNKN61A0, empty(commands.UNKN61A0))
+	server(T, commands.UNKN61A0, func() Message { return &Unkn61A0Tell{} })
+	client(Q, commands.UNKN61A1, empty(commands.UNKN61A1))
+	server(T, commands.UNKN61A1, func() Message { return &Unkn61A1Tell{} })
+	server(B, commands.IDHNPAIRS, func() Message { return &IDHNPairsBroadcast{} })
+	client(Q, commands.HNSELECT, func() Message { return &HNSelectQuery{} })
+	server(T, commands.HNSELECT, func() Message { return &HNSelectTell{} })
+	server(Q, commands.POSTGAMEINFO, empty(commands.POSTGAMEINFO))
+	client(T, commands.POSTGAMEINFO, func() Message { return &PostGameInfoTell{} })
+	server(B, commands.UNKN6104, empty(commands.UNKN6104))
+	client(Q, commands.MOTHEDAY, empty(commands.MOTHEDAY))
+	server(T, commands.MOTHEDAY, func() Message { return &MOTDTell{} })
+	client(Q, commands.CHARSELECT, func() Message { return &CharSelectQuery{} })
+	server(T, commands.CHARSELECT, empty(commands.CHARSELECT))
+	client(Q, commands.UNKN6881, empty(commands.UNKN6881))
+	server(T, commands.UNKN6881, func() Message { return &Unkn6881Tell{} })
+	client(Q, commands.UNKN6882, func() Message { return &Unkn6882Query{} })
+	client(Q, commands.RANKINGS, number(commands.RANKINGS))
+	server(T, commands.RANKINGS, func() Message { return &RankingsTell{} })
+	client(Q, commands.UNKN6181, empty(commands.UNKN6181))
+	server(T, commands.UNKN6181, empty(commands.UNKN6181))
+
+	// areas and rooms
+	client(Q, commands.AREACOUNT, empty(commands.AREACOUNT))
+	server(T, commands.AREACOUNT, numberTell(commands.AREACOUNT))
+	for _, cmd := range []int{commands.AREAPLAYERCNT, commands.AREASTATUS, commands.AREANAME,
+		commands.AREADESCRIPT, commands.AREASELECT, commands.ROOMPLAYERCNT, commands.ROOMSTATUS,
+		commands.ROOMNAME, commands.UNKN6308, commands.ENTERROOM} {
+		client(Q, cmd, number(cmd))
+	}
+	server(T, commands.AREAPLAYERCNT, count(commands.AREAPLAYERCNT))
+	server(B, commands.AREAPLAYERCNT, count(commands.AREAPLAYERCNT))
+	server(T, commands.AREASTATUS, status(commands.AREASTATUS))
+	server(T, commands.AREANAME, name(commands.AREANAME))
+	server(T, commands.AREADESCRIPT, name(commands.AREADESCRIPT))
+	server(T, commands.AREASELECT, numberTell(commands.AREASELECT))
+	client(Q, commands.EXITAREA, empty(commands.EXITAREA))
+	server(T, commands.EXITAREA, empty(commands.EXITAREA))
+	client(Q, commands.ROOMSCOUNT, empty(commands.ROOMSCOUNT))
+	server(T, commands.ROOMSCOUNT, numberTell(commands.ROOMSCOUNT))
+	server(T, commands.ROOMPLAYERCNT, count(commands.ROOMPLAYERCNT))
+	server(B, commands.ROOMPLAYERCNT, count(commands.ROOMPLAYERCNT))
+	server(T, commands.ROOMSTATUS, status(commands.ROOMSTATUS))
+	server(T, commands.ROOMNAME, name(commands.ROOMNAME))
+	server(T, commands.UNKN6308, func() Message { return &Unkn6308Tell{} })
+	server(T, commands.ENTERROOM, numberTell(commands.ENTERROOM))
+	server(B, commands.HEARTBEAT, func() Message { return &HeartbeatBroadcast{} })
+
+	// slots
+	client(Q, commands.SLOTCOUNT, empty(commands.SLOTCOUNT))
+	server(T, commands.SLOTCOUNT, numberTell(commands.SLOTCOUNT))
+	for _, cmd := range []int{commands.SLOTSTATUS, commands.SLOTPLRSTATUS, commands.SLOTTITLE,
+		commands.SLOTATTRIB2, commands.SLOTPWDPROT, commands.SLOTSCENTYPE, commands.RULESCOUNT,
+		commands.UNKN6601, commands.UNKN6602, commands.PLAYERSTATS, commands.CREATESLOT,
+		commands.UNKN6412, commands.JOINGAME} {
+		client(Q, cmd, number(cmd))
+	}
+	server(T, commands.SLOTSTATUS, status(commands.SLOTSTATUS))
+	server(B, commands.SLOTSTATUS, status(commands.SLOTSTATUS))
+	server(T, commands.SLOTPLRSTATUS, func() Message { return &SlotPlayerStatusTell{} })
+	server(B, commands.SLOTPLRSTATUS, func() Message { return &SlotPlayerStatusTell{} })
+	server(T, commands.SLOTTITLE, name(commands.SLOTTITLE))
+	server(B, commands.SLOTTITLE, name(commands.SLOTTITLE))
+	server(T, commands.SLOTATTRIB2, func() Message { return &SlotAttrib2Tell{} })
+	server(T, commands.SLOTPWDPROT, status(commands.SLOTPWDPROT))
+	server(B, commands.SLOTPWDPROT, status(commands.SLOTPWDPROT))
+	server(T, commands.SLOTSCENTYPE, scene(commands.SLOTSCENTYPE))
+	server(T, commands.PLAYERSTATS, stats(commands.PLAYERSTATS))
+	client(Q, commands.EXITSLOTLIST, empty(commands.EXITSLOTLIST))
+	server(T, commands.EXITSLOTLIST, empty(commands.EXITSLOTLIST))
+	server(T, commands.CREATESLOT, numberTell(commands.CREATESLOT))
+	client(Q, commands.SCENESELECT, func() Message { return &SceneSelectQuery{} })
+	server(T, commands.SCENESELECT, scene(commands.SCENESELECT))
+	client(Q, commands.SLOTNAME, secret(commands.SLOTNAME))
+	server(T, commands.SLOTNAME, echo(commands.SLOTNAME))
+	client(Q, commands.SLOTPASSWD, secret(commands.SLOTPASSWD))
+	server(T, commands.SLOTPASSWD, echo(commands.SLOTPASSWD))
+	client(Q, commands.SLOTTIMER, func() Message { return &Raw{Cmd: commands.SLOTTIMER} })
+	server(T, commands.SLOTTIMER, func() Message { return &SlotTimerTell{} })
+	server(T, commands.UNKN6412, func() Message { return &Unkn6412Tell{} })
+	client(Q, commands.UNKN6504, byteQuery(commands.UNKN6504))
+	server(T, commands.UNKN6504, byteTell(commands.UNKN6504))
+	client(Q, commands.CANCELSLOT, empty(commands.CANCELSLOT))
+	server(T, commands.CANCELSLOT, empty(commands.CANCELSLOT))
+	server(B, commands.LEAVESLOT, handle(commands.LEAVESLOT))
+	server(B, commands.CANCELSLOTBC, text(commands.CANCELSLOTBC))
+	server(B, commands.PLAYERSTATBC, stat(commands.PLAYERSTATBC))
+	server(B, commands.PLAYEROK, func() Message { return &PlayerOKBroadcast{} })
+	client(B, commands.STARTGAME, func() Message { return &Raw{Cmd: commands.STARTGAME} })
+	client(Q, commands.JOINGAME, func() Message { return &JoinGameQuery{} })
+	server(T, commands.JOINGAME, numberTell(commands.JOINGAME))
+
+	// rules
+	server(T, commands.RULESCOUNT, byteTell(commands.RULESCOUNT))
+	client(Q, commands.RULEATTCOUNT, rule(commands.RULEATTCOUNT))
+	server(T, commands.RULEATTCOUNT, ruleTell(commands.RULEATTCOUNT))
+	server(T, commands.UNKN6601, unkn66(commands.UNKN6601))
+	server(T, commands.UNKN6602, unkn66(commands.UNKN6602))
+	client(Q, commands.RULEDESCRIPT, rule(commands.RULEDESCRIPT))
+	server(T, commands.RULEDESCRIPT, func() Message { return &RuleDescriptTell{} })
+	client(Q, commands.RULEVALUE, rule(commands.RULEVALUE))
+	server(T, commands.RULEVALUE, ruleTell(commands.RULEVALUE))
+	client(Q, commands.RULEATTRIB, rule(commands.RULEATTRIB))
+	server(T, commands.RULEATTRIB, ruleTell(commands.RULEATTRIB))
+	client(Q, commands.ATTRDESCRIPT, attr(commands.ATTRDESCRIPT))
+	server(T, commands.ATTRDESCRIPT, func() Message { return &AttrDescriptTell{} })
+	client(Q, commands.ATTRATTRIB, attr(commands.ATTRATTRIB))
+	server(T, commands.ATTRATTRIB, func() Message { return &AttrAttribTell{} })
+	client(Q, commands.SETRULE, ruleTell(commands.SETRULE))
+	server(T, commands.SETRULE, byteTell(commands.SETRULE))
+	client(Q, commands.UNKN660C, func() Message { return &Raw{Cmd: commands.UNKN660C} })
+	server(T, commands.UNKN660C, func() Message { return &Raw{Cmd: commands.UNKN660C} })
+
+	// game start
+	server(B, commands.GETREADY, empty(commands.GETREADY))
+	client(Q, commands.PLAYERCOUNT, empty(commands.PLAYERCOUNT))
+	server(T, commands.PLAYERCOUNT, byteTell(commands.PLAYERCOUNT))
+	client(Q, commands.PLAYERNUMBER, empty(commands.PLAYERNUMBER))
+	server(T, commands.PLAYERNUMBER, byteTell(commands.PLAYERNUMBER))
+	client(Q, commands.PLAYERSTAT, byteQuery(commands.PLAYERSTAT))
+	server(T, commands.PLAYERSTAT, func() Message { return &PlayerStatTell{} })
+	client(Q, commands.PLAYERSCORE, byteQuery(commands.PLAYERSCORE))
+	server(T, commands.PLAYERSCORE, func() Message { return &PlayerScoreTell{} })
+	client(Q, commands.GAMESESSION, empty(commands.GAMESESSION))
+	server(T, commands.GAMESESSION, func() Message { return &GameSessionTell{} })
+	client(Q, commands.GAMEDIFF, empty(commands.GAMEDIFF))
+	server(T, commands.GAMEDIFF, func() Message { return &GameDiffTell{} })
+	client(Q, commands.GSINFO, empty(commands.GSINFO))
+	server(T, commands.GSINFO, func() Message { return &GSInfoTell{} })
+	client(Q, commands.UNKN6002, empty(commands.UNKN6002))
+	server(T, commands.UNKN6002, empty(commands.UNKN6002))
+
+	// after game lobby
+	client(Q, commands.ENTERAGL, empty(commands.ENTERAGL))
+	server(T, commands.ENTERAGL, empty(commands.ENTERAGL))
+	client(Q, commands.AGLSTATS, empty(commands.AGLSTATS))
+	server(T, commands.AGLSTATS, stats(commands.AGLSTATS))
+	client(Q, commands.AGLPLAYERCNT, empty(commands.AGLPLAYERCNT))
+	server(T, commands.AGLPLAYERCNT, numberTell(commands.AGLPLAYERCNT))
+	server(B, commands.AGLPLAYERCNT, numberTell(commands.AGLPLAYERCNT))
+	client(Q, commands.LEAVEAGL, empty(commands.LEAVEAGL))
+	server(T, commands.LEAVEAGL, empty(commands.LEAVEAGL))
+	server(B, commands.LEAVEAGL, handle(commands.LEAVEAGL))
+	server(B, commands.AGLJOIN, stat(commands.AGLJOIN))
+
+	// chat, information, buddies
+	client(B, commands.CHATIN, secret(commands.CHATIN))
+	server(B, commands.CHATOUT, func() Message { return &ChatOutBroadcast{} })
+	client(Q, commands.GETINFO, secret(commands.GETINFO))
+	server(T, commands.GETINFO, func() Message { return &GetInfoTell{} })
+	client(Q, commands.EVENTDAT, message(commands.EVENTDAT))
+	server(T, commands.EVENTDAT, handle(commands.EVENTDAT))
+	server(B, commands.EVENTDATBC, func() Message { return &EventDatBroadcast{} })
+	client(Q, commands.BUDDYLIST, secret(commands.BUDDYLIST))
+	server(T, commands.BUDDYLIST, func() Message { return &BuddyListTell{} })
+	client(Q, commands.CHECKBUDDY, secret(commands.CHECKBUDDY))
+	server(T, commands.CHECKBUDDY, func() Message { return &CheckBuddyTell{} })
+	client(Q, commands.PRIVATEMSG, message(commands.PRIVATEMSG))
+	server(T, commands.PRIVATEMSG, empty(commands.PRIVATEMSG))
+	server(B, commands.PRIVATEMSGBC, func() Message { return &PrivateMsgBroadcast{} })
+
+	// patch
+	server(B, commands.PATCHSTART, func() Message { return &PatchStartBroadcast{} })
+	server(B, commands.PATCHDATA, func() Message { return &PatchDataBroadcast{} })
+	server(B, commands.PATCHFOOTER, empty(commands.PATCHFOOTER))
+	server(Q, commands.PATCHLINECHECK, number(commands.PATCHLINECHECK))
+	client(T, commands.PATCHLINECHECK, numberTell(commands.PATCHLINECHECK))
+	server(Q, commands.PATCHFINISH, empty(commands.PATCHFINISH))
+	client(T, commands.PATCHFINISH, empty(commands.PATCHFINISH))
+
+	// connection
+	server(Q, commands.CONNCHECK, empty(commands.CONNCHECK))
+	client(T, commands.CONNCHECK, func() Message { return &Raw{Cmd: commands.CONNCHECK} })
+	client(Q, commands.LOGOUT, empty(commands.LOGOUT))
+	server(T, commands.LOGOUT, empty(commands.LOGOUT))
+	server(B, commands.SHUTDOWN, text(commands.SHUTDOWN))
+	server(Q, commands.GSLOGIN, empty(commands.GSLOGIN))
+	client(T, commands.GSLOGIN, func() Message { return &GSLoginTell{} })
+}
+
+// New returns an empty message for a command sent by who, or a *Raw when
+// the payload of the command is not known.
+func New(who byte, qsw byte, cmd int) Message {
+	fromServer := who == commands.SERVER || who == commands.GAMESERVER
+	if f, ok := registry[kind{fromServer, qsw, cmd}]; ok {
+		return f()
+	}
+	return &Raw{Cmd: cmd}
+}
+
+// Name returns the name of a command for logging.
+func Name(cmd int) string {
+	return commands.GetConstName(cmd)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const RELAY_RECONNECT_DELAY = 5 * time.Second
+
+// RelayClient is the relay end of the control channel. It keeps dialing the
+// lobby and reports the game server's sessions while connected, reports
+// made while the lobby is unreachable are dropped.
+type RelayClient struct {
+	lobby   string
+	secret  string
+	title   string
+	name    string
+	gsp     *GameServerPacketHandler
+	control *ControlConn
+	mu      sync.Mutex
+}
+
+func NewRelayClient(lobby, secret, title, name string, gsp *GameServerPacketHandler) *RelayClient {
+	return &RelayClient{lobby: lobby, secret: secret, title: title, name: name, gsp: gsp}
+}
+
+func (rc *RelayClient) Run() {
+	for {
+		if err := rc.serve(); err != nil {
+			relayLog.Warn("lobby control", "lobby", rc.lobby, "err", err)
+		}
+		time.Sleep(RELAY_RECONNECT_DELAY)
+	}
+}
+
+func (rc *RelayClient) serve() error {
+	conn, err := net.DialTimeout("tcp", rc.lobby, CONTROL_HANDSHAKE_TIMEOUT)
+	if err != nil {
+		return err
+	}
+	c := NewControlConn(conn)
+	defer c.Close()
+
+	conn.SetDeadline(time.Now().Add(CONTROL_HANDSHAKE_TIMEOUT))
+	challenge, err := c.Receive()
+	if err != nil {
+		return err
+	}
+	hello := &ControlMessage{Type: CONTROL_HELLO, Title: rc.title, Relay: rc.name}
+	hello.MAC = controlMAC(rc.secret, challenge.Nonce, rc.title, rc.name)
+	if err := c.Send(hello); err != nil {
+		return err
+	}
+	welcome, err := c.Receive()
+	if err != nil {
+		return err
+	}
+	if welcome.Type != CONTROL_WELCOME {
+		return fmt.Errorf("refused by lobby: %s", welcome.Reason)
+	}
+	conn.SetDeadline(time.Time{})
+	relayLog.Info("connected to lobby", "lobby", rc.lobby)
+
+	rc.mu.Lock()
+	rc.control = c
+	rc.mu.Unlock()
+	defer func() {
+		rc.mu.Lock()
+		rc.control = nil
+		rc.mu.Unlock()
+	}()
+
+	// the lobby might have been restarted, tell it who is already here
+	for gamenr, userids := range rc.gsp.Members() {
+		rc.SessionStarted(gamenr)
+		for _, userid := range userids {
+			rc.SessionJoined(gamenr, userid)
+		}
+	}
+
+	for {
+		m, err := c.Receive()
+		if err != nil {
+			return err
+		}
+		switch m.Type {
+		case CONTROL_GAME:
+			rc.gsp.Expect(m.Game, m.Players)
+		default:
+			relayLog.Warn("unknown control message from lobby", "type", m.Type)
+		}
+	}
+}
+
+func (rc *RelayClient) send(m *ControlMessage) {
+	rc.mu.Lock()
+	c := rc.control
+	rc.mu.Unlock()
+	if c == nil {
+		relayLog.Warn("lobby unreachable, dropping report", "type", m.Type, "game", m.Game)
+		return
+	}
+	if err := c.Send(m); err != nil {
+		relayLog.Warn("lobby control", "lobby", rc.lobby, "err", err)
+		c.Close()
+	}
+}
+
+func (rc *RelayClient) SessionStarted(gamenr int) {
+	rc.send(&ControlMessage{Type: CONTROL_START, Game: gamenr})
+}
+
+func (rc *RelayClient) SessionJoined(gamenr int, userid string) {
+	rc.send(&ControlMessage{Type: CONTROL_JOIN, Game: gamenr, UserID: userid})
+}
+
+func (rc *RelayClient) SessionLeft(gamenr int, userid string, reason string) {
+	rc.send(&ControlMessage{Type: CONTROL_LEAVE, Game: gamenr, UserID: userid, Reason: reason})
+}
+
+func (rc *RelayClient) SessionEnded(gamenr int) {
+	rc.send(&ControlMessage{Type: CONTROL_END, Game: gamenr})
+}
+
+// runRelay runs a game server without a lobby or database, it learns about
+// its games from the lobby's relay control port.
+func runRelay(args []string) int {
+	fs := flag.NewFlagSet("bioserver relay", flag.ContinueOnError)
+	listen := fs.String("listen", fmt.Sprintf("0.0.0.0:%d", FILE1.GamePort), "address the game server binds to")
+	name := fs.String("relay", "", "this relay as listed in the lobby's relays, host:port")
+	title := fs.String("title", FILE1.Name, "title of the games: file1 or file2")
+	lobby := fs.String("lobby", "", "relay control address of the lobby, host:port")
+	secret := fs.String("secret", os.Getenv(ENV_PREFIX+"RELAY_SECRET"), "relay_secret of the lobby")
+	metrics := fs.String("metrics", "", "address /metrics is served on, empty disables it")
+	logFormat := fs.String("log-format", LOG_FORMAT_TEXT, "log output: text or json")
+	logLevel := fs.String("log-level", "info", "log level, optionally per subsystem: info,game=debug")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *name == "" || *lobby == "" || *secret == "" {
+		fmt.Fprintln(os.Stderr, "usage: bioserver relay -relay host:port -lobby host:port -secret secret [-listen host:port] [-title file1] [-metrics host:port]")
+		return 2
+	}
+	if err := SetupLogging(*logFormat, *logLevel); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if _, err := ParseVariants(*title); err != nil {
+		fmt.Fprintln(os.Stderr, "title:", err)
+		return 2
+	}
+	host, port, err := net.SplitHostPort(*listen)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "listen:", err)
+		return 2
+	}
+	portnr, err := strconv.Atoi(port)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "listen: invalid port", port)
+		return 2
+	}
+
+	relayLog.Info("starting relay", "title", *title, "relay", *name, "listen", *listen)
+	var wg sync.WaitGroup
+	gamePacketHandler := NewGameServerPacketHandler(*title)
+	client := NewRelayClient(*lobby, *secret, *title, *name, gamePacketHandler)
+	gamePacketHandler.SetReporter(client)
+	gameServer := NewGameServerThread(host, portnr, gamePacketHandler)
+	if err := gameServer.Listen(); err != nil {
+		relayLog.Error("starting relay", "err", err)
+		return 1
+	}
+	go gamePacketHandler.Run()
+	wg.Add(1)
+	go gameServer.Run(&wg)
+	go client.Run()
+	if *metrics != "" {
+		collectGameMetrics(gamePacketHandler)
+		go RunMetrics(*metrics)
+	}
+
+	// same keepalive as the lobby's heartbeat
+	go func() {
+		for {
+			gamePacketHandler.ConnCheck(gameServer)
+			time.Sleep(30 * time.Second)
+		}
+	}()
+	wg.Wait()
+	return 0
+}
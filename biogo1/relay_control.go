@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// The control channel between lobby and remote relays is JSON, one message
+// per line. The relay dials the lobby, gets a challenge, and proves it knows
+// the shared secret in its hello. After the welcome the lobby announces
+// games with their players and the relay reports what happens to them.
+const (
+	CONTROL_CHALLENGE = "challenge" // lobby: nonce
+	CONTROL_HELLO     = "hello"     // relay: title, relay, mac
+	CONTROL_WELCOME   = "welcome"   // lobby: relay accepted
+	CONTROL_ERROR     = "error"     // lobby: reason, connection is closed
+	CONTROL_GAME      = "game"      // lobby: game, players to let in
+	CONTROL_START     = "start"     // relay: game, first player arrived
+	CONTROL_JOIN      = "join"      // relay: game, userid
+	CONTROL_LEAVE     = "leave"     // relay: game, userid, reason
+	CONTROL_END       = "end"       // relay: game, last player left
+
+	CONTROL_HANDSHAKE_TIMEOUT = 10 * time.Second
+)
+
+// a relay that doesn't take a message in this time is disconnected
+var CONTROL_SEND_TIMEOUT = 10 * time.Second
+
+// ControlMessage is any message of the control channel, only the fields of
+// its type are set.
+type ControlMessage struct {
+	Type    string           `json:"type"`
+	Nonce   string           `json:"nonce,omitempty"`
+	Title   string           `json:"title,omitempty"`
+	Relay   string           `json:"relay,omitempty"`
+	MAC     string           `json:"mac,omitempty"`
+	Game    int              `json:"game,omitempty"`
+	Players []ExpectedPlayer `json:"players,omitempty"`
+	UserID  string           `json:"userid,omitempty"`
+	Reason  string           `json:"reason,omitempty"`
+}
+
+// controlMAC proves knowledge of the secret for one handshake.
+func controlMAC(secret, nonce, title, relay string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s", nonce, title, relay)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ControlConn is one end of a control channel, Send may be called from any
+// goroutine.
+type ControlConn struct {
+	conn net.Conn
+	dec  *json.Decoder
+	enc  *json.Encoder
+	mu   sync.Mutex
+}
+
+func NewControlConn(conn net.Conn) *ControlConn {
+	return &ControlConn{conn: conn, dec: json.NewDecoder(bufio.NewReader(conn)), enc: json.NewEncoder(conn)}
+}
+
+func (c *ControlConn) Send(m *ControlMessage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(CONTROL_SEND_TIMEOUT))
+	if err := c.enc.Encode(m); err != nil {
+		// a message may be cut off, nothing can follow it
+		c.conn.Close()
+		return err
+	}
+	return nil
+}
+
+func (c *ControlConn) Receive() (*ControlMessage, error) {
+	m := &ControlMessage{}
+	if err := c.dec.Decode(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *ControlConn) Close() error {
+	return c.conn.Close()
+}
+
+// RelayControl is the lobby end, it accepts the remote relays of all
+// served titles.
+type RelayControl struct {
+	secret string
+	pools  map[string]*RelayPool // by variant name
+}
+
+func NewRelayControl(secret string) *RelayControl {
+	return &RelayControl{secret: secret, pools: make(map[string]*RelayPool)}
+}
+
+// AddPool lets the relays of a title connect.
+func (rc *RelayControl) AddPool(v *Variant, pool *RelayPool) {
+	rc.pools[v.Name] = pool
+}
+
+func (rc *RelayControl) Run(addr string) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		relayLog.Error("starting relay control", "addr", addr, "err", err)
+		return
+	}
+	relayLog.Info("relay control listening", "addr", addr)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			relayLog.Error("accepting relay control connection", "err", err)
+			continue
+		}
+		go rc.serve(NewControlConn(conn))
+	}
+}
+
+func (rc *RelayControl) serve(c *ControlConn) {
+	defer c.Close()
+	pool, relay, err := rc.handshake(c)
+	if err != nil {
+		relayLog.Warn("relay refused", "remote", c.conn.RemoteAddr().String(), "err", err)
+		c.Send(&ControlMessage{Type: CONTROL_ERROR, Reason: err.Error()})
+		return
+	}
+	relayLog.Info("relay connected", "relay", relay.Name, "remote", c.conn.RemoteAddr().String())
+	reporter := pool.connect(relay, c)
+	defer pool.disconnect(relay, c)
+
+	for {
+		m, err := c.Receive()
+		if err != nil {
+			relayLog.Info("relay disconnected", "relay", relay.Name, "err", err)
+			return
+		}
+		switch m.Type {
+		case CONTROL_START:
+			reporter.SessionStarted(m.Game)
+		case CONTROL_JOIN:
+			reporter.SessionJoined(m.Game, m.UserID)
+		case CONTROL_LEAVE:
+			reporter.SessionLeft(m.Game, m.UserID, m.Reason)
+		case CONTROL_END:
+			reporter.SessionEnded(m.Game)
+		default:
+			relayLog.Warn("unknown control message", "relay", relay.Name, "type", m.Type)
+		}
+	}
+}
+
+func (rc *RelayControl) handshake(c *ControlConn) (*RelayPool, *Relay, error) {
+	c.conn.SetDeadline(time.Now().Add(CONTROL_HANDSHAKE_TIMEOUT))
+	defer c.conn.SetDeadline(time.Time{})
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	challenge := &ControlMessage{Type: CONTROL_CHALLENGE, Nonce: hex.EncodeToString(nonce)}
+	if err := c.Send(challenge); err != nil {
+		return nil, nil, err
+	}
+	hello, err := c.Receive()
+	if err != nil {
+		return nil, nil, err
+	}
+	if hello.Type != CONTROL_HELLO {
+		return nil, nil, fmt.Errorf("expected hello, got %q", hello.Type)
+	}
+	mac := controlMAC(rc.secret, challenge.Nonce, hello.Title, hello.Relay)
+	if !hmac.Equal([]byte(mac), []byte(hello.MAC)) {
+		return nil, nil, fmt.Errorf("wrong secret")
+	}
+	pool, ok := rc.pools[hello.Title]
+	if !ok {
+		return nil, nil, fmt.Errorf("title %q is not served", hello.Title)
+	}
+	relay := pool.find(hello.Relay)
+	if relay == nil {
+		return nil, nil, fmt.Errorf("relay %q is not configured for %s", hello.Relay, hello.Title)
+	}
+	if err := c.Send(&ControlMessage{Type: CONTROL_WELCOME}); err != nil {
+		return nil, nil, err
+	}
+	return pool, relay, nil
+}
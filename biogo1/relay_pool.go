@@ -0,0 +1,355 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// games nobody showed up for on their relay are dropped from its load after this
+const RELAY_ASSIGN_TIMEOUT = 30 * time.Minute
+
+// RelayReporter is told by a relay which players are in which game.
+type RelayReporter interface {
+	SessionStarted(gamenr int)
+	SessionJoined(gamenr int, userid string)
+	SessionLeft(gamenr int, userid string, reason string)
+	SessionEnded(gamenr int)
+}
+
+// Relay is a game server the lobby can send the players of a game to, either
+// the one running in this process or one running elsewhere.
+type Relay struct {
+	Name     string
+	IP       []byte // IPv4 address sent in GSINFO
+	Port     int
+	Networks []*net.IPNet // client networks this relay is close to, empty for any
+	Capacity int          // games at a time, 0 is unlimited
+	Local    bool
+
+	local   *GameServerPacketHandler // game server of a local relay
+	control *ControlConn             // control connection of a remote relay
+}
+
+// ParseRelay reads a relay given as host:port, optionally followed by
+// @network for every client network it should be preferred for, like
+// "203.0.113.5:8690@10.1.0.0/16@10.2.0.0/16".
+func ParseRelay(s string, capacity int) (*Relay, error) {
+	parts := strings.Split(strings.TrimSpace(s), "@")
+	host, port, err := net.SplitHostPort(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("relay %q: %w", s, err)
+	}
+	ip, err := resolveIPv4(host)
+	if err != nil {
+		return nil, fmt.Errorf("relay %q: %w", s, err)
+	}
+	r := &Relay{Name: parts[0], IP: ip, Capacity: capacity}
+	r.Port, err = strconv.Atoi(port)
+	if err != nil || r.Port <= 0 || r.Port > 0xffff {
+		return nil, fmt.Errorf("relay %q: invalid port %q", s, port)
+	}
+	for _, network := range parts[1:] {
+		_, n, err := net.ParseCIDR(strings.TrimSpace(network))
+		if err != nil {
+			return nil, fmt.Errorf("relay %q: %w", s, err)
+		}
+		r.Networks = append(r.Networks, n)
+	}
+	return r, nil
+}
+
+// ParseRelays reads a comma separated list of relays.
+func ParseRelays(list string, capacity int) ([]*Relay, error) {
+	var relays []*Relay
+	for _, s := range strings.Split(list, ",") {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+		r, err := ParseRelay(s, capacity)
+		if err != nil {
+			return nil, err
+		}
+		relays = append(relays, r)
+	}
+	return relays, nil
+}
+
+// near tells if a client at ip is in one of the relay's networks.
+func (r *Relay) near(ip net.IP) bool {
+	for _, n := range r.Networks {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// available tells if the relay can be told about games, mu of the pool has
+// to be held.
+func (r *Relay) available() bool {
+	return r.local != nil || r.control != nil
+}
+
+type relayGame struct {
+	relay    *Relay
+	members  map[string]bool // userids the relay reported in this game
+	assigned time.Time
+}
+
+// RelayPool assigns games to relays. All players of a game get the same
+// relay, picked when the first of them asks with GSINFO: the least loaded
+// relay with room left, preferring relays near that player. Remote relays
+// are only picked while their control connection is up.
+type RelayPool struct {
+	relays []*Relay
+	games  map[int]*relayGame
+	db     Store // player status while on a relay
+	mu     sync.Mutex
+}
+
+func NewRelayPool(relays []*Relay, db Store) *RelayPool {
+	return &RelayPool{relays: relays, games: make(map[int]*relayGame), db: db}
+}
+
+// AttachLocal connects the game server of this process to the local relay.
+func (rp *RelayPool) AttachLocal(gsp *GameServerPacketHandler) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	for _, r := range rp.relays {
+		if r.Local {
+			r.local = gsp
+			gsp.SetReporter(&relayReporter{pool: rp, relay: r})
+		}
+	}
+}
+
+// Expect tells the relay of a game which players to let in.
+func (rp *RelayPool) Expect(r *Relay, gamenr int, players []ExpectedPlayer) error {
+	rp.mu.Lock()
+	local, control := r.local, r.control
+	rp.mu.Unlock()
+	switch {
+	case local != nil:
+		local.Expect(gamenr, players)
+		return nil
+	case control != nil:
+		return control.Send(&ControlMessage{Type: CONTROL_GAME, Game: gamenr, Players: players})
+	}
+	return fmt.Errorf("relay %s is not connected", r.Name)
+}
+
+// Assign returns the relay of a game, choosing one if the game has none yet.
+func (rp *RelayPool) Assign(gamenr int, client net.IP) (*Relay, error) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if g, ok := rp.games[gamenr]; ok {
+		return g.relay, nil
+	}
+	rp.expire()
+
+	load := make(map[*Relay]int)
+	for _, g := range rp.games {
+		load[g.relay]++
+	}
+	var best *Relay
+	for _, r := range rp.relays {
+		if !r.available() || (r.Capacity > 0 && load[r] >= r.Capacity) {
+			continue
+		}
+		if best == nil || rp.better(r, best, load, client) {
+			best = r
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("all %d relays are full or offline", len(rp.relays))
+	}
+	rp.games[gamenr] = &relayGame{relay: best, members: make(map[string]bool), assigned: time.Now()}
+	return best, nil
+}
+
+// better compares two relays for a new game, earlier relays win ties.
+func (rp *RelayPool) better(a, b *Relay, load map[*Relay]int, client net.IP) bool {
+	if a.near(client) != b.near(client) {
+		return a.near(client)
+	}
+	return load[a] < load[b]
+}
+
+// expire forgets games nobody joined in time, mu has to be held.
+func (rp *RelayPool) expire() {
+	for gamenr, g := range rp.games {
+		if len(g.members) == 0 && time.Since(g.assigned) > RELAY_ASSIGN_TIMEOUT {
+			delete(rp.games, gamenr)
+		}
+	}
+}
+
+// find returns the remote relay of a title with this name.
+func (rp *RelayPool) find(name string) *Relay {
+	for _, r := range rp.relays {
+		if !r.Local && r.Name == name {
+			return r
+		}
+	}
+	return nil
+}
+
+// connect makes a remote relay available through its control connection,
+// replacing an older connection.
+func (rp *RelayPool) connect(r *Relay, c *ControlConn) RelayReporter {
+	rp.mu.Lock()
+	old := r.control
+	r.control = c
+	rp.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return &relayReporter{pool: rp, relay: r}
+}
+
+// disconnect takes a remote relay out of the pool, its games are gone.
+func (rp *RelayPool) disconnect(r *Relay, c *ControlConn) {
+	rp.mu.Lock()
+	if r.control != c {
+		rp.mu.Unlock()
+		return
+	}
+	r.control = nil
+	var offline []string
+	for gamenr, g := range rp.games {
+		if g.relay == r {
+			for userid := range g.members {
+				offline = append(offline, userid)
+			}
+			delete(rp.games, gamenr)
+		}
+	}
+	rp.mu.Unlock()
+	rp.setStatus(STATUS_OFFLINE, -1, offline...)
+}
+
+// setStatus records the status of players in the store. It's called after
+// mu is released, the store may wait for the database.
+func (rp *RelayPool) setStatus(state, area int, userids ...string) {
+	for _, userid := range userids {
+		if err := rp.db.UpdateClientOrigin(userid, state, area, 0, 0); err != nil {
+			relayLog.Warn("updating player status", "userid", userid, "err", err)
+		}
+	}
+}
+
+func (rp *RelayPool) game(r *Relay, gamenr int) *relayGame {
+	g, ok := rp.games[gamenr]
+	if !ok {
+		// the lobby was restarted or the game expired, adopt it
+		g = &relayGame{relay: r, members: make(map[string]bool), assigned: time.Now()}
+		rp.games[gamenr] = g
+	}
+	if g.relay != r {
+		relayLog.Warn("relay reported a game of another relay", "relay", r.Name, "game", gamenr, "owner", g.relay.Name)
+		return nil
+	}
+	return g
+}
+
+func (rp *RelayPool) joined(r *Relay, gamenr int, userid string) {
+	rp.mu.Lock()
+	g := rp.game(r, gamenr)
+	if g != nil {
+		g.members[userid] = true
+	}
+	rp.mu.Unlock()
+	if g != nil {
+		rp.setStatus(STATUS_GAME, 0, userid)
+	}
+}
+
+func (rp *RelayPool) left(r *Relay, gamenr int, userid string) {
+	rp.mu.Lock()
+	g, ok := rp.games[gamenr]
+	ok = ok && g.relay == r
+	if ok {
+		delete(g.members, userid)
+	}
+	rp.mu.Unlock()
+	if ok {
+		rp.setStatus(STATUS_OFFLINE, -1, userid)
+	}
+}
+
+func (rp *RelayPool) ended(r *Relay, gamenr int) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if g, ok := rp.games[gamenr]; ok && g.relay == r {
+		delete(rp.games, gamenr)
+	}
+}
+
+// CountPlayers is the number of players the relays reported in games.
+func (rp *RelayPool) CountPlayers() int {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	cnt := 0
+	for _, g := range rp.games {
+		cnt += len(g.members)
+	}
+	return cnt
+}
+
+// RelayGameInfo describes a game on a relay.
+type RelayGameInfo struct {
+	Title    string    `json:"title"`
+	Game     int       `json:"game"`
+	Relay    string    `json:"relay"`
+	Players  []string  `json:"players"`
+	Assigned time.Time `json:"assigned"`
+}
+
+// Games lists the games assigned to the relays, with the players the
+// relays reported in them.
+func (rp *RelayPool) Games(title string) []RelayGameInfo {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	var games []RelayGameInfo
+	for gamenr, g := range rp.games {
+		info := RelayGameInfo{Title: title, Game: gamenr, Relay: g.relay.Name, Players: []string{}, Assigned: g.assigned}
+		for userid := range g.members {
+			info.Players = append(info.Players, userid)
+		}
+		slices.Sort(info.Players)
+		games = append(games, info)
+	}
+	slices.SortFunc(games, func(a, b RelayGameInfo) int { return a.Game - b.Game })
+	return games
+}
+
+// relayReporter applies the reports of one relay to the pool.
+type relayReporter struct {
+	pool  *RelayPool
+	relay *Relay
+}
+
+func (rr *relayReporter) SessionStarted(gamenr int) {
+	relayLog.Info("game started", "relay", rr.relay.Name, "game", gamenr)
+}
+
+func (rr *relayReporter) SessionJoined(gamenr int, userid string) {
+	rr.pool.joined(rr.relay, gamenr, userid)
+}
+
+func (rr *relayReporter) SessionLeft(gamenr int, userid string, reason string) {
+	if reason != "" {
+		relayLog.Info("player left game", "relay", rr.relay.Name, "game", gamenr, "userid", userid, "reason", reason)
+	}
+	rr.pool.left(rr.relay, gamenr, userid)
+}
+
+func (rr *relayReporter) SessionEnded(gamenr int) {
+	relayLog.Info("game ended", "relay", rr.relay.Name, "game", gamenr)
+	rr.pool.ended(rr.relay, gamenr)
+}
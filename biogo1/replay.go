@@ -0,0 +1,590 @@
+package main
+
+import (
+	"bioserver/commands"
+	"bioserver/protocol"
+	"bioserver/simclient"
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// how long a golden packet is waited for before it counts as missing
+	REPLAY_TIMEOUT = 2 * time.Second
+	// always left out, the game server address depends on the setup
+	REPLAY_IGNORE = "GSINFO.IP,GSINFO.Port"
+)
+
+// Replay plays the client side of golden traces, recorded from the Java
+// server or from an earlier version of this one, against a fresh server
+// and compares what it sends with the recorded server packets. The store
+// is seeded from the traces: the sessions of the logins, the handles of
+// the IDHNPAIRS broadcasts and the message of the day.
+type Replay struct {
+	server  *SimServer
+	timeout time.Duration
+	pids    bool            // compare the ids of server queries and broadcasts
+	exact   bool            // compare byte for byte, stop at the first difference
+	cmds    map[int]bool    // commands left out of the comparison
+	fields  map[string]bool // "CMD.Field" left out of the comparison
+	verbose bool
+	out     io.Writer // where differences are reported
+
+	conns   map[string]*replayConn
+	aliases map[string]string // handles given out by the golden server to ours
+	packets int
+	diffs   int
+}
+
+// replayRecord is a lobby packet of a golden trace.
+type replayRecord struct {
+	time   time.Time
+	conn   string
+	userid string
+	title  string
+	dir    string
+	data   []byte
+}
+
+type replayConn struct {
+	name      string
+	userid    string
+	records   []replayRecord
+	client    *simclient.Client
+	closed    bool
+	newHandle bool // the golden client asked for a new handle
+}
+
+// runReplay replays golden traces and reports the ones the server doesn't
+// follow.
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("bioserver replay", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: bioserver replay [flags] trace|directory ...")
+		fmt.Fprintln(fs.Output(), "Replays the client packets of golden traces (capture_dir traces, pcap/pcapng captures) against a server on loopback")
+		fmt.Fprintln(fs.Output(), "and compares its packets with the recorded ones. The files of a directory are one session.")
+		fs.PrintDefaults()
+	}
+	verbose := fs.Bool("v", false, "print every packet compared")
+	timeout := fs.Duration("timeout", REPLAY_TIMEOUT, "how long a recorded server packet is waited for")
+	title := fs.String("title", "", "file1 or file2, by default the title of the traces")
+	pids := fs.Bool("pids", false, "compare the packet ids of server queries and broadcasts too")
+	exact := fs.Bool("exact", false, "compare packets byte for byte and stop at the first difference")
+	ignore := fs.String("ignore", "", "more commands (CMD) or fields (CMD.Field) left out, comma separated")
+	logLevel := fs.String("log-level", "error", "server log levels, like log_level")
+	lobbyPorts := fs.String("lobby-ports", fmt.Sprintf("%d,%d", FILE1.LobbyPort, FILE2.LobbyPort), "lobby server ports in captures")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	if err := SetupLogging(LOG_FORMAT_TEXT, *logLevel); err != nil {
+		fmt.Fprintln(os.Stderr, "replay:", err)
+		return 2
+	}
+	cmds, fields, err := parseReplayIgnore(REPLAY_IGNORE + "," + *ignore)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "replay: -ignore:", err)
+		return 2
+	}
+	ports, err := parsePorts(*lobbyPorts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "replay: -lobby-ports:", err)
+		return 2
+	}
+
+	failed := 0
+	for _, path := range fs.Args() {
+		records, err := loadGolden(path, ports)
+		if err != nil {
+			fmt.Printf("FAIL %s: %v\n", path, err)
+			failed++
+			continue
+		}
+		r := &Replay{timeout: *timeout, pids: *pids, exact: *exact, cmds: cmds, fields: fields, verbose: *verbose, out: os.Stdout}
+		if err := r.Run(records, *title); err != nil {
+			fmt.Printf("FAIL %s: %v\n", path, err)
+			failed++
+			continue
+		}
+		if r.diffs > 0 {
+			fmt.Printf("FAIL %s: %d differences in %d packets\n", path, r.diffs, r.packets)
+			failed++
+			continue
+		}
+		fmt.Printf("ok   %s (%d packets)\n", path, r.packets)
+	}
+	if failed > 0 {
+		fmt.Printf("%d of %d traces failed\n", failed, fs.NArg())
+		return 1
+	}
+	return 0
+}
+
+// parseReplayIgnore reads the -ignore list.
+func parseReplayIgnore(list string) (map[int]bool, map[string]bool, error) {
+	var names []string
+	fields := make(map[string]bool)
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if cmd, field, ok := strings.Cut(item, "."); ok {
+			n, err := parseDissectCommands(cmd)
+			if err != nil {
+				return nil, nil, err
+			}
+			for c := range n {
+				fields[protocol.Name(c)+"."+field] = true
+			}
+			continue
+		}
+		names = append(names, item)
+	}
+	cmds, err := parseDissectCommands(strings.Join(names, ","))
+	if cmds == nil {
+		cmds = make(map[int]bool)
+	}
+	return cmds, fields, err
+}
+
+// loadGolden reads the lobby packets of a trace file or of all traces in
+// a directory, in the order they were recorded.
+func loadGolden(path string, lobbyPorts []int) ([]replayRecord, error) {
+	files := []string{path}
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		files = nil
+		for _, pattern := range []string{"*.jsonl", "*.pcap", "*.pcapng"} {
+			found, _ := filepath.Glob(filepath.Join(path, pattern))
+			files = append(files, found...)
+		}
+	}
+	var records []replayRecord
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var recs []replayRecord
+		if isPcap(data) {
+			recs, err = goldenPcap(data, filepath.Base(file), lobbyPorts)
+		} else {
+			recs, err = goldenTrace(data, filepath.Base(file))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		records = append(records, recs...)
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("no lobby packets")
+	}
+	slices.SortStableFunc(records, func(a, b replayRecord) int { return a.time.Compare(b.time) })
+	return records, nil
+}
+
+// goldenTrace reads a trace of the packet capture.
+func goldenTrace(data []byte, file string) ([]replayRecord, error) {
+	var records []replayRecord
+	lines := bufio.NewScanner(bytes.NewReader(data))
+	lines.Buffer(nil, 1<<20)
+	for n := 1; lines.Scan(); n++ {
+		if len(bytes.TrimSpace(lines.Bytes())) == 0 {
+			continue
+		}
+		var rec CaptureRecord
+		if err := json.Unmarshal(lines.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		if rec.Server != CAPTURE_LOBBY {
+			continue
+		}
+		raw, err := hex.DecodeString(rec.Raw)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: raw: %w", n, err)
+		}
+		records = append(records, replayRecord{
+			time:   rec.Time,
+			conn:   file + "#" + strconv.FormatUint(rec.Conn, 10),
+			userid: rec.UserID,
+			title:  rec.Title,
+			dir:    rec.Dir,
+			data:   raw,
+		})
+	}
+	return records, lines.Err()
+}
+
+// goldenPcap follows the lobby connections of a capture with the
+// dissector.
+func goldenPcap(data []byte, file string, lobbyPorts []int) ([]replayRecord, error) {
+	var records []replayRecord
+	d := &Dissector{out: bufio.NewWriter(os.Stderr), lobbyPorts: lobbyPorts}
+	d.packet = func(t time.Time, server, conn, dir string, data []byte) {
+		if server != CAPTURE_LOBBY {
+			return
+		}
+		records = append(records, replayRecord{time: t, conn: file + "#" + conn, dir: dir, data: bytes.Clone(data)})
+	}
+	err := d.dissectPcap(data)
+	d.out.Flush()
+	return records, err
+}
+
+// Run replays one session on a server of its own.
+func (r *Replay) Run(records []replayRecord, title string) error {
+	if title == "" {
+		title = FILE1.Name
+		if records[0].title != "" {
+			title = records[0].title
+		}
+	}
+	variants, err := ParseVariants(title)
+	if err != nil || len(variants) != 1 {
+		return fmt.Errorf("title %q: one of file1 or file2", title)
+	}
+	if r.server, err = StartSimServer(variants[0]); err != nil {
+		return err
+	}
+	defer r.server.Stop()
+
+	r.conns = make(map[string]*replayConn)
+	r.aliases = make(map[string]string)
+	var order []*replayConn
+	for _, rec := range records {
+		rc, ok := r.conns[rec.conn]
+		if !ok {
+			rc = &replayConn{name: rec.conn, userid: rec.userid}
+			if rc.userid == "" {
+				rc.userid = fmt.Sprintf("conn%d", len(r.conns)+1)
+			}
+			r.conns[rec.conn] = rc
+			order = append(order, rc)
+		}
+		rc.records = append(rc.records, rec)
+	}
+	r.seedMOTD(records)
+
+	for i, rec := range records {
+		rc := r.conns[rec.conn]
+		if r.exact && r.diffs > 0 {
+			break
+		}
+		if rc.closed {
+			continue
+		}
+		if rec.dir == CAPTURE_CLOSE {
+			// what the server sends after it is cleaning up, not for the client
+			rc.closed = true
+			if rc.client != nil {
+				r.extra(i+1, rc, rc.client.Pending())
+				rc.client.Close()
+			}
+			continue
+		}
+		if rc.client == nil {
+			if err := r.dial(rc); err != nil {
+				return err
+			}
+		}
+		if rec.dir == CAPTURE_IN {
+			if err := r.send(rc, rec.data); err != nil {
+				return fmt.Errorf("packet %d: %w", i+1, err)
+			}
+		} else {
+			r.expect(i+1, rc, rec.data)
+		}
+	}
+	// still connected when the traces end
+	for _, rc := range order {
+		if rc.closed || rc.client == nil {
+			continue
+		}
+		if r.exact && r.diffs > 0 {
+			rc.client.Close()
+			continue
+		}
+		if extra, err := rc.client.Flush(); err == nil {
+			r.extra(len(records), rc, extra)
+		}
+		rc.client.Close()
+	}
+	return nil
+}
+
+// seedMOTD makes the first message of the day of the traces ours.
+func (r *Replay) seedMOTD(records []replayRecord) {
+	for _, rec := range records {
+		h, m, err := protocol.Decode(rec.data)
+		if err != nil || rec.dir != CAPTURE_OUT || h.Cmd != commands.MOTHEDAY {
+			continue
+		}
+		if motd, ok := m.(*protocol.MOTDTell); ok {
+			message := strings.TrimPrefix(string(motd.Message), "<LF=6><BODY><CENTER>")
+			r.server.db.AddMOTD(strings.TrimSuffix(message, "<END>"))
+			return
+		}
+	}
+}
+
+// dial connects a recorded client, after registering its session and
+// handles.
+func (r *Replay) dial(rc *replayConn) error {
+	session := ""
+	for _, rec := range rc.records {
+		_, m, err := protocol.Decode(rec.data)
+		if err != nil {
+			continue
+		}
+		switch m := m.(type) {
+		case *protocol.LoginTell:
+			if session == "" && rec.dir == CAPTURE_IN {
+				session = m.Session
+			}
+		case *protocol.IDHNPairsBroadcast:
+			for _, p := range m.Pairs {
+				handle := string(bytes.TrimRight(p.Handle, "\x00"))
+				if _, ok := r.aliases[handle]; !ok {
+					r.server.db.AddHNPair(rc.userid, []byte(handle), p.Nickname)
+				}
+			}
+		}
+	}
+	if session != "" {
+		r.server.db.AddSession(rc.userid, session)
+	}
+	c, err := simclient.Dial(r.server.addr, rc.name, session)
+	if err != nil {
+		return err
+	}
+	c.Timeout = r.timeout
+	rc.client = c
+	return nil
+}
+
+// send sends a recorded client packet, with the handles of the golden
+// server replaced by ours.
+func (r *Replay) send(rc *replayConn, data []byte) error {
+	h, m, err := protocol.Decode(data)
+	if err != nil || m == nil {
+		return rc.client.Write(data)
+	}
+	switch {
+	case h.Cmd == commands.CONNCHECK:
+		// answered by the client
+		return nil
+	case h.Cmd == commands.HNSELECT:
+		if q, ok := m.(*protocol.HNSelectQuery); ok {
+			rc.newHandle = string(bytes.TrimRight(q.Handle, "\x00")) == "******"
+		}
+	}
+	changed := false
+	for _, f := range protocol.FlatFields(m) {
+		if to, ok := r.aliases[simclient.FormatValue(f.Value)]; ok {
+			if err := protocol.SetField(m, f.Name, to); err == nil {
+				changed = true
+			}
+		}
+	}
+	if changed {
+		data = protocol.Encode(h.Who, h.Qsw, h.PID, m)
+	}
+	return rc.client.Write(data)
+}
+
+// expect compares the next packet of a kind with a recorded server packet.
+// Packets the server sent before it are extra.
+func (r *Replay) expect(n int, rc *replayConn, golden []byte) {
+	h, m, err := protocol.Decode(golden)
+	if err != nil && m == nil {
+		r.report(n, rc, "golden packet %x: %v", golden, err)
+		return
+	}
+	if r.skipped(h.Cmd) {
+		return
+	}
+	r.packets++
+	got, extra, err := rc.client.Take(h.Qsw, h.Cmd)
+	r.extra(n, rc, extra)
+	kind := fmt.Sprintf("%s %s pid=%d", commands.GetConstName(h.Qsw), protocol.Name(h.Cmd), h.PID)
+	if err != nil {
+		r.report(n, rc, "%s: missing (%v)", kind, err)
+		return
+	}
+
+	if h.Cmd == commands.HNSELECT && rc.newHandle {
+		tell, ok1 := got.Message.(*protocol.HNSelectTell)
+		golden, ok2 := m.(*protocol.HNSelectTell)
+		if ok1 && ok2 {
+			ours := string(bytes.TrimRight(tell.Handle, "\x00"))
+			theirs := string(bytes.TrimRight(golden.Handle, "\x00"))
+			r.aliases[theirs] = ours
+			if r.verbose {
+				fmt.Fprintf(r.out, "  [%5d] %s: new handle %s is %s here\n", n, rc.name, theirs, ours)
+			}
+		}
+		rc.newHandle = false
+	}
+
+	var diffs []string
+	if r.exact {
+		diffs = r.diffBytes(h, m, golden, got)
+	} else {
+		diffs = r.diffPackets(h, m, golden, got)
+	}
+	if len(diffs) > 0 {
+		r.report(n, rc, "%s", kind)
+		for _, d := range diffs {
+			fmt.Fprintf(r.out, "          %s\n", d)
+		}
+	} else if r.verbose {
+		fmt.Fprintf(r.out, "  [%5d] %s %s ok\n", n, rc.name, kind)
+	}
+}
+
+// diffPackets lists how got differs from the golden packet: the header,
+// the decoded fields, and the payload bytes when the fields are the same.
+// The payload of packets with other ids isn't compared byte for byte, the
+// obfuscation of secret strings depends on it.
+func (r *Replay) diffPackets(h protocol.Header, m protocol.Message, golden []byte, got simclient.Packet) []string {
+	var diffs []string
+	if h.Who != got.Header.Who {
+		diffs = append(diffs, fmt.Sprintf("sender: golden %#02x, got %#02x", h.Who, got.Header.Who))
+	}
+	if h.Err != got.Header.Err {
+		diffs = append(diffs, fmt.Sprintf("error flag: golden %#02x, got %#02x", h.Err, got.Header.Err))
+	}
+	samePID := h.PID == got.Header.PID
+	if !samePID && (h.Qsw == commands.TELL || r.pids || r.exact) {
+		diffs = append(diffs, fmt.Sprintf("pid: golden %d, got %d", h.PID, got.Header.PID))
+	}
+
+	exact := samePID
+	var want, have []protocol.Field
+	if m != nil {
+		want = protocol.FlatFields(m)
+	}
+	if got.Message != nil {
+		have = protocol.FlatFields(got.Message)
+	}
+	values := make(map[string]string, len(have))
+	for _, f := range have {
+		values[f.Name] = simclient.FormatValue(f.Value)
+	}
+	seen := make(map[string]bool, len(want))
+	for _, f := range want {
+		seen[f.Name] = true
+		if r.ignored(h.Cmd, f.Name) {
+			exact = false
+			continue
+		}
+		value := simclient.FormatValue(f.Value)
+		if alias, ok := r.aliases[value]; ok {
+			value, exact = alias, false
+		}
+		v, ok := values[f.Name]
+		switch {
+		case !ok:
+			diffs = append(diffs, fmt.Sprintf("%s: golden %q, missing", f.Name, value))
+		case v != value:
+			diffs = append(diffs, fmt.Sprintf("%s: golden %q, got %q", f.Name, value, v))
+		}
+	}
+	for _, f := range have {
+		if !seen[f.Name] && !r.ignored(h.Cmd, f.Name) {
+			diffs = append(diffs, fmt.Sprintf("%s: got %q, not in golden", f.Name, values[f.Name]))
+		}
+	}
+
+	payload, gotPayload := golden[protocol.HEADER_SIZE:], got.Data[protocol.HEADER_SIZE:]
+	if len(diffs) == 0 && exact && !bytes.Equal(payload, gotPayload) {
+		diffs = append(diffs, fmt.Sprintf("payload: golden %x", payload),
+			fmt.Sprintf("         got    %x", gotPayload))
+	}
+	return diffs
+}
+
+// diffBytes compares got with the golden packet byte for byte, header and
+// packet id included. Handles the golden server made up and the ignored
+// fields are put into the golden packet first. The field differences only
+// explain the first differing byte.
+func (r *Replay) diffBytes(h protocol.Header, m protocol.Message, golden []byte, got simclient.Packet) []string {
+	want := golden
+	if m != nil {
+		values := make(map[string]string)
+		if got.Message != nil {
+			for _, f := range protocol.FlatFields(got.Message) {
+				values[f.Name] = simclient.FormatValue(f.Value)
+			}
+		}
+		changed := false
+		for _, f := range protocol.FlatFields(m) {
+			value, ok := r.aliases[simclient.FormatValue(f.Value)]
+			if r.ignored(h.Cmd, f.Name) {
+				value, ok = values[f.Name]
+			}
+			if ok && protocol.SetField(m, f.Name, value) == nil {
+				changed = true
+			}
+		}
+		if changed {
+			want = protocol.Encode(h.Who, h.Qsw, h.PID, m)
+		}
+	}
+	n := min(len(want), len(got.Data))
+	i := 0
+	for i < n && want[i] == got.Data[i] {
+		i++
+	}
+	if i == n && len(want) == len(got.Data) {
+		return nil
+	}
+	const context = 16
+	diffs := []string{fmt.Sprintf("byte %d of %d: golden %x, got %x", i, len(want),
+		want[i:min(i+context, len(want))], got.Data[i:min(i+context, len(got.Data))])}
+	return append(diffs, r.diffPackets(h, m, want, got)...)
+}
+
+// extra reports packets the golden server didn't send.
+func (r *Replay) extra(n int, rc *replayConn, packets []simclient.Packet) {
+	for _, p := range packets {
+		if !r.skipped(p.Header.Cmd) {
+			r.report(n, rc, "extra %s", p)
+		}
+	}
+}
+
+func (r *Replay) report(n int, rc *replayConn, format string, v ...any) {
+	r.diffs++
+	fmt.Fprintf(r.out, "  [%5d] %s %s\n", n, rc.name, fmt.Sprintf(format, v...))
+}
+
+// skipped tells if a command is left out of the comparison. Heartbeats and
+// connection checks depend on the time.
+func (r *Replay) skipped(cmd int) bool {
+	return cmd == commands.HEARTBEAT || cmd == commands.CONNCHECK || r.cmds[cmd]
+}
+
+func (r *Replay) ignored(cmd int, field string) bool {
+	for {
+		if r.fields[protocol.Name(cmd)+"."+field] {
+			return true
+		}
+		i := strings.LastIndexByte(field, '.')
+		if i < 0 {
+			return false
+		}
+		field = field[:i]
+	}
+}
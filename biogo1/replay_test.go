@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestSnapshotTraces replays every session in testdata/snapshots and fails
+// at the first byte the server sends differently. The snapshots were
+// recorded from this server, they catch changes of its own output, not
+// differences to the Java server.
+func TestSnapshotTraces(t *testing.T) {
+	traces, err := filepath.Glob(filepath.Join("testdata", "snapshots", "*.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(traces) == 0 {
+		t.Fatal("no snapshot traces")
+	}
+	cmds, fields, err := parseReplayIgnore(REPLAY_IGNORE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, trace := range traces {
+		t.Run(strings.TrimSuffix(filepath.Base(trace), ".jsonl"), func(t *testing.T) {
+			records, err := loadGolden(trace, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var out bytes.Buffer
+			r := &Replay{timeout: REPLAY_TIMEOUT, exact: true, cmds: cmds, fields: fields, out: &out}
+			if err := r.Run(records, ""); err != nil {
+				t.Fatal(err)
+			}
+			if r.diffs > 0 {
+				t.Fatalf("%s differs after %d packets:\n%s", trace, r.packets, out.String())
+			}
+		})
+	}
+}
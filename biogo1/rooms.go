@@ -1,61 +1,47 @@
 package main
 
-// TODO i hate this lol should probably replace it with a 2d array
-
-const (
-	NUMBER_OF_ROOMS int = 10
-)
-
 type Rooms struct {
 	rooms         []*Room
 	NumberOfAreas int
+	numberOfRooms int
 }
 
-func NewRooms(numberOfAreas int) *Rooms {
-	r := &Rooms{}
-	r.rooms = make([]*Room, NUMBER_OF_ROOMS*numberOfAreas)
-	curIndex := 0
-	for i := 0; i < numberOfAreas; i++ {
-		r.rooms[curIndex] = NewRoom(i, "R1", STATUS_ACTIVE)
-		curIndex++
-		r.rooms[curIndex] = NewRoom(i, "R2", STATUS_ACTIVE)
-		curIndex++
-		r.rooms[curIndex] = NewRoom(i, "R3", STATUS_ACTIVE)
-		curIndex++
-		r.rooms[curIndex] = NewRoom(i, "R4", STATUS_ACTIVE)
-		curIndex++
-		r.rooms[curIndex] = NewRoom(i, "R5", STATUS_ACTIVE)
-		curIndex++
-		r.rooms[curIndex] = NewRoom(i, "R6", STATUS_ACTIVE)
-		curIndex++
-		r.rooms[curIndex] = NewRoom(i, "R7", STATUS_ACTIVE)
-		curIndex++
-		r.rooms[curIndex] = NewRoom(i, "R8", STATUS_ACTIVE)
-		curIndex++
-		r.rooms[curIndex] = NewRoom(i, "R9", STATUS_ACTIVE)
-		curIndex++
-		r.rooms[curIndex] = NewRoom(i, "RA", STATUS_ACTIVE)
-		curIndex++
+// NewRooms gives every area a copy of the rooms of a title, see Variant.
+func NewRooms(numberOfAreas int, rooms []*Room) *Rooms {
+	r := &Rooms{
+		NumberOfAreas: numberOfAreas,
+		numberOfRooms: len(rooms),
+	}
+	for i := 1; i <= numberOfAreas; i++ {
+		for _, room := range rooms {
+			r.rooms = append(r.rooms, NewRoom(i, room.Name, room.Status))
+		}
 	}
-	r.NumberOfAreas = numberOfAreas
-
 	return r
 }
 
+// GetRoomCount returns the number of rooms in an area.
 func (r *Rooms) GetRoomCount() int {
-	return len(r.rooms)
+	return r.numberOfRooms
+}
+
+func (r *Rooms) get(areanr int, roomnr int) *Room {
+	if areanr <= 0 || areanr > r.NumberOfAreas || roomnr <= 0 || roomnr > r.numberOfRooms {
+		return nil
+	}
+	return r.rooms[(areanr-1)*r.numberOfRooms+roomnr-1]
 }
 
 func (r *Rooms) GetName(areanr int, roomnr int) string {
-	if areanr < 0 || areanr >= r.NumberOfAreas || roomnr < 0 || roomnr >= NUMBER_OF_ROOMS {
-		return ""
+	if room := r.get(areanr, roomnr); room != nil {
+		return room.Name
 	}
-	return r.rooms[areanr*NUMBER_OF_ROOMS+roomnr-1].Name
+	return ""
 }
 
 func (r *Rooms) GetStatus(areanr int, roomnr int) byte {
-	if areanr < 0 || areanr >= r.NumberOfAreas || roomnr < 0 || roomnr >= NUMBER_OF_ROOMS {
-		return 0
+	if room := r.get(areanr, roomnr); room != nil {
+		return room.Status
 	}
-	return r.rooms[areanr*NUMBER_OF_ROOMS+roomnr-1].Status
-}
\ No newline at end of file
+	return 0
+}
@@ -2,7 +2,7 @@ package main
 
 type Rule struct {
 	name      string
-	attribute byte // todo: what happens if <> 1?
+	attribute byte // 1 = changeable, 0 = fixed
 	value     byte
 }
 
@@ -14,13 +14,60 @@ func NewRule(name string, attribute byte, value byte) *Rule {
 	}
 }
 
-// RuleSet contains the standard ruleset and associated attribute options.
+// RuleSet contains the rules of a slot and the associated attribute options.
 type RuleSet struct {
 	ruleset    []*Rule
 	attributes [][]*Rule
+	defaults   []byte // values Reset goes back to
 }
 
-// NewRuleSet creates a new RuleSet with the standard settings.
+func newRuleSet(ruleset []*Rule, attributes [][]*Rule) *RuleSet {
+	rs := &RuleSet{ruleset: ruleset, attributes: attributes}
+	for _, r := range ruleset {
+		rs.defaults = append(rs.defaults, r.value)
+	}
+	return rs
+}
+
+// standardRules are the rules every area of both titles starts with:
+// four players, ten minutes wait, very hard.
+func standardRules() ([]*Rule, [][]*Rule) {
+	rules := []*Rule{
+		NewRule("number of players", 1, 2),
+		NewRule("wait limit", 1, 2),
+		NewRule("difficulty level", 1, 3),
+	}
+	attributes := [][]*Rule{
+		{
+			NewRule("two players", 0, 0),
+			NewRule("three players", 0, 0),
+			NewRule("four players", 0, 0),
+		},
+		{
+			NewRule("three minutes", 0, 0),
+			NewRule("five minutes", 0, 0),
+			NewRule("ten minutes", 0, 0),
+			NewRule("fifteen minutes", 0, 0),
+			NewRule("thirty minutes", 0, 0),
+		},
+		{
+			NewRule("easy", 0, 0),
+			NewRule("normal", 0, 0),
+			NewRule("hard", 0, 0),
+			NewRule("very hard", 0, 0),
+		},
+	}
+	return rules, attributes
+}
+
+func onOff() []*Rule {
+	return []*Rule{
+		NewRule("off", 0, 0),
+		NewRule("on", 0, 0),
+	}
+}
+
+// NewRuleSet creates a new RuleSet with the File #1 settings.
 // Standard settings:
 //
 //	ruleset[0]: "number of players", attribute 1, value 2
@@ -30,39 +77,32 @@ type RuleSet struct {
 //
 // And the associated attributes arrays as defined in the Java version.
 func NewRuleSet() *RuleSet {
-	rs := &RuleSet{
-		ruleset: []*Rule{
-			NewRule("number of players", 1, 2),
-			NewRule("wait limit", 1, 2),
-			NewRule("difficulty level", 1, 3),
-			NewRule("friendly fire", 1, 0),
-		},
-		attributes: [][]*Rule{
-			{
-				NewRule("two players", 0, 0),
-				NewRule("three players", 0, 0),
-				NewRule("four players", 0, 0),
-			},
-			{
-				NewRule("three minutes", 0, 0),
-				NewRule("five minutes", 0, 0),
-				NewRule("ten minutes", 0, 0),
-				NewRule("fifteen minutes", 0, 0),
-				NewRule("thirty minutes", 0, 0),
-			},
-			{
-				NewRule("easy", 0, 0),
-				NewRule("normal", 0, 0),
-				NewRule("hard", 0, 0),
-				NewRule("very hard", 0, 0),
-			},
-			{
-				NewRule("off", 0, 0),
-				NewRule("on", 0, 0),
-			},
-		},
+	rules, attributes := standardRules()
+	rules = append(rules, NewRule("friendly fire", 1, 0))
+	attributes = append(attributes, onOff())
+	return newRuleSet(rules, attributes)
+}
+
+// NewRuleSetFile2 creates the RuleSet of a File #2 area. The special areas
+// switch on nightmare mode, friendly fire or infinite ammo by default,
+// everywhere else only the standard rules are offered.
+func NewRuleSetFile2(area int) *RuleSet {
+	rules, attributes := standardRules()
+	switch area {
+	case 2: // Nightmare
+		rules = append(rules, NewRule("nightmare", 0, 1))
+		attributes = append(attributes, onOff())
+	case 3: // Survival
+		rules = append(rules, NewRule("friendly fire", 0, 1))
+		attributes = append(attributes, onOff())
+	case 4: // Panic
+		rules = append(rules, NewRule("friendly fire", 0, 1), NewRule("nightmare", 0, 1))
+		attributes = append(attributes, onOff(), onOff())
+	case 5: // Infinity
+		rules = append(rules, NewRule("friendly fire", 1, 0), NewRule("nightmare", 1, 0), NewRule("infinity", 0, 1))
+		attributes = append(attributes, onOff(), onOff(), onOff())
 	}
-	return rs
+	return newRuleSet(rules, attributes)
 }
 
 // GetRuleField is a helper function to return the database field for a given rule number.
@@ -84,10 +124,19 @@ func GetRuleField(area int, rulenr byte) string {
 
 // Reset resets the ruleset values to the standard settings.
 func (rs *RuleSet) Reset() {
-	rs.ruleset[0].value = 2
-	rs.ruleset[1].value = 2
-	rs.ruleset[2].value = 3
-	rs.ruleset[3].value = 0
+	for i, v := range rs.defaults {
+		rs.ruleset[i].value = v
+	}
+}
+
+// valueOf returns the value of a rule by name, 0 if the ruleset lacks it.
+func (rs *RuleSet) valueOf(name string) byte {
+	for _, r := range rs.ruleset {
+		if r.name == name {
+			return r.value
+		}
+	}
+	return 0
 }
 
 // GetRuleName returns the name of the rule at the given index.
@@ -110,6 +159,16 @@ func (rs *RuleSet) GetRuleAttAttribute(nr int, nratt int) byte {
 	return rs.attributes[nr][nratt].attribute
 }
 
+// HasRule tells if nr is the index of a rule.
+func (rs *RuleSet) HasRule(nr int) bool {
+	return nr >= 0 && nr < len(rs.ruleset) && nr < len(rs.attributes)
+}
+
+// HasRuleAtt tells if nratt is the index of an attribute option of rule nr.
+func (rs *RuleSet) HasRuleAtt(nr int, nratt int) bool {
+	return rs.HasRule(nr) && nratt >= 0 && nratt < len(rs.attributes[nr])
+}
+
 // GetRulesCount returns the number of rules in the ruleset.
 func (rs *RuleSet) GetRulesCount() int {
 	return len(rs.ruleset)
@@ -137,7 +196,17 @@ func (rs *RuleSet) GetDifficulty() byte {
 
 // GetFriendlyFire returns the friendly fire value.
 func (rs *RuleSet) GetFriendlyFire() byte {
-	return rs.ruleset[3].value
+	return rs.valueOf("friendly fire")
+}
+
+// GetNightmare returns the nightmare mode value (File #2).
+func (rs *RuleSet) GetNightmare() byte {
+	return rs.valueOf("nightmare")
+}
+
+// GetInfinity returns the infinite ammo value (File #2).
+func (rs *RuleSet) GetInfinity() byte {
+	return rs.valueOf("infinity")
 }
 
 // GetWaitTime returns the wait time in minutes corresponding to the wait limit rule.
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 )
 
@@ -9,6 +10,10 @@ const (
 	PACKET_HEADER_SIZE = 12   // Size of a packet header.
 )
 
+// ErrBadFrame is returned for a length field that can never be satisfied,
+// the stream can't be resynchronized after that.
+var ErrBadFrame = errors.New("invalid message length")
+
 // ServerStreamBuffer manages incoming data using a fixed-size array.
 // Instead of a dynamic slice, we use a [RECEIVE_SIZE]byte array and keep track
 // of the number of valid bytes (buflen) and a pointer (messptr) to where the next
@@ -35,7 +40,7 @@ func NewServerStreamBuffer() *ServerStreamBuffer {
 func (s *ServerStreamBuffer) Append(data []byte) []byte {
 	n := len(data)
 	if s.buflen+n > RECEIVE_SIZE {
-		fmt.Println("Buffer overflow: cannot append data")
+		serverLog.Warn("stream buffer overflow, dropping data", "bytes", n)
 		return s.buf[:s.buflen] // Return what we have so far.
 	}
 	// Copy the incoming data into the buffer starting at index buflen.
@@ -45,9 +50,16 @@ func (s *ServerStreamBuffer) Append(data []byte) []byte {
 	return s.buf[:s.buflen]
 }
 
-// AppendData writes new incoming data into the buffer
+// AppendData writes new incoming data into the buffer. The start of an
+// incomplete message is moved to the front first when the data would not
+// fit behind it.
 func (s *ServerStreamBuffer) AppendData(data []byte) error {
 	n := len(data)
+	if s.buflen+n > RECEIVE_SIZE && s.messptr > 0 {
+		copy(s.buf[:], s.buf[s.messptr:s.buflen])
+		s.buflen -= s.messptr
+		s.messptr = 0
+	}
 	if s.buflen+n > RECEIVE_SIZE {
 		return fmt.Errorf("buffer overflow")
 	}
@@ -59,10 +71,11 @@ func (s *ServerStreamBuffer) AppendData(data []byte) error {
 // GetCompleteMessages scans the buffer for complete messages.
 // It uses the header information (assumed to be PACKET_HEADERSIZE bytes)
 // and a length field at offset 4-5 (big-endian) to determine message boundaries.
-func (s *ServerStreamBuffer) GetCompleteMessages() []byte {
+// A message that can't fit into the buffer returns ErrBadFrame.
+func (s *ServerStreamBuffer) GetCompleteMessages() ([]byte, error) {
 	size := s.buflen - s.messptr
 	if size < PACKET_HEADER_SIZE {
-		return nil
+		return nil, nil
 	}
 	total := 0
 	// Walk through the buffer from messptr, summing up complete messages.
@@ -78,6 +91,9 @@ func (s *ServerStreamBuffer) GetCompleteMessages() []byte {
 		// This mimics:
 		// plen = (((int) b[messptr+total+4] << 8)&0xFF00) | ((int) b[messptr+total+5] &0xFF);
 		plen := (int(s.buf[s.messptr+total+4]) << 8) | int(s.buf[s.messptr+total+5])
+		if plen+PACKET_HEADER_SIZE > RECEIVE_SIZE {
+			return nil, fmt.Errorf("%w: %d", ErrBadFrame, plen)
+		}
 		// Check if we have the full message (header + payload)
 		if size < plen+PACKET_HEADER_SIZE {
 			break
@@ -86,7 +102,7 @@ func (s *ServerStreamBuffer) GetCompleteMessages() []byte {
 		size = s.buflen - s.messptr - total
 	}
 	if total == 0 {
-		return nil
+		return nil, nil
 	}
 	// Extract the complete messages.
 	retval := make([]byte, total)
@@ -98,7 +114,7 @@ func (s *ServerStreamBuffer) GetCompleteMessages() []byte {
 	} else {
 		s.messptr += total
 	}
-	return retval
+	return retval, nil
 }
 
 // // GetCompleteMessages scans the buffer for complete packets.
@@ -164,18 +180,19 @@ func (s *ServerStreamBuffer) GetCompleteMessages() []byte {
 // GetCompleteGameMessages processes game server packets that have a different format.
 // If the first two bytes indicate a session packet (0x82, 0x02), it returns the entire buffer.
 // Otherwise, it assumes each message starts with a one-byte length indicator.
-func (s *ServerStreamBuffer) GetCompleteGameMessages() []byte {
+// A zero length byte returns ErrBadFrame.
+func (s *ServerStreamBuffer) GetCompleteGameMessages() ([]byte, error) {
 	// Check if the buffer starts with the session packet marker.
 	if s.buflen >= 2 && s.buf[0] == 0x82 && s.buf[1] == 0x02 {
 		retval := make([]byte, s.buflen)
 		copy(retval, s.buf[:s.buflen])
 		s.buflen = 0
 		s.messptr = 0
-		return retval
+		return retval, nil
 	}
 	size := s.buflen - s.messptr
 	if size < 1 {
-		return nil
+		return nil, nil
 	}
 	total := 0
 	remaining := size
@@ -186,6 +203,9 @@ func (s *ServerStreamBuffer) GetCompleteGameMessages() []byte {
 			break
 		}
 		plen := int(s.buf[index]) & 0xFF
+		if plen == 0 {
+			return nil, ErrBadFrame
+		}
 		if remaining < plen {
 			break
 		}
@@ -193,7 +213,7 @@ func (s *ServerStreamBuffer) GetCompleteGameMessages() []byte {
 		remaining -= plen
 	}
 	if total == 0 {
-		return nil
+		return nil, nil
 	}
 	retval := make([]byte, total)
 	copy(retval, s.buf[s.messptr:s.messptr+total])
@@ -203,7 +223,7 @@ func (s *ServerStreamBuffer) GetCompleteGameMessages() []byte {
 	} else {
 		s.messptr += total
 	}
-	return retval
+	return retval, nil
 }
 
 // func (s *ServerStreamBuffer) GetCompleteGameMessages() []byte {
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// streamBlocks feeds data to a fresh buffer in reads of chunk bytes, the
+// way the server threads do, and collects what get returns after each
+// read. It stops at the first error.
+func streamBlocks(t *testing.T, data []byte, chunk uint8, get func(*ServerStreamBuffer) ([]byte, error)) [][]byte {
+	n := max(int(chunk), 1)
+	s := NewServerStreamBuffer()
+	var blocks [][]byte
+	for len(data) > 0 {
+		read := data[:min(n, len(data))]
+		data = data[len(read):]
+		if err := s.AppendData(read); err != nil {
+			break
+		}
+		msg, err := get(s)
+		if err != nil {
+			if !errors.Is(err, ErrBadFrame) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			break
+		}
+		if msg != nil {
+			blocks = append(blocks, msg)
+		}
+	}
+	return blocks
+}
+
+func FuzzGetCompleteMessages(f *testing.F) {
+	f.Add([]byte{}, uint8(1))
+	f.Add([]byte{0x18, 0x01, 0x61, 0x00, 0x00, 0x00, 0x00, 0x01, 0xff, 0xff, 0xff, 0xff}, uint8(5))
+	f.Add([]byte{0x18, 0x01, 0x61, 0x00, 0xff, 0xff, 0x00, 0x01, 0xff, 0xff, 0xff, 0xff}, uint8(12))
+	f.Fuzz(func(t *testing.T, data []byte, chunk uint8) {
+		var out []byte
+		for _, msg := range streamBlocks(t, data, chunk, (*ServerStreamBuffer).GetCompleteMessages) {
+			// only whole packets are handed out
+			for rest := msg; len(rest) > 0; {
+				p, err := NewPacketFromBytes(rest)
+				if err != nil {
+					t.Fatalf("block %x: %v", msg, err)
+				}
+				rest = rest[HEADER_SIZE+p.len:]
+			}
+			out = append(out, msg...)
+		}
+		if !bytes.HasPrefix(data, out) {
+			t.Fatalf("returned %x, not a prefix of the stream %x", out, data)
+		}
+	})
+}
+
+func FuzzGetCompleteGameMessages(f *testing.F) {
+	f.Add([]byte{}, uint8(1))
+	f.Add([]byte{0x05, 0x01, 0x02, 0x03, 0x04, 0x03, 0x00, 0x00}, uint8(3))
+	f.Add([]byte{0x05, 0x00, 0x01, 0x02, 0x03, 0x00, 0x01}, uint8(255))
+	f.Fuzz(func(t *testing.T, data []byte, chunk uint8) {
+		var out []byte
+		for _, msg := range streamBlocks(t, data, chunk, (*ServerStreamBuffer).GetCompleteGameMessages) {
+			// the session packet comes in the lobby format and is passed on
+			// as it is, game messages are whole
+			if len(msg) < 2 || msg[0] != 0x82 || msg[1] != 0x02 {
+				for rest := msg; len(rest) > 0; {
+					size := int(rest[0])
+					if size == 0 || size > len(rest) {
+						t.Fatalf("block %x cuts a message", msg)
+					}
+					rest = rest[size:]
+				}
+			}
+			out = append(out, msg...)
+		}
+		if !bytes.HasPrefix(data, out) {
+			t.Fatalf("returned %x, not a prefix of the stream %x", out, data)
+		}
+	})
+}
+
+func TestGetCompleteMessagesBadFrame(t *testing.T) {
+	header := make([]byte, HEADER_SIZE)
+	binary.BigEndian.PutUint16(header[4:], RECEIVE_SIZE)
+	s := NewServerStreamBuffer()
+	if err := s.AppendData(header); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetCompleteMessages(); !errors.Is(err, ErrBadFrame) {
+		t.Fatalf("got %v, want ErrBadFrame", err)
+	}
+}
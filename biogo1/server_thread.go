@@ -2,20 +2,23 @@ package main
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
+	"os"
 	"sync"
+	"sync/atomic"
 )
 
 type ServerThread struct {
-	addr           *net.TCPAddr
-	packetHandler  *PacketHandler
-	listener       *net.TCPListener
-	changeRequests chan ServerChangeEvent
-	pendingData    map[net.Conn][][]byte
-	readBuffers    map[net.Conn]*ServerStreamBuffer
-	initOK         bool
-	mu             sync.Mutex
+	addr          *net.TCPAddr
+	packetHandler *PacketHandler
+	listener      *net.TCPListener
+	pendingData   map[net.Conn][][]byte
+	readBuffers   map[net.Conn]*ServerStreamBuffer
+	initOK        bool
+	closing       atomic.Bool
+	mu            sync.Mutex
+	log           *slog.Logger
 }
 
 func NewServerThread(address string, port int, packetHandler *PacketHandler) (*ServerThread, error) {
@@ -25,59 +28,77 @@ func NewServerThread(address string, port int, packetHandler *PacketHandler) (*S
 		return nil, fmt.Errorf("failed to resolve address %s:%d: %w", address, port, err)
 	}
 
-	log.Printf("Initializing Server at %s\n", tcpAddr.String())
+	logger := NewLogger("lobby")
+	if packetHandler != nil {
+		logger = packetHandler.baseLog
+	}
 
 	return &ServerThread{
-		addr:           tcpAddr,
-		packetHandler:  packetHandler,
-		changeRequests: make(chan ServerChangeEvent, 100),
-		pendingData:    make(map[net.Conn][][]byte),
-		readBuffers:    make(map[net.Conn]*ServerStreamBuffer),
-		initOK:         true,
+		addr:          tcpAddr,
+		packetHandler: packetHandler,
+		pendingData:   make(map[net.Conn][][]byte),
+		readBuffers:   make(map[net.Conn]*ServerStreamBuffer),
+		initOK:        true,
+		log:           logger,
 	}, nil
 }
 
-func (s *ServerThread) Run(wg *sync.WaitGroup) {
-	defer wg.Done()
+// Listen binds the lobby port before Run, port 0 picks a free one. Run
+// listens itself when this wasn't called.
+func (s *ServerThread) Listen() error {
 	ln, err := net.ListenTCP("tcp", s.addr)
 	if err != nil {
-		log.Fatalf("Error starting server on %s: %v", s.addr.String(), err)
+		return fmt.Errorf("listening on %s: %w", s.addr, err)
 	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.listener = ln
-	fmt.Printf("Lobby server started on %s\n", s.addr.String())
-	go s.processChangeRequests()
+	s.addr = ln.Addr().(*net.TCPAddr)
+	return nil
+}
+
+// Addr is the address of the lobby, with the port picked by Listen.
+func (s *ServerThread) Addr() *net.TCPAddr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.addr
+}
+
+func (s *ServerThread) Run(wg *sync.WaitGroup) {
+	defer wg.Done()
+	s.mu.Lock()
+	ln := s.listener
+	s.mu.Unlock()
+	if ln == nil {
+		if err := s.Listen(); err != nil {
+			s.log.Error("starting lobby server", "err", err)
+			os.Exit(1)
+		}
+		ln = s.listener
+	}
+	s.log.Info("lobby server started", "addr", s.Addr().String())
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			log.Println("Accept error:", err)
+			if s.closing.Load() {
+				return
+			}
+			s.log.Error("accepting connection", "err", err)
 			continue
 		}
 		go s.accept(conn)
 	}
 }
 
-func (s *ServerThread) processChangeRequests() {
-	for change := range s.changeRequests {
-		switch change.EventType {
-		case CHANGEOPS:
-			// go does not need to manage interestOps
-		case FORCECLOSE:
-			// close the connection
-			// change.Conn.Close()
-			s.close(change.conn)
-		}
-	}
-}
-
 func (s *ServerThread) accept(conn net.Conn) {
-	fmt.Println("New connection from", conn.RemoteAddr())
+	s.connLog(conn).Info("new connection")
 	s.mu.Lock()
 	if _, exists := s.readBuffers[conn]; !exists {
 		s.readBuffers[conn] = NewServerStreamBuffer()
 	}
 	s.mu.Unlock()
 	if s.packetHandler != nil {
-		fmt.Printf("%p conn SendLogin() to it\n", conn)
+		METRIC_CONNECTIONS.Inc(s.packetHandler.variant.Name, "lobby")
 		s.packetHandler.SendLogin(s, conn)
 	}
 	go s.read(conn)
@@ -88,7 +109,7 @@ func (s *ServerThread) read(conn net.Conn) {
 	for {
 		n, err := conn.Read(buffer)
 		if err != nil {
-			log.Println("Read error from", conn.RemoteAddr(), err)
+			s.connLog(conn).Debug("read error", "err", err)
 			s.mu.Lock()
 			delete(s.readBuffers, conn)
 			s.mu.Unlock()
@@ -107,11 +128,16 @@ func (s *ServerThread) read(conn net.Conn) {
 		}
 		s.mu.Unlock()
 		if err := rb.AppendData(data); err != nil {
-			log.Println("Buffer overflow for", conn.RemoteAddr())
+			s.connLog(conn).Warn("read buffer overflow")
+			s.close(conn)
+			return
+		}
+		msg, err := rb.GetCompleteMessages()
+		if err != nil {
+			s.connLog(conn).Warn("dropping connection", "err", err)
 			s.close(conn)
 			return
 		}
-		msg := rb.GetCompleteMessages()
 		if msg != nil && s.packetHandler != nil {
 			s.packetHandler.ProcessData(s, conn, msg)
 		}
@@ -131,7 +157,7 @@ func (s *ServerThread) write(conn net.Conn) {
 
 		n, err := conn.Write(data)
 		if err != nil {
-			log.Println("Write error to", conn.RemoteAddr(), err)
+			s.connLog(conn).Debug("write error", "err", err)
 			s.close(conn)
 			return
 		}
@@ -157,8 +183,20 @@ func (s *ServerThread) Send(conn net.Conn, data []byte) {
 	go s.write(conn)
 }
 
+// StopAccepting closes the listener, connected clients stay.
+func (s *ServerThread) StopAccepting() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener != nil && !s.closing.Swap(true) {
+		s.listener.Close()
+	}
+}
+
+// Disconnect closes a connection. The read goroutine runs into the closed
+// connection and cleans up, so this never waits on the lobby's event loop
+// and can be called from it.
 func (s *ServerThread) Disconnect(conn net.Conn) {
-	s.changeRequests <- ServerChangeEvent{conn: conn, EventType: FORCECLOSE, ops: 0}
+	conn.Close()
 }
 
 func (s *ServerThread) close(conn net.Conn) {
@@ -168,7 +206,10 @@ func (s *ServerThread) close(conn net.Conn) {
 	delete(s.pendingData, conn)
 	s.mu.Unlock()
 	if s.packetHandler != nil {
-		fmt.Printf("Trying to remove client no disconnect %s\n", conn.RemoteAddr())
 		s.packetHandler.RemoveClientNoDisconnect(s, conn)
 	}
 }
+
+func (s *ServerThread) connLog(conn net.Conn) *slog.Logger {
+	return s.log.With("remote", conn.RemoteAddr().String())
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// TestDisconnectDoesNotWait disconnects more connections at once than any
+// queue would hold, as the lobby's event loop may do. The read goroutines
+// have to clean up after all of them.
+func TestDisconnectDoesNotWait(t *testing.T) {
+	s, err := NewServerThread("127.0.0.1", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conns []net.Conn
+	for i := 0; i < 500; i++ {
+		conn, peer := net.Pipe()
+		t.Cleanup(func() { peer.Close() })
+		s.accept(conn)
+		conns = append(conns, conn)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for _, conn := range conns {
+			s.Disconnect(conn)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Disconnect blocked")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mu.Lock()
+		left := len(s.readBuffers)
+		s.mu.Unlock()
+		if left == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connections not cleaned up", left)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
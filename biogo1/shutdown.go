@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// time for the SHUTDOWN notice to reach the clients before they're cut off
+const SHUTDOWN_NOTICE_DELAY = 2 * time.Second
+
+// Lobby is a running lobby and game server of one title.
+type Lobby struct {
+	variant           *Variant
+	packetHandler     *PacketHandler
+	lobbyServer       *ServerThread
+	gamePacketHandler *GameServerPacketHandler
+	gameServer        *GameServerThread
+}
+
+// shutdown stops the servers: no new connections, lobby players get the
+// shutdown notice and are disconnected, running games get timeout to
+// finish. Another signal stops waiting for them.
+func shutdown(conf *Configuration, db Store, lobbies []*Lobby, signals chan os.Signal, timeout time.Duration) {
+	serverLog.Info("shutting down")
+	for _, l := range lobbies {
+		l.lobbyServer.StopAccepting()
+		l.gameServer.StopAccepting()
+		ph, server := l.packetHandler, l.lobbyServer
+		ph.Call(func() { ph.BroadcastShutdown(server, conf.ShutdownMessage) })
+	}
+	time.Sleep(SHUTDOWN_NOTICE_DELAY)
+	for _, l := range lobbies {
+		ph, server := l.packetHandler, l.lobbyServer
+		ph.Call(func() { ph.DisconnectAll(server) })
+	}
+
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for waiting := true; waiting; {
+		players := 0
+		for _, l := range lobbies {
+			players += l.gamePacketHandler.CountInGamePlayers()
+		}
+		if players == 0 {
+			break
+		}
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			serverLog.Info("shutdown timeout, ending games", "players", players)
+			waiting = false
+		case <-signals:
+			serverLog.Info("second signal, ending games", "players", players)
+			waiting = false
+		}
+	}
+	for _, l := range lobbies {
+		l.gamePacketHandler.DisconnectAll(l.gameServer)
+	}
+
+	if err := db.ResetSessions(); err != nil {
+		serverLog.Error("resetting sessions", "err", err)
+	}
+}
+
+// restartServer replaces the process with a fresh server, started with the
+// same arguments and environment.
+func restartServer() {
+	exe, err := os.Executable()
+	if err == nil {
+		serverLog.Info("restarting")
+		err = syscall.Exec(exe, os.Args, os.Environ())
+	}
+	serverLog.Error("restarting", "err", err)
+	os.Exit(1)
+}
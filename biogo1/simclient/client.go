@@ -0,0 +1,306 @@
+// Package simclient is a headless PS2 client for end-to-end tests of the
+// server. It speaks the lobby protocol and the game server login, and runs
+// scenarios written in a small line based language, see Parse.
+package simclient
+
+import (
+	"bioserver/commands"
+	"bioserver/protocol"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+const (
+	DEFAULT_TIMEOUT = 5 * time.Second
+	QUIET_TIME      = 200 * time.Millisecond // wait for stray packets
+)
+
+// ErrTimeout is returned when the server didn't send the awaited packet.
+var ErrTimeout = errors.New("timeout")
+
+// Packet is a packet received from the server.
+type Packet struct {
+	Header  protocol.Header
+	Message protocol.Message
+	Data    []byte // the whole packet as received
+}
+
+func (p Packet) String() string {
+	s := fmt.Sprintf("%s %s pid=%d", commands.GetConstName(p.Header.Qsw), protocol.Name(p.Header.Cmd), p.Header.PID)
+	if p.Header.Err == protocol.ERR_FLAG {
+		s += " error"
+	}
+	return s
+}
+
+// Is tells if p is a qsw packet of cmd.
+func (p Packet) Is(qsw byte, cmd int) bool {
+	return p.Header.Qsw == qsw && p.Header.Cmd == cmd
+}
+
+// Err returns the message of an error answer, nil for any other packet.
+func (p Packet) Err() error {
+	if e, ok := p.Message.(*protocol.ErrorTell); ok {
+		return fmt.Errorf("%s refused: %s", protocol.Name(p.Header.Cmd), e.Message)
+	}
+	return nil
+}
+
+// Client is one simulated console on the lobby server. Packets are read
+// into an inbox; Expect takes them in order, Await looks for one further
+// down. Connection checks are answered and heartbeats dropped on the way,
+// they never show up in the inbox.
+type Client struct {
+	Name    string
+	Session string // 8 digit session id from the login pages
+	Handle  []byte // confirmed by HNSELECT
+	Relay   string // game server address from GSINFO
+	Timeout time.Duration
+	// Trace, when set, is called for every packet sent ("out") and
+	// received ("in").
+	Trace func(c *Client, dir string, p Packet)
+
+	conn  net.Conn
+	buf   []byte
+	inbox []Packet
+	pid   int
+	game  *GameClient
+}
+
+// Dial connects to the lobby server at addr, the server starts with the
+// LOGIN query, see Login.
+func Dial(addr, name, session string) (*Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, DEFAULT_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{Name: name, Session: session, Timeout: DEFAULT_TIMEOUT, conn: conn}, nil
+}
+
+// Close disconnects from the lobby and the game server.
+func (c *Client) Close() error {
+	if c.game != nil {
+		c.game.Close()
+	}
+	return c.conn.Close()
+}
+
+// Send sends a query or broadcast with the next packet id of the client.
+func (c *Client) Send(qsw byte, m protocol.Message) error {
+	c.pid++
+	return c.SendPID(qsw, c.pid, m)
+}
+
+// Reply answers a query of the server, with its packet id.
+func (c *Client) Reply(query Packet, m protocol.Message) error {
+	return c.SendPID(commands.TELL, query.Header.PID, m)
+}
+
+// Write sends a packet as it is, like one recorded from a real console.
+func (c *Client) Write(data []byte) error {
+	if c.Trace != nil {
+		h, m, _ := protocol.Decode(data)
+		c.Trace(c, "out", Packet{Header: h, Message: m, Data: data})
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(c.Timeout))
+	if _, err := c.conn.Write(data); err != nil {
+		return fmt.Errorf("%s: sending: %w", c.Name, err)
+	}
+	return nil
+}
+
+// SendPID sends m with the given packet id, secret strings are encrypted
+// for it.
+func (c *Client) SendPID(qsw byte, pid int, m protocol.Message) error {
+	data := protocol.Encode(commands.CLIENT, qsw, pid, m)
+	if c.Trace != nil {
+		h, _ := protocol.ParseHeader(data)
+		c.Trace(c, "out", Packet{Header: h, Message: m, Data: data})
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(c.Timeout))
+	if _, err := c.conn.Write(data); err != nil {
+		return fmt.Errorf("%s: sending %s: %w", c.Name, protocol.Name(m.Command()), err)
+	}
+	return nil
+}
+
+// Next returns the next packet of the inbox, waiting up to the timeout for
+// one to arrive.
+func (c *Client) Next() (Packet, error) {
+	if err := c.fill(time.Now().Add(c.Timeout), func() bool { return len(c.inbox) > 0 }); err != nil {
+		return Packet{}, err
+	}
+	p := c.inbox[0]
+	c.inbox = c.inbox[1:]
+	return p, nil
+}
+
+// Expect returns the next packet, which has to be a qsw packet of cmd.
+func (c *Client) Expect(qsw byte, cmd int) (Packet, error) {
+	p, err := c.Next()
+	if err != nil {
+		return p, fmt.Errorf("%s: waiting for %s %s: %w", c.Name, commands.GetConstName(qsw), protocol.Name(cmd), err)
+	}
+	if !p.Is(qsw, cmd) {
+		return p, fmt.Errorf("%s: expected %s %s, got %s", c.Name, commands.GetConstName(qsw), protocol.Name(cmd), p)
+	}
+	return p, nil
+}
+
+// Await returns the first qsw packet of cmd, the packets before it stay in
+// the inbox.
+func (c *Client) Await(qsw byte, cmd int) (Packet, error) {
+	i, err := c.find(qsw, cmd)
+	if err != nil {
+		return Packet{}, err
+	}
+	p := c.inbox[i]
+	c.inbox = append(c.inbox[:i], c.inbox[i+1:]...)
+	return p, nil
+}
+
+// Take is Await taking the packets before the one found out of the inbox
+// as well, they are returned in order.
+func (c *Client) Take(qsw byte, cmd int) (Packet, []Packet, error) {
+	i, err := c.find(qsw, cmd)
+	if err != nil {
+		return Packet{}, nil, err
+	}
+	p, skipped := c.inbox[i], c.inbox[:i:i]
+	c.inbox = c.inbox[i+1:]
+	return p, skipped, nil
+}
+
+// find waits for a qsw packet of cmd and returns its index in the inbox.
+func (c *Client) find(qsw byte, cmd int) (int, error) {
+	found := -1
+	match := func() bool {
+		for i := range c.inbox {
+			if c.inbox[i].Is(qsw, cmd) {
+				found = i
+				return true
+			}
+		}
+		return false
+	}
+	if err := c.fill(time.Now().Add(c.Timeout), match); err != nil {
+		return -1, fmt.Errorf("%s: waiting for %s %s: %w%s", c.Name, commands.GetConstName(qsw), protocol.Name(cmd), err, c.inboxSummary())
+	}
+	return found, nil
+}
+
+// Answer awaits the server's answer to a query of cmd, error answers are
+// returned as error.
+func (c *Client) Answer(cmd int) (Packet, error) {
+	p, err := c.Await(commands.TELL, cmd)
+	if err != nil {
+		return p, err
+	}
+	if err := p.Err(); err != nil {
+		return p, fmt.Errorf("%s: %w", c.Name, err)
+	}
+	return p, nil
+}
+
+// Flush empties the inbox after waiting QUIET_TIME for more packets, it
+// returns what was dropped.
+func (c *Client) Flush() ([]Packet, error) {
+	if err := c.fill(time.Now().Add(QUIET_TIME), func() bool { return false }); err != nil && !errors.Is(err, ErrTimeout) {
+		return nil, err
+	}
+	dropped := c.inbox
+	c.inbox = nil
+	return dropped, nil
+}
+
+// Quiet checks that the server sends nothing more for d.
+func (c *Client) Quiet(d time.Duration) error {
+	if err := c.fill(time.Now().Add(d), func() bool { return len(c.inbox) > 0 }); err != nil && !errors.Is(err, ErrTimeout) {
+		return err
+	}
+	if len(c.inbox) > 0 {
+		return fmt.Errorf("%s: unexpected %s%s", c.Name, c.inbox[0], c.inboxSummary())
+	}
+	return nil
+}
+
+// Pending returns the packets in the inbox without taking them.
+func (c *Client) Pending() []Packet {
+	return c.inbox
+}
+
+func (c *Client) inboxSummary() string {
+	if len(c.inbox) == 0 {
+		return ""
+	}
+	var b bytes.Buffer
+	b.WriteString(", inbox:")
+	for _, p := range c.inbox {
+		fmt.Fprintf(&b, " [%s]", p)
+	}
+	return b.String()
+}
+
+// fill reads packets into the inbox until done is true or the deadline
+// passes.
+func (c *Client) fill(deadline time.Time, done func() bool) error {
+	for !done() {
+		if err := c.parse(); err != nil {
+			return err
+		}
+		if done() {
+			return nil
+		}
+		c.conn.SetReadDeadline(deadline)
+		var chunk [4096]byte
+		n, err := c.conn.Read(chunk[:])
+		c.buf = append(c.buf, chunk[:n]...)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			if n == 0 {
+				return ErrTimeout
+			}
+		} else if err != nil {
+			return fmt.Errorf("connection lost: %w", err)
+		}
+	}
+	return nil
+}
+
+// parse moves the complete packets of the read buffer to the inbox.
+func (c *Client) parse() error {
+	for len(c.buf) >= protocol.HEADER_SIZE {
+		h, err := protocol.ParseHeader(c.buf)
+		if err != nil {
+			return err
+		}
+		size := protocol.HEADER_SIZE + h.Len
+		if len(c.buf) < size {
+			return nil
+		}
+		data := bytes.Clone(c.buf[:size])
+		c.buf = c.buf[size:]
+		_, m, err := protocol.Decode(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", c.Name, err)
+		}
+		p := Packet{Header: h, Message: m, Data: data}
+		if c.Trace != nil {
+			c.Trace(c, "in", p)
+		}
+		switch {
+		case p.Is(commands.QUERY, commands.CONNCHECK):
+			// the answer isn't decoded by the server, any payload will do
+			if err := c.Reply(p, &protocol.Raw{Cmd: commands.CONNCHECK}); err != nil {
+				return err
+			}
+		case p.Is(commands.BROADCAST, commands.HEARTBEAT):
+		default:
+			c.inbox = append(c.inbox, p)
+		}
+	}
+	return nil
+}
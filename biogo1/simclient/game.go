@@ -0,0 +1,139 @@
+package simclient
+
+import (
+	"bioserver/commands"
+	"bioserver/protocol"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// GameClient is a console on the game server. After the session check
+// everything is game data the server relays to the other players of the
+// game, each message starting with its length byte.
+type GameClient struct {
+	Name    string
+	Timeout time.Duration
+	// Trace, when set, is called for every message sent ("out") and
+	// received ("in").
+	Trace func(g *GameClient, dir string, data []byte)
+
+	conn net.Conn
+	buf  []byte
+}
+
+// DialGame connects to a game server and answers its GSLOGIN query with
+// the lobby session. The server doesn't confirm a good session but drops
+// the connection on a bad one, so DialGame waits QUIET_TIME for that.
+func DialGame(addr, name, session string) (*GameClient, error) {
+	conn, err := net.DialTimeout("tcp", addr, DEFAULT_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	g := &GameClient{Name: name, Timeout: DEFAULT_TIMEOUT, conn: conn}
+	if err := g.login(session); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("%s: game server login: %w", name, err)
+	}
+	return g, nil
+}
+
+func (g *GameClient) login(session string) error {
+	// the query is in lobby format
+	deadline := time.Now().Add(g.Timeout)
+	for {
+		h, err := protocol.ParseHeader(g.buf)
+		if err == nil && len(g.buf) >= protocol.HEADER_SIZE+h.Len {
+			break
+		}
+		if err := g.read(deadline); err != nil {
+			return err
+		}
+	}
+	h, _, err := protocol.Decode(g.buf)
+	if err != nil {
+		return err
+	}
+	if h.Qsw != commands.QUERY || h.Cmd != commands.GSLOGIN {
+		return fmt.Errorf("expected QUERY GSLOGIN, got %s %s", commands.GetConstName(h.Qsw), protocol.Name(h.Cmd))
+	}
+	if g.Trace != nil {
+		g.Trace(g, "in", g.buf[:protocol.HEADER_SIZE+h.Len])
+	}
+	g.buf = g.buf[protocol.HEADER_SIZE+h.Len:]
+	login := protocol.Encode(commands.GAMECLIENT, commands.TELL, h.PID, &protocol.GSLoginTell{Session: session})
+	if err := g.write(login); err != nil {
+		return err
+	}
+	// a rejected session is disconnected right away
+	err = g.read(time.Now().Add(QUIET_TIME))
+	if errors.Is(err, ErrTimeout) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("session %s rejected: %w", session, err)
+	}
+	return nil
+}
+
+// Close disconnects from the game server.
+func (g *GameClient) Close() error {
+	return g.conn.Close()
+}
+
+// Send sends one game message, the length byte is added in front.
+func (g *GameClient) Send(data []byte) error {
+	if len(data) == 0 || len(data) > 0xfe {
+		return fmt.Errorf("%s: game messages have 1 to 254 bytes, not %d", g.Name, len(data))
+	}
+	return g.write(append([]byte{byte(len(data) + 1)}, data...))
+}
+
+// Receive returns the next game message relayed from another player,
+// without its length byte.
+func (g *GameClient) Receive() ([]byte, error) {
+	deadline := time.Now().Add(g.Timeout)
+	for len(g.buf) == 0 || len(g.buf) < int(g.buf[0]) {
+		if len(g.buf) > 0 && g.buf[0] == 0 {
+			return nil, fmt.Errorf("%s: game message of length 0", g.Name)
+		}
+		if err := g.read(deadline); err != nil {
+			return nil, fmt.Errorf("%s: waiting for game data: %w", g.Name, err)
+		}
+	}
+	n := int(g.buf[0])
+	msg := bytes.Clone(g.buf[:n])
+	g.buf = g.buf[n:]
+	if g.Trace != nil {
+		g.Trace(g, "in", msg)
+	}
+	return msg[1:], nil
+}
+
+func (g *GameClient) write(data []byte) error {
+	if g.Trace != nil {
+		g.Trace(g, "out", data)
+	}
+	g.conn.SetWriteDeadline(time.Now().Add(g.Timeout))
+	_, err := g.conn.Write(data)
+	return err
+}
+
+func (g *GameClient) read(deadline time.Time) error {
+	g.conn.SetReadDeadline(deadline)
+	var chunk [1024]byte
+	n, err := g.conn.Read(chunk[:])
+	g.buf = append(g.buf, chunk[:n]...)
+	switch {
+	case n > 0:
+		return nil
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return ErrTimeout
+	case err != nil:
+		return fmt.Errorf("connection lost: %w", err)
+	}
+	return nil
+}
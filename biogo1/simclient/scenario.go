@@ -0,0 +1,594 @@
+package simclient
+
+import (
+	"bioserver/commands"
+	"bioserver/protocol"
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"maps"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Scenario is a parsed scenario file.
+type Scenario struct {
+	Name  string
+	Title string // file1 or file2, file1 when not set
+	Steps []Step
+}
+
+// Step is one line of a scenario: a client and what it does, or a
+// directive like sleep with an empty Client.
+type Step struct {
+	Line   int
+	Client string
+	Verb   string
+	Args   []string
+}
+
+func (s Step) String() string {
+	return strings.TrimSpace(strings.Join(append([]string{s.Client, s.Verb}, s.Args...), " "))
+}
+
+// Env is where a scenario runs.
+type Env struct {
+	Lobby   string // address of the lobby server
+	Timeout time.Duration
+	// NewSession registers a login session for a user, like the login
+	// pages do.
+	NewSession func(userid string) (string, error)
+	// Trace, when set, sees every packet and game message of the clients.
+	Trace func(client, dir string, data []byte, m protocol.Message)
+}
+
+// argument counts of the client verbs, -1 for a variable number
+var verbs = map[string][2]int{
+	"connect":      {0, 0},
+	"login":        {0, 1},
+	"checkrnd":     {1, 1},
+	"motd":         {0, 0},
+	"handle":       {2, 2},
+	"character":    {0, 1},
+	"area":         {1, 1},
+	"room":         {1, 1},
+	"createslot":   {1, 1},
+	"scene":        {2, 2},
+	"slotname":     {1, 1},
+	"slotpassword": {1, 1},
+	"openslot":     {0, 0},
+	"join":         {1, 2},
+	"chat":         {1, 1},
+	"start":        {0, 0},
+	"gamesession":  {0, 0},
+	"gsinfo":       {0, 0},
+	"gamelogin":    {0, 0},
+	"gamesend":     {1, 1},
+	"gameexpect":   {1, 1},
+	"logout":       {0, 0},
+	"send":         {2, -1},
+	"expect":       {2, -1},
+	"await":        {2, -1},
+	"flush":        {0, 0},
+	"quiet":        {0, 1},
+	"close":        {0, 0},
+}
+
+// Parse reads a scenario. Every line is a step of a client, named by its
+// userid, followed by a verb and its arguments:
+//
+//	# two players meet in a slot
+//	title file1
+//	alice login
+//	alice handle ALICE1 Alice
+//	alice send QUERY AREASELECT Number=1
+//	alice expect TELL AREASELECT Number=1
+//	bob chat "hello there"
+//	alice expect BROADCAST CHATOUT Sender.Handle=BOB001 Message="hello there"
+//	sleep 1s
+//
+// Arguments are separated by spaces, double quotes keep them together and
+// follow Go's escapes. ${alice.handle} and ${alice.session} are replaced
+// when the step runs.
+//
+// The steps of the login and lobby navigation send their query and wait
+// for the answer, which has to be no error; broadcasts arriving meanwhile
+// stay in the inbox of the client:
+//
+//	connect                 connect with a new session, without logging in
+//	login [VERSION]         connect if needed and log in up to IDHNPAIRS
+//	checkrnd TEXT           CHECKRND
+//	motd                    MOTHEDAY
+//	handle HANDLE NICKNAME  HNSELECT, ****** for a new handle
+//	character [N]           CHARSELECT of character N
+//	area N                  AREASELECT
+//	room N                  ENTERROOM
+//	createslot N            CREATESLOT
+//	scene TYPE SCENARIO     SCENESELECT, type 0x11 DVD or 0x12 HDD
+//	slotname NAME           SLOTNAME
+//	slotpassword PASSWORD   SLOTPASSWD
+//	openslot                UNKN6504, the slot can be joined
+//	join SLOT [PASSWORD]    JOINGAME
+//	chat TEXT               CHATIN, not answered
+//	start                   STARTGAME, waits for GETREADY
+//	gamesession             GAMESESSION
+//	gsinfo                  GSINFO, the game server for gamelogin
+//	gamelogin               GSLOGIN on the game server
+//	gamesend HEX            game data without the length byte
+//	gameexpect HEX          the next game data relayed to the client
+//	logout                  LOGOUT
+//	close                   disconnect
+//
+// Packets are checked with:
+//
+//	send QSW CMD [FIELD=VALUE ...]    send any packet
+//	expect QSW CMD [FIELD=VALUE ...]  the next packet in the inbox
+//	await QSW CMD [FIELD=VALUE ...]   the first such packet in the inbox
+//	flush                             empty the inbox
+//	quiet [DURATION]                  nothing arrives for a while
+//
+// QSW is QUERY, TELL or BROADCAST, CMD a command name or hex number. Field
+// names and values are the ones the dissector shows, nested fields are
+// dotted like Sender.Handle or Players.0.Nickname. An expectation can
+// also check pid=N, payload=HEX or the whole packet as raw=HEX, and that
+// it is an error answer with the bare word error.
+func Parse(r io.Reader, name string) (*Scenario, error) {
+	s := &Scenario{Name: name, Title: "file1"}
+	lines := bufio.NewScanner(r)
+	for n := 1; lines.Scan(); n++ {
+		words, err := splitLine(lines.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", name, n, err)
+		}
+		if len(words) == 0 {
+			continue
+		}
+		switch words[0] {
+		case "title":
+			if len(words) != 2 || len(s.Steps) > 0 {
+				return nil, fmt.Errorf("%s:%d: title NAME goes before the steps", name, n)
+			}
+			s.Title = words[1]
+			continue
+		case "sleep":
+			if len(words) != 2 {
+				return nil, fmt.Errorf("%s:%d: sleep DURATION", name, n)
+			}
+			if _, err := time.ParseDuration(words[1]); err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", name, n, err)
+			}
+			s.Steps = append(s.Steps, Step{Line: n, Verb: words[0], Args: words[1:]})
+			continue
+		}
+		if len(words) < 2 {
+			return nil, fmt.Errorf("%s:%d: CLIENT VERB [ARGS]", name, n)
+		}
+		step := Step{Line: n, Client: words[0], Verb: words[1], Args: words[2:]}
+		count, ok := verbs[step.Verb]
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: unknown verb %q", name, n, step.Verb)
+		}
+		if len(step.Args) < count[0] || count[1] >= 0 && len(step.Args) > count[1] {
+			return nil, fmt.Errorf("%s:%d: wrong number of arguments for %s", name, n, step.Verb)
+		}
+		s.Steps = append(s.Steps, step)
+	}
+	if err := lines.Err(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// splitLine splits a line into words, a # outside quotes starts a comment.
+func splitLine(line string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case c == '#':
+			i = len(line)
+		case c == ' ' || c == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case c == '"':
+			end := i + 1
+			for ; end < len(line) && line[end] != '"'; end++ {
+				if line[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(line) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			text, err := strconv.Unquote(line[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("string %s: %w", line[i:end+1], err)
+			}
+			word.WriteString(text)
+			inWord = true
+			i = end
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// runner is the state of a running scenario.
+type runner struct {
+	env     Env
+	clients map[string]*Client
+}
+
+// Run plays the scenario, it stops at the first step that fails.
+func (s *Scenario) Run(env Env) error {
+	if env.Timeout == 0 {
+		env.Timeout = DEFAULT_TIMEOUT
+	}
+	r := &runner{env: env, clients: make(map[string]*Client)}
+	defer func() {
+		// in a fixed order, the server tells the others about each
+		for _, name := range slices.Sorted(maps.Keys(r.clients)) {
+			r.clients[name].Close()
+		}
+	}()
+	for _, step := range s.Steps {
+		if err := r.run(step); err != nil {
+			return fmt.Errorf("%s:%d: %s: %w", s.Name, step.Line, step, err)
+		}
+	}
+	return nil
+}
+
+var variable = regexp.MustCompile(`\$\{(\w+)\.(\w+)\}`)
+
+// expand replaces the variables in an argument.
+func (r *runner) expand(arg string) (string, error) {
+	var err error
+	arg = variable.ReplaceAllStringFunc(arg, func(v string) string {
+		m := variable.FindStringSubmatch(v)
+		c, ok := r.clients[m[1]]
+		if !ok {
+			err = fmt.Errorf("%s: no client %s", v, m[1])
+			return v
+		}
+		switch m[2] {
+		case "handle":
+			return string(c.Handle)
+		case "session":
+			return c.Session
+		}
+		err = fmt.Errorf("%s: unknown variable", v)
+		return v
+	})
+	return arg, err
+}
+
+func (r *runner) run(step Step) error {
+	args := make([]string, len(step.Args))
+	for i, a := range step.Args {
+		var err error
+		if args[i], err = r.expand(a); err != nil {
+			return err
+		}
+	}
+	if step.Verb == "sleep" {
+		d, _ := time.ParseDuration(args[0])
+		time.Sleep(d)
+		return nil
+	}
+
+	c := r.clients[step.Client]
+	if c == nil {
+		if step.Verb != "connect" && step.Verb != "login" {
+			return fmt.Errorf("%s is not connected", step.Client)
+		}
+		var err error
+		if c, err = r.connect(step.Client); err != nil {
+			return err
+		}
+	}
+
+	switch step.Verb {
+	case "connect":
+		return nil
+	case "login":
+		version := VERSION
+		if len(args) > 0 {
+			version = args[0]
+		}
+		_, err := c.Login(version)
+		return err
+	case "checkrnd":
+		_, err := c.CheckRnd(args[0])
+		return err
+	case "motd":
+		_, err := c.MessageOfTheDay()
+		return err
+	case "handle":
+		return c.SelectHandle(args[0], args[1])
+	case "character":
+		n := 0
+		if len(args) > 0 {
+			var err error
+			if n, err = number(args[0]); err != nil {
+				return err
+			}
+		}
+		return c.SelectCharacter(byte(n))
+	case "area", "room", "createslot":
+		n, err := number(args[0])
+		if err != nil {
+			return err
+		}
+		switch step.Verb {
+		case "area":
+			return c.SelectArea(n)
+		case "room":
+			return c.EnterRoom(n)
+		}
+		return c.CreateSlot(n)
+	case "scene":
+		slotType, err := number(args[0])
+		if err != nil {
+			return err
+		}
+		scenario, err := number(args[1])
+		if err != nil {
+			return err
+		}
+		return c.SelectScene(slotType, scenario)
+	case "slotname":
+		return c.SetSlotName(args[0])
+	case "slotpassword":
+		return c.SetSlotPassword(args[0])
+	case "openslot":
+		return c.OpenSlot()
+	case "join":
+		slot, err := number(args[0])
+		if err != nil {
+			return err
+		}
+		password := ""
+		if len(args) > 1 {
+			password = args[1]
+		}
+		return c.JoinGame(slot, password)
+	case "chat":
+		return c.Chat(args[0])
+	case "start":
+		return c.StartGame()
+	case "gamesession":
+		_, err := c.GameSession()
+		return err
+	case "gsinfo":
+		_, err := c.GameServerInfo()
+		return err
+	case "gamelogin":
+		g, err := c.GameLogin()
+		if err == nil && r.env.Trace != nil {
+			g.Trace = func(g *GameClient, dir string, data []byte) { r.env.Trace(g.Name, dir, data, nil) }
+		}
+		return err
+	case "gamesend", "gameexpect":
+		if c.Game() == nil {
+			return fmt.Errorf("%s is not on a game server", c.Name)
+		}
+		data, err := hex.DecodeString(args[0])
+		if err != nil {
+			return err
+		}
+		if step.Verb == "gamesend" {
+			return c.Game().Send(data)
+		}
+		got, err := c.Game().Receive()
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(got, data) {
+			return fmt.Errorf("got game data %x", got)
+		}
+		return nil
+	case "logout":
+		return c.Logout()
+	case "send":
+		return r.send(c, args)
+	case "expect", "await":
+		return r.expect(c, step.Verb == "await", args)
+	case "flush":
+		_, err := c.Flush()
+		return err
+	case "quiet":
+		d := QUIET_TIME
+		if len(args) > 0 {
+			var err error
+			if d, err = time.ParseDuration(args[0]); err != nil {
+				return err
+			}
+		}
+		return c.Quiet(d)
+	case "close":
+		delete(r.clients, c.Name)
+		return c.Close()
+	}
+	return fmt.Errorf("unknown verb %q", step.Verb)
+}
+
+func (r *runner) connect(name string) (*Client, error) {
+	session, err := r.env.NewSession(name)
+	if err != nil {
+		return nil, err
+	}
+	c, err := Dial(r.env.Lobby, name, session)
+	if err != nil {
+		return nil, err
+	}
+	c.Timeout = r.env.Timeout
+	if r.env.Trace != nil {
+		c.Trace = func(c *Client, dir string, p Packet) { r.env.Trace(c.Name, dir, p.Data, p.Message) }
+	}
+	r.clients[name] = c
+	return c, nil
+}
+
+// send builds a packet from QSW CMD FIELD=VALUE..., pid=N picks its id.
+func (r *runner) send(c *Client, args []string) error {
+	qsw, cmd, err := packetKind(args[0], args[1])
+	if err != nil {
+		return err
+	}
+	m := protocol.New(commands.CLIENT, qsw, cmd)
+	pid := -1
+	for _, a := range args[2:] {
+		name, value, ok := strings.Cut(a, "=")
+		if !ok {
+			return fmt.Errorf("%q is not FIELD=VALUE", a)
+		}
+		if name == "pid" {
+			if pid, err = number(value); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := protocol.SetField(m, name, value); err != nil {
+			return err
+		}
+	}
+	if pid >= 0 {
+		return c.SendPID(qsw, pid, m)
+	}
+	return c.Send(qsw, m)
+}
+
+// expect checks a received packet against QSW CMD and the expectations.
+func (r *runner) expect(c *Client, await bool, args []string) error {
+	qsw, cmd, err := packetKind(args[0], args[1])
+	if err != nil {
+		return err
+	}
+	var p Packet
+	if await {
+		p, err = c.Await(qsw, cmd)
+	} else {
+		p, err = c.Expect(qsw, cmd)
+	}
+	if err != nil {
+		return err
+	}
+	return Match(p, args[2:])
+}
+
+// Match checks a packet against expectations: FIELD=VALUE, pid=N,
+// payload=HEX, raw=HEX and error.
+func Match(p Packet, expectations []string) error {
+	fields := protocol.FlatFields(p.Message)
+	var mismatches []string
+	for _, e := range expectations {
+		if e == "error" {
+			if p.Header.Err != protocol.ERR_FLAG {
+				mismatches = append(mismatches, "not an error answer")
+			}
+			continue
+		}
+		name, want, ok := strings.Cut(e, "=")
+		if !ok {
+			return fmt.Errorf("%q is not FIELD=VALUE", e)
+		}
+		var got string
+		switch name {
+		case "pid":
+			got = strconv.Itoa(p.Header.PID)
+		case "raw":
+			got = hex.EncodeToString(p.Data)
+		case "payload":
+			got = hex.EncodeToString(p.Data[protocol.HEADER_SIZE:])
+		default:
+			found := false
+			for _, f := range fields {
+				if f.Name == name {
+					got, found = FormatValue(f.Value), true
+					break
+				}
+			}
+			if !found {
+				mismatches = append(mismatches, fmt.Sprintf("%s missing", name))
+				continue
+			}
+		}
+		if !sameValue(got, want) {
+			mismatches = append(mismatches, fmt.Sprintf("%s=%q, want %q", name, got, want))
+		}
+	}
+	if len(mismatches) > 0 {
+		return fmt.Errorf("%s: %s", p, strings.Join(mismatches, ", "))
+	}
+	return nil
+}
+
+// FormatValue shows a field value of protocol.Fields as in scenarios.
+func FormatValue(v any) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+// sameValue compares a field with an expected value, numbers can be
+// written in hex and byte strings as hex:.
+func sameValue(got, want string) bool {
+	if got == want {
+		return true
+	}
+	if strings.HasPrefix(got, "hex:") || strings.HasPrefix(want, "hex:") {
+		g, err1 := protocol.ParseBytes(got)
+		w, err2 := protocol.ParseBytes(want)
+		return err1 == nil && err2 == nil && bytes.Equal(g, w)
+	}
+	g, err1 := strconv.ParseInt(got, 0, 64)
+	w, err2 := strconv.ParseInt(want, 0, 64)
+	return err1 == nil && err2 == nil && g == w
+}
+
+// packetKind reads the QSW CMD of send and expect.
+func packetKind(qswName, cmdName string) (byte, int, error) {
+	var qsw byte
+	switch strings.ToUpper(qswName) {
+	case "QUERY":
+		qsw = commands.QUERY
+	case "TELL":
+		qsw = commands.TELL
+	case "BROADCAST":
+		qsw = commands.BROADCAST
+	default:
+		return 0, 0, fmt.Errorf("%q is not QUERY, TELL or BROADCAST", qswName)
+	}
+	if n, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(cmdName), "0x"), 16, 16); err == nil {
+		return qsw, int(n), nil
+	}
+	cmd, ok := commands.GetConstValue(cmdName)
+	if !ok {
+		return 0, 0, fmt.Errorf("unknown command %q", cmdName)
+	}
+	return qsw, cmd, nil
+}
+
+func number(s string) (int, error) {
+	n, err := strconv.ParseInt(s, 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a number", s)
+	}
+	return int(n), nil
+}
@@ -0,0 +1,208 @@
+package simclient
+
+import (
+	"bioserver/commands"
+	"bioserver/protocol"
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// version string of the File #1 1.01 patch, older versions get patched
+const VERSION = "101 0311172500"
+
+// The steps of a console from the login to the game server. Each sends the
+// query and waits for its answer; broadcasts arriving in between stay in
+// the inbox for Expect.
+
+// Login answers the LOGIN and CHECKVERSION queries of the server and
+// returns the handles offered for the user.
+func (c *Client) Login(version string) ([]protocol.HNPair, error) {
+	query, err := c.Expect(commands.QUERY, commands.LOGIN)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Reply(query, &protocol.LoginTell{Session: c.Session}); err != nil {
+		return nil, err
+	}
+	query, err = c.Expect(commands.QUERY, commands.CHECKVERSION)
+	if err != nil {
+		return nil, fmt.Errorf("%w (session %s not accepted?)", err, c.Session)
+	}
+	if err := c.Reply(query, &protocol.CheckVersionTell{Version: []byte(version)}); err != nil {
+		return nil, err
+	}
+	p, err := c.Expect(commands.BROADCAST, commands.IDHNPAIRS)
+	if err != nil {
+		return nil, err
+	}
+	return p.Message.(*protocol.IDHNPairsBroadcast).Pairs, nil
+}
+
+// CheckRnd sends the random numbers check, the server answers with the
+// first byte.
+func (c *Client) CheckRnd(text string) (byte, error) {
+	p, err := c.query(&protocol.SecretQuery{Cmd: commands.CHECKRND, Text: []byte(text)})
+	if err != nil {
+		return 0, err
+	}
+	return p.Message.(*protocol.CheckRndTell).Value, nil
+}
+
+// MessageOfTheDay returns the message shown after the login.
+func (c *Client) MessageOfTheDay() (string, error) {
+	p, err := c.query(&protocol.Empty{Cmd: commands.MOTHEDAY})
+	if err != nil {
+		return "", err
+	}
+	return string(p.Message.(*protocol.MOTDTell).Message), nil
+}
+
+// SelectHandle picks a handle, "******" asks for a new one. It waits for
+// the end of the login procedure.
+func (c *Client) SelectHandle(handle, nickname string) error {
+	q := &protocol.HNSelectQuery{HNPair: protocol.HNPair{Handle: []byte(handle), Nickname: []byte(nickname)}}
+	p, err := c.query(q)
+	if err != nil {
+		return err
+	}
+	c.Handle = bytes.TrimRight(p.Message.(*protocol.HNSelectTell).Handle, "\x00")
+	_, err = c.Await(commands.BROADCAST, commands.UNKN6104)
+	return err
+}
+
+// SelectCharacter sends statistics for the given character, all zero
+// otherwise.
+func (c *Client) SelectCharacter(character byte) error {
+	stats := make([]byte, protocol.CHARACTER_STATS_SIZE)
+	stats[0xc8] = character
+	_, err := c.query(&protocol.CharSelectQuery{Stats: stats})
+	return err
+}
+
+// SelectArea enters an area.
+func (c *Client) SelectArea(area int) error {
+	return c.number(commands.AREASELECT, area)
+}
+
+// EnterRoom enters a room of the area.
+func (c *Client) EnterRoom(room int) error {
+	return c.number(commands.ENTERROOM, room)
+}
+
+// CreateSlot opens a slot of the room as its host.
+func (c *Client) CreateSlot(slot int) error {
+	return c.number(commands.CREATESLOT, slot)
+}
+
+// SelectScene sets the slot type (0x11 DVD, 0x12 HDD) and the scenario of
+// the created slot.
+func (c *Client) SelectScene(slotType, scenario int) error {
+	_, err := c.query(&protocol.SceneSelectQuery{Type: slotType, Scenario: scenario})
+	return err
+}
+
+// SetSlotName sets the title of the created slot.
+func (c *Client) SetSlotName(name string) error {
+	_, err := c.query(&protocol.SecretQuery{Cmd: commands.SLOTNAME, Text: []byte(name)})
+	return err
+}
+
+// SetSlotPassword protects the created slot.
+func (c *Client) SetSlotPassword(password string) error {
+	_, err := c.query(&protocol.SecretQuery{Cmd: commands.SLOTPASSWD, Text: []byte(password)})
+	return err
+}
+
+// OpenSlot is the last packet of the host after setting up a slot, others
+// can join from then on.
+func (c *Client) OpenSlot() error {
+	_, err := c.query(&protocol.ByteQuery{Cmd: commands.UNKN6504})
+	return err
+}
+
+// JoinGame joins a slot of the room.
+func (c *Client) JoinGame(slot int, password string) error {
+	_, err := c.query(&protocol.JoinGameQuery{Slot: slot, Password: []byte(password)})
+	return err
+}
+
+// Chat sends a message to the area, slot or after game lobby the client is
+// in. The server doesn't answer, CHATOUT goes to everyone there including
+// the sender.
+func (c *Client) Chat(text string) error {
+	return c.Send(commands.BROADCAST, &protocol.SecretQuery{Cmd: commands.CHATIN, Text: []byte(text)})
+}
+
+// StartGame starts the game of the slot and waits for GETREADY.
+func (c *Client) StartGame() error {
+	if err := c.Send(commands.BROADCAST, &protocol.Raw{Cmd: commands.STARTGAME}); err != nil {
+		return err
+	}
+	_, err := c.Await(commands.BROADCAST, commands.GETREADY)
+	return err
+}
+
+// GameSession returns the 15 digit game number.
+func (c *Client) GameSession() (string, error) {
+	p, err := c.query(&protocol.Empty{Cmd: commands.GAMESESSION})
+	if err != nil {
+		return "", err
+	}
+	return string(p.Message.(*protocol.GameSessionTell).Session), nil
+}
+
+// GameServerInfo asks for the game server of the started game and keeps
+// its address for GameLogin.
+func (c *Client) GameServerInfo() (string, error) {
+	p, err := c.query(&protocol.Empty{Cmd: commands.GSINFO})
+	if err != nil {
+		return "", err
+	}
+	info := p.Message.(*protocol.GSInfoTell)
+	c.Relay = net.JoinHostPort(net.IP(info.IP).String(), strconv.Itoa(info.Port))
+	return c.Relay, nil
+}
+
+// GameLogin connects to the game server told by GameServerInfo with the
+// session of the lobby login.
+func (c *Client) GameLogin() (*GameClient, error) {
+	if c.Relay == "" {
+		return nil, fmt.Errorf("%s: no game server, GSINFO first", c.Name)
+	}
+	if c.game != nil {
+		c.game.Close()
+	}
+	g, err := DialGame(c.Relay, c.Name, c.Session)
+	if err != nil {
+		return nil, err
+	}
+	g.Timeout = c.Timeout
+	c.game = g
+	return g, nil
+}
+
+// Game returns the game server connection of GameLogin.
+func (c *Client) Game() *GameClient {
+	return c.game
+}
+
+// Logout leaves the lobby.
+func (c *Client) Logout() error {
+	_, err := c.query(&protocol.Empty{Cmd: commands.LOGOUT})
+	return err
+}
+
+func (c *Client) number(cmd, n int) error {
+	_, err := c.query(&protocol.NumberQuery{Cmd: cmd, Number: n})
+	return err
+}
+
+// query sends a query and returns the answer.
+func (c *Client) query(m protocol.Message) (Packet, error) {
+	if err := c.Send(commands.QUERY, m); err != nil {
+		return Packet{}, err
+	}
+	return c.Answer(m.Command())
+}
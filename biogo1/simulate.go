@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bioserver/commands"
+	"bioserver/protocol"
+	"bioserver/simclient"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SimServer is a lobby and game server on loopback for one scenario, with
+// a store of its own so every scenario starts from the same state.
+type SimServer struct {
+	lobby    *Lobby
+	db       *MemoryStore
+	addr     string
+	sessions int
+	capture  bool // capture the traffic of every user logging in
+	mu       sync.Mutex
+}
+
+// runSimulate plays client scenarios against fresh servers and reports
+// which failed.
+func runSimulate(args []string) int {
+	fs := flag.NewFlagSet("bioserver simulate", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: bioserver simulate [flags] scenario|directory ...")
+		fmt.Fprintln(fs.Output(), "Plays scenario files (*.sim in directories) against a server on loopback, see simclient.Parse.")
+		fs.PrintDefaults()
+	}
+	verbose := fs.Bool("v", false, "print every packet")
+	timeout := fs.Duration("timeout", simclient.DEFAULT_TIMEOUT, "how long a step waits for the server")
+	logLevel := fs.String("log-level", "error", "server log levels, like log_level")
+	capture := fs.String("capture", "", "record the traces of each scenario in a directory of this one, for replay")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	if err := SetupLogging(LOG_FORMAT_TEXT, *logLevel); err != nil {
+		fmt.Fprintln(os.Stderr, "simulate:", err)
+		return 2
+	}
+
+	var files []string
+	for _, arg := range fs.Args() {
+		if info, err := os.Stat(arg); err == nil && info.IsDir() {
+			found, _ := filepath.Glob(filepath.Join(arg, "*.sim"))
+			files = append(files, found...)
+		} else {
+			files = append(files, arg)
+		}
+	}
+
+	failed := 0
+	for _, file := range files {
+		start := time.Now()
+		if err := simulate(file, *timeout, *verbose, *capture); err != nil {
+			fmt.Printf("FAIL %s: %v\n", file, err)
+			failed++
+			continue
+		}
+		fmt.Printf("ok   %s (%.2fs)\n", file, time.Since(start).Seconds())
+	}
+	if failed > 0 {
+		fmt.Printf("%d of %d scenarios failed\n", failed, len(files))
+		return 1
+	}
+	return 0
+}
+
+func simulate(file string, timeout time.Duration, verbose bool, capture string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	scenario, err := simclient.Parse(f, file)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	variants, err := ParseVariants(scenario.Title)
+	if err != nil || len(variants) != 1 {
+		return fmt.Errorf("title %q: one of file1 or file2", scenario.Title)
+	}
+
+	server, err := StartSimServer(variants[0])
+	if err != nil {
+		return err
+	}
+	if capture != "" {
+		// until the server is gone, the traces end with the disconnects
+		packetCapture.SetDir(filepath.Join(capture, strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))))
+		server.capture = true
+		defer stopCapture()
+	}
+	defer server.Stop()
+
+	env := simclient.Env{Lobby: server.addr, Timeout: timeout, NewSession: server.NewSession}
+	if verbose {
+		env.Trace = printSimPacket
+	}
+	return scenario.Run(env)
+}
+
+// printSimPacket prints a packet of a client like the dissector, on one
+// line.
+func printSimPacket(client, dir string, data []byte, m protocol.Message) {
+	if m == nil {
+		fmt.Printf("  %-10s %-3s game %x\n", client, dir, data)
+		return
+	}
+	h, _ := protocol.ParseHeader(data)
+	var fields []string
+	for _, f := range protocol.FlatFields(m) {
+		fields = append(fields, fmt.Sprintf("%s=%q", f.Name, simclient.FormatValue(f.Value)))
+	}
+	fmt.Printf("  %-10s %-3s %s %s pid=%d %s\n", client, dir, commands.GetConstName(h.Qsw),
+		protocol.Name(h.Cmd), h.PID, strings.Join(fields, " "))
+}
+
+// StartSimServer starts the lobby and game server of a title on ports
+// picked by the system, with an empty in-memory store.
+func StartSimServer(v *Variant) (*SimServer, error) {
+	conf := NewConfiguration()
+	conf.Variants = v.Name
+	conf.LobbyHost, conf.GameHost, conf.GsIP = "127.0.0.1", "127.0.0.1", "127.0.0.1"
+	conf.LobbyPort, conf.GamePort = 0, 0
+	conf.File2LobbyPort, conf.File2GamePort = 0, 0
+	conf.DBDriver = DB_DRIVER_MEMORY
+
+	db := NewMemoryStore()
+	var wg sync.WaitGroup
+	lobby, err := startLobby(conf, db, v, NewRelayControl(""), &wg)
+	if err != nil {
+		return nil, err
+	}
+	return &SimServer{lobby: lobby, db: db, addr: lobby.lobbyServer.Addr().String()}, nil
+}
+
+// NewSession registers a session for userid, numbered so the packets of a
+// scenario are the same on every run.
+func (s *SimServer) NewSession(userid string) (string, error) {
+	s.mu.Lock()
+	s.sessions++
+	session := fmt.Sprintf("%04d%04d", 1000+s.sessions, s.sessions)
+	s.mu.Unlock()
+	s.db.AddSession(userid, session)
+	if s.capture {
+		packetCapture.Start(userid)
+	}
+	return session, nil
+}
+
+// stopCapture closes the traces of a scenario.
+func stopCapture() {
+	for _, userid := range packetCapture.Users() {
+		packetCapture.Stop(userid)
+	}
+}
+
+// Stop disconnects everybody and closes the listeners.
+func (s *SimServer) Stop() {
+	l := s.lobby
+	l.lobbyServer.StopAccepting()
+	l.gameServer.StopAccepting()
+	l.packetHandler.Sync(func() { l.packetHandler.DisconnectAll(l.lobbyServer) })
+	l.gamePacketHandler.DisconnectAll(l.gameServer)
+	// until the lobby saw the connections go, for their traces
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		n := 0
+		l.packetHandler.Sync(func() { n = len(l.packetHandler.clients.GetList()) })
+		if n == 0 {
+			break
+		}
+	}
+}
@@ -53,7 +53,7 @@ type Slot struct {
 	host string //room master's userid
 }
 
-func NewSlot(area, room, slotnum int) *Slot {
+func NewSlot(area, room, slotnum int, rules *RuleSet) *Slot {
 	tmpname := fmt.Sprintf("a%d-r%d-s%d", area, room, slotnum)
 	return &Slot{
 		area:     area,
@@ -68,7 +68,7 @@ func NewSlot(area, room, slotnum int) *Slot {
 		scenario:   SCENARIO_TRAINING,
 		slottype:   LOAD_NOTSET,
 		protection: PROTECTION_OFF,
-		rules:      NewRuleSet(),
+		rules:      rules,
 		livetime:   -1,
 	}
 }
@@ -7,8 +7,9 @@ type Slots struct {
 	numberOfSlots int
 }
 
-// NewSlots creates a new Slots instance by allocating numberOfAreas * numberOfRooms * 20 slots.
-func NewSlots(numberOfAreas, numberOfRooms int) *Slots {
+// NewSlots creates a new Slots instance by allocating numberOfAreas * numberOfRooms * 20 slots,
+// newRuleSet gives the rules of the slots in an area.
+func NewSlots(numberOfAreas, numberOfRooms int, newRuleSet func(area int) *RuleSet) *Slots {
     numberOfSlots := 20
     total := numberOfAreas * numberOfRooms * numberOfSlots
     slots := make([]*Slot, total)
@@ -16,7 +17,7 @@ func NewSlots(numberOfAreas, numberOfRooms int) *Slots {
     for area := 1; area <= numberOfAreas; area++ {
         for room := 1; room <= numberOfRooms; room++ {
             for slot := 1; slot <= numberOfSlots; slot++ {
-                slots[slotNum] = NewSlot(area, room, slot)
+                slots[slotNum] = NewSlot(area, room, slot, newRuleSet(area))
                 slotNum++
             }
         }
@@ -36,6 +37,14 @@ func (s *Slots) calcSlotnr(area, room, slotnr int) int {
     return (slotnr - 1) + ((room - 1) * s.numberOfSlots) + ((area - 1) * s.numberOfRooms * s.numberOfSlots)
 }
 
+// Exists tells if area, room and slotnr name a slot. Numbers sent by a
+// client have to be checked with it before they are passed to GetSlot.
+func (s *Slots) Exists(area, room, slotnr int) bool {
+    return area > 0 && area <= s.numberOfAreas &&
+        room > 0 && room <= s.numberOfRooms &&
+        slotnr > 0 && slotnr <= s.numberOfSlots
+}
+
 // GetSlot returns the Slot for the given area, room and slotnr.
 func (s *Slots) GetSlot(area, room, slotnr int) *Slot {
     return s.slots[s.calcSlotnr(area, room, slotnr)]
@@ -116,6 +125,16 @@ func (s *Slots) GetFriendlyFire(area, room, slotnr int) byte {
     return s.GetSlot(area, room, slotnr).GetRuleSet().GetFriendlyFire()
 }
 
+// GetNightmare returns the nightmare mode value from the slot's ruleset.
+func (s *Slots) GetNightmare(area, room, slotnr int) byte {
+    return s.GetSlot(area, room, slotnr).GetRuleSet().GetNightmare()
+}
+
+// GetInfinity returns the infinite ammo value from the slot's ruleset.
+func (s *Slots) GetInfinity(area, room, slotnr int) byte {
+    return s.GetSlot(area, room, slotnr).GetRuleSet().GetInfinity()
+}
+
 // GetMaximumPlayers returns the maximum number of players from the slot's ruleset.
 func (s *Slots) GetMaximumPlayers(area, room, slotnr int) byte {
     return s.GetSlot(area, room, slotnr).GetRuleSet().GetNumberOfPlayers()
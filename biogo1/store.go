@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+const (
+	DB_DRIVER_MYSQL  = "mysql"
+	DB_DRIVER_MEMORY = "memory"
+)
+
+// Store is everything the lobby and the gameserver need to persist:
+// sessions created by the login pages, the handle/nickname pairs of a user,
+// the message of the day and the game number a session is playing in.
+// Database is the MySQL implementation, MemoryStore keeps everything in
+// process for single box servers and tests.
+type Store interface {
+	GetUserID(session string) (string, error)
+	UpdateClientOrigin(userid string, state, area, room, slot int) error
+	GetGameNumber(userid string) (int, error)
+	UpdateClientGame(userid string, gameNumber int) error
+
+	CheckHandle(handle string) (bool, error)
+	CreateNewHNPair(cl *Client)
+	UpdateHNPair(cl *Client)
+	GetHNPairs(userid string) *HNPairs
+
+	GetMOTD() (string, error)
+
+	CreateUser(userid, pwhash string) error
+	GetUserPassword(userid string) (pwhash string, legacy string, err error)
+	SetPasswordHash(userid, pwhash string) error
+	CreateSession(userid, ip string, port int) (string, error)
+	ResetSessions() error
+
+	Close() error
+}
+
+var (
+	ErrUserExists = errors.New("user already exists")
+	ErrNoUser     = errors.New("no such user")
+)
+
+// newSessionID returns a random 8 digit session id like the login pages
+// always did; the client sends it back in the LOGIN packet.
+func newSessionID() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(90000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d", n.Int64()+10000000), nil
+}
+
+// NewStore opens the backend selected by db_driver.
+func NewStore(conf *Configuration) (Store, error) {
+	switch conf.DBDriver {
+	case DB_DRIVER_MYSQL, "":
+		return NewDatabase(conf)
+	case DB_DRIVER_MEMORY:
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown db_driver %q", conf.DBDriver)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Variant is everything that differs between the two titles the lobby can
+// serve: areas, rooms, rulesets, the 6881 data tables and the handful of
+// commands that are answered differently or only known to one title.
+type Variant struct {
+	Name      string // as used in the configuration
+	Title     string
+	LobbyPort int // ports of the original service
+	GamePort  int
+	WebDir    string // the login pages of the title below www01.kddi-mmbb.jp
+
+	areas      []*Area
+	rooms      []*Room // the same rooms are in every area
+	newRuleSet func(area int) *RuleSet
+	scenarios  []string // by slot scenario, 0 is training
+	data6881   [][]byte
+	unkn6308   []byte // answer to 6308 after the room number
+	gameDiff   int    // size of the GAMEDIFF block
+
+	patchable bool // File #1 1.01 patch is offered
+	autoStart bool // games in area 1 room 1 start when the wait limit ran out
+	testSlot  bool // area 2 room 1 slot 3 is the character test slot
+}
+
+var FILE1 = &Variant{
+	Name:      "file1",
+	Title:     "Biohazard Outbreak File #1",
+	LobbyPort: 8300,
+	GamePort:  8690,
+	WebDir:    "00000002",
+	areas: []*Area{
+		NewArea(1, "East Town", "<BODY><SIZE=3>standard rules<END>", STATUS_ACTIVE),
+		NewArea(2, "West Town", "<BODY><SIZE=3>individual games<END>", STATUS_ACTIVE),
+	},
+	rooms: []*Room{
+		NewRoom(0, "R1", STATUS_ACTIVE),
+		NewRoom(0, "R2", STATUS_ACTIVE),
+		NewRoom(0, "R3", STATUS_ACTIVE),
+		NewRoom(0, "R4", STATUS_ACTIVE),
+		NewRoom(0, "R5", STATUS_ACTIVE),
+		NewRoom(0, "R6", STATUS_ACTIVE),
+		NewRoom(0, "R7", STATUS_ACTIVE),
+		NewRoom(0, "R8", STATUS_ACTIVE),
+		NewRoom(0, "R9", STATUS_ACTIVE),
+		NewRoom(0, "RA", STATUS_ACTIVE),
+	},
+	newRuleSet: func(area int) *RuleSet { return NewRuleSet() },
+	scenarios:  []string{"training", "outbreak", "below freezing point", "the hive", "hellfire", "decisions, decisions"},
+	data6881:   [][]byte{data6881File1},
+	unkn6308:   []byte{0x00, 0x02, 0x81, 0x40}, // shift-jis space
+	gameDiff:   0x10,
+	patchable:  true,
+	autoStart:  true,
+	testSlot:   true,
+}
+
+var FILE2 = &Variant{
+	Name:      "file2",
+	Title:     "Biohazard Outbreak File #2",
+	LobbyPort: 8200,
+	GamePort:  8590,
+	WebDir:    "00000010",
+	areas: []*Area{
+		NewArea(1, "Free Area", "<BODY><SIZE=3>Join games or create your own<BR><BODY><C=3>keep an eye on PS2 and emu problems<END>", STATUS_ACTIVE),
+		NewArea(2, "Nightmare", "<BODY><SIZE=3>Nightmare mode is ON by default<BR><BODY><C=3><END>", STATUS_ACTIVE),
+		NewArea(3, "Survival", "<BODY><SIZE=3>Friendly Fire is ON by default<BR><BODY><C=3>Beware of stray bullets ;-)<END>", STATUS_ACTIVE),
+		NewArea(4, "Panic", "<BODY><SIZE=3>Nightmare mode and friendly fire is on!<BR><BODY><C=3>just keep alive...<END>", STATUS_ACTIVE),
+		NewArea(5, "Infinity", "<BODY><SIZE=3>Infinitive bullets<BR><BODY><C=3>Games are not considered for rankings!<END>", STATUS_ACTIVE),
+		NewArea(6, "reserved", "<BODY><SIZE=3>reserved<END>", STATUS_INACTIVE),
+		NewArea(7, "TESTING", "<BODY><SIZE=3>for tests<BR><BODY>expect problems and crashes, <C=3>use at your own risk<END>", STATUS_ACTIVE),
+		NewArea(8, "Elimination", "<BODY><SIZE=3>Play scenarios elimination 1-3<BR><BODY><C=3>defeat enemies within given time with your colleagues<END>", STATUS_ACTIVE),
+		NewArea(9, "Showdown", "<BODY><SIZE=3>Play scenarios showdown 1-3<BR><BODY><C=3>defeat bosses with joined forces!<END>", STATUS_ACTIVE),
+		NewArea(10, "SECRET Area", "<BODY><SIZE=3>?????<BR><BODY><C=3>Games are not considered for rankings!<END>", STATUS_INACTIVE),
+	},
+	rooms: []*Room{
+		NewRoom(0, "free", STATUS_ACTIVE),
+		NewRoom(0, "R1", STATUS_INACTIVE),
+		NewRoom(0, "R2", STATUS_INACTIVE),
+		NewRoom(0, "R3", STATUS_INACTIVE),
+		NewRoom(0, "R4", STATUS_INACTIVE),
+		NewRoom(0, "R5", STATUS_INACTIVE),
+	},
+	newRuleSet: NewRuleSetFile2,
+	scenarios: []string{"training", "wild things", "underbelly", "flashback", "desperate times", "end of the road",
+		"elimination 1", "elimination 2", "elimination 3", "showdown 1", "showdown 2", "showdown 3"},
+	data6881: data6881File2,
+	unkn6308: []byte{0x00, 0x00, 0x00, 0x03, 0xff, 0xff, 0x00, 0x00},
+	gameDiff: 0x20,
+}
+
+var variants = []*Variant{FILE1, FILE2}
+
+// ParseVariants reads a comma separated list of variant names.
+func ParseVariants(names string) ([]*Variant, error) {
+	var list []*Variant
+	for _, name := range strings.Split(names, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		var found *Variant
+		for _, v := range variants {
+			if v.Name == name {
+				found = v
+			}
+		}
+		if found == nil {
+			return nil, fmt.Errorf("unknown variant %q", name)
+		}
+		for _, v := range list {
+			if v == found {
+				return nil, fmt.Errorf("variant %q listed twice", name)
+			}
+		}
+		list = append(list, found)
+	}
+	if len(list) == 0 {
+		return nil, fmt.Errorf("no variant selected")
+	}
+	return list, nil
+}
+
+// ScenarioName is the name of a slot scenario in this title.
+func (v *Variant) ScenarioName(scenario byte) string {
+	if int(scenario) < len(v.scenarios) {
+		return v.scenarios[scenario]
+	}
+	return fmt.Sprintf("scenario %d", scenario)
+}
+
+// Get6881Sizes are the sizes of the 6881 data tables.
+func (v *Variant) Get6881Sizes() []uint32 {
+	var sizes []uint32
+	for _, t := range v.data6881 {
+		sizes = append(sizes, uint32(len(t)))
+	}
+	return sizes
+}
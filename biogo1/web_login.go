@@ -0,0 +1,335 @@
+package main
+
+import (
+	"crypto/subtle"
+	"embed"
+	"errors"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the images used by the login pages, copied from bioserv1/www
+//
+//go:embed www/ps2_bg.png www/ps2_logo.png
+var webImages embed.FS
+
+const (
+	WEB_FIELD_MAXLEN = 14 // userid is varchar(14)
+)
+
+var webFieldFilter = regexp.MustCompile(`[^A-Za-z0-9 _]`)
+
+// WebServer serves the pages the PS2 browser loads before it connects to
+// the lobby: login, account creation and the session handoff. It replaces
+// the PHP pages in bioserv1/www and has to be reachable as
+// https://www01.kddi-mmbb.jp/00000002/ for File #1 and .../00000010/ for
+// File #2 (DNS redirect, self-signed cert).
+type WebServer struct {
+	conf   *Configuration
+	db     Store
+	server *http.Server
+}
+
+func NewWebServer(conf *Configuration, db Store) *WebServer {
+	ws := &WebServer{conf: conf, db: db}
+	mux := http.NewServeMux()
+	// the clients always ask below the directory of their title, serve the
+	// root too for testing
+	prefixes := []string{"/"}
+	for _, v := range variants {
+		prefixes = append(prefixes, "/"+v.WebDir+"/")
+	}
+	for _, prefix := range prefixes {
+		mux.HandleFunc(prefix+"CRS-top.jsp", ws.handleTop)
+		mux.HandleFunc(prefix+"login.php", ws.handleLoginPage)
+		mux.HandleFunc(prefix+"login_form.php", ws.handleLoginForm)
+		mux.HandleFunc(prefix+"startsession.php", ws.handleStartSession)
+		mux.HandleFunc(prefix+"enterareas.html", ws.handleEnterAreas)
+		mux.HandleFunc(prefix+"ps2_bg.png", ws.handleImage("www/ps2_bg.png"))
+		mux.HandleFunc(prefix+"ps2_logo.png", ws.handleImage("www/ps2_logo.png"))
+	}
+	ws.server = &http.Server{
+		Addr:              fmt.Sprintf("%s:%d", conf.WebHost, conf.WebPort),
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return ws
+}
+
+// Run blocks serving the pages, with TLS when a certificate is configured.
+func (ws *WebServer) Run() {
+	var err error
+	if ws.conf.WebCert != "" {
+		webLog.Info("login pages served", "url", "https://"+ws.server.Addr)
+		err = ws.server.ListenAndServeTLS(ws.conf.WebCert, ws.conf.WebKey)
+	} else {
+		webLog.Info("login pages served", "url", "http://"+ws.server.Addr)
+		err = ws.server.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
+		webLog.Error("login pages stopped", "err", err)
+	}
+}
+
+// sanitizeWebField mirrors the old PHP filter, the PS2 keyboard can't
+// produce anything else anyway.
+func sanitizeWebField(v string) string {
+	v = webFieldFilter.ReplaceAllString(v, "")
+	if len(v) > WEB_FIELD_MAXLEN {
+		v = v[:WEB_FIELD_MAXLEN]
+	}
+	return v
+}
+
+func (ws *WebServer) writePage(w http.ResponseWriter, body string) {
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	fmt.Fprint(w, `<html><head><!--CRS-top-->
+   <title>non production server</title>
+   <meta http-equiv="Content-Type" content="text/html; charset=UTF-8">
+</head>
+<body text="#D7E0FF" background="ps2_bg.png" bgcolor="black" link="#224EAB">
+		<center>
+			<img src="ps2_logo.png" width="320" height="109"></img>
+
+			<br></br>
+			<font size="-2"><br></br></font>`)
+	fmt.Fprint(w, body)
+	fmt.Fprintf(w, `			<br></br>
+			<br></br>
+
+				<font size="-2"><br></br><br></br></font>
+				<table border="1" width="80%%" cellspacing="0" cellpadding="0"></table>
+				<font size="-2"><br></br></font>
+
+				<font size="-2" color="#aaaaaa">
+					Fan Made Biohazard Outbreak(tm) Server
+					<br></br>
+					(c)2013-%d obsrv.org
+				</font>
+		</center>
+</body></html>`, time.Now().Year())
+}
+
+func (ws *WebServer) handleTop(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html")
+	fmt.Fprint(w, `<html><head><meta http-equiv="Refresh" content="1; url=login.php"></head></html>`)
+}
+
+func (ws *WebServer) handleLoginPage(w http.ResponseWriter, r *http.Request) {
+	form := func(title, mode string) string {
+		return `			<form method="post" action="login_form.php">
+				` + title + `<br></br>
+				<table>
+					<tr>
+						<td>ID:</td>
+						<td><input type="text" name="username"></input></td>
+					</tr>
+
+					<tr>
+						<td>Password:</td>
+						<td><input type="password" name="password"></input></td>
+					</tr>
+
+					<input type="hidden" name="login" value="` + mode + `"></input>
+					<tr><td></td><td><input type="submit" value="LOGIN"></input></td></tr>
+
+				</table>
+			</form>
+`
+	}
+	ws.writePage(w, `
+<font size="-2"><br></br></font>
+<table align="center" width="100%" cellspacing="0" cellpadding="0">
+	<tr align="center" valign="top">
+		<td align="center" width="50%">
+`+form("Login with existing account:", "manual")+`		</td>
+
+		<td align="center" width="50%">
+`+form("Create new account and login:", "newaccount")+`		</td>
+	</tr>
+</table>
+`)
+}
+
+func (ws *WebServer) handleLoginForm(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "CRS-top.jsp", http.StatusFound)
+		return
+	}
+	username := strings.ToLower(sanitizeWebField(r.PostFormValue("username")))
+	password := sanitizeWebField(r.PostFormValue("password"))
+
+	// no password entered, return to login page
+	if username == "" || password == "" {
+		http.Redirect(w, r, "CRS-top.jsp", http.StatusFound)
+		return
+	}
+
+	var result string
+	switch r.PostFormValue("login") {
+	case "manual":
+		result = ws.login(r, username, password)
+	case "newaccount":
+		result = ws.register(r, username, password)
+	default:
+		result = `Login failed.<br><a href="CRS-top.jsp">back</a>`
+	}
+	ws.writePage(w, "\n<br></br>\n<br></br>\n\n"+result+"\n\n<br></br>\n<br></br>\n\n")
+}
+
+func (ws *WebServer) login(r *http.Request, username, password string) string {
+	failed := `Login failed. Your login/password combination is wrong.<br><a href="CRS-top.jsp">back</a>`
+
+	pwhash, legacy, err := ws.db.GetUserPassword(username)
+	if errors.Is(err, ErrNoUser) {
+		CheckPassword(dummyPasswordHash, password)
+		return failed
+	}
+	if err != nil {
+		webLog.Error("login failed", "user", username, "err", err)
+		return failed
+	}
+
+	switch {
+	case pwhash != "":
+		if !CheckPassword(pwhash, password) {
+			return failed
+		}
+	case legacy != "" && subtle.ConstantTimeCompare([]byte(legacy), []byte(password)) == 1:
+		// account from the PHP pages, replace the plain text password
+		if hash, err := HashPassword(password); err == nil {
+			if err := ws.db.SetPasswordHash(username, hash); err != nil {
+				webLog.Error("upgrading password", "user", username, "err", err)
+			}
+		}
+	default:
+		CheckPassword(dummyPasswordHash, password)
+		return failed
+	}
+	return ws.startSession(r, username)
+}
+
+func (ws *WebServer) register(r *http.Request, username, password string) string {
+	hash, err := HashPassword(password)
+	if err != nil {
+		webLog.Error("hashing password", "err", err)
+		return `Login failed.<br><a href="CRS-top.jsp">back</a>`
+	}
+	if err := ws.db.CreateUser(username, hash); err != nil {
+		if !errors.Is(err, ErrUserExists) {
+			webLog.Error("creating user", "user", username, "err", err)
+		}
+		return `Login failed. User already exists.<br><a href="CRS-top.jsp">back</a>`
+	}
+	webLog.Info("new account", "user", username)
+	return ws.startSession(r, username)
+}
+
+func (ws *WebServer) startSession(r *http.Request, username string) string {
+	ip, portStr, _ := net.SplitHostPort(r.RemoteAddr)
+	port, _ := strconv.Atoi(portStr)
+	sessid, err := ws.db.CreateSession(username, ip, port)
+	if err != nil {
+		webLog.Error("creating session", "user", username, "err", err)
+		return `Login successful. Session creation failed.<br><a href="login.php">Back to menu</a>`
+	}
+	return `Login successful.<br><a href="startsession.php?sessid=` + url.QueryEscape(sessid) + `.">Enter lobbies</a>`
+}
+
+// handleStartSession hands the session id to the game, which then connects
+// to the lobby and sends it in the LOGIN packet.
+func (ws *WebServer) handleStartSession(w http.ResponseWriter, r *http.Request) {
+	// echoed exactly like the PHP page did, including the trailing dot
+	sessid := r.URL.Query().Get("sessid")
+	base := ws.baseURL(webVariant(r))
+	w.Header().Set("Content-Type", "text/html; charset=EUC-JP")
+	fmt.Fprint(w, "<html><head><!--CRS-game-start-->")
+	fmt.Fprint(w, "<META HTTP-EQUIV=Content-Type CONTENT=text/html;CHARSET=EUC-JP></head>")
+	fmt.Fprint(w, "<!--result--><!--connection id--><!--start the game url--><!--exit game url-->")
+	fmt.Fprintf(w, "<!--<CSV>\"OK\",\"%s\",", html.EscapeString(sessid))
+	fmt.Fprintf(w, "\"%s/enterareas.html\",", base)
+	fmt.Fprintf(w, "\"%s/login.php\",</CSV>--></html>", base)
+}
+
+// handleEnterAreas tells the game where the lobby server is.
+func (ws *WebServer) handleEnterAreas(w http.ResponseWriter, r *http.Request) {
+	lobby := ws.conf.WebLobbyHost
+	if u, err := url.Parse(ws.conf.WebBaseURL); lobby == "" && err == nil {
+		lobby = u.Hostname()
+	}
+	port, _ := ws.conf.Ports(webVariant(r))
+	lobby = fmt.Sprintf("%s:%d", lobby, port)
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	fmt.Fprintf(w, `<html>
+<head>
+<!--CRS-lbs-info-get-->
+<META HTTP-EQUIV=Content-Type CONTENT=text/html;CHARSET=UTF-8>
+</head>
+<!-- Results -->
+<!-- LBS domain name + port number -->
+<!-- connection number -->
+<!-- Maximum number of connections -->
+<!-- Additional Information 1 -->
+<!-- Additional Information 2 -->
+<!-- Additional Information 3 -->
+<!--
+<CSV>
+"OK",
+"%[1]s",
+"0",
+"999",
+"0ad601082008,WEST TOWN,2",
+"<BODY><SIZE=4>Free AREA<BR><BODY>Create your own
+games<BR><BODY>obsrv.org<END>",
+"<BODY><SIZE=4>Not much to say<BR><BODY>have fun<END>",
+"%[1]s",
+"0",
+"999",
+"0ad601082008,EAST TOWN,1",
+"<BODY><SIZE=4>Scenario Mode<BR><BODY>obsrv.org<END>",
+"<BODY><SIZE=4>have fun<END>",
+</CSV>
+-->
+</html>`, lobby)
+}
+
+// webVariant tells the title of a request by its directory, File #1 for
+// the root.
+func webVariant(r *http.Request) *Variant {
+	for _, v := range variants {
+		if strings.HasPrefix(r.URL.Path, "/"+v.WebDir+"/") {
+			return v
+		}
+	}
+	return FILE1
+}
+
+// baseURL is web_base_url with the directory of the title v.
+func (ws *WebServer) baseURL(v *Variant) string {
+	base := strings.TrimSuffix(ws.conf.WebBaseURL, "/")
+	for _, other := range variants {
+		if strings.HasSuffix(base, "/"+other.WebDir) {
+			return strings.TrimSuffix(base, other.WebDir) + v.WebDir
+		}
+	}
+	return base
+}
+
+func (ws *WebServer) handleImage(name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		data, err := webImages.ReadFile(name)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(data)
+	}
+}